@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/avahidi/molly"
@@ -237,8 +239,10 @@ func main() {
 		help(false, "No rules were loaded", 20)
 	}
 
-	// scan input files
-	err = molly.ScanFiles(m, ifiles...)
+	// scan input files, ctrl-c stops the scan but we still show what was found
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = molly.ScanFilesContext(ctx, m, ifiles...)
+	stop()
 	if err != nil {
 		fmt.Println("SCAN while parsing file: ", err)
 	}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/avahidi/molly/types"
 )
@@ -11,11 +12,20 @@ import (
 var loadBuiltinRules = true
 
 var parameters = map[string]any{
-	"config.builtin":  loadBuiltinRules,
-	"config.maxdepth": 12,
-	"config.verbose":  false,
-	"perm.create":     true,
-	"perm.execute":    false,
+	"config.builtin":      loadBuiltinRules,
+	"config.maxdepth":     12,
+	"config.verbose":      false,
+	"config.carve":        false,
+	"config.carvealign":   512,
+	"config.deleted":      false,
+	"config.workers":      1,
+	"config.timeout":      0,
+	"config.maxfilesize":  0,
+	"config.maxtotalsize": 0,
+	"config.maxchildren":  0,
+	"config.maxratio":     0,
+	"perm.create":         true,
+	"perm.execute":        false,
 }
 
 func parametersHelp() {
@@ -29,6 +39,35 @@ func setParameterInt(c *types.Configuration, name string, i int) error {
 	switch name {
 	case "config.maxdepth":
 		c.MaxDepth = i
+	case "config.carvealign":
+		if i <= 0 {
+			return fmt.Errorf("carve alignment must be positive")
+		}
+		c.CarveAlign = int64(i)
+	case "config.workers":
+		if i <= 0 {
+			return fmt.Errorf("number of workers must be positive")
+		}
+		c.Workers = i
+	case "config.timeout":
+		if i < 0 {
+			return fmt.Errorf("timeout cannot be negative")
+		}
+		c.Timeout = time.Duration(i) * time.Second
+	case "config.maxfilesize", "config.maxtotalsize", "config.maxchildren", "config.maxratio":
+		if i < 0 {
+			return fmt.Errorf("limit cannot be negative")
+		}
+		switch name {
+		case "config.maxfilesize":
+			c.MaxFileSize = int64(i) * 1024 * 1024
+		case "config.maxtotalsize":
+			c.MaxTotalSize = int64(i) * 1024 * 1024
+		case "config.maxchildren":
+			c.MaxChildren = i
+		case "config.maxratio":
+			c.MaxRatio = int64(i)
+		}
 	}
 	return nil
 }
@@ -39,6 +78,10 @@ func setParameterBool(c *types.Configuration, name string, b bool) error {
 		c.Verbose = b
 	case "config.builtin":
 		loadBuiltinRules = b
+	case "config.carve":
+		c.Carve = b
+	case "config.deleted":
+		c.Deleted = b
 	case "perm.create":
 		c.SetPermission(types.Create, b)
 	case "perm.execute":
@@ -52,6 +52,10 @@ func inputToReportEntry(file *types.FileData) map[string]interface{} {
 		ret["warnings"] = file.Warnings
 	}
 
+	if len(file.Metadata) > 0 {
+		ret["metadata"] = file.Metadata
+	}
+
 	if file.DuplicateOf != nil {
 		ret["duplicate-of"] = file.DuplicateOf.Filename
 	}
@@ -11,7 +11,7 @@ import (
 // envLookupEnvironment checks for environment variables instead of rules
 func envLookupEnvironment(e *types.Env, id string) (interface{}, bool) {
 	if strings.HasPrefix(id, "$") {
-		if val, found := e.Current.Get(id[1:]); found {
+		if val, found := e.Get(id[1:]); found {
 			return val, true
 		}
 		types.FileDataGetHelp()
@@ -0,0 +1,181 @@
+package exp
+
+import (
+	"encoding/binary"
+
+	"github.com/avahidi/molly/exp/prim"
+	"github.com/avahidi/molly/types"
+)
+
+// RuleSignatures derives byte signatures from the conditions of a rule.
+// A condition such as 'magic == "\x7FELF"' where magic is read from a constant
+// offset means the rule can only match if those bytes are found there.
+// It returns nil if no signature could be derived
+func RuleSignatures(rule *types.Rule) []types.Signature {
+	var best []types.Signature
+	for _, c := range rule.Conditions {
+		best = betterSignatures(best, signatures(rule, c, 0))
+	}
+	for _, sig := range best {
+		if sig.Offset+int64(len(sig.Data)) > types.SignatureMaxEnd {
+			return nil
+		}
+	}
+	return best
+}
+
+// betterSignatures picks the most selective set of alternatives
+func betterSignatures(a, b []types.Signature) []types.Signature {
+	shortest := func(sigs []types.Signature) int {
+		n := -1
+		for _, s := range sigs {
+			if n == -1 || len(s.Data) < n {
+				n = len(s.Data)
+			}
+		}
+		return n
+	}
+	if la, lb := shortest(a), shortest(b); la > lb || (la == lb && len(a) <= len(b)) {
+		return a
+	}
+	return b
+}
+
+// signatures returns the signatures an expression requires to be true
+func signatures(rule *types.Rule, e types.Expression, depth int) []types.Signature {
+	oe, valid := e.(*OperationExpression)
+	if !valid || oe.Right == nil || depth > 16 {
+		return nil
+	}
+
+	switch oe.Operation {
+	case prim.BAND:
+		return betterSignatures(signatures(rule, oe.Left, depth+1),
+			signatures(rule, oe.Right, depth+1))
+	case prim.BOR:
+		left := signatures(rule, oe.Left, depth+1)
+		right := signatures(rule, oe.Right, depth+1)
+		if left == nil || right == nil {
+			return nil
+		}
+		return append(left, right...)
+	case prim.EQ:
+		if sig, found := equalSignature(rule, oe.Left, oe.Right); found {
+			return []types.Signature{sig}
+		}
+		if sig, found := equalSignature(rule, oe.Right, oe.Left); found {
+			return []types.Signature{sig}
+		}
+	}
+	return nil
+}
+
+// equalSignature handles the "data == constant" case
+func equalSignature(rule *types.Rule, data, constant types.Expression) (types.Signature, bool) {
+	var sig types.Signature
+	ve, valid := constant.(*ValueExpression)
+	if !valid {
+		return sig, false
+	}
+
+	offset, size, ee, found := fixedData(rule, data, 0)
+	if !found {
+		return sig, false
+	}
+	sig.Offset = offset
+
+	switch c := ve.Value.(type) {
+	case *prim.String:
+		if ee != nil && ee.Format != String {
+			return sig, false
+		}
+		if len(c.Value) != size || size == 0 {
+			return sig, false
+		}
+		sig.Data = append([]byte{}, c.Value...)
+		return sig, true
+
+	case *prim.Number:
+		if size > 8 || (size < 8 && c.Value>>uint(8*size) != 0) {
+			return sig, false
+		}
+		var bo binary.ByteOrder = binary.BigEndian
+		if ee != nil {
+			if ee.Format != Number {
+				return sig, false
+			}
+			if signed, _ := ee.Metadata.GetBoolean("signed", false); signed {
+				return sig, false
+			}
+			if bigendian, _ := ee.Metadata.GetBoolean("bigendian", true); !bigendian {
+				bo = binary.LittleEndian
+			}
+		}
+		buf := make([]byte, 8)
+		switch size {
+		case 1:
+			buf[0] = byte(c.Value)
+		case 2:
+			bo.PutUint16(buf, uint16(c.Value))
+		case 4:
+			bo.PutUint32(buf, uint32(c.Value))
+		case 8:
+			bo.PutUint64(buf, c.Value)
+		default:
+			return sig, false
+		}
+		sig.Data = buf[:size]
+		return sig, true
+	}
+	return sig, false
+}
+
+// fixedData figures out if an expression always reads the same bytes from the input.
+// The returned extract expression is nil when a single byte is taken from a string
+func fixedData(rule *types.Rule, e types.Expression, depth int) (int64, int, *ExtractExpression, bool) {
+	if depth > 16 {
+		return 0, 0, nil, false
+	}
+
+	switch n := e.(type) {
+	case *VariableExpression:
+		if v, found := rule.Variables[n.Id]; found {
+			return fixedData(rule, v, depth+1)
+		}
+	case *ExtractExpression:
+		offset, valid1 := constantNumber(n.Offset)
+		size, valid2 := constantNumber(n.Size)
+		if valid1 && valid2 && offset >= 0 && size > 0 &&
+			(n.Format == String || n.Format == Number) {
+			return int64(offset), size, n, true
+		}
+	case *SliceExpression:
+		offset, size, ee, found := fixedData(rule, n.Expr, depth+1)
+		if !found || ee == nil || ee.Format != String {
+			break
+		}
+		start, valid := constantNumber(n.Start)
+		if !valid || start < 0 || start >= size {
+			break
+		}
+		if n.End == nil {
+			return offset + int64(start), 1, nil, true
+		}
+		end, valid := constantNumber(n.End)
+		if !valid || end <= start || end > size {
+			break
+		}
+		return offset + int64(start), end - start, ee, true
+	}
+	return 0, 0, nil, false
+}
+
+// constantNumber returns the value of a constant number expression
+func constantNumber(e types.Expression) (int, bool) {
+	if ve, valid := e.(*ValueExpression); valid {
+		if n, valid := ve.Value.(*prim.Number); valid && n.Value < 1<<31 {
+			return int(n.Value), true
+		}
+	}
+	return 0, false
+}
@@ -1,8 +1,10 @@
 package molly
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -18,124 +20,174 @@ func suggestBaseName(c *types.Configuration, input *types.FileData) string {
 		if i != 0 {
 			basename = fmt.Sprintf("%s_%04d", basename, i)
 		}
-		if util.GetPathType(basename) == util.NoFile && util.GetPathType(basename+"_") == util.NoFile {
+		if !util.Exists(c.FS, basename) && !util.Exists(c.FS, basename+"_") {
 			return basename
 		}
 	}
 }
 
 // checkDuplicate if a file is duplicate and does all the book keeping
-func checkDuplicate(m *types.Molly, file *types.FileData) (bool, error) {
-	hash, err := util.HashFile(file.Filename)
+func checkDuplicate(m *types.Molly, file *types.FileData, reader io.ReadSeeker) (bool, error) {
+	hash, err := util.HashStream(reader)
 	if err != nil {
 		return false, err
 	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
 
 	hashtxt := hex.EncodeToString(hash)
 
 	// seen it has been done, add the checksum to our analysis
 	file.RegisterAnalysis("checksum", hashtxt, nil)
 
-	// check if we have already seen this checksum:
-	org, alreadyseen := m.FilesByHash[hashtxt]
-	if !alreadyseen {
-		m.FilesByHash[hashtxt] = file
-		return false, nil
+	// check if we have already seen this checksum, see also linkDuplicates
+	_, alreadyseen := m.AddHash(hashtxt, file)
+	return alreadyseen, nil
+}
+
+// rescanDuplicates queues files that became originals after the scan of
+// another file was undone, it returns false if there are none
+func rescanDuplicates(s *scheduler) bool {
+	files := s.m.ResolveDuplicates()
+	for _, fr := range files {
+		fs := s.m.Config.FS
+		if fr.Parent == nil {
+			fs = util.NewDiskFS()
+		}
+		fi, err := fs.Lstat(fr.Filename)
+		s.push(&scanJob{file: fr, info: fi, err: err})
 	}
+	return len(files) > 0
+}
 
-	// record it
-	file.DuplicateOf = org
-	file.RegisterWarning("duplicate of %s", org.Filename)
-	return true, nil
+// linkDuplicates records the duplicates found while scanning. This is done
+// when the scan is over since an original may turn into a duplicate if an
+// earlier file with the same content is hashed later by another worker
+func linkDuplicates(m *types.Molly) {
+	for _, file := range m.TakeDuplicates() {
+		file.RegisterWarning("duplicate of %s", file.DuplicateOf.Filename)
+
+		// if we already have this guy, just delete it (assuming its ours)
+		// XXX: this does not follow the extraction hierarchy
+		if file.Parent != nil {
+			m.Config.FS.Remove(file.FilenameOut)
+			m.Config.FS.Symlink(file.DuplicateOf.Filename, file.FilenameOut)
+		}
+	}
 }
 
-// scanFile opens and scans a single file
-func scanFile(m *types.Molly, env *types.Env, filename_ string, parent *types.FileData) {
+// addRootFile registers a file given by the user and gives it a place in the output
+func addRootFile(m *types.Molly, filename string) *types.FileData {
+	fr, created := m.AddFile(filename, nil)
+	if created {
+		// update basename to something we can use to create files from
+		fr.FilenameOut = suggestBaseName(m.Config, fr)
+
+		// make sure its path is there and we have a soft link to the real file
+		path, _ := filepath.Split(fr.FilenameOut)
+		m.Config.FS.Mkdir(path)
+
+		// make sure we link to the absolute path
+		filename_abs, _ := filepath.Abs(fr.Filename)
+		m.Config.FS.Symlink(filename_abs, fr.FilenameOut)
+	}
+	return fr
+}
 
-	fl := &util.FileList{}
+// scanPath scans a file or all files in a folder created while scanning parent
+func scanPath(s *scheduler, env *types.Env, filename_ string, parent *types.FileData) {
+	fl := &util.FileList{FS: s.m.Config.FS}
 	fl.Push(filename_)
 	for {
 		filename, fi, err := fl.Pop()
 		if filename == "" {
 			return
 		}
-		fr, found := m.Files[filename]
-		if !found {
-			fr = types.NewFileData(filename, parent)
-			m.Files[filename] = fr
-
-			// update basename to something we can use to create files from
-			if fr.Parent == nil {
-				fr.FilenameOut = suggestBaseName(m.Config, fr)
-
-				// make sure its path is there and we have a soft link to the real file
-				path, _ := filepath.Split(fr.FilenameOut)
-				util.Mkdir(path)
-
-				// make sure we link to the absolute path
-				filename_abs, _ := filepath.Abs(fr.Filename)
-				os.Symlink(filename_abs, fr.FilenameOut)
-			}
-		}
-
-		// if we for some reason have done this one before, just skip it
-		if fr.Processed {
-			continue
-		}
-		fr.Processed = true
+		fr, _ := s.m.AddFile(filename, parent)
+		scanFile(s, env, fr, fi, err)
+	}
+}
 
-		// started with an error, no point moving on
-		if err != nil {
-			fr.RegisterError(err)
-			continue
-		}
+// scanFile opens and scans a single file
+func scanFile(s *scheduler, env *types.Env, fr *types.FileData, fi os.FileInfo, err error) {
+	m := s.m
 
-		// record what we know about it so far
-		fr.SetTime(fi.ModTime())
-		fr.Filesize = fi.Size()
+	// if we for some reason have done this one before, just skip it
+	if !m.MarkProcessed(fr) {
+		return
+	}
 
-		if m.Config.MaxDepth != 0 && fr.Depth >= m.Config.MaxDepth {
-			fr.RegisterErrorf("File depth above %d", m.Config.MaxDepth)
-			continue
-		}
+	// started with an error, no point moving on
+	if err != nil {
+		fr.RegisterError(err)
+		return
+	}
 
-		alreadyseen, err := checkDuplicate(m, fr)
-		if err != nil {
-			fr.RegisterError(err)
-		}
-		if alreadyseen {
-			// if we already have this guy, just delete it (assuming its ours)
-			// XXX: this does not follow the extraction hierarchy
-			if fr.Parent != nil {
-				os.Remove(fr.FilenameOut)
-				os.Symlink(fr.DuplicateOf.Filename, fr.FilenameOut)
-			}
-			continue
-		}
+	// record what we know about it so far
+	fr.SetTime(fi.ModTime())
+	fr.Filesize = fi.Size()
 
-		reader, err := os.Open(filename)
-		if err != nil {
-			fr.RegisterError(err)
-			continue
-		}
+	if m.Config.MaxDepth != 0 && fr.Depth >= m.Config.MaxDepth {
+		fr.RegisterErrorf("File depth above %d", m.Config.MaxDepth)
+		return
+	}
 
-		scanInput(m, env, reader, fr)
+	reader, err := m.Open(fr)
+	if err != nil {
+		fr.RegisterError(err)
+		return
+	}
 
-		// manual Close insted of defer Close, or we will have too many files open
+	// manual Close insted of defer Close, or we will have too many files open
+	alreadyseen, err := checkDuplicate(m, fr, reader)
+	if err != nil {
+		fr.RegisterError(err)
+	}
+	if alreadyseen {
 		reader.Close()
+		return
+	}
 
-		// now that the file is closed, attempt to adjust its time
-		if t := fr.GetTime(); t != fi.ModTime() {
-			os.Chtimes(fr.FilenameOut, t, t)
-		}
+	scanInputContext(s.ctx, m, env, reader, fr)
+	reader.Close()
+
+	// now that the file is closed, attempt to adjust its time
+	if t := fr.GetTime(); t != fi.ModTime() {
+		m.Config.FS.Chtimes(fr.FilenameOut, t)
 	}
+
+	// this file may have created new files, scan them too
+	s.pushChildren(fr)
 }
 
 // ScanFiles scans a set of files for matches.
 func ScanFiles(m *types.Molly, files ...string) error {
-	env := types.NewEnv(m)
-	for _, filename := range files {
-		scanFile(m, env, filename, nil)
+	return ScanFilesContext(context.Background(), m, files...)
+}
+
+// ScanFilesContext scans a set of files for matches until done or the context expires.
+// Files not scanned when the context expires are marked with an error
+func ScanFilesContext(ctx context.Context, m *types.Molly, files ...string) error {
+	s := newScheduler(ctx, m)
+
+	// register all files first, so their names do not depend on scan order
+	for _, file := range files {
+		fl := &util.FileList{}
+		fl.Push(file)
+		for {
+			filename, fi, err := fl.Pop()
+			if filename == "" {
+				break
+			}
+			fr := addRootFile(m, filename)
+			s.push(&scanJob{file: fr, info: fi, err: err})
+		}
+	}
+	err := s.run()
+	for err == nil && rescanDuplicates(s) {
+		err = s.run()
 	}
-	return nil
+	linkDuplicates(m)
+	return err
 }
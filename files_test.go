@@ -0,0 +1,424 @@
+package molly
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/avahidi/molly/report"
+	"github.com/avahidi/molly/types"
+)
+
+// createTarGz creates a tar.gz file with the given files in it
+func createTarGz(t *testing.T, filename string, files map[string]string) {
+	w, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+	tw := tar.NewWriter(gw)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Format: tar.FormatGNU}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	gw.Close()
+}
+
+// scanBuiltin scans files with the builtin rules and given configuration
+func scanBuiltin(t *testing.T, config func(c *types.Configuration), files ...string) *types.Molly {
+	m := New()
+	m.Config.OutDir = t.TempDir()
+	config(m.Config)
+	names, texts := LoadBuiltinRules()
+	for i, name := range names {
+		if err := LoadRulesFromText(m, name, texts[i]); err != nil {
+			t.Fatalf("Could not load builtin rules: %v", err)
+		}
+	}
+	if err := ScanFiles(m, files...); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestScanWorkers(t *testing.T) {
+	indir := t.TempDir()
+	for i := 0; i < 8; i++ {
+		files := map[string]string{
+			"a.txt":        fmt.Sprintf("file %d", i),
+			"dir/b.txt":    "same in all archives",
+			"dir/c/d.data": fmt.Sprintf("more data %d", i*i),
+		}
+		createTarGz(t, filepath.Join(indir, fmt.Sprintf("archive%d.tar.gz", i)), files)
+	}
+
+	// the output should not depend on number of workers, except for the output folder
+	var results [2]map[string][]string
+	for i, workers := range []int{1, 8} {
+		m := scanBuiltin(t, func(c *types.Configuration) { c.Workers = workers }, indir)
+		results[i] = make(map[string][]string)
+		for _, file := range m.Files {
+			name, _ := filepath.Rel(m.Config.OutDir, file.Filename)
+			if file.Parent == nil {
+				name = file.Filename
+			}
+			names := report.ExtractMatchNames(file, true)
+			sort.Strings(names)
+			results[i][name] = append([]string{}, names...)
+		}
+	}
+
+	if len(results[0]) != 8*4+8 {
+		t.Errorf("Found %d files, expected %d", len(results[0]), 8*4+8)
+	}
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("Scan results differ between 1 and 8 workers:\n%v\n%v", results[0], results[1])
+	}
+}
+
+func TestScanDuplicates(t *testing.T) {
+	indir := t.TempDir()
+	inner := filepath.Join(t.TempDir(), "inner.tar.gz")
+	createTarGz(t, inner, map[string]string{"d.txt": "in the inner archive"})
+	data, err := os.ReadFile(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		files := map[string]string{
+			"a.txt":        fmt.Sprintf("file %d", i),
+			"b.txt":        "same in all archives",
+			"dir/c.txt":    "also the same in all archives",
+			"inner.tar.gz": string(data),
+		}
+		createTarGz(t, filepath.Join(indir, fmt.Sprintf("archive%02d.tar.gz", i)), files)
+	}
+	for i := 0; i < 8; i++ {
+		files := map[string]string{"a.txt": "the same archive"}
+		createTarGz(t, filepath.Join(indir, fmt.Sprintf("copy%02d.tar.gz", i)), files)
+	}
+
+	// files, duplicates and their links should be the same as for a serial scan
+	scan := func(workers int) map[string]string {
+		m := scanBuiltin(t, func(c *types.Configuration) { c.Workers = workers }, indir)
+		ret := make(map[string]string)
+		for _, file := range m.Files {
+			name, _ := filepath.Rel(m.Config.OutDir, file.Filename)
+			if file.Parent == nil {
+				name = file.Filename
+			} else if file.Parent.DuplicateOf != nil {
+				t.Errorf("%s was extracted from a duplicate", name)
+			}
+			names := report.ExtractMatchNames(file, true)
+			sort.Strings(names)
+			ret[name] = fmt.Sprintf("%v", names)
+			if file.DuplicateOf == nil {
+				continue
+			}
+			org, _ := filepath.Rel(m.Config.OutDir, file.DuplicateOf.Filename)
+			if file.DuplicateOf.Parent == nil {
+				org = file.DuplicateOf.Filename
+			}
+			ret[name] += " duplicate of " + org
+			if file.Parent == nil {
+				continue
+			}
+			link, err := os.Readlink(file.FilenameOut)
+			if err != nil {
+				t.Errorf("Duplicate %s is not a link: %v", name, err)
+			}
+			link, _ = filepath.Rel(m.Config.OutDir, link)
+			ret[name] += " link " + link
+		}
+		return ret
+	}
+
+	serial := scan(1)
+	duplicates := 0
+	for _, result := range serial {
+		if strings.Contains(result, "duplicate of") {
+			duplicates++
+		}
+	}
+	// b.txt, c.txt and inner.tar.gz in 15 archives and 7 copies
+	if duplicates != 3*15+7 {
+		t.Errorf("Found %d duplicates, expected %d", duplicates, 3*15+7)
+	}
+	for i := 0; i < 8; i++ {
+		if parallel := scan(8); !reflect.DeepEqual(serial, parallel) {
+			t.Fatalf("Results differ between 1 and 8 workers:\n%v\n%v", serial, parallel)
+		}
+	}
+}
+
+func TestScanSquashfsCompression(t *testing.T) {
+	var testdata = []struct {
+		compression uint16
+		rule        string
+	}{
+		{1, "squashfs"},
+		{4, "squashfs"},
+		{5, "squashfs_le"}, // lz4 is left to unsquashfs
+		{6, "squashfs"},
+	}
+	for _, test := range testdata {
+		sb := make([]byte, 96)
+		copy(sb, "hsqs")
+		binary.LittleEndian.PutUint16(sb[20:], test.compression)
+		binary.LittleEndian.PutUint16(sb[22:], 12)
+		binary.LittleEndian.PutUint16(sb[28:], 4)
+		filename := filepath.Join(t.TempDir(), "image.sqfs")
+		if err := os.WriteFile(filename, sb, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		m := scanBuiltin(t, func(c *types.Configuration) {}, filename)
+		names := report.ExtractMatchNames(m.Files[filename], true)
+		if !reflect.DeepEqual(names, []string{test.rule}) {
+			t.Errorf("Compression %d matched %v, expected %s", test.compression, names, test.rule)
+		}
+	}
+}
+
+func TestScanCarveZynos(t *testing.T) {
+	// a ZyNOS object in a flash dump with other data that has the signature
+	zynos := func(typ byte, size uint32) []byte {
+		head := make([]byte, 0x30)
+		binary.BigEndian.PutUint32(head, 0x80010000)
+		head[4] = typ
+		copy(head[5:], "SIG")
+		binary.BigEndian.PutUint32(head[8:], size)
+		return head
+	}
+	dump := make([]byte, 0x2000)
+	copy(dump[0x200:], zynos(4, 0x100))
+	copy(dump[0x400:], zynos(0x41, 0x100))
+	copy(dump[0x600:], zynos(4, 0x10000))
+	copy(dump[0x800:], "....\x00SIG")
+	filename := filepath.Join(t.TempDir(), "flash.bin")
+	if err := os.WriteFile(filename, dump, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := scanBuiltin(t, func(c *types.Configuration) { c.Carve = true }, filename)
+	var offsets []int64
+	for _, match := range m.Files[filename].Matches {
+		if match.Rule.ID == "ZyNOS" {
+			offsets = append(offsets, match.Offset)
+		}
+	}
+	if !reflect.DeepEqual(offsets, []int64{0x200}) {
+		t.Errorf("ZyNOS matched at %x, expected 200", offsets)
+	}
+}
+
+func TestScanFilesCancel(t *testing.T) {
+	indir := t.TempDir()
+	for i := 0; i < 4; i++ {
+		os.WriteFile(filepath.Join(indir, fmt.Sprintf("file%d", i)), []byte("data"), 0644)
+	}
+
+	m := New()
+	m.Config.OutDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ScanFilesContext(ctx, m, indir); err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if len(m.Files) != 4 {
+		t.Fatalf("Found %d files, expected 4", len(m.Files))
+	}
+	for _, file := range m.Files {
+		if !file.Processed || len(file.Errors) != 1 {
+			t.Errorf("Scan of %s was not stopped", file.Filename)
+		}
+	}
+}
+
+func TestScanLimits(t *testing.T) {
+	// a small tar.gz with 3 MB of zeros in it
+	indir := t.TempDir()
+	zeros := string(bytes.Repeat([]byte{0}, 1024*1024))
+	createTarGz(t, filepath.Join(indir, "bomb.tar.gz"),
+		map[string]string{"a": zeros, "b": zeros, "c": zeros})
+
+	testdata := []struct {
+		config  func(c *types.Configuration)
+		limited bool
+		files   int    // number of extracted files
+		max     int64  // max size of extracted files
+		warning string // warning on the file the data was extracted from
+	}{
+		{func(c *types.Configuration) {}, false, 4, 3*1024*1024 + 4096, ""},
+		{func(c *types.Configuration) { c.MaxFileSize = 1000 }, true, 2, 1000, ""},
+		{func(c *types.Configuration) { c.MaxChildren = 2 }, true, 3, 3*1024*1024 + 4096, ""},
+		{func(c *types.Configuration) { c.MaxRatio = 10 }, true, 2, 1024 * 1024, "(ratio 10)"},
+		{func(c *types.Configuration) { c.MaxTotalSize = 2 * 1024 * 1024 }, true, 2, 2 * 1024 * 1024, ""},
+	}
+
+	for i, test := range testdata {
+		m := scanBuiltin(t, test.config, indir)
+
+		files, limited, warned := 0, false, false
+		var total int64
+		for _, file := range m.Files {
+			for _, warning := range file.Warnings {
+				warned = warned || (test.warning != "" && strings.Contains(warning, test.warning))
+			}
+			for _, err := range file.Errors {
+				limited = limited || strings.Contains(err.Error(), types.ErrLimit.Error())
+			}
+			if file.Parent != nil {
+				files++
+				total += file.Filesize
+			}
+		}
+		if limited != test.limited {
+			t.Errorf("%d: expected limited=%t got %t", i, test.limited, limited)
+		}
+		if warned != (test.warning != "") {
+			t.Errorf("%d: expected warning %q, got %t", i, test.warning, warned)
+		}
+		if files != test.files {
+			t.Errorf("%d: expected %d extracted files got %d", i, test.files, files)
+		}
+		if total > test.max*int64(files) {
+			t.Errorf("%d: extracted %d bytes, expected at most %d per file", i, total, test.max)
+		}
+	}
+}
+
+// cpioEntry writes an entry of a binary cpio archive
+func cpioEntry(w *bytes.Buffer, name string, mode int, data string) {
+	head := []uint16{0x71c7, 0, 0, uint16(mode), 0, 0, 1, 0, 0, 0,
+		uint16(len(name) + 1), 0, uint16(len(data))}
+	binary.Write(w, binary.LittleEndian, head)
+	w.WriteString(name + "\x00")
+	if len(name)%2 == 0 {
+		w.WriteByte(0)
+	}
+	w.WriteString(data)
+	if len(data)%2 == 1 {
+		w.WriteByte(0)
+	}
+}
+
+func TestScanMalicious(t *testing.T) {
+	sandbox := t.TempDir()
+	indir := filepath.Join(sandbox, "in")
+	outdir := filepath.Join(sandbox, "a", "b", "out")
+	os.Mkdir(indir, 0755)
+
+	// tar with traversal, absolute names and a symlink we then write through
+	var tarbuf bytes.Buffer
+	tw := tar.NewWriter(&tarbuf)
+	for _, h := range []*tar.Header{
+		{Name: "../../../evil1", Size: 5},
+		{Name: filepath.Join(sandbox, "evil2"), Size: 5},
+		{Name: "x/../../../../evil3", Size: 5},
+		{Name: "..\\..\\..\\evil4", Size: 5},
+		{Name: "tlink", Typeflag: tar.TypeSymlink, Linkname: "../../../.."},
+		{Name: "tlink/evil5", Size: 5},
+		{Name: "thard", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+	} {
+		h.Mode = 0644
+		h.Format = tar.FormatGNU
+		tw.WriteHeader(h)
+		if h.Size > 0 {
+			tw.Write([]byte(filepath.Base(h.Name)))
+		}
+	}
+	tw.Close()
+	os.WriteFile(filepath.Join(indir, "evil.tar"), tarbuf.Bytes(), 0644)
+
+	// zip with the same tricks
+	var zipbuf bytes.Buffer
+	zw := zip.NewWriter(&zipbuf)
+	for _, name := range []string{"../../../evil6", "zlink", "zlink/evil7"} {
+		fh := &zip.FileHeader{Name: name, Method: zip.Store}
+		content := filepath.Base(name)
+		if name == "zlink" {
+			fh.SetMode(os.ModeSymlink | 0777)
+			content = "/"
+		}
+		f, _ := zw.CreateHeader(fh)
+		f.Write([]byte(content))
+	}
+	zw.Close()
+	os.WriteFile(filepath.Join(indir, "evil.zip"), zipbuf.Bytes(), 0644)
+
+	// and cpio
+	var cpiobuf bytes.Buffer
+	cpioEntry(&cpiobuf, "../../../evil8", 0100644, "evil8")
+	cpioEntry(&cpiobuf, "clink", 0120777, "../../../../..")
+	cpioEntry(&cpiobuf, "clink/evil9", 0100644, "evil9")
+	cpioEntry(&cpiobuf, "TRAILER!!!", 0, "")
+	cpiobuf.Write(make([]byte, 512-cpiobuf.Len()%512))
+	os.WriteFile(filepath.Join(indir, "evil.cpio"), cpiobuf.Bytes(), 0644)
+
+	m := scanBuiltin(t, func(c *types.Configuration) { c.OutDir = outdir }, indir)
+
+	// nothing may be created outside the output folder, and no links inside it
+	// except the ones pointing to our input files
+	var found []string
+	filepath.Walk(sandbox, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), "evil") && !info.IsDir() && !strings.HasPrefix(path, indir) {
+			found = append(found, info.Name())
+			if !strings.HasPrefix(path, outdir+string(filepath.Separator)) {
+				t.Errorf("%s was created outside the output folder", path)
+			}
+		}
+		if info.Mode()&os.ModeSymlink != 0 && filepath.Dir(path) != filepath.Join(outdir, indir) {
+			t.Errorf("%s is a symbolic link", path)
+		}
+		return nil
+	})
+	sort.Strings(found)
+	expected := []string{"evil.cpio", "evil.tar", "evil.zip",
+		"evil1", "evil2", "evil3", "evil4", "evil5", "evil6", "evil7", "evil8", "evil9"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Extracted %v, expected %v", found, expected)
+	}
+
+	// the links should be recorded as metadata
+	links := make(map[string]string)
+	for _, file := range m.Files {
+		if typ, _ := file.Get("type"); typ == "symlink" || typ == "hardlink" {
+			link, _ := file.Get("link")
+			links[filepath.Base(file.Filename)+":"+typ.(string)] = link.(string)
+		}
+	}
+	expectedLinks := map[string]string{
+		"tlink:symlink":  "../../../..",
+		"thard:hardlink": "/etc/passwd",
+		"zlink:symlink":  "/",
+		"clink:symlink":  "../../../../..",
+	}
+	if !reflect.DeepEqual(links, expectedLinks) {
+		t.Errorf("Found links %v, expected %v", links, expectedLinks)
+	}
+}
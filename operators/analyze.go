@@ -55,8 +55,8 @@ func analyzeFunction(e *types.Env, typ string, prefix string, data ...interface{
 	// res, err := f(e.GetFile(), e.Reader, data...)
 	res, err := f.Call(ps)
 
-	// generate analysis name based on type and parameters
-	name := typ
+	// generate analysis name based on type, offset and parameters
+	name := e.AnalysisName(typ)
 	for _, d := range data {
 		name = fmt.Sprintf("%s__%v", name, d)
 	}
@@ -85,4 +85,8 @@ func init() {
 	AnalyzerRegister("histogram", analyzers.HistogramAnalyzer)
 	AnalyzerRegister("elf", analyzers.ElfAnalyzer)
 	AnalyzerRegister("dex", analyzers.DexAnalyzer)
+	AnalyzerRegister("dtb", analyzers.DtbAnalyzer)
+	AnalyzerRegister("axml", analyzers.AxmlAnalyzer)
+	AnalyzerRegister("apk", analyzers.ApkAnalyzer)
+	AnalyzerRegister("kernel", analyzers.KernelAnalyzer)
 }
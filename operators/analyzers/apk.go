@@ -0,0 +1,128 @@
+package analyzers
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/avahidi/molly/util"
+)
+
+// apkMaxEntry is the largest manifest or dex file read from an APK
+const apkMaxEntry = 256 << 20
+
+// apkRead reads a file from the archive
+func apkRead(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > apkMaxEntry {
+		return nil, fmt.Errorf("%s is too large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, apkMaxEntry))
+}
+
+// ApkAnalyzer summarizes the manifest of an APK and correlates it with the
+// classes and strings of its dex files: permissions used in the code but
+// not declared, declared permissions the code never mentions and exported
+// components whose class is missing
+func ApkAnalyzer(filename string, r io.ReadSeeker) (interface{}, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	z, err := zip.NewReader(util.NewReaderAt(r), size)
+	if err != nil {
+		return nil, err
+	}
+
+	var report map[string]interface{}
+	var dexes []string
+	classes, strs := map[string]bool{}, map[string]bool{}
+	dexErrors := map[string]string{}
+	for _, f := range z.File {
+		switch {
+		case f.Name == "AndroidManifest.xml":
+			data, err := apkRead(f)
+			if err != nil {
+				return nil, err
+			}
+			if report, err = axmlReport(data); err != nil {
+				return nil, err
+			}
+		case path.Dir(f.Name) == "." && strings.HasPrefix(f.Name, "classes") && path.Ext(f.Name) == ".dex":
+			dexes = append(dexes, f.Name)
+			data, err := apkRead(f)
+			if err == nil {
+				var res interface{}
+				if res, err = DexAnalyzer(f.Name, bytes.NewReader(data)); err == nil {
+					dex, _ := res.(map[string]interface{})
+					dexClasses, _ := dex["classes"].([]string)
+					for _, c := range dexClasses {
+						classes[c] = true
+					}
+					dexStrings, _ := dex["strings"].([]string)
+					for _, s := range dexStrings {
+						strs[s] = true
+					}
+				}
+			}
+			if err != nil {
+				dexErrors[f.Name] = err.Error()
+			}
+		}
+	}
+	if report == nil {
+		return nil, fmt.Errorf("apk: no AndroidManifest.xml")
+	}
+	delete(report, "xml")
+	sort.Strings(dexes)
+	report["dex"] = dexes
+	if len(dexErrors) > 0 {
+		report["dex-errors"] = dexErrors
+	}
+
+	declared := map[string]bool{}
+	unreferenced := []string{}
+	permissions, _ := report["permissions"].([]string)
+	for _, p := range permissions {
+		declared[p] = true
+		if !strs[p] {
+			unreferenced = append(unreferenced, p)
+		}
+	}
+	undeclared := []string{}
+	for s := range strs {
+		if strings.HasPrefix(s, "android.permission.") && !declared[s] {
+			undeclared = append(undeclared, s)
+		}
+	}
+	sort.Strings(undeclared)
+	report["undeclared-permissions"] = undeclared
+	report["unreferenced-permissions"] = unreferenced
+
+	// components can be missing when the code is loaded at runtime.
+	// Inner classes are not listed by the dex analyzer, look for the outer class
+	missing := []string{}
+	exported, _ := report["exported"].(map[string][]string)
+	for _, names := range exported {
+		for _, name := range names {
+			outer := name
+			if i := strings.Index(name, "$"); i >= 0 {
+				outer = name[:i]
+			}
+			if !classes[outer] {
+				missing = append(missing, name)
+			}
+		}
+	}
+	sort.Strings(missing)
+	report["missing-components"] = missing
+	return report, nil
+}
@@ -0,0 +1,425 @@
+package analyzers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Android binary XML analyzer based on ResourceTypes.h in the Android
+// framework. The document is converted to text and manifests are
+// summarized
+
+const (
+	axmlStringPool   = 0x0001
+	axmlDocument     = 0x0003
+	axmlStartNs      = 0x0100
+	axmlStartElement = 0x0102
+	axmlEndElement   = 0x0103
+	axmlCdata        = 0x0104
+	axmlResourceMap  = 0x0180
+
+	axmlUTF8     = 1 << 8
+	axmlNoString = 0xFFFFFFFF
+	axmlMaxDepth = 256
+
+	axmlAndroidNs = "http://schemas.android.com/apk/res/android"
+)
+
+// axmlAttrNames are the names of the attributes used in the manifest
+// summary, the names can be stripped and only the resource ids left
+var axmlAttrNames = map[uint32]string{
+	0x01010003: "name",
+	0x01010006: "permission",
+	0x01010010: "exported",
+	0x0101020c: "minSdkVersion",
+	0x0101021b: "versionCode",
+	0x0101021c: "versionName",
+	0x01010270: "targetSdkVersion",
+	0x01010271: "maxSdkVersion",
+}
+
+type axmlAttr struct {
+	ns, name string
+	typ      uint8
+	data     uint32
+	value    string
+}
+
+type axmlElement struct {
+	ns, name   string
+	namespaces [][2]string
+	attrs      []axmlAttr
+	children   []*axmlElement
+	text       string
+}
+
+type axmlContext struct {
+	strings []string
+	ids     []uint32
+	nsmap   map[string]string
+}
+
+// str returns a string from the pool, invalid references are empty
+func (c *axmlContext) str(n uint32) string {
+	if n >= uint32(len(c.strings)) {
+		return ""
+	}
+	return c.strings[n]
+}
+
+// axmlPool decodes a string pool with UTF-8 or UTF-16 strings
+func axmlPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, fmt.Errorf("axml: truncated string pool")
+	}
+	le := binary.LittleEndian
+	headerSize := uint32(le.Uint16(chunk[2:]))
+	count, flags, start := le.Uint32(chunk[8:]), le.Uint32(chunk[16:]), le.Uint32(chunk[20:])
+	if uint64(headerSize)+4*uint64(count) > uint64(len(chunk)) || start > uint32(len(chunk)) {
+		return nil, fmt.Errorf("axml: bad string pool")
+	}
+
+	strs := make([]string, count)
+	for i := range strs {
+		offset := uint64(start) + uint64(le.Uint32(chunk[headerSize+4*uint32(i):]))
+		if offset >= uint64(len(chunk)) {
+			return nil, fmt.Errorf("axml: string %d is outside the pool", i)
+		}
+		b := chunk[offset:]
+		if flags&axmlUTF8 != 0 {
+			// the length in UTF-16 units is followed by the length in bytes
+			length := func() int {
+				if len(b) == 0 {
+					return 0
+				}
+				n := int(b[0])
+				if n&0x80 != 0 && len(b) > 1 {
+					n, b = (n&0x7F)<<8|int(b[1]), b[2:]
+				} else {
+					b = b[1:]
+				}
+				return n
+			}
+			length()
+			n := length()
+			if n > len(b) {
+				return nil, fmt.Errorf("axml: string %d is truncated", i)
+			}
+			strs[i] = string(b[:n])
+		} else {
+			if len(b) < 2 {
+				return nil, fmt.Errorf("axml: string %d is truncated", i)
+			}
+			n := int(le.Uint16(b))
+			b = b[2:]
+			if n&0x8000 != 0 && len(b) >= 2 {
+				n, b = (n&0x7FFF)<<16|int(le.Uint16(b)), b[2:]
+			}
+			if 2*n > len(b) {
+				return nil, fmt.Errorf("axml: string %d is truncated", i)
+			}
+			units := make([]uint16, n)
+			for j := range units {
+				units[j] = le.Uint16(b[2*j:])
+			}
+			strs[i] = string(utf16.Decode(units))
+		}
+	}
+	return strs, nil
+}
+
+// value converts a typed value to text
+func (c *axmlContext) value(raw, typ uint32, data uint32) string {
+	switch typ {
+	case 0x01:
+		return fmt.Sprintf("@0x%08x", data)
+	case 0x02:
+		return fmt.Sprintf("?0x%08x", data)
+	case 0x03:
+		return c.str(data)
+	case 0x04:
+		return fmt.Sprintf("%g", math.Float32frombits(data))
+	case 0x05, 0x06:
+		// dimensions and fractions are kept raw
+		return fmt.Sprintf("0x%08x", data)
+	case 0x10:
+		return fmt.Sprintf("%d", int32(data))
+	case 0x11:
+		return fmt.Sprintf("0x%x", data)
+	case 0x12:
+		if data != 0 {
+			return "true"
+		}
+		return "false"
+	case 0x1c, 0x1d, 0x1e, 0x1f:
+		return fmt.Sprintf("#%08x", data)
+	}
+	if raw != axmlNoString {
+		return c.str(raw)
+	}
+	return ""
+}
+
+// attrName returns the name of an attribute, falling back to the resource
+// id when the name has been stripped
+func (c *axmlContext) attrName(n uint32) string {
+	if name := c.str(n); name != "" {
+		return name
+	}
+	if n < uint32(len(c.ids)) {
+		if name, found := axmlAttrNames[c.ids[n]]; found {
+			return name
+		}
+		return fmt.Sprintf("0x%08x", c.ids[n])
+	}
+	return ""
+}
+
+// element decodes a start element node
+func (c *axmlContext) element(chunk []byte, headerSize uint16) (*axmlElement, error) {
+	le := binary.LittleEndian
+	if int(headerSize)+20 > len(chunk) {
+		return nil, fmt.Errorf("axml: truncated element")
+	}
+	ext := chunk[headerSize:]
+	el := &axmlElement{name: c.str(le.Uint32(ext[4:]))}
+	if ns := le.Uint32(ext[0:]); ns != axmlNoString {
+		el.ns = c.str(ns)
+	}
+	start, size, count := int(le.Uint16(ext[8:])), int(le.Uint16(ext[10:])), int(le.Uint16(ext[12:]))
+	if size < 20 || start+count*size > len(ext) {
+		return nil, fmt.Errorf("axml: bad attributes in %s", el.name)
+	}
+	for i := 0; i < count; i++ {
+		a := ext[start+i*size:]
+		attr := axmlAttr{name: c.attrName(le.Uint32(a[4:])), typ: a[15], data: le.Uint32(a[16:])}
+		if ns := le.Uint32(a[0:]); ns != axmlNoString {
+			attr.ns = c.str(ns)
+		}
+		attr.value = c.value(le.Uint32(a[8:]), uint32(attr.typ), attr.data)
+		el.attrs = append(el.attrs, attr)
+	}
+	return el, nil
+}
+
+// axmlDecode decodes a document into its root element
+func axmlDecode(data []byte) (*axmlElement, *axmlContext, error) {
+	le := binary.LittleEndian
+	if len(data) < 8 || le.Uint16(data) != axmlDocument {
+		return nil, nil, fmt.Errorf("axml: not a binary XML document")
+	}
+	if size := le.Uint32(data[4:]); size < uint32(len(data)) {
+		data = data[:size]
+	}
+	c := &axmlContext{nsmap: map[string]string{}}
+
+	root := &axmlElement{}
+	stack := []*axmlElement{root}
+	var namespaces [][2]string
+	for offset := int(le.Uint16(data[2:])); offset+8 <= len(data); {
+		typ, headerSize, size := le.Uint16(data[offset:]), le.Uint16(data[offset+2:]), int(le.Uint32(data[offset+4:]))
+		if size < 8 || int(headerSize) > size || offset+size > len(data) {
+			return nil, nil, fmt.Errorf("axml: bad chunk at %d", offset)
+		}
+		chunk := data[offset : offset+size]
+		offset += size
+
+		switch typ {
+		case axmlStringPool:
+			strs, err := axmlPool(chunk)
+			if err != nil {
+				return nil, nil, err
+			}
+			c.strings = strs
+		case axmlResourceMap:
+			c.ids = make([]uint32, (size-int(headerSize))/4)
+			for i := range c.ids {
+				c.ids[i] = le.Uint32(chunk[int(headerSize)+4*i:])
+			}
+		case axmlStartNs:
+			if int(headerSize)+8 > size {
+				return nil, nil, fmt.Errorf("axml: truncated namespace")
+			}
+			prefix, uri := c.str(le.Uint32(chunk[headerSize:])), c.str(le.Uint32(chunk[headerSize+4:]))
+			c.nsmap[uri] = prefix
+			namespaces = append(namespaces, [2]string{prefix, uri})
+		case axmlStartElement:
+			if len(stack) > axmlMaxDepth {
+				return nil, nil, fmt.Errorf("axml: elements are nested too deep")
+			}
+			el, err := c.element(chunk, headerSize)
+			if err != nil {
+				return nil, nil, err
+			}
+			el.namespaces, namespaces = namespaces, nil
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, el)
+			stack = append(stack, el)
+		case axmlEndElement:
+			if len(stack) == 1 {
+				return nil, nil, fmt.Errorf("axml: unbalanced elements")
+			}
+			stack = stack[:len(stack)-1]
+		case axmlCdata:
+			if int(headerSize)+4 <= size {
+				stack[len(stack)-1].text += c.str(le.Uint32(chunk[headerSize:]))
+			}
+		}
+	}
+	if len(root.children) != 1 {
+		return nil, nil, fmt.Errorf("axml: document has %d root elements", len(root.children))
+	}
+	return root.children[0], c, nil
+}
+
+// qname returns the name with the namespace prefix
+func (c *axmlContext) qname(ns, name string) string {
+	if prefix, found := c.nsmap[ns]; found && prefix != "" {
+		return prefix + ":" + name
+	}
+	return name
+}
+
+var axmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;")
+
+// text writes the element as indented XML
+func (c *axmlContext) text(w *strings.Builder, el *axmlElement, indent string) {
+	fmt.Fprintf(w, "%s<%s", indent, c.qname(el.ns, el.name))
+	for _, ns := range el.namespaces {
+		fmt.Fprintf(w, " xmlns:%s=\"%s\"", ns[0], axmlEscaper.Replace(ns[1]))
+	}
+	for _, a := range el.attrs {
+		fmt.Fprintf(w, " %s=\"%s\"", c.qname(a.ns, a.name), axmlEscaper.Replace(a.value))
+	}
+	if len(el.children) == 0 && el.text == "" {
+		w.WriteString("/>\n")
+		return
+	}
+	w.WriteString(">")
+	if el.text != "" {
+		w.WriteString(axmlEscaper.Replace(el.text))
+	}
+	if len(el.children) > 0 {
+		w.WriteString("\n")
+		for _, child := range el.children {
+			c.text(w, child, indent+"  ")
+		}
+		w.WriteString(indent)
+	}
+	fmt.Fprintf(w, "</%s>\n", c.qname(el.ns, el.name))
+}
+
+// attr returns an attribute in the android namespace
+func (el *axmlElement) attr(name string) (axmlAttr, bool) {
+	for _, a := range el.attrs {
+		if a.name == name && (a.ns == axmlAndroidNs || a.ns == "") {
+			return a, true
+		}
+	}
+	return axmlAttr{}, false
+}
+
+// number returns integer attributes as numbers and everything else as text
+func (a axmlAttr) number() interface{} {
+	if a.typ == 0x10 || a.typ == 0x11 {
+		return int64(int32(a.data))
+	}
+	return a.value
+}
+
+// axmlManifest summarizes a manifest, components without an exported
+// attribute are exported when they have an intent filter
+func axmlManifest(root *axmlElement, report map[string]interface{}) {
+	pkg, _ := root.attr("package")
+	report["package"] = pkg.value
+	for key, name := range map[string]string{"version-code": "versionCode", "version-name": "versionName"} {
+		if a, found := root.attr(name); found {
+			report[key] = a.number()
+		}
+	}
+
+	permissions := []string{}
+	exported := map[string][]string{}
+	for _, el := range root.children {
+		switch el.name {
+		case "uses-sdk":
+			for key, name := range map[string]string{"min-sdk": "minSdkVersion",
+				"target-sdk": "targetSdkVersion", "max-sdk": "maxSdkVersion"} {
+				if a, found := el.attr(name); found {
+					report[key] = a.number()
+				}
+			}
+		case "uses-permission", "uses-permission-sdk-23":
+			if a, found := el.attr("name"); found {
+				permissions = append(permissions, a.value)
+			}
+		case "application":
+			for _, comp := range el.children {
+				switch comp.name {
+				case "activity", "activity-alias", "service", "receiver", "provider":
+				default:
+					continue
+				}
+				isExported := false
+				if a, found := comp.attr("exported"); found {
+					isExported = a.value == "true"
+				} else {
+					for _, child := range comp.children {
+						isExported = isExported || child.name == "intent-filter"
+					}
+				}
+				if name, _ := comp.attr("name"); isExported {
+					exported[comp.name] = append(exported[comp.name], axmlClassName(pkg.value, name.value))
+				}
+			}
+		}
+	}
+	sort.Strings(permissions)
+	report["permissions"] = permissions
+	report["exported"] = exported
+}
+
+// axmlClassName expands component names relative to the package
+func axmlClassName(pkg, name string) string {
+	if strings.HasPrefix(name, ".") {
+		return pkg + name
+	}
+	if !strings.Contains(name, ".") && pkg != "" {
+		return pkg + "." + name
+	}
+	return name
+}
+
+// AxmlAnalyzer converts Android binary XML to text, manifests are also
+// summarized with package, version, SDK levels, permissions and exported
+// components
+func AxmlAnalyzer(filename string, r io.ReadSeeker) (interface{}, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return axmlReport(data)
+}
+
+func axmlReport(data []byte) (map[string]interface{}, error) {
+	root, c, err := axmlDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	var w strings.Builder
+	w.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	c.text(&w, root, "")
+	report := map[string]interface{}{"xml": w.String()}
+	if root.name == "manifest" {
+		axmlManifest(root, report)
+	}
+	return report, nil
+}
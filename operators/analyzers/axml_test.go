@@ -0,0 +1,248 @@
+package analyzers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// axmlBuilder creates binary XML documents, the first strings are the
+// attribute names with resource ids
+type axmlBuilder struct {
+	strings []string
+	ids     []uint32
+	nodes   bytes.Buffer
+}
+
+type axmlTestAttr struct {
+	name  string
+	typ   uint8
+	data  uint32
+	value string
+}
+
+func (b *axmlBuilder) str(s string) uint32 {
+	for i, str := range b.strings {
+		if str == s {
+			return uint32(i)
+		}
+	}
+	b.strings = append(b.strings, s)
+	return uint32(len(b.strings) - 1)
+}
+
+func (b *axmlBuilder) node(typ uint16, ext ...uint32) {
+	binary.Write(&b.nodes, binary.LittleEndian, []uint16{typ, 16})
+	binary.Write(&b.nodes, binary.LittleEndian, []uint32{uint32(16 + 4*len(ext)), 1, axmlNoString})
+	binary.Write(&b.nodes, binary.LittleEndian, ext)
+}
+
+func (b *axmlBuilder) start(name string, attrs ...axmlTestAttr) {
+	ext := []uint32{axmlNoString, b.str(name), 20<<16 | 20, uint32(len(attrs)), 0}
+	for _, a := range attrs {
+		raw, data := uint32(axmlNoString), a.data
+		if a.typ == 0x03 {
+			raw = b.str(a.value)
+			data = raw
+		}
+		// only the package is outside the android namespace
+		ns := b.str(axmlAndroidNs)
+		if a.name == "package" {
+			ns = axmlNoString
+		}
+		ext = append(ext, ns, b.str(a.name), raw, uint32(a.typ)<<24|8, data)
+	}
+	b.node(axmlStartElement, ext...)
+}
+
+func (b *axmlBuilder) end(name string) {
+	b.node(axmlEndElement, axmlNoString, b.str(name))
+}
+
+func (b *axmlBuilder) bytes(utf8 bool) []byte {
+	var data bytes.Buffer
+	offsets := make([]uint32, len(b.strings))
+	for i, s := range b.strings {
+		offsets[i] = uint32(data.Len())
+		if utf8 {
+			data.Write([]byte{byte(len(s)), byte(len(s))})
+			data.WriteString(s + "\x00")
+		} else {
+			units := utf16.Encode([]rune(s))
+			binary.Write(&data, binary.LittleEndian, uint16(len(units)))
+			binary.Write(&data, binary.LittleEndian, append(units, 0))
+		}
+	}
+	for data.Len()%4 != 0 {
+		data.WriteByte(0)
+	}
+	flags := uint32(0)
+	if utf8 {
+		flags = axmlUTF8
+	}
+
+	var pool bytes.Buffer
+	start := uint32(28 + 4*len(offsets))
+	binary.Write(&pool, binary.LittleEndian, []uint16{axmlStringPool, 28})
+	binary.Write(&pool, binary.LittleEndian, []uint32{start + uint32(data.Len()), uint32(len(offsets)), 0, flags, start, 0})
+	binary.Write(&pool, binary.LittleEndian, offsets)
+	pool.Write(data.Bytes())
+
+	var ids bytes.Buffer
+	binary.Write(&ids, binary.LittleEndian, []uint16{axmlResourceMap, 8})
+	binary.Write(&ids, binary.LittleEndian, append([]uint32{uint32(8 + 4*len(b.ids))}, b.ids...))
+
+	var doc bytes.Buffer
+	binary.Write(&doc, binary.LittleEndian, []uint16{axmlDocument, 8})
+	binary.Write(&doc, binary.LittleEndian, uint32(8+pool.Len()+ids.Len()+b.nodes.Len()))
+	doc.Write(pool.Bytes())
+	doc.Write(ids.Bytes())
+	doc.Write(b.nodes.Bytes())
+	return doc.Bytes()
+}
+
+// axmlTestManifest creates a manifest where the name of targetSdkVersion
+// has been stripped
+func axmlTestManifest(utf8 bool) []byte {
+	b := &axmlBuilder{
+		strings: []string{"name", "exported", "versionCode", "minSdkVersion", ""},
+		ids:     []uint32{0x01010003, 0x01010010, 0x0101021b, 0x0101020c, 0x01010270},
+	}
+	str := func(name, value string) axmlTestAttr { return axmlTestAttr{name: name, typ: 0x03, value: value} }
+	num := func(name string, n uint32) axmlTestAttr { return axmlTestAttr{name: name, typ: 0x10, data: n} }
+	boolean := func(name string, v uint32) axmlTestAttr { return axmlTestAttr{name: name, typ: 0x12, data: v} }
+
+	b.node(axmlStartNs, b.str("android"), b.str(axmlAndroidNs))
+	b.start("manifest", str("package", "com.example"), num("versionCode", 42))
+	b.start("uses-sdk", num("minSdkVersion", 21), num("", 33))
+	b.end("uses-sdk")
+	for _, p := range []string{"android.permission.INTERNET", "android.permission.CAMERA"} {
+		b.start("uses-permission", str("name", p))
+		b.end("uses-permission")
+	}
+	b.start("application")
+	b.start("activity", str("name", ".Main"))
+	b.start("intent-filter")
+	b.end("intent-filter")
+	b.end("activity")
+	b.start("service", str("name", "Hidden"), boolean("exported", 0))
+	b.end("service")
+	b.start("receiver", str("name", "com.other.Receiver"), boolean("exported", 0xFFFFFFFF))
+	b.end("receiver")
+	b.start("receiver", str("name", ".Main$Boot"), boolean("exported", 0xFFFFFFFF))
+	b.end("receiver")
+	b.end("application")
+	b.end("manifest")
+	return b.bytes(utf8)
+}
+
+func TestAxmlAnalyzer(t *testing.T) {
+	for _, utf8 := range []bool{false, true} {
+		res, err := AxmlAnalyzer("AndroidManifest.xml", bytes.NewReader(axmlTestManifest(utf8)))
+		if err != nil {
+			t.Fatalf("utf8 %v: analysis failed: %v", utf8, err)
+		}
+		report := res.(map[string]interface{})
+		xml := report["xml"].(string)
+		for _, want := range []string{`<manifest xmlns:android="` + axmlAndroidNs + `" package="com.example" android:versionCode="42">`,
+			`<uses-sdk android:minSdkVersion="21" android:targetSdkVersion="33"/>`,
+			`<service android:name="Hidden" android:exported="false"/>`} {
+			if !strings.Contains(xml, want) {
+				t.Errorf("utf8 %v: %s is missing in\n%s", utf8, want, xml)
+			}
+		}
+		if report["package"] != "com.example" || report["version-code"] != int64(42) ||
+			report["min-sdk"] != int64(21) || report["target-sdk"] != int64(33) {
+			t.Errorf("utf8 %v: wrong manifest %v", utf8, report)
+		}
+		if p := report["permissions"]; !reflect.DeepEqual(p, []string{"android.permission.CAMERA", "android.permission.INTERNET"}) {
+			t.Errorf("utf8 %v: wrong permissions %v", utf8, p)
+		}
+		want := map[string][]string{"activity": {"com.example.Main"}, "receiver": {"com.other.Receiver", "com.example.Main$Boot"}}
+		if e := report["exported"]; !reflect.DeepEqual(e, want) {
+			t.Errorf("utf8 %v: wrong exported components %v", utf8, e)
+		}
+	}
+
+	if _, err := AxmlAnalyzer("bad.xml", bytes.NewReader([]byte("<?xml version="))); err == nil {
+		t.Errorf("text XML was accepted")
+	}
+}
+
+// dexTestFile creates a dex file with one class and a few strings
+func dexTestFile(class string, strs ...string) []byte {
+	strs = append(strs, class)
+	le := binary.LittleEndian
+	dex := make([]byte, 0x70)
+	copy(dex, "dex\n035\x00")
+	le.PutUint32(dex[40:], 0x12345678)
+
+	stringIds := len(dex)
+	dex = append(dex, make([]byte, 4*len(strs))...)
+	typeIds := len(dex)
+	dex = append(dex, make([]byte, 4)...)
+	le.PutUint32(dex[typeIds:], uint32(len(strs)-1))
+	classDefs := len(dex)
+	dex = append(dex, make([]byte, 32)...)
+	for i, s := range strs {
+		le.PutUint32(dex[stringIds+4*i:], uint32(len(dex)))
+		dex = append(append(append(dex, byte(len(s))), s...), 0)
+	}
+	for len(dex)%4 != 0 {
+		dex = append(dex, 0)
+	}
+
+	le.PutUint32(dex[52:], uint32(len(dex)))
+	items := [][3]uint32{{1, uint32(len(strs)), uint32(stringIds)}, {2, 1, uint32(typeIds)},
+		{3, 0, 0}, {4, 0, 0}, {5, 0, 0}, {6, 1, uint32(classDefs)}}
+	dex = append(dex, make([]byte, 4+12*len(items))...)
+	le.PutUint32(dex[len(dex)-4-12*len(items):], uint32(len(items)))
+	for i, item := range items {
+		p := dex[len(dex)-12*(len(items)-i):]
+		le.PutUint16(p, uint16(item[0]))
+		le.PutUint32(p[4:], item[1])
+		le.PutUint32(p[8:], item[2])
+	}
+	return dex
+}
+
+func TestApkAnalyzer(t *testing.T) {
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for name, data := range map[string][]byte{
+		"AndroidManifest.xml": axmlTestManifest(false),
+		"classes.dex":         dexTestFile("Lcom/example/Main;", "android.permission.CAMERA", "android.permission.RECORD_AUDIO"),
+		"classes2.dex":        []byte("not a dex file"),
+	} {
+		w, _ := z.Create(name)
+		w.Write(data)
+	}
+	z.Close()
+
+	res, err := ApkAnalyzer("test.apk", bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("analysis failed: %v", err)
+	}
+	report := res.(map[string]interface{})
+	var testdata = []struct {
+		key  string
+		want interface{}
+	}{
+		{"dex", []string{"classes.dex", "classes2.dex"}},
+		{"undeclared-permissions", []string{"android.permission.RECORD_AUDIO"}},
+		{"unreferenced-permissions", []string{"android.permission.INTERNET"}},
+		{"missing-components", []string{"com.other.Receiver"}},
+	}
+	for _, test := range testdata {
+		if got := report[test.key]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s is %v, wanted %v", test.key, got, test.want)
+		}
+	}
+	if errs, _ := report["dex-errors"].(map[string]string); len(errs) != 1 || errs["classes2.dex"] == "" {
+		t.Errorf("wrong dex errors %v", report["dex-errors"])
+	}
+}
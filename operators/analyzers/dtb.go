@@ -0,0 +1,65 @@
+package analyzers
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/avahidi/molly/util/fdt"
+)
+
+// dtbMaxValue is the largest binary property shown in full
+const dtbMaxValue = 64
+
+// dtbValue converts a property to strings or numbers when possible
+func dtbValue(value []byte) interface{} {
+	if len(value) == 0 {
+		return true
+	}
+	if list, ok := fdt.Strings(value); ok {
+		if len(list) == 1 {
+			return list[0]
+		}
+		return list
+	}
+	if len(value) > dtbMaxValue {
+		return fmt.Sprintf("<%d bytes>", len(value))
+	}
+	if len(value)%4 != 0 {
+		return hex.EncodeToString(value)
+	}
+	cells := make([]uint32, len(value)/4)
+	for i := range cells {
+		cells[i] = binary.BigEndian.Uint32(value[4*i:])
+	}
+	if len(cells) == 1 {
+		return cells[0]
+	}
+	return cells
+}
+
+func dtbNode(n *fdt.Node) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for _, p := range n.Props {
+		ret[p.Name] = dtbValue(p.Value)
+	}
+	for _, c := range n.Children {
+		ret[c.Name] = dtbNode(c)
+	}
+	return ret
+}
+
+// DtbAnalyzer decodes a device tree blob into a tree of nodes and properties
+func DtbAnalyzer(filename string, r io.ReadSeeker) (interface{}, error) {
+	t, err := fdt.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	report := map[string]interface{}{
+		"version":  t.Version,
+		"boot-cpu": t.BootCPU,
+		"/":        dtbNode(t.Root),
+	}
+	return report, nil
+}
@@ -0,0 +1,136 @@
+package analyzers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	kernelMaxSize   = 512 << 20
+	kernelBanner    = "Linux version "
+	kernelConfigBeg = "IKCFG_ST"
+	kernelConfigEnd = "IKCFG_ED"
+)
+
+// kernelHardening are options that harden the kernel, they are reported
+// with their value or "n" when they are not set
+var kernelHardening = []string{
+	"CONFIG_STACKPROTECTOR_STRONG",
+	"CONFIG_STRICT_KERNEL_RWX",
+	"CONFIG_STRICT_MODULE_RWX",
+	"CONFIG_RANDOMIZE_BASE",
+	"CONFIG_HARDENED_USERCOPY",
+	"CONFIG_FORTIFY_SOURCE",
+	"CONFIG_SECCOMP",
+	"CONFIG_SECURITY_SELINUX",
+	"CONFIG_MODULE_SIG_FORCE",
+	"CONFIG_STATIC_USERMODEHELPER",
+	"CONFIG_INIT_ON_ALLOC_DEFAULT_ON",
+	"CONFIG_DEVMEM",
+	"CONFIG_DEVKMEM",
+	"CONFIG_KEXEC",
+	"CONFIG_PROC_KCORE",
+	"CONFIG_DEBUG_FS",
+}
+
+// kernelFindBanner returns the first version banner, format strings
+// with the same prefix are skipped
+func kernelFindBanner(data []byte) string {
+	for offset := 0; ; {
+		n := bytes.Index(data[offset:], []byte(kernelBanner))
+		if n == -1 {
+			return ""
+		}
+		offset += n + len(kernelBanner)
+		if offset < len(data) && data[offset] >= '0' && data[offset] <= '9' {
+			end := offset
+			for end < len(data) && end-offset < 512 && data[end] != '\n' && data[end] != 0 {
+				end++
+			}
+			return kernelBanner + string(data[offset:end])
+		}
+	}
+}
+
+// kernelConfig decompresses and parses the configuration stored with
+// CONFIG_IKCONFIG, options that are not set have the value "n"
+func kernelConfig(data []byte) (map[string]string, error) {
+	start := bytes.Index(data, []byte(kernelConfigBeg))
+	if start == -1 {
+		return nil, nil
+	}
+	start += len(kernelConfigBeg)
+	end := bytes.Index(data[start:], []byte(kernelConfigEnd))
+	if end == -1 {
+		return nil, fmt.Errorf("kernel: configuration has no end marker")
+	}
+	z, err := gzip.NewReader(bytes.NewReader(data[start : start+end]))
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]string{}
+	s := bufio.NewScanner(z)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "# CONFIG_") && strings.HasSuffix(line, " is not set") {
+			config[strings.TrimSuffix(line[2:], " is not set")] = "n"
+		} else if n := strings.Index(line, "="); n > 0 && strings.HasPrefix(line, "CONFIG_") {
+			config[line[:n]] = line[n+1:]
+		}
+	}
+	return config, s.Err()
+}
+
+// KernelAnalyzer reports the version banner of a decompressed Linux kernel,
+// the configuration when it is embedded and the builtin command line
+func KernelAnalyzer(filename string, r io.ReadSeeker) (interface{}, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, kernelMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	banner := kernelFindBanner(data)
+	if banner == "" {
+		return nil, fmt.Errorf("kernel: no version banner found")
+	}
+	report := map[string]interface{}{
+		"banner":  banner,
+		"version": strings.Fields(banner)[2],
+	}
+
+	config, err := kernelConfig(data)
+	if err != nil {
+		return report, err
+	}
+	report["ikconfig"] = config != nil
+	if config == nil {
+		return report, nil
+	}
+	report["config"] = config
+
+	hardening := map[string]string{}
+	for _, option := range kernelHardening {
+		hardening[option] = "n"
+		if value, found := config[option]; found {
+			hardening[option] = value
+		}
+	}
+	report["hardening"] = hardening
+
+	if cmdline, found := config["CONFIG_CMDLINE"]; found {
+		if s, err := strconv.Unquote(cmdline); err == nil {
+			cmdline = s
+		}
+		report["cmdline"] = cmdline
+	}
+	return report, nil
+}
@@ -0,0 +1,52 @@
+package analyzers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func TestKernelAnalyzer(t *testing.T) {
+	var config bytes.Buffer
+	z := gzip.NewWriter(&config)
+	z.Write([]byte("#\n# Automatically generated file; DO NOT EDIT.\n#\nCONFIG_SECCOMP=y\n" +
+		"# CONFIG_DEVMEM is not set\nCONFIG_CMDLINE=\"console=ttyS0 quiet\"\nCONFIG_HZ=250\n"))
+	z.Close()
+
+	kernel := bytes.Join([][]byte{
+		[]byte("code \x00Linux version %s\x00 more code "),
+		[]byte("Linux version 5.10.0-test (builder@host) (gcc 10.2) #1 SMP PREEMPT\n\x00data "),
+		[]byte(kernelConfigBeg), config.Bytes(), []byte(kernelConfigEnd),
+	}, nil)
+
+	res, err := KernelAnalyzer("vmlinux", bytes.NewReader(kernel))
+	if err != nil {
+		t.Fatalf("analysis failed: %v", err)
+	}
+	report := res.(map[string]interface{})
+	if report["version"] != "5.10.0-test" ||
+		report["banner"] != "Linux version 5.10.0-test (builder@host) (gcc 10.2) #1 SMP PREEMPT" {
+		t.Errorf("wrong banner %v", report["banner"])
+	}
+	if report["cmdline"] != "console=ttyS0 quiet" {
+		t.Errorf("wrong command line %v", report["cmdline"])
+	}
+	if c := report["config"].(map[string]string); len(c) != 4 || c["CONFIG_HZ"] != "250" {
+		t.Errorf("wrong config %v", c)
+	}
+	hardening := report["hardening"].(map[string]string)
+	for option, value := range map[string]string{"CONFIG_SECCOMP": "y", "CONFIG_DEVMEM": "n", "CONFIG_RANDOMIZE_BASE": "n"} {
+		if hardening[option] != value {
+			t.Errorf("%s is %s, wanted %s", option, hardening[option], value)
+		}
+	}
+
+	// kernels without IKCONFIG only have the banner
+	res, err = KernelAnalyzer("vmlinux", bytes.NewReader(kernel[:bytes.Index(kernel, []byte(kernelConfigBeg))]))
+	if err != nil || res.(map[string]interface{})["ikconfig"] != false {
+		t.Errorf("kernel without config gave %v %v", res, err)
+	}
+	if _, err := KernelAnalyzer("data", bytes.NewReader([]byte("no kernel here"))); err == nil {
+		t.Errorf("data without a banner was accepted")
+	}
+}
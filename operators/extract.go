@@ -16,16 +16,47 @@ type extractor struct {
 }
 
 var extractorList = map[string]extractor{
-	"":       extractor{slice: extractors.BinarySlice},
-	"binary": extractor{slice: extractors.BinarySlice},
-	"zip":    extractor{full: extractors.Unzip},
-	"gz":     extractor{full: extractors.Ungzip},
-	"tar":    extractor{full: extractors.Untar},
-	"cpio":   extractor{full: extractors.Uncpio},
-	"mbrlba": extractor{full: extractors.MbrLba},
-	"cramfs": extractor{full: extractors.Uncramfs},
-	"jffs2":  extractor{full: extractors.Unjffs2},
-	"uimage": extractor{full: extractors.UnUimage},
+	"":            extractor{slice: extractors.BinarySlice},
+	"binary":      extractor{slice: extractors.BinarySlice},
+	"zip":         extractor{full: extractors.Unzip},
+	"gz":          extractor{full: extractors.Ungzip},
+	"xz":          extractor{full: extractors.Unxz},
+	"lzma":        extractor{full: extractors.Unlzma},
+	"lzip":        extractor{full: extractors.Unlzip},
+	"bzip2":       extractor{full: extractors.Unbzip2},
+	"zstd":        extractor{full: extractors.Unzstd},
+	"tar":         extractor{full: extractors.Untar},
+	"cpio":        extractor{full: extractors.Uncpio},
+	"ar":          extractor{full: extractors.Unar},
+	"rpm":         extractor{full: extractors.Unrpm},
+	"mbrlba":      extractor{full: extractors.MbrLba},
+	"gpt":         extractor{full: extractors.Gpt},
+	"cramfs":      extractor{full: extractors.Uncramfs},
+	"jffs2":       extractor{full: extractors.Unjffs2},
+	"yaffs2":      extractor{full: extractors.Unyaffs2},
+	"uimage":      extractor{full: extractors.UnUimage},
+	"fit":         extractor{full: extractors.UnFit},
+	"androidboot": extractor{full: extractors.Unandroidboot},
+	"sparse":      extractor{full: extractors.Unsparse},
+	"zimage":      extractor{full: extractors.Unzimage},
+	"payload":     extractor{full: extractors.Unpayload},
+	"squashfs":    extractor{full: extractors.Unsquashfs},
+	"ext":         extractor{full: extractors.Unext},
+	"fat":         extractor{full: extractors.Unfat},
+	"ubi":         extractor{full: extractors.Unubi},
+	"ubifs":       extractor{full: extractors.Unubifs},
+	"iso9660":     extractor{full: extractors.Uniso9660},
+	"ihex":        extractor{full: extractors.Unihex},
+	"srec":        extractor{full: extractors.Unsrec},
+	"titxt":       extractor{full: extractors.Untitxt},
+	"trx":         extractor{full: extractors.Untrx},
+	"seama":       extractor{full: extractors.Unseama},
+	"shrs":        extractor{full: extractors.Unshrs},
+	"tplink":      extractor{full: extractors.Untplink},
+	"chk":         extractor{full: extractors.Unchk},
+	"zynos":       extractor{full: extractors.Unzynos},
+	"uefifv":      extractor{full: extractors.Unuefifv},
+	"capsule":     extractor{full: extractors.Uncapsule},
 }
 
 // ExtractorRegister provides a method to register user extractor functions
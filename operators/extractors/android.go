@@ -0,0 +1,358 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	abootMagic          = "ANDROID!"
+	abootVendorMagic    = "VNDRBOOT"
+	abootV3PageSize     = 4096
+	abootMaxPageSize    = 1 << 16
+	abootMaxVersion     = 4
+	abootRamdiskEntSize = 108
+
+	sparseMagic     = 0xED26FF3A
+	sparseHeadSize  = 28
+	sparseChunkSize = 12
+	sparseRaw       = 0xCAC1
+	sparseFill      = 0xCAC2
+	sparseDontCare  = 0xCAC3
+	sparseCRC       = 0xCAC4
+)
+
+// abootHeader is the boot image header up to version 2, newer versions
+// are read from the raw header
+type abootHeader struct {
+	Magic         [8]byte
+	KernelSize    uint32
+	KernelAddr    uint32
+	RamdiskSize   uint32
+	RamdiskAddr   uint32
+	SecondSize    uint32
+	SecondAddr    uint32
+	TagsAddr      uint32
+	PageSize      uint32
+	HeaderVersion uint32
+	OsVersion     uint32
+	Name          [16]byte
+	Cmdline       [512]byte
+	ID            [8]uint32
+	ExtraCmdline  [1024]byte
+	DtboSize      uint32
+	DtboOffset    uint64
+	HeaderSize    uint32
+	DtbSize       uint32
+	DtbAddr       uint64
+}
+
+type abootVendorHeader struct {
+	Magic          [8]byte
+	HeaderVersion  uint32
+	PageSize       uint32
+	KernelAddr     uint32
+	RamdiskAddr    uint32
+	RamdiskSize    uint32
+	Cmdline        [2048]byte
+	TagsAddr       uint32
+	Name           [16]byte
+	HeaderSize     uint32
+	DtbSize        uint32
+	DtbAddr        uint64
+	TableSize      uint32
+	TableEntryNum  uint32
+	TableEntrySize uint32
+	BootconfigSize uint32
+}
+
+type sparseHeader struct {
+	Magic         uint32
+	Major         uint16
+	Minor         uint16
+	FileHdrSize   uint16
+	ChunkHdrSize  uint16
+	BlockSize     uint32
+	TotalBlocks   uint32
+	TotalChunks   uint32
+	ImageChecksum uint32
+}
+
+type sparseChunk struct {
+	Type      uint16
+	Reserved  uint16
+	Blocks    uint32
+	TotalSize uint32
+}
+
+// abootPart is a part of a boot image, the parts follow the header in
+// the order they are listed and each starts on a new page. Parts without
+// a name are skipped
+type abootPart struct {
+	name string
+	size uint32
+}
+
+// abootOsVersion decodes the os version and patch level
+func abootOsVersion(v uint32) (string, string) {
+	version := fmt.Sprintf("%d.%d.%d", v>>25, (v>>18)&0x7F, (v>>11)&0x7F)
+	patch := fmt.Sprintf("%04d-%02d", 2000+(v>>4)&0x7F, v&0xF)
+	return version, patch
+}
+
+// abootParts writes the parts of a boot image starting at the second page
+func abootParts(e *types.Env, prefix string, pageSize, offset int64, parts []abootPart) error {
+	pages := func(size int64) int64 { return (size + pageSize - 1) / pageSize * pageSize }
+	for _, part := range parts {
+		size := int64(part.size)
+		if size == 0 || part.name == "" {
+			offset += pages(size)
+			continue
+		}
+		if offset+size > int64(e.GetSize()) {
+			return fmt.Errorf("android: %s is outside the image", part.name)
+		}
+		w, _, err := e.Create(prefix + part.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, util.NewSectionReader(e.Reader, offset, size))
+		w.Close()
+		if err != nil {
+			return err
+		}
+		offset += pages(size)
+	}
+	return nil
+}
+
+// abootVendor extracts a vendor boot image, version 4 images can have
+// several vendor ramdisks which are extracted separately
+func abootVendor(e *types.Env, prefix string, report map[string]interface{}) error {
+	var head abootVendorHeader
+	img := util.Structured{Reader: e.Reader, Order: binary.LittleEndian}
+	if err := img.ReadAt(0, &head); err != nil {
+		return err
+	}
+	if head.HeaderVersion < 3 || head.HeaderVersion > abootMaxVersion {
+		return fmt.Errorf("android: unknown vendor boot version %d", head.HeaderVersion)
+	}
+	if head.PageSize == 0 || head.PageSize > abootMaxPageSize {
+		return fmt.Errorf("android: bad page size %d", head.PageSize)
+	}
+	if head.HeaderVersion < 4 {
+		head.TableSize, head.TableEntryNum, head.BootconfigSize = 0, 0, 0
+	}
+	report["version"] = head.HeaderVersion
+	report["page-size"] = head.PageSize
+	report["name"] = util.AsciizToString(head.Name[:])
+	report["cmdline"] = util.AsciizToString(head.Cmdline[:])
+
+	pageSize := int64(head.PageSize)
+	pages := func(size int64) int64 { return (size + pageSize - 1) / pageSize * pageSize }
+	ramdisks := pages(int64(head.HeaderSize))
+	table := ramdisks + pages(int64(head.RamdiskSize)) + pages(int64(head.DtbSize))
+
+	// the table splits the vendor ramdisk section into several ramdisks
+	parts := []abootPart{{"vendor_ramdisk", head.RamdiskSize}, {"dtb", head.DtbSize},
+		{"", head.TableSize}, {"bootconfig", head.BootconfigSize}}
+	if head.TableEntryNum > 0 {
+		if head.TableEntrySize < abootRamdiskEntSize ||
+			int64(head.TableEntryNum)*int64(head.TableEntrySize) > int64(head.TableSize) {
+			return fmt.Errorf("android: bad vendor ramdisk table")
+		}
+		var entries []map[string]interface{}
+		for i := 0; i < int(head.TableEntryNum); i++ {
+			var ent [abootRamdiskEntSize]byte
+			if err := img.ReadAt(table+int64(i)*int64(head.TableEntrySize), ent[:]); err != nil {
+				return err
+			}
+			size := binary.LittleEndian.Uint32(ent[0:])
+			offset := binary.LittleEndian.Uint32(ent[4:])
+			name := util.AsciizToString(ent[12:44])
+			if int64(offset)+int64(size) > int64(head.RamdiskSize) {
+				return fmt.Errorf("android: vendor ramdisk %s is outside the section", name)
+			}
+			entries = append(entries, map[string]interface{}{
+				"name": name, "size": size, "offset": offset,
+				"type": binary.LittleEndian.Uint32(ent[8:]),
+			})
+			part := fmt.Sprintf("vendor_ramdisk%d", i)
+			if name != "" {
+				part = "vendor_ramdisk_" + name
+			}
+			if err := abootParts(e, prefix, pageSize, ramdisks+int64(offset), []abootPart{{part, size}}); err != nil {
+				return err
+			}
+		}
+		report["vendor-ramdisks"] = entries
+		parts[0].name = ""
+	}
+	return abootParts(e, prefix, pageSize, ramdisks, parts)
+}
+
+// Unandroidboot extracts kernel, ramdisk, second stage loader and device
+// trees from an Android boot image with a version 0 to 4 header, or the
+// vendor ramdisks and device tree of a vendor boot image. The header is
+// recorded as the analysis "androidboot"
+func Unandroidboot(e *types.Env, prefix string) (string, error) {
+	// short headers are padded with zeros
+	var raw [1660]byte
+	if n, _ := util.NewReaderAt(e.Reader).ReadAt(raw[:], 0); n < 16 {
+		return "", fmt.Errorf("file is not an Android boot image")
+	}
+
+	report := map[string]interface{}{}
+	analysis := e.AnalysisName("androidboot")
+
+	var err error
+	switch string(raw[:8]) {
+	case abootVendorMagic:
+		report["type"] = "vendor_boot"
+		err = abootVendor(e, prefix, report)
+	case abootMagic:
+		report["type"] = "boot"
+		err = abootBoot(e, prefix, raw[:], report)
+	default:
+		err = fmt.Errorf("file is not an Android boot image")
+	}
+	e.Current.RegisterAnalysis(analysis, report, err)
+	return "", err
+}
+
+// abootBoot extracts a boot image, the layout of version 3 and 4 headers
+// differs from the older ones
+func abootBoot(e *types.Env, prefix string, raw []byte, report map[string]interface{}) error {
+	var head abootHeader
+	binary.Read(bytes.NewReader(raw), binary.LittleEndian, &head)
+	version := head.HeaderVersion
+	// older images use this field as the device tree size
+	if version > abootMaxVersion {
+		version = 0
+	}
+	report["version"] = version
+
+	if version >= 3 {
+		le := binary.LittleEndian
+		kernel, ramdisk := le.Uint32(raw[8:]), le.Uint32(raw[12:])
+		osVersion, patch := abootOsVersion(le.Uint32(raw[16:]))
+		report["os-version"], report["os-patch-level"] = osVersion, patch
+		report["cmdline"] = util.AsciizToString(raw[44 : 44+1536])
+		parts := []abootPart{{"kernel", kernel}, {"ramdisk", ramdisk}}
+		if version == 4 {
+			parts = append(parts, abootPart{"signature", le.Uint32(raw[1580:])})
+		}
+		return abootParts(e, prefix, abootV3PageSize, abootV3PageSize, parts)
+	}
+
+	if head.PageSize == 0 || head.PageSize > abootMaxPageSize {
+		return fmt.Errorf("android: bad page size %d", head.PageSize)
+	}
+	osVersion, patch := abootOsVersion(head.OsVersion)
+	report["os-version"], report["os-patch-level"] = osVersion, patch
+	report["page-size"] = head.PageSize
+	report["name"] = util.AsciizToString(head.Name[:])
+	report["cmdline"] = util.AsciizToString(head.Cmdline[:]) + util.AsciizToString(head.ExtraCmdline[:])
+	report["kernel-address"] = head.KernelAddr
+	report["ramdisk-address"] = head.RamdiskAddr
+
+	parts := []abootPart{{"kernel", head.KernelSize}, {"ramdisk", head.RamdiskSize}, {"second", head.SecondSize}}
+	if version >= 1 {
+		parts = append(parts, abootPart{"recovery_dtbo", head.DtboSize})
+	}
+	if version >= 2 {
+		parts = append(parts, abootPart{"dtb", head.DtbSize})
+	}
+	return abootParts(e, prefix, int64(head.PageSize), int64(head.PageSize), parts)
+}
+
+// Unsparse converts an Android sparse image into the raw image. Blocks that
+// are not stored are written as zeros and checksum chunks are verified
+func Unsparse(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.LittleEndian}
+	var head sparseHeader
+	if err := img.ReadAt(0, &head); err != nil {
+		return "", err
+	}
+	if head.Magic != sparseMagic || head.Major != 1 || head.FileHdrSize < sparseHeadSize ||
+		head.ChunkHdrSize < sparseChunkSize || head.BlockSize == 0 || head.BlockSize%4 != 0 {
+		return "", fmt.Errorf("file is not an Android sparse image")
+	}
+
+	w, fd, err := e.Create(decompressedName(e.GetFile(), prefix, "simg", "sparse"))
+	if err != nil {
+		return "", err
+	}
+	defer w.Close()
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(w, crc)
+
+	blockSize := int64(head.BlockSize)
+	offset, blocks := int64(head.FileHdrSize), int64(0)
+	for i := uint32(0); i < head.TotalChunks; i++ {
+		if err := e.Canceled(); err != nil {
+			return "", err
+		}
+		var chunk sparseChunk
+		if err := img.ReadAt(offset, &chunk); err != nil {
+			return "", err
+		}
+		data := offset + int64(head.ChunkHdrSize)
+		size := int64(chunk.Blocks) * blockSize
+		offset += int64(chunk.TotalSize)
+		blocks += int64(chunk.Blocks)
+		if blocks > int64(head.TotalBlocks) {
+			return "", fmt.Errorf("sparse: chunk %d is outside the image", i)
+		}
+
+		switch chunk.Type {
+		case sparseRaw:
+			if int64(chunk.TotalSize) != int64(head.ChunkHdrSize)+size {
+				return "", fmt.Errorf("sparse: bad size of chunk %d", i)
+			}
+			n, err := io.Copy(out, util.NewSectionReader(e.Reader, data, size))
+			if err != nil {
+				return "", err
+			}
+			if n != size {
+				return "", fmt.Errorf("sparse: chunk %d is truncated", i)
+			}
+		case sparseFill:
+			var fill [4]byte
+			if err := img.ReadAt(data, fill[:]); err != nil {
+				return "", err
+			}
+			block := bytes.Repeat(fill[:], int(blockSize/4))
+			for n := uint32(0); n < chunk.Blocks; n++ {
+				if _, err := out.Write(block); err != nil {
+					return "", err
+				}
+			}
+		case sparseDontCare:
+			if err := writeZeros(out, size); err != nil {
+				return "", err
+			}
+		case sparseCRC:
+			var sum uint32
+			if err := img.ReadAt(data, &sum); err != nil {
+				return "", err
+			}
+			if sum != crc.Sum32() {
+				fd.RegisterError(fmt.Errorf("sparse: bad checksum in chunk %d", i))
+			}
+		default:
+			return "", fmt.Errorf("sparse: unknown chunk type %04x", chunk.Type)
+		}
+	}
+	// the image ends with blocks that are not stored
+	if err := writeZeros(out, (int64(head.TotalBlocks)-blocks)*blockSize); err != nil {
+		return "", err
+	}
+	return w.Name(), nil
+}
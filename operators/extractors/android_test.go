@@ -0,0 +1,192 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// abootImage creates a boot image, parts are padded to whole pages
+func abootImage(header []byte, pageSize int, parts ...[]byte) []byte {
+	pad := func(b []byte) []byte {
+		return append(b, make([]byte, (pageSize-len(b)%pageSize)%pageSize)...)
+	}
+	img := pad(append([]byte{}, header...))
+	for _, part := range parts {
+		img = append(img, pad(append([]byte{}, part...))...)
+	}
+	return img
+}
+
+func TestUnandroidboot(t *testing.T) {
+	kernel := bytes.Repeat([]byte("kernel "), 1000)
+	ramdisk := gzipData([]byte("ramdisk"))
+	second := []byte("second stage")
+	dtbo := []byte("recovery dtbo")
+	dtb := []byte{0xd0, 0x0d, 0xfe, 0xed, 1, 2, 3}
+	signature := bytes.Repeat([]byte{0x55}, 100)
+	osVersion := uint32(11<<25 | 0<<18 | 0<<11 | 21<<4 | 3)
+
+	legacy := func(version uint32, pageSize int, parts ...[]byte) []byte {
+		head := abootHeader{
+			KernelSize: uint32(len(kernel)), RamdiskSize: uint32(len(ramdisk)),
+			SecondSize: uint32(len(second)), PageSize: uint32(pageSize),
+			HeaderVersion: version, OsVersion: osVersion, KernelAddr: 0x10008000,
+		}
+		copy(head.Magic[:], abootMagic)
+		copy(head.Cmdline[:], "console=ttyS0")
+		if version >= 1 {
+			head.DtboSize = uint32(len(dtbo))
+		}
+		if version >= 2 {
+			head.DtbSize = uint32(len(dtb))
+		}
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, &head)
+		return abootImage(b.Bytes(), pageSize, parts...)
+	}
+	modern := func(version uint32) []byte {
+		head := make([]byte, 1584)
+		copy(head, abootMagic)
+		binary.LittleEndian.PutUint32(head[8:], uint32(len(kernel)))
+		binary.LittleEndian.PutUint32(head[12:], uint32(len(ramdisk)))
+		binary.LittleEndian.PutUint32(head[16:], osVersion)
+		binary.LittleEndian.PutUint32(head[40:], version)
+		copy(head[44:], "console=ttyS0")
+		if version == 4 {
+			binary.LittleEndian.PutUint32(head[1580:], uint32(len(signature)))
+			return abootImage(head, abootV3PageSize, kernel, ramdisk, signature)
+		}
+		return abootImage(head, abootV3PageSize, kernel, ramdisk)
+	}
+
+	parts := func(extra ...interface{}) map[string][]byte {
+		m := map[string][]byte{"kernel": kernel, "ramdisk": ramdisk}
+		for i := 0; i < len(extra); i += 2 {
+			m[extra[i].(string)] = extra[i+1].([]byte)
+		}
+		return m
+	}
+	var testdata = []struct {
+		img   []byte
+		parts map[string][]byte
+	}{
+		{legacy(0, 2048, kernel, ramdisk, second), parts("second", second)},
+		{legacy(1, 4096, kernel, ramdisk, second, dtbo), parts("second", second, "recovery_dtbo", dtbo)},
+		{legacy(2, 2048, kernel, ramdisk, second, dtbo, dtb),
+			parts("second", second, "recovery_dtbo", dtbo, "dtb", dtb)},
+		{modern(3), parts()},
+		{modern(4), parts("signature", signature)},
+	}
+	for i, test := range testdata {
+		x, err := runExtractor(test.img, Unandroidboot)
+		if err != nil {
+			t.Errorf("boot image %d: extraction failed: %v", i, err)
+			continue
+		}
+		for name, data := range test.parts {
+			if got := x.content(t, name); !bytes.Equal(got, data) {
+				t.Errorf("boot image %d: %s has wrong content", i, name)
+			}
+		}
+		if len(x.files) != len(test.parts) {
+			t.Errorf("boot image %d: extracted %d files", i, len(x.files))
+		}
+		report := x.input.Analyses["androidboot"].Result.(map[string]interface{})
+		if report["os-version"] != "11.0.0" || report["os-patch-level"] != "2021-03" ||
+			report["cmdline"] != "console=ttyS0" {
+			t.Errorf("boot image %d: wrong analysis %v", i, report)
+		}
+	}
+
+	// a vendor boot image with two ramdisks in the table
+	vendor1, vendor2 := gzipData([]byte("vendor")), gzipData([]byte("dlkm"))
+	head := abootVendorHeader{HeaderVersion: 4, PageSize: 2048, HeaderSize: 2128,
+		RamdiskSize: uint32(len(vendor1) + len(vendor2)), DtbSize: uint32(len(dtb)),
+		TableSize: 2 * abootRamdiskEntSize, TableEntryNum: 2, TableEntrySize: abootRamdiskEntSize,
+		BootconfigSize: 12}
+	copy(head.Magic[:], abootVendorMagic)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &head)
+	var table bytes.Buffer
+	for i, ent := range []struct {
+		name   string
+		offset int
+		size   int
+	}{{"", 0, len(vendor1)}, {"dlkm", len(vendor1), len(vendor2)}} {
+		raw := make([]byte, abootRamdiskEntSize)
+		binary.LittleEndian.PutUint32(raw, uint32(ent.size))
+		binary.LittleEndian.PutUint32(raw[4:], uint32(ent.offset))
+		binary.LittleEndian.PutUint32(raw[8:], uint32(1+2*i))
+		copy(raw[12:], ent.name)
+		table.Write(raw)
+	}
+	img := abootImage(b.Bytes(), 2048, append(append([]byte{}, vendor1...), vendor2...), dtb,
+		table.Bytes(), []byte("androidboot="))
+	x, err := runExtractor(img, Unandroidboot)
+	if err != nil {
+		t.Fatalf("vendor boot extraction failed: %v", err)
+	}
+	for name, data := range map[string][]byte{"vendor_ramdisk0": vendor1, "vendor_ramdisk_dlkm": vendor2,
+		"dtb": dtb, "bootconfig": []byte("androidboot=")} {
+		if got := x.content(t, name); !bytes.Equal(got, data) {
+			t.Errorf("vendor boot: %s has wrong content", name)
+		}
+	}
+}
+
+// sparseImage creates a sparse image with 1K blocks from raw, fill and
+// don't care chunks followed by a checksum
+func sparseImage(badCRC bool) ([]byte, []byte) {
+	const blockSize = 1024
+	raw := bytes.Repeat([]byte("raw block "), 2*blockSize/10+1)[:2*blockSize]
+	fill := bytes.Repeat([]byte{0xDE, 0xAD, 0xBE, 0xEF}, 3*blockSize/4)
+	zeros := make([]byte, blockSize)
+	tail := make([]byte, 2*blockSize)
+	want := bytes.Join([][]byte{raw, fill, zeros, tail}, nil)
+
+	var b bytes.Buffer
+	chunk := func(typ uint16, blocks uint32, data []byte) {
+		binary.Write(&b, binary.LittleEndian, &sparseChunk{Type: typ, Blocks: blocks,
+			TotalSize: uint32(sparseChunkSize + len(data))})
+		b.Write(data)
+	}
+	binary.Write(&b, binary.LittleEndian, &sparseHeader{Magic: sparseMagic, Major: 1,
+		FileHdrSize: sparseHeadSize, ChunkHdrSize: sparseChunkSize, BlockSize: blockSize,
+		TotalBlocks: 8, TotalChunks: 4})
+	chunk(sparseRaw, 2, raw)
+	chunk(sparseFill, 3, []byte{0xDE, 0xAD, 0xBE, 0xEF})
+	chunk(sparseDontCare, 1, nil)
+	sum := crc32.ChecksumIEEE(want[:6*blockSize])
+	if badCRC {
+		sum++
+	}
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, sum)
+	chunk(sparseCRC, 0, crc)
+	return b.Bytes(), want
+}
+
+func TestUnsparse(t *testing.T) {
+	for _, bad := range []bool{false, true} {
+		img, want := sparseImage(bad)
+		x, err := runExtractor(img, Unsparse)
+		if err != nil {
+			t.Fatalf("sparse extraction failed: %v", err)
+		}
+		if got := x.content(t, "noname"); !bytes.Equal(got, want) {
+			t.Errorf("sparse image has wrong content")
+		}
+		if errs := x.files["noname"].Errors; (len(errs) != 0) != bad {
+			t.Errorf("bad checksum %v gave errors %v", bad, errs)
+		}
+	}
+
+	// unknown chunks are rejected
+	img, _ := sparseImage(false)
+	binary.LittleEndian.PutUint16(img[sparseHeadSize:], 0xCAC9)
+	if _, err := runExtractor(img, Unsparse); err == nil {
+		t.Errorf("unknown chunk was accepted")
+	}
+}
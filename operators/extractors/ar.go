@@ -0,0 +1,188 @@
+package extractors
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+	"github.com/avahidi/molly/util/compress"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+	arMaxControl = 16 << 20
+)
+
+type arHeader struct {
+	Name  [16]byte
+	Mtime [12]byte
+	UID   [6]byte
+	GID   [6]byte
+	Mode  [8]byte
+	Size  [10]byte
+	Fmag  [2]byte
+}
+
+// arNumber parses a space padded decimal field
+func arNumber(field []byte) (int64, error) {
+	s := strings.TrimSpace(string(field))
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// arDecompress opens a control archive by its extension
+func arDecompress(name string, r io.Reader) (io.Reader, error) {
+	switch path.Ext(name) {
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".xz":
+		return compress.NewXzReader(r)
+	case ".zst":
+		return compress.NewZstdReader(r)
+	case ".bz2":
+		return bzip2.NewReader(r), nil
+	case ".tar":
+		return r, nil
+	}
+	return nil, fmt.Errorf("ar: unknown compression of %s", name)
+}
+
+// arControl reads the package name, version and architecture from the
+// control file in control.tar of a Debian or opkg package
+func arControl(name string, r io.Reader) (map[string]interface{}, error) {
+	dr, err := arDecompress(name, r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(dr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("ar: %s has no control file", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(h.Name) != "control" {
+			continue
+		}
+
+		report := map[string]interface{}{"format": "deb"}
+		fields := map[string]string{"Package": "name", "Version": "version", "Architecture": "arch",
+			"Maintainer": "maintainer", "Depends": "depends"}
+		s := bufio.NewScanner(io.LimitReader(tr, arMaxControl))
+		for s.Scan() {
+			line := s.Text()
+			n := strings.Index(line, ":")
+			if n <= 0 || line[0] == ' ' || line[0] == '\t' {
+				continue
+			}
+			if key, found := fields[line[:n]]; found {
+				report[key] = strings.TrimSpace(line[n+1:])
+			}
+		}
+		return report, s.Err()
+	}
+}
+
+// Unar extracts the members of an ar archive in the GNU or BSD format, such
+// as Debian and opkg packages. For packages the name, version and
+// architecture in the control file are recorded as the analysis "package"
+func Unar(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader}
+	var magic [8]byte
+	if err := img.ReadAt(0, magic[:]); err != nil || string(magic[:]) != arMagic {
+		return "", fmt.Errorf("file is not an ar archive")
+	}
+
+	var names []byte
+	offset := int64(len(arMagic))
+	for offset+arHeaderSize <= int64(e.GetSize()) {
+		if err := e.Canceled(); err != nil {
+			return "", err
+		}
+		var head arHeader
+		if err := img.ReadAt(offset, &head); err != nil {
+			return "", err
+		}
+		if string(head.Fmag[:]) != "`\n" {
+			return "", fmt.Errorf("ar: bad member header at %d", offset)
+		}
+		size, err := arNumber(head.Size[:])
+		if err != nil || size < 0 || offset+arHeaderSize+size > int64(e.GetSize()) {
+			return "", fmt.Errorf("ar: bad member size at %d", offset)
+		}
+		data := offset + arHeaderSize
+		offset = data + size + size%2
+
+		name := strings.TrimRight(string(head.Name[:]), " ")
+		switch {
+		case name == "/" || name == "/SYM64/" || name == "__.SYMDEF" || name == "__.SYMDEF SORTED":
+			// symbol tables
+			continue
+		case name == "//":
+			// GNU long names, terminated by "/\n"
+			names = make([]byte, size)
+			if err := img.ReadAt(data, names); err != nil {
+				return "", err
+			}
+			continue
+		case strings.HasPrefix(name, "#1/"):
+			// BSD long names are stored before the data
+			n, err := strconv.ParseUint(name[3:], 10, 63)
+			if err != nil || int64(n) > size {
+				return "", fmt.Errorf("ar: bad long name %s", name)
+			}
+			long := make([]byte, n)
+			if err := img.ReadAt(data, long); err != nil {
+				return "", err
+			}
+			name = string(bytes.TrimRight(long, "\x00"))
+			data, size = data+int64(n), size-int64(n)
+		case len(name) > 1 && name[0] == '/':
+			n, err := strconv.ParseUint(name[1:], 10, 31)
+			if err != nil || int(n) >= len(names) {
+				return "", fmt.Errorf("ar: bad long name %s", name)
+			}
+			name = string(names[n:])
+			if end := strings.Index(name, "/\n"); end != -1 {
+				name = name[:end]
+			}
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+
+		w, d, err := e.Create(prefix + name)
+		if err != nil {
+			return "", err
+		}
+		if mtime, err := arNumber(head.Mtime[:]); err == nil {
+			d.SetTime(time.Unix(mtime, 0))
+		}
+		_, err = io.Copy(w, util.NewSectionReader(e.Reader, data, size))
+		w.Close()
+		if err != nil {
+			return "", err
+		}
+
+		if strings.HasPrefix(name, "control.tar") {
+			report, err := arControl(name, util.NewSectionReader(e.Reader, data, size))
+			analysis := e.AnalysisName("package")
+			e.Current.RegisterAnalysis(analysis, report, err)
+		}
+	}
+	return "", nil
+}
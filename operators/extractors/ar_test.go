@@ -0,0 +1,86 @@
+package extractors
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// arArchive creates a GNU ar archive, names longer than 15 characters are
+// stored in the long name table
+func arArchive(members ...[2]string) []byte {
+	var b, names bytes.Buffer
+	b.WriteString(arMagic)
+	member := func(name, data string) {
+		fmt.Fprintf(&b, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", name, 1600000000, 0, 0, "100644", len(data))
+		b.WriteString(data)
+		if len(data)%2 != 0 {
+			b.WriteByte('\n')
+		}
+	}
+	for _, m := range members {
+		if len(m[0]) > 15 {
+			names.WriteString(m[0] + "/\n")
+		}
+	}
+	if names.Len() > 0 {
+		member("//", names.String())
+	}
+	long := 0
+	for _, m := range members {
+		name := m[0] + "/"
+		if len(m[0]) > 15 {
+			name = fmt.Sprintf("/%d", long)
+			long += len(m[0]) + 2
+		}
+		member(name, m[1])
+	}
+	return b.Bytes()
+}
+
+func TestUnar(t *testing.T) {
+	var control bytes.Buffer
+	tw := tar.NewWriter(&control)
+	text := "Package: molly\nVersion: 1.2-3\nArchitecture: arm64\nDescription: test\n multi line\n"
+	tw.WriteHeader(&tar.Header{Name: "./control", Mode: 0644, Size: int64(len(text))})
+	tw.Write([]byte(text))
+	tw.Close()
+
+	deb := arArchive([2]string{"debian-binary", "2.0\n"},
+		[2]string{"control.tar.gz", string(gzipData(control.Bytes()))},
+		[2]string{"data-with-a-long-name.tar", "odd"})
+	x, err := runExtractor(deb, Unar)
+	if err != nil {
+		t.Fatalf("ar extraction failed: %v", err)
+	}
+	if data := x.content(t, "debian-binary"); string(data) != "2.0\n" {
+		t.Errorf("wrong debian-binary %q", data)
+	}
+	if data := x.content(t, "data-with-a-long-name.tar"); string(data) != "odd" {
+		t.Errorf("wrong long name member %q", data)
+	}
+
+	a := x.input.Analyses["package"]
+	if a == nil || a.Error != nil {
+		t.Fatalf("package analysis is missing or failed: %v", a)
+	}
+	report := a.Result.(map[string]interface{})
+	if report["format"] != "deb" || report["name"] != "molly" || report["version"] != "1.2-3" || report["arch"] != "arm64" {
+		t.Errorf("wrong package analysis %v", report)
+	}
+
+	if _, err := runExtractor([]byte("!<arch>\nbad"), Unar); err != nil {
+		t.Errorf("empty archive failed: %v", err)
+	}
+	// negative long name lengths and offsets are rejected
+	for _, name := range []string{"#1/-3", "/-1"} {
+		bad := fmt.Sprintf("%s%-16s%-12d%-6d%-6d%-8s%-10d`\nabcd", arMagic, name, 0, 0, 0, "100644", 4)
+		if _, err := runExtractor([]byte(bad), Unar); err == nil {
+			t.Errorf("long name %s was accepted", name)
+		}
+	}
+	if _, err := runExtractor([]byte("not an archive"), Unar); err == nil {
+		t.Errorf("bad magic was accepted")
+	}
+}
@@ -0,0 +1,70 @@
+package extractors
+
+import (
+	"compress/bzip2"
+	"io"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util/compress"
+)
+
+// bzip2Trailing is returned by the bzip2 reader when a stream is followed
+// by something that is not bzip2 data
+var bzip2Trailing = bzip2.StructuralError("bad magic value in continuation file")
+
+// decompress writes the output of a decompressor to a new file
+func decompress(e *types.Env, prefix string, r io.Reader, compressed ...string) (string, error) {
+	name := decompressedName(e.GetFile(), prefix, compressed...)
+	w, _, err := e.Create(name)
+	if err != nil {
+		return "", err
+	}
+	defer w.Close()
+
+	// trailing data is common in carved files and not an error
+	if _, err := io.Copy(w, r); err != nil && err != bzip2Trailing {
+		return "", err
+	}
+	return w.Name(), nil
+}
+
+// Unxz extracts a xz file
+func Unxz(e *types.Env, prefix string) (string, error) {
+	r, err := compress.NewXzReader(e.Reader)
+	if err != nil {
+		return "", err
+	}
+	return decompress(e, prefix, r, "xz")
+}
+
+// Unlzma extracts a file in the legacy lzma format, also known as lzma alone
+func Unlzma(e *types.Env, prefix string) (string, error) {
+	r, err := compress.NewLzmaReader(e.Reader)
+	if err != nil {
+		return "", err
+	}
+	return decompress(e, prefix, r, "lzma")
+}
+
+// Unlzip extracts a lzip file
+func Unlzip(e *types.Env, prefix string) (string, error) {
+	r, err := compress.NewLzipReader(e.Reader)
+	if err != nil {
+		return "", err
+	}
+	return decompress(e, prefix, r, "lz")
+}
+
+// Unbzip2 extracts a bzip2 file
+func Unbzip2(e *types.Env, prefix string) (string, error) {
+	return decompress(e, prefix, bzip2.NewReader(e.Reader), "bz2", "bz")
+}
+
+// Unzstd extracts a zstd file
+func Unzstd(e *types.Env, prefix string) (string, error) {
+	r, err := compress.NewZstdReader(e.Reader)
+	if err != nil {
+		return "", err
+	}
+	return decompress(e, prefix, r, "zst", "zstd")
+}
@@ -0,0 +1,71 @@
+package extractors
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/avahidi/molly/types"
+)
+
+// testData compressed with xz and bzip2, these are also used by other tests
+const (
+	xzTestData    = "/Td6WFoAAATm1rRGBMAp9AMhARYAAAAAAAAAAKvqdwXgAfMAIV0ANpvJ4pXWt8zGtaefYYB06isDHpNOImV/fh12wgkQpUAAAAAAAB92LN0eI4OuAAFF9AMAAABxFsEzscRn+wIAAAAABFla"
+	bzip2TestData = "QlpoOTFBWSZTWRETQgQAAJ/RgAAQQAArZpxgIABwUwAE0ClURhMMp9JknonpNydk4EwTonZPCYJuTwmCcE2JoTkmSZJknJP4u5IpwoSAiJoQIA=="
+)
+
+var testData = strings.Repeat("molly extracts this file\n", 20)
+
+func TestDecompress(t *testing.T) {
+	want := testData
+	var testdata = []struct {
+		name      string
+		extractor func(*types.Env, string) (string, error)
+		data      string
+	}{
+		{"xz", Unxz, xzTestData},
+		{"lzma", Unlzma, "XQAAgAD//////////wA2m8nilda3zMa1p59hgHTqKwMek04iZX9+HXbCCRE5BT///7qmAAA="},
+		{"lzip", Unlzip, "TFpJUAEMADabyc5EcFIDxpF1ZvQwW7xkHR1Fv66D7j3spgfRK3oXV///5tnAAM977pL0AQAAAAAAAEIAAAAAAAAA"},
+		{"bzip2", Unbzip2, bzip2TestData},
+		{"zstd", Unzstd, "KLUv/WT0AAUBAMhtb2xseSBleHRyYWN0cyB0aGlzIGZpbGUKAQBhszrHgXRKqg=="},
+	}
+
+	for _, test := range testdata {
+		data, _ := base64.StdEncoding.DecodeString(test.data)
+
+		// trailing data is ignored, which is needed when carving
+		x, err := runExtractor(append(data, "trailing data"...), test.extractor)
+		if err != nil {
+			t.Errorf("%s: extraction failed: %v", test.name, err)
+			continue
+		}
+		if got := x.content(t, "noname"); string(got) != want {
+			t.Errorf("%s: wrong output %q", test.name, got)
+		}
+
+		if _, err := runExtractor(data[:len(data)/2], test.extractor); err == nil {
+			t.Errorf("%s: truncated data was accepted", test.name)
+		}
+	}
+}
+
+func TestDecompressedName(t *testing.T) {
+	var testdata = []struct {
+		filename, prefix string
+		compressed       []string
+		name             string
+	}{
+		{"a.tar.gz", "", []string{"gz"}, ".tar"},
+		{"a.GZ", "", []string{"gz"}, ""},
+		{"a.tgz", "", []string{"gz"}, ".tgz"},
+		{"dir.x/a.cpio.bz2", "out", []string{"bz2", "bz"}, "out.cpio"},
+		{"a.img.zst", "", []string{"zst", "zstd"}, ".img"},
+		{"a.xz", "", []string{"xz"}, ""},
+		{"a", "", []string{"xz"}, ""},
+	}
+	for _, test := range testdata {
+		if name := decompressedName(test.filename, test.prefix, test.compressed...); name != test.name {
+			t.Errorf("decompressedName(%q): wanted %q, got %q", test.filename, test.name, name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package extractors
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -15,12 +16,25 @@ type cpioFileHead struct {
 	namesize int
 	filesize int64
 	mtime    int64
+	mode     int64
 }
 
+const (
+	cpioModeLink   = 0120000
+	cpioBinarySize = 26
+	cpioOdcSize    = 76
+	cpioNewcSize   = 110
+	cpioMaxName    = 4096
+	cpioMaxLink    = 4096
+)
+
 func cpioBinaryParser(r io.Reader) (*cpioFileHead, error) {
 	var head struct {
 		Magic     uint16
-		Garbage   [7]uint16
+		Dev       uint16
+		Ino       uint16
+		Mode      uint16
+		Garbage   [4]uint16
 		MTime     [2]uint16
 		NameSize  uint16
 		FileSizes [2]uint16
@@ -36,13 +50,17 @@ func cpioBinaryParser(r io.Reader) (*cpioFileHead, error) {
 		namesize: int(head.NameSize),
 		filesize: int64(head.FileSizes[1]) + (int64(head.FileSizes[0]) << 16),
 		mtime:    int64(head.MTime[1]) + (int64(head.MTime[0]) << 16),
+		mode:     int64(head.Mode),
 	}, nil
 }
 
 func cpioAsciiParser(r io.Reader) (*cpioFileHead, error) {
 	var head struct {
 		Magic    [6]byte
-		Garbage  [42]byte
+		Dev      [6]byte
+		Ino      [6]byte
+		Mode     [6]byte
+		Garbage  [24]byte
 		MTime    [11]byte
 		NameSize [6]byte
 		FileSize [11]byte
@@ -61,6 +79,13 @@ func cpioAsciiParser(r io.Reader) (*cpioFileHead, error) {
 	if err != nil {
 		return nil, err
 	}
+	if fs < 0 {
+		return nil, fmt.Errorf("cpio: bad file size %d", fs)
+	}
+	mode, err := strconv.ParseInt(string(head.Mode[:]), 8, 64)
+	if err != nil {
+		return nil, err
+	}
 
 	// cpio ascii mdate is octal ascii :(
 	mtime, err := strconv.ParseInt(string(head.MTime[:]), 8, 32)
@@ -69,71 +94,125 @@ func cpioAsciiParser(r io.Reader) (*cpioFileHead, error) {
 		namesize: int(ns),
 		filesize: int64(fs),
 		mtime:    mtime,
+		mode:     mode,
 	}, err
 }
 
+func cpioNewcParser(r io.Reader) (*cpioFileHead, error) {
+	var head [cpioNewcSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if magic := string(head[:6]); magic != "070701" && magic != "070702" {
+		return nil, fmt.Errorf("Not CPIO header?")
+	}
+	// the fields after the magic are 8 hex digits each
+	var fields [13]int64
+	for i := range fields {
+		v, err := strconv.ParseUint(string(head[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = int64(v)
+	}
+	return &cpioFileHead{
+		namesize: int(fields[11]),
+		filesize: fields[6],
+		mtime:    fields[5],
+		mode:     fields[1],
+	}, nil
+}
+
+// Uncpio extracts a cpio archive in the binary, old ASCII or new ASCII format
 func Uncpio(e *types.Env, prefix string) (string, error) {
-	var parser func(io.Reader) (*cpioFileHead, error)
-	mustPad := false
-	r := e.Reader
+	if _, err := e.Reader.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	return "", cpioExtract(e, e.Reader, prefix)
+}
+
+// cpioExtract extracts a cpio archive from a stream
+func cpioExtract(e *types.Env, r io.Reader, prefix string) error {
+	br := bufio.NewReader(r)
 
 	// vad type is this?
-	magic := make([]byte, 6)
-	if _, err := r.Read(magic); err != nil {
-		return "", err
+	magic, err := br.Peek(6)
+	if err != nil {
+		return err
 	}
+	var parser func(io.Reader) (*cpioFileHead, error)
+	var headSize, align int64
 	if string(magic) == "070707" {
-		parser = cpioAsciiParser
+		parser, headSize, align = cpioAsciiParser, cpioOdcSize, 1
 	} else if string(magic) == "070701" || string(magic) == "070702" {
-		// parser = cpioAsciiParser ???
+		parser, headSize, align = cpioNewcParser, cpioNewcSize, 4
 	} else if magic[0] == 0xC7 && magic[1] == 0x71 {
-		parser = cpioBinaryParser
-		mustPad = true
+		parser, headSize, align = cpioBinaryParser, cpioBinarySize, 2
 	}
 	if parser == nil {
-		return "", fmt.Errorf("Unknown cpio format: magic=%v", magic)
+		return fmt.Errorf("Unknown cpio format: magic=%v", magic)
 	}
 
-	// start parsing the file
-	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
-		return "", err
+	// names and file contents are padded to the alignment of the format
+	skipPad := func(n int64) error {
+		_, err := io.CopyN(io.Discard, br, (align-n%align)%align)
+		return err
 	}
-	pad := make([]byte, 1)
 	for {
-		fh, err := parser(r)
+		if err := e.Canceled(); err != nil {
+			return err
+		}
+		fh, err := parser(br)
 		if err != nil {
-			return "", err
+			return err
 		}
 
 		// read name
+		if fh.namesize <= 0 || fh.namesize > cpioMaxName {
+			return fmt.Errorf("cpio: bad name size %d", fh.namesize)
+		}
 		name := make([]byte, fh.namesize)
-		r.Read(name)
-		if mustPad && fh.namesize%2 == 1 {
-			r.Read(pad)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return err
+		}
+		if err := skipPad(headSize + int64(fh.namesize)); err != nil {
+			return err
 		}
 		if name[len(name)-1] == 0 {
 			name = name[:len(name)-1]
 		}
 		if string(name) == "TRAILER!!!" {
-			return "", nil
+			return nil
 		}
 
-		// copy file contents
-		if fh.filesize > 0 {
-
+		switch {
+		case fh.mode&s_IFMT == cpioModeLink:
+			// links are recorded, not created
+			if fh.filesize > cpioMaxLink {
+				return fmt.Errorf("cpio: link %s is too long", name)
+			}
+			target := make([]byte, fh.filesize)
+			if _, err := io.ReadFull(br, target); err != nil {
+				return err
+			}
+			if _, err := e.Link(prefix+string(name), string(target), false); err != nil {
+				return err
+			}
+		case fh.filesize > 0:
+			// copy file contents
 			w, d, err := e.Create(prefix + string(name))
 			if err != nil {
-				return "", err
+				return err
 			}
-			defer w.Close()
-
 			d.SetTime(time.Unix(fh.mtime, 0))
-			if _, err = io.CopyN(w, r, fh.filesize); err != nil {
-				return "", err
-			}
-			if mustPad && fh.filesize%2 == 1 {
-				r.Read(pad)
+			_, err = io.CopyN(w, br, fh.filesize)
+			w.Close()
+			if err != nil {
+				return err
 			}
 		}
+		if err := skipPad(fh.filesize); err != nil {
+			return err
+		}
 	}
 }
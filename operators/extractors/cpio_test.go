@@ -0,0 +1,38 @@
+package extractors
+
+import (
+	"fmt"
+	"testing"
+)
+
+// cpioOdc creates an old ASCII cpio archive with a single entry
+func cpioOdc(name string, mode int, size string, data string) []byte {
+	head := fmt.Sprintf("070707%06o%06o%06o%024o%011o%06o%11s", 0, 1, mode, 0, 1600000000, len(name)+1, size)
+	return []byte(head + name + "\x00" + data)
+}
+
+func TestUncpio(t *testing.T) {
+	x, err := runExtractor(append(cpioOdc("link", cpioModeLink, "00000000006", "target"),
+		cpioOdc("TRAILER!!!", 0, "00000000000", "")...), Uncpio)
+	if err != nil {
+		t.Fatalf("cpio extraction failed: %v", err)
+	}
+	if _, found := x.files["link"]; !found {
+		t.Errorf("link was not recorded")
+	}
+
+	// negative sizes and huge link targets are rejected
+	var testdata = []struct {
+		mode int
+		size string
+	}{
+		{0100644, "-0000000001"},
+		{cpioModeLink, "-0000000001"},
+		{cpioModeLink, "77777777777"},
+	}
+	for _, test := range testdata {
+		if _, err := runExtractor(cpioOdc("bad", test.mode, test.size, "data"), Uncpio); err == nil {
+			t.Errorf("size %s of mode %o was accepted", test.size, test.mode)
+		}
+	}
+}
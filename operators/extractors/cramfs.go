@@ -6,7 +6,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 	"path/filepath"
 
 	"github.com/avahidi/molly/types"
@@ -21,6 +20,7 @@ const (
 	s_IFMT        = 0170000
 	s_IFDIR       = 0040000
 	s_IFREG       = 0100000
+	s_IFLNK       = 0120000
 )
 
 type cramHead struct {
@@ -51,7 +51,9 @@ func (c cramInode) Ofsset() uint32  { return uint32(c.NameWidthOffset>>6) * 4 }
 
 type cramContext struct {
 	util.Structured
-	Create func(string) (*os.File, *types.FileData, error)
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Link     func(string, string, bool) (*types.FileData, error)
+	Canceled func() error
 }
 
 func (c cramContext) inodeDir(inode *cramInode, name string) error {
@@ -80,15 +82,30 @@ func (c cramContext) inodeDir(inode *cramInode, name string) error {
 }
 
 func (c cramContext) inodeFile(inode *cramInode, name string) error {
-	ptrOffset := int64(inode.Ofsset())
-	size := int64(inode.Size())
-	nblocks := (size-1)/cramBlkSize + 1
-
 	w, _, err := c.Create(name)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
+	return c.inodeData(inode, w)
+}
+
+func (c cramContext) inodeLink(inode *cramInode, name string) error {
+	var target bytes.Buffer
+	if err := c.inodeData(inode, &target); err != nil {
+		return err
+	}
+	_, err := c.Link(name, target.String(), false)
+	return err
+}
+
+func (c cramContext) inodeData(inode *cramInode, w io.Writer) error {
+	ptrOffset := int64(inode.Ofsset())
+	size := int64(inode.Size())
+	if size == 0 {
+		return nil
+	}
+	nblocks := (size-1)/cramBlkSize + 1
 
 	ptr := uint32(ptrOffset + nblocks*4) // first block is right at the end of pointers
 	buf := make([]byte, cramBlkSize+cramZlibSize)
@@ -118,16 +135,20 @@ func (c cramContext) inodeFile(inode *cramInode, name string) error {
 		}
 		ptrOffset += 4
 	}
-
-	return err
+	return nil
 }
 
 func (c cramContext) inode(inode *cramInode, name string) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
 	switch inode.Mode & s_IFMT {
 	case s_IFDIR:
 		return c.inodeDir(inode, name)
 	case s_IFREG:
 		return c.inodeFile(inode, name)
+	case s_IFLNK:
+		return c.inodeLink(inode, name)
 	default:
 		util.RegisterWarningf("Warning: ignoring unknown file type: %08x", inode.Mode)
 	}
@@ -140,7 +161,7 @@ func (c cramContext) inode(inode *cramInode, name string) error {
 // create these files seem to be very buggy so don't be surprised if this
 // code fails to handle your images.
 func Uncramfs(e *types.Env, prefix string) (string, error) {
-	ctx := &cramContext{Create: e.Create}
+	ctx := &cramContext{Create: e.Create, Link: e.Link, Canceled: e.Canceled}
 	ctx.Reader = e.Reader
 
 	// we don't know the native byte-order, try both:
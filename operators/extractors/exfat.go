@@ -0,0 +1,210 @@
+package extractors
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	exfatOEM        = "EXFAT   "
+	exfatInUse      = 0x80
+	exfatFile       = 0x85
+	exfatStream     = 0xC0
+	exfatName       = 0xC1
+	exfatNameChars  = 15
+	exfatNoFatChain = 0x02
+	exfatEOC        = 0xFFFFFFF8
+)
+
+type exfatBoot struct {
+	Jump                   [3]byte
+	OEM                    [8]byte
+	Zero                   [53]byte
+	PartitionOffset        uint64
+	VolumeLength           uint64
+	FatOffset              uint32
+	FatLength              uint32
+	ClusterHeapOffset      uint32
+	ClusterCount           uint32
+	RootCluster            uint32
+	Serial                 uint32
+	Revision               uint16
+	Flags                  uint16
+	BytesPerSectorShift    uint8
+	SectorsPerClusterShift uint8
+	NumberOfFats           uint8
+}
+
+// exfatTime converts a timestamp, the offset from UTC is optional
+func exfatTime(stamp uint32, ms10, utc uint8) time.Time {
+	t := fatTime(uint16(stamp>>16), uint16(stamp))
+	t = t.Add(time.Duration(ms10) * 10 * time.Millisecond)
+	if utc&0x80 != 0 {
+		offset := int8(utc<<1) >> 1
+		t = t.Add(-time.Duration(offset) * 15 * time.Minute)
+	}
+	return t
+}
+
+// exfatChecksum is the checksum of a directory entry set
+func exfatChecksum(set []byte) uint16 {
+	var sum uint16
+	for i, c := range set {
+		if i == 2 || i == 3 {
+			continue
+		}
+		sum = (sum&1)<<15 + sum>>1 + uint16(c)
+	}
+	return sum
+}
+
+// exfatDir extracts the files in an exFAT directory. Each file is described
+// by a set of entries: the file entry, a stream entry and its name entries
+func (c *fatContext) exfatDir(data []byte, name string) error {
+	for pos := 0; pos+fatEntrySize <= len(data); pos += fatEntrySize {
+		typ := data[pos]
+		if typ == 0 {
+			break
+		}
+		deleted := typ == exfatFile&^exfatInUse
+		if typ != exfatFile && !(deleted && c.deleted) {
+			continue
+		}
+		count := int(data[pos+1])
+		end := pos + (count+1)*fatEntrySize
+		if count < 2 || end > len(data) {
+			return fmt.Errorf("exfat: bad entry set in %s", name)
+		}
+		set := data[pos:end]
+		pos = end - fatEntrySize
+
+		// deleted sets have the in use bit cleared in all entries
+		streamType, nameType := byte(exfatStream), byte(exfatName)
+		if deleted {
+			streamType &^= exfatInUse
+			nameType &^= exfatInUse
+		}
+		stream := set[fatEntrySize:]
+		if stream[0] != streamType {
+			continue
+		}
+		if !deleted && exfatChecksum(set) != binary.LittleEndian.Uint16(set[2:]) {
+			return fmt.Errorf("exfat: bad entry set checksum in %s", name)
+		}
+
+		var chars []uint16
+		for i := 2; i <= count; i++ {
+			ent := set[i*fatEntrySize:]
+			if ent[0] != nameType {
+				break
+			}
+			for j := 0; j < exfatNameChars; j++ {
+				chars = append(chars, binary.LittleEndian.Uint16(ent[2+2*j:]))
+			}
+		}
+		if n := int(stream[3]); n < len(chars) {
+			chars = chars[:n]
+		}
+		ename := string(utf16.Decode(chars))
+		if ename == "" || ename == "." || ename == ".." {
+			continue
+		}
+
+		attr := binary.LittleEndian.Uint16(set[4:])
+		mtime := exfatTime(binary.LittleEndian.Uint32(set[12:]), set[21], set[23])
+		contiguous := stream[1]&exfatNoFatChain != 0
+		valid := int64(binary.LittleEndian.Uint64(stream[8:]))
+		first := binary.LittleEndian.Uint32(stream[20:])
+		size := int64(binary.LittleEndian.Uint64(stream[24:]))
+		if valid > size {
+			valid = size
+		}
+		fullname := path.Join(name, ename)
+
+		if attr&fatAttrDir == 0 {
+			if err := c.exfatFile(fullname, first, valid, size, contiguous, deleted, mtime); err != nil {
+				return err
+			}
+			continue
+		}
+		if deleted {
+			continue
+		}
+		fd, err := c.Mkdir(fullname)
+		if err != nil {
+			return err
+		}
+		fd.SetTime(mtime)
+		if size == 0 {
+			continue
+		}
+		sub, err := c.dirData(first, size, contiguous, fullname)
+		if err != nil {
+			return err
+		}
+		if err := c.exfatDir(sub, fullname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exfatFile extracts a file, data after the valid length reads as zeros
+func (c *fatContext) exfatFile(name string, first uint32, valid, size int64, contiguous, deleted bool, mtime time.Time) error {
+	if valid == size || size == 0 {
+		return c.file(name, first, size, contiguous, deleted, mtime)
+	}
+	w, fd, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	fd.SetTime(mtime)
+	if deleted {
+		fd.SetMetadata("deleted", true)
+		contiguous = true
+	}
+	if err := c.data(w, first, valid, contiguous); err != nil {
+		if deleted {
+			fd.RegisterError(err)
+			return nil
+		}
+		return err
+	}
+	return writeZeros(w, size-valid)
+}
+
+func (c *fatContext) exfat(prefix string) error {
+	var b exfatBoot
+	if err := c.ReadAt(0, &b); err != nil {
+		return err
+	}
+	if b.BytesPerSectorShift < 9 || b.BytesPerSectorShift > 12 ||
+		b.SectorsPerClusterShift > 25-b.BytesPerSectorShift ||
+		b.ClusterCount == 0 || b.ClusterCount > fatMaxClusters ||
+		int64(b.FatLength)<<b.BytesPerSectorShift < (int64(b.ClusterCount)+2)*4 {
+		return fmt.Errorf("exfat: bad boot sector")
+	}
+	bps := int64(1) << b.BytesPerSectorShift
+	c.clusterSize = bps << b.SectorsPerClusterShift
+	c.dataStart = int64(b.ClusterHeapOffset) * bps
+	c.clusters = b.ClusterCount
+	c.eoc = exfatEOC
+	if err := c.fatTable(int64(b.FatOffset)*bps, 32); err != nil {
+		return err
+	}
+
+	if prefix != "" {
+		if _, err := c.Mkdir(prefix); err != nil {
+			return err
+		}
+	}
+	root, err := c.dirData(b.RootCluster, 0, false, prefix)
+	if err != nil {
+		return err
+	}
+	return c.exfatDir(root, prefix)
+}
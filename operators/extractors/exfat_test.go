@@ -0,0 +1,184 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/types"
+)
+
+// exfatImage creates small exFAT images with 512 byte clusters, files are
+// fragmented unless they are marked as contiguous or deleted
+type exfatImage struct {
+	img   []byte
+	table []uint32
+	next  uint32
+	heap  int
+}
+
+func (f *exfatImage) write(data []byte, fragment bool) uint32 {
+	if len(data) == 0 {
+		return 0
+	}
+	n := (len(data) + 511) / 512
+	step := uint32(1)
+	if fragment {
+		step = 2
+	}
+	first := f.next
+	for i := 0; i < n; i++ {
+		c := first + uint32(i)*step
+		copy(f.img[f.heap+int(c-2)*512:], data[i*512:])
+		if fragment {
+			f.table[c] = c + step
+			if i == n-1 {
+				f.table[c] = 0xFFFFFFFF
+			}
+		}
+	}
+	f.next += uint32(n) * step
+	return first
+}
+
+// entrySet returns the entries describing a file
+func (f *exfatImage) entrySet(name string, attr uint16, cluster uint32, valid, size int, fragment, deleted bool) []byte {
+	chars := utf16.Encode([]rune(name))
+	names := (len(chars) + exfatNameChars - 1) / exfatNameChars
+	set := make([]byte, (2+names)*fatEntrySize)
+	set[0], set[1] = exfatFile, byte(1+names)
+	binary.LittleEndian.PutUint16(set[4:], attr)
+	t := fatTestTime
+	binary.LittleEndian.PutUint32(set[12:], uint32((t.Year()-1980)<<25|int(t.Month())<<21|
+		t.Day()<<16|t.Hour()<<11|t.Minute()<<5|t.Second()/2))
+
+	stream := set[fatEntrySize:]
+	stream[0], stream[3] = exfatStream, byte(len(chars))
+	if !fragment {
+		stream[1] = exfatNoFatChain
+	}
+	binary.LittleEndian.PutUint64(stream[8:], uint64(valid))
+	binary.LittleEndian.PutUint32(stream[20:], cluster)
+	binary.LittleEndian.PutUint64(stream[24:], uint64(size))
+	for i, c := range chars {
+		ent := set[(2+i/exfatNameChars)*fatEntrySize:]
+		ent[0] = exfatName
+		binary.LittleEndian.PutUint16(ent[2+2*(i%exfatNameChars):], c)
+	}
+	binary.LittleEndian.PutUint16(set[2:], exfatChecksum(set))
+	if deleted {
+		for i := 0; i < len(set); i += fatEntrySize {
+			set[i] &^= exfatInUse
+		}
+	}
+	return set
+}
+
+func exfatBuild(files []fatFile, contiguous string) []byte {
+	const clusters = 200
+	f := &exfatImage{img: make([]byte, (32+clusters)*512), table: make([]uint32, clusters+2), next: 2, heap: 32 * 512}
+
+	var dir func(files []fatFile) []byte
+	dir = func(files []fatFile) []byte {
+		var b bytes.Buffer
+		for _, file := range files {
+			if file.files != nil {
+				data := dir(file.files)
+				cluster := f.write(data, true)
+				b.Write(f.entrySet(file.name, fatAttrDir, cluster, len(data), len(data), true, false))
+				continue
+			}
+			fragment := !file.deleted && file.name != contiguous
+			cluster := f.write(file.data, fragment)
+			valid := len(file.data)
+			if file.name == contiguous {
+				// the end of the file has not been written
+				valid -= 10
+			}
+			b.Write(f.entrySet(file.name, 0x20, cluster, valid, len(file.data), fragment, file.deleted))
+		}
+		return b.Bytes()
+	}
+	root := f.write(append(dir(files), make([]byte, 512)...), true)
+
+	boot := exfatBoot{
+		Jump: [3]byte{0xEB, 0x76, 0x90}, VolumeLength: uint64(len(f.img) / 512),
+		FatOffset: 24, FatLength: 8, ClusterHeapOffset: 32, ClusterCount: clusters,
+		RootCluster: root, Revision: 0x100, BytesPerSectorShift: 9, NumberOfFats: 1,
+	}
+	copy(boot.OEM[:], exfatOEM)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &boot)
+	copy(f.img, b.Bytes())
+	f.img[0x1FE], f.img[0x1FF] = 0x55, 0xAA
+	for n, v := range f.table {
+		binary.LittleEndian.PutUint32(f.img[24*512+4*n:], v)
+	}
+	return f.img
+}
+
+func TestUnexfat(t *testing.T) {
+	big := bytes.Repeat([]byte("exfat cluster chain "), 100)
+	files := []fatFile{
+		{name: "hello.txt", data: []byte("hello exfat\n")},
+		{name: "a-very-long-file-name-for-exfat.bin", data: big},
+		{name: "contiguous.bin", data: big[:1500]},
+		{name: "removed.txt", data: []byte("deleted data"), deleted: true},
+		{name: "dir", files: []fatFile{{name: "nested.txt", data: []byte("nested")}}},
+	}
+	img := exfatBuild(files, "contiguous.bin")
+	x, err := runExtractor(img, Unfat)
+	if err != nil {
+		t.Fatalf("exFAT extraction failed: %v", err)
+	}
+	valid := append(append([]byte{}, big[:1490]...), make([]byte, 10)...)
+	var testdata = []struct {
+		name string
+		data []byte
+	}{
+		{"hello.txt", files[0].data},
+		{"a-very-long-file-name-for-exfat.bin", big},
+		{"contiguous.bin", valid},
+		{"dir/nested.txt", []byte("nested")},
+	}
+	for _, test := range testdata {
+		if data := x.content(t, test.name); !bytes.Equal(data, test.data) {
+			t.Errorf("%s has wrong content", test.name)
+		}
+	}
+	if fd := x.files["hello.txt"]; !fd.GetTime().Equal(fatTestTime) {
+		t.Errorf("wrong time %v", fd.GetTime())
+	}
+	if _, found := x.files["removed.txt"]; found {
+		t.Errorf("deleted file was extracted")
+	}
+
+	x, err = runExtractorConfig(img, Unfat, func(c *types.Configuration) { c.Deleted = true })
+	if err != nil {
+		t.Fatalf("exFAT extraction failed: %v", err)
+	}
+	if data := x.content(t, "removed.txt"); string(data) != "deleted data" {
+		t.Errorf("deleted file has wrong content %q", data)
+	}
+	if x.metadata(t, "removed.txt", "deleted") != true {
+		t.Errorf("deleted file is not marked as deleted")
+	}
+
+	// damaged entry sets are detected
+	damaged := append([]byte{}, img...)
+	for pos := 32 * 512; pos < len(damaged); pos += fatEntrySize {
+		if damaged[pos] == exfatName {
+			damaged[pos+2] ^= 1
+			break
+		}
+	}
+	if _, err := runExtractor(damaged, Unfat); err == nil {
+		t.Errorf("damaged entry set was not detected")
+	}
+
+	// the cluster count must fit in the image
+	if _, err := runExtractor(img[:512], Unfat); err == nil {
+		t.Errorf("truncated image was accepted")
+	}
+}
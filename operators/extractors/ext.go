@@ -0,0 +1,608 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	extSuperOffset    = 1024
+	extMagic          = 0xEF53
+	extRootInode      = 2
+	extMaxLinkSize    = 4096
+	extMaxDirSize     = 1 << 26
+	extMaxDepth       = 5
+	extExtentMagic    = 0xF30A
+	extExtentInit     = 32768
+	extRoSparseSuper  = 0x1
+	extIncompatComp   = 0x1
+	extIncompatMetaBg = 0x10
+	extIncompat64Bit  = 0x80
+	extFlagExtents    = 0x80000
+	extFlagInline     = 0x10000000
+	extXattrMagic     = 0xEA020000
+	extXattrSystem    = 7
+)
+
+type extSuper struct {
+	InodesCount       uint32
+	BlocksCountLo     uint32
+	RBlocksCountLo    uint32
+	FreeBlocksCountLo uint32
+	FreeInodesCount   uint32
+	FirstDataBlock    uint32
+	LogBlockSize      uint32
+	LogClusterSize    uint32
+	BlocksPerGroup    uint32
+	ClustersPerGroup  uint32
+	InodesPerGroup    uint32
+	Mtime             uint32
+	Wtime             uint32
+	MntCount          uint16
+	MaxMntCount       uint16
+	Magic             uint16
+	State             uint16
+	Errors            uint16
+	MinorRevLevel     uint16
+	Lastcheck         uint32
+	Checkinterval     uint32
+	CreatorOS         uint32
+	RevLevel          uint32
+	DefResuid         uint16
+	DefResgid         uint16
+	FirstIno          uint32
+	InodeSize         uint16
+	BlockGroupNr      uint16
+	FeatureCompat     uint32
+	FeatureIncompat   uint32
+	FeatureRoCompat   uint32
+	UUID              [16]byte
+	VolumeName        [16]byte
+	LastMounted       [64]byte
+	AlgorithmBitmap   uint32
+	PreallocBlocks    uint8
+	PreallocDirBlocks uint8
+	ReservedGdtBlocks uint16
+	JournalUUID       [16]byte
+	JournalInum       uint32
+	JournalDev        uint32
+	LastOrphan        uint32
+	HashSeed          [4]uint32
+	DefHashVersion    uint8
+	JnlBackupType     uint8
+	DescSize          uint16
+	DefaultMountOpts  uint32
+	FirstMetaBg       uint32
+}
+
+type extDiskInode struct {
+	Mode       uint16
+	UIDLo      uint16
+	SizeLo     uint32
+	Atime      uint32
+	Ctime      uint32
+	Mtime      uint32
+	Dtime      uint32
+	GIDLo      uint16
+	LinksCount uint16
+	BlocksLo   uint32
+	Flags      uint32
+	Osd1       uint32
+	Block      [60]byte
+	Generation uint32
+	FileACLLo  uint32
+	SizeHi     uint32
+	Faddr      uint32
+	BlocksHi   uint16
+	FileACLHi  uint16
+	UIDHi      uint16
+	GIDHi      uint16
+	ChecksumLo uint16
+	Reserved   uint16
+}
+
+type extInode struct {
+	extDiskInode
+
+	// the raw inode, in-inode extended attributes are stored after the
+	// fixed fields
+	raw []byte
+}
+
+func (inode *extInode) size() int64 {
+	return int64(inode.SizeLo) | int64(inode.SizeHi)<<32
+}
+
+// extExtent maps file blocks to disk blocks, uninitialized extents read as zeros
+type extExtent struct {
+	logical  int64
+	physical int64
+	length   int64
+	zero     bool
+}
+
+type extExtentHeader struct {
+	Magic      uint16
+	Entries    uint16
+	Max        uint16
+	Depth      uint16
+	Generation uint32
+}
+
+type extContext struct {
+	util.Structured
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Link     func(string, string, bool) (*types.FileData, error)
+	Node     func(string, string) (*types.FileData, error)
+	Mkdir    func(string) (*types.FileData, error)
+	Canceled func() error
+
+	super     extSuper
+	blockSize int64
+	inodeSize int64
+	descSize  int64
+	dirs      map[uint32]bool
+	files     map[uint32]string
+}
+
+// hasSuper returns true if a group contains a superblock backup, and
+// thereby also a copy of the group descriptors
+func (c *extContext) hasSuper(group int64) bool {
+	if group <= 1 || c.super.FeatureRoCompat&extRoSparseSuper == 0 {
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// inodeTable returns the first block of the inode table of a group
+func (c *extContext) inodeTable(group int64) (int64, error) {
+	perBlock := c.blockSize / c.descSize
+	meta := group / perBlock
+	block := int64(c.super.FirstDataBlock) + 1 + meta
+	if c.super.FeatureIncompat&extIncompatMetaBg != 0 && meta >= int64(c.super.FirstMetaBg) {
+		// with meta_bg, the descriptors are in the first group they describe
+		first := meta * perBlock
+		block = int64(c.super.FirstDataBlock) + first*int64(c.super.BlocksPerGroup)
+		if c.hasSuper(first) {
+			block++
+		}
+	}
+
+	desc := make([]byte, c.descSize)
+	if err := c.ReadAt(block*c.blockSize+(group%perBlock)*c.descSize, desc); err != nil {
+		return 0, err
+	}
+	table := int64(binary.LittleEndian.Uint32(desc[8:]))
+	if c.descSize >= 64 {
+		table |= int64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+	return table, nil
+}
+
+func (c *extContext) inode(ino uint32) (*extInode, error) {
+	if ino == 0 || ino > c.super.InodesCount {
+		return nil, fmt.Errorf("ext: bad inode number %d", ino)
+	}
+	group := int64(ino-1) / int64(c.super.InodesPerGroup)
+	index := int64(ino-1) % int64(c.super.InodesPerGroup)
+	table, err := c.inodeTable(group)
+	if err != nil {
+		return nil, err
+	}
+
+	inode := &extInode{raw: make([]byte, c.inodeSize)}
+	if err := c.ReadAt(table*c.blockSize+index*c.inodeSize, inode.raw); err != nil {
+		return nil, err
+	}
+	binary.Read(bytes.NewReader(inode.raw), binary.LittleEndian, &inode.extDiskInode)
+	return inode, nil
+}
+
+// inlineData returns the data of an inode with inline data, which starts in
+// the block map and continues in the "system.data" extended attribute
+func (c *extContext) inlineData(inode *extInode) []byte {
+	data := append([]byte{}, inode.Block[:]...)
+	if len(inode.raw) <= 130 {
+		return data
+	}
+	start := 128 + int(binary.LittleEndian.Uint16(inode.raw[128:]))
+	if start+4 > len(inode.raw) || binary.LittleEndian.Uint32(inode.raw[start:]) != extXattrMagic {
+		return data
+	}
+	xattrs := inode.raw[start+4:]
+	for pos := 0; pos+16 <= len(xattrs) && binary.LittleEndian.Uint32(xattrs[pos:]) != 0; {
+		nameLen, index := int(xattrs[pos]), xattrs[pos+1]
+		offset := int(binary.LittleEndian.Uint16(xattrs[pos+2:]))
+		size := int(binary.LittleEndian.Uint32(xattrs[pos+8:]))
+		if pos+16+nameLen > len(xattrs) {
+			break
+		}
+		name := string(xattrs[pos+16 : pos+16+nameLen])
+		if index == extXattrSystem && name == "data" && offset+size <= len(xattrs) {
+			return append(data, xattrs[offset:offset+size]...)
+		}
+		pos += (16 + nameLen + 3) &^ 3
+	}
+	return data
+}
+
+// extentTree collects the extents of an extent tree node
+func (c *extContext) extentTree(node []byte, depth int, extents []extExtent) ([]extExtent, error) {
+	var head extExtentHeader
+	binary.Read(bytes.NewReader(node), binary.LittleEndian, &head)
+	if head.Magic != extExtentMagic || 12+12*int(head.Entries) > len(node) {
+		return nil, fmt.Errorf("ext: bad extent header")
+	}
+	if int(head.Depth) > depth {
+		return nil, fmt.Errorf("ext: extent tree is too deep")
+	}
+	for i := 0; i < int(head.Entries); i++ {
+		entry := node[12+12*i:]
+		logical := int64(binary.LittleEndian.Uint32(entry))
+		if head.Depth == 0 {
+			length := int64(binary.LittleEndian.Uint16(entry[4:]))
+			physical := int64(binary.LittleEndian.Uint16(entry[6:]))<<32 |
+				int64(binary.LittleEndian.Uint32(entry[8:]))
+			zero := length > extExtentInit
+			if zero {
+				length -= extExtentInit
+			}
+			extents = append(extents, extExtent{logical, physical, length, zero})
+			continue
+		}
+
+		leaf := int64(binary.LittleEndian.Uint32(entry[4:])) |
+			int64(binary.LittleEndian.Uint16(entry[8:]))<<32
+		child := make([]byte, c.blockSize)
+		if err := c.ReadAt(leaf*c.blockSize, child); err != nil {
+			return nil, err
+		}
+		var err error
+		if extents, err = c.extentTree(child, int(head.Depth)-1, extents); err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
+
+// blockMap collects the blocks referenced by an (indirect) block map, blocks
+// beyond the end of the file are ignored
+func (c *extContext) blockMap(ptrs []byte, level int, logical *int64, blocks int64, extents []extExtent) ([]extExtent, error) {
+	perBlock := c.blockSize / 4
+	span := int64(1)
+	for i := 0; i < level; i++ {
+		span *= perBlock
+	}
+	for i := 0; i+4 <= len(ptrs) && *logical < blocks; i += 4 {
+		ptr := int64(binary.LittleEndian.Uint32(ptrs[i:]))
+		if ptr == 0 {
+			*logical += span
+			continue
+		}
+		if level == 0 {
+			n := len(extents) - 1
+			if n >= 0 && extents[n].logical+extents[n].length == *logical &&
+				extents[n].physical+extents[n].length == ptr {
+				extents[n].length++
+			} else {
+				extents = append(extents, extExtent{logical: *logical, physical: ptr, length: 1})
+			}
+			*logical++
+			continue
+		}
+		if err := c.Canceled(); err != nil {
+			return nil, err
+		}
+		child := make([]byte, c.blockSize)
+		if err := c.ReadAt(ptr*c.blockSize, child); err != nil {
+			return nil, err
+		}
+		var err error
+		if extents, err = c.blockMap(child, level-1, logical, blocks, extents); err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
+
+func (c *extContext) extents(inode *extInode) ([]extExtent, error) {
+	if inode.Flags&extFlagExtents != 0 {
+		return c.extentTree(inode.Block[:], extMaxDepth, nil)
+	}
+	blocks := (inode.size() + c.blockSize - 1) / c.blockSize
+	var extents []extExtent
+	var logical int64
+	var err error
+	// direct blocks are followed by single, double and triple indirect blocks
+	ptrs := [][]byte{inode.Block[:48], inode.Block[48:52], inode.Block[52:56], inode.Block[56:60]}
+	for level := 0; level < len(ptrs) && err == nil; level++ {
+		extents, err = c.blockMap(ptrs[level], level, &logical, blocks, extents)
+	}
+	return extents, err
+}
+
+// writeZeros writes n zero bytes, used for holes in sparse files
+func writeZeros(w io.Writer, n int64) error {
+	zeros := make([]byte, 64*1024)
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		if _, err := w.Write(zeros[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// data writes the contents of an inode
+func (c *extContext) data(w io.Writer, inode *extInode) error {
+	size := inode.size()
+	if inode.Flags&extFlagInline != 0 {
+		data := c.inlineData(inode)
+		if int64(len(data)) < size {
+			return fmt.Errorf("ext: short inline data")
+		}
+		_, err := w.Write(data[:size])
+		return err
+	}
+
+	extents, err := c.extents(inode)
+	if err != nil {
+		return err
+	}
+	var written int64
+	for _, ext := range extents {
+		if err := c.Canceled(); err != nil {
+			return err
+		}
+		start, end := ext.logical*c.blockSize, (ext.logical+ext.length)*c.blockSize
+		if end > size {
+			end = size
+		}
+		if start < written || start >= end {
+			continue
+		}
+		if err := writeZeros(w, start-written); err != nil {
+			return err
+		}
+		if ext.zero {
+			err = writeZeros(w, end-start)
+		} else {
+			var n int64
+			n, err = io.Copy(w, util.NewSectionReader(c.Reader, ext.physical*c.blockSize, end-start))
+			if err == nil && n != end-start {
+				err = fmt.Errorf("ext: file data is outside the image")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		written = end
+	}
+	return writeZeros(w, size-written)
+}
+
+// setInfo records file information as metadata
+func (c *extContext) setInfo(fd *types.FileData, inode *extInode) {
+	fd.SetTime(time.Unix(int64(inode.Mtime), 0))
+	fd.SetMetadata("mode", int64(inode.Mode&07777))
+	fd.SetMetadata("uid", int64(inode.UIDLo)|int64(inode.UIDHi)<<16)
+	fd.SetMetadata("gid", int64(inode.GIDLo)|int64(inode.GIDHi)<<16)
+}
+
+func (c *extContext) inodeDir(ino uint32, inode *extInode, name string) error {
+	// directories are never linked, seeing one twice means the image is broken
+	if c.dirs[ino] {
+		return fmt.Errorf("ext: directory loop at %s", name)
+	}
+	c.dirs[ino] = true
+
+	if name != "" {
+		fd, err := c.Mkdir(name)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, inode)
+	}
+	if inode.size() > extMaxDirSize {
+		return fmt.Errorf("ext: directory %s is too large", name)
+	}
+	var b bytes.Buffer
+	if err := c.data(&b, inode); err != nil {
+		return err
+	}
+	data := b.Bytes()
+	// inline directories start with the parent inode number
+	if inode.Flags&extFlagInline != 0 && len(data) >= 4 {
+		data = data[4:]
+	}
+
+	// hashed directories are compatible with linear ones, the index is
+	// stored in entries without an inode
+	for pos := 0; pos+8 <= len(data); {
+		ent := binary.LittleEndian.Uint32(data[pos:])
+		recLen := int(binary.LittleEndian.Uint16(data[pos+4:]))
+		nameLen := int(data[pos+6])
+		if recLen < 8 || pos+recLen > len(data) || 8+nameLen > recLen {
+			return fmt.Errorf("ext: bad directory entry in %s", name)
+		}
+		ename := string(data[pos+8 : pos+8+nameLen])
+		pos += recLen
+		if ent == 0 || ename == "." || ename == ".." {
+			continue
+		}
+		if err := c.file(ent, path.Join(name, ename)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *extContext) inodeFile(ino uint32, inode *extInode, name string) error {
+	// the first name of a hard linked file gets the data
+	if first, found := c.files[ino]; found {
+		fd, err := c.Link(name, first, true)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, inode)
+		return nil
+	}
+	if inode.LinksCount > 1 {
+		c.files[ino] = name
+	}
+
+	w, fd, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	c.setInfo(fd, inode)
+	return c.data(w, inode)
+}
+
+func (c *extContext) inodeLink(inode *extInode, name string) error {
+	size := inode.size()
+	if size > extMaxLinkSize {
+		return fmt.Errorf("ext: bad link size in %s", name)
+	}
+	// short targets are stored in the block map
+	var target []byte
+	if size < int64(len(inode.Block)) && inode.Flags&(extFlagExtents|extFlagInline) == 0 {
+		target = inode.Block[:size]
+	} else {
+		var b bytes.Buffer
+		if err := c.data(&b, inode); err != nil {
+			return err
+		}
+		target = b.Bytes()
+	}
+	fd, err := c.Link(name, string(target), false)
+	if err != nil {
+		return err
+	}
+	c.setInfo(fd, inode)
+	return nil
+}
+
+func (c *extContext) inodeNode(inode *extInode, name string) error {
+	var typ string
+	switch inode.Mode & 0xF000 {
+	case 0x6000:
+		typ = "blockdev"
+	case 0x2000:
+		typ = "chardev"
+	case 0x1000:
+		typ = "fifo"
+	case 0xC000:
+		typ = "socket"
+	default:
+		return fmt.Errorf("ext: unknown file type %o for %s", inode.Mode, name)
+	}
+
+	fd, err := c.Node(name, typ)
+	if err != nil {
+		return err
+	}
+	c.setInfo(fd, inode)
+	if typ == "blockdev" || typ == "chardev" {
+		// the old encoding is in the first word, the new in the second
+		device := binary.LittleEndian.Uint32(inode.Block[0:])
+		if device == 0 {
+			device = binary.LittleEndian.Uint32(inode.Block[4:])
+		}
+		fd.SetMetadata("major", int64((device>>8)&0xFFF))
+		fd.SetMetadata("minor", int64(device&0xFF|(device>>12)&0xFFF00))
+	}
+	return nil
+}
+
+func (c *extContext) file(ino uint32, name string) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
+	inode, err := c.inode(ino)
+	if err != nil {
+		return err
+	}
+
+	switch inode.Mode & 0xF000 {
+	case 0x4000:
+		return c.inodeDir(ino, inode, name)
+	case 0x8000:
+		return c.inodeFile(ino, inode, name)
+	case 0xA000:
+		return c.inodeLink(inode, name)
+	default:
+		return c.inodeNode(inode, name)
+	}
+}
+
+// Unext extracts an ext2, ext3 or ext4 file system.
+//
+// The journal is not replayed. Links and device nodes are not created, they
+// are recorded as metadata together with the mode and owner of each file
+func Unext(e *types.Env, prefix string) (string, error) {
+	c := &extContext{
+		Create:   e.Create,
+		Link:     e.Link,
+		Node:     e.Node,
+		Mkdir:    e.Mkdir,
+		Canceled: e.Canceled,
+		dirs:     make(map[uint32]bool),
+		files:    make(map[uint32]string),
+	}
+	c.Reader = e.Reader
+	c.Order = binary.LittleEndian
+
+	s := &c.super
+	if err := c.ReadAt(extSuperOffset, s); err != nil {
+		return "", err
+	}
+	if s.Magic != extMagic {
+		return "", fmt.Errorf("file is not an ext file system")
+	}
+	if s.LogBlockSize > 6 || s.InodesPerGroup == 0 || s.BlocksPerGroup == 0 {
+		return "", fmt.Errorf("ext: bad superblock")
+	}
+	if s.FeatureIncompat&extIncompatComp != 0 {
+		return "", fmt.Errorf("ext: compression is not supported")
+	}
+	c.blockSize = 1024 << s.LogBlockSize
+
+	c.inodeSize = 128
+	if s.RevLevel > 0 {
+		c.inodeSize = int64(s.InodeSize)
+	}
+	if c.inodeSize < 128 || c.inodeSize > c.blockSize || c.inodeSize&(c.inodeSize-1) != 0 {
+		return "", fmt.Errorf("ext: bad inode size %d", c.inodeSize)
+	}
+
+	c.descSize = 32
+	if s.FeatureIncompat&extIncompat64Bit != 0 {
+		c.descSize = int64(s.DescSize)
+	}
+	if c.descSize < 32 || c.descSize > c.blockSize || c.descSize&(c.descSize-1) != 0 {
+		return "", fmt.Errorf("ext: bad group descriptor size %d", c.descSize)
+	}
+	return prefix, c.file(extRootInode, prefix)
+}
@@ -0,0 +1,116 @@
+package extractors
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// extTree creates the files that are copied into the test images
+func extTree(t *testing.T) (string, map[string][]byte) {
+	files := map[string][]byte{
+		"hello.txt":        []byte("hello ext\n"),
+		"tiny":             []byte("x"),
+		"bin/busybox":      bytes.Repeat([]byte("busybox "), 3000),
+		"dir/sub/big.bin":  bytes.Repeat([]byte("0123456789abcdef"), 80000),
+		"dir/sub/empty":    nil,
+		"dir/many/file000": []byte("0"),
+	}
+	for i := 1; i < 200; i++ {
+		files[fmt.Sprintf("dir/many/file%03d", i)] = []byte(fmt.Sprint(i))
+	}
+
+	root := t.TempDir()
+	for name, data := range files {
+		filename := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "bin/busybox"), os.ModeSetuid|0755); err != nil {
+		t.Fatal(err)
+	}
+	long := string(bytes.Repeat([]byte("a/"), 50)) + "target"
+	for link, target := range map[string]string{"bin/sh": "busybox", "long": long} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "hello.txt"), filepath.Join(root, "dir/hello.txt")); err != nil {
+		t.Fatal(err)
+	}
+	return root, files
+}
+
+func TestUnext(t *testing.T) {
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("mke2fs not found, skipping test")
+	}
+	root, files := extTree(t)
+
+	testdata := [][]string{
+		{"-t", "ext2", "-b", "1024"},
+		{"-t", "ext3", "-b", "2048"},
+		{"-t", "ext4"},
+		{"-t", "ext4", "-O", "inline_data,64bit,^resize_inode,meta_bg"},
+		{"-t", "ext4", "-I", "128", "-O", "^extent,^64bit"},
+	}
+	for _, opts := range testdata {
+		image := filepath.Join(t.TempDir(), "image")
+		args := append([]string{"-q", "-F", "-E", "root_owner=0:0", "-d", root}, opts...)
+		args = append(args, image, "4M")
+		if out, err := exec.Command("mke2fs", args...).CombinedOutput(); err != nil {
+			t.Logf("mke2fs %v failed, skipping test: %v %s", opts, err, out)
+			continue
+		}
+		data, err := os.ReadFile(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, err := runExtractor(data, Unext)
+		if err != nil {
+			t.Errorf("%v: extraction failed: %v", opts, err)
+			continue
+		}
+		for name, content := range files {
+			if fd := x.files[name]; fd != nil && fd.Metadata["type"] == "hardlink" {
+				continue
+			}
+			if got := x.content(t, name); !bytes.Equal(got, content) {
+				t.Errorf("%v: %s has wrong content", opts, name)
+			}
+		}
+
+		var metadata = []struct {
+			file, key string
+			value     interface{}
+		}{
+			{"bin/busybox", "mode", int64(04755)},
+			{"bin/busybox", "uid", int64(0)},
+			{"hello.txt", "mode", int64(0644)},
+			{"bin/sh", "type", "symlink"},
+			{"bin/sh", "link", "busybox"},
+			{"long", "link", string(bytes.Repeat([]byte("a/"), 50)) + "target"},
+		}
+		for _, test := range metadata {
+			if v := x.metadata(t, test.file, test.key); v != test.value {
+				t.Errorf("%v: %s has %s %v, wanted %v", opts, test.file, test.key, v, test.value)
+			}
+		}
+
+		// the first name of a hard link gets the data, the other is a link
+		first, second := x.files["hello.txt"], x.files["dir/hello.txt"]
+		if first == nil || second == nil {
+			t.Errorf("%v: hard link was not extracted", opts)
+		} else if first.Metadata["type"] != "hardlink" && second.Metadata["type"] != "hardlink" {
+			t.Errorf("%v: hard link was not recorded", opts)
+		}
+	}
+}
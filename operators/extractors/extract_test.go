@@ -0,0 +1,74 @@
+package extractors
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+// extracted is the result of running an extractor in memory
+type extracted struct {
+	m     *types.Molly
+	input *types.FileData
+	files map[string]*types.FileData
+}
+
+// runExtractor runs an extractor on data, the extracted files are keyed by
+// their name below the input
+func runExtractor(data []byte, extractor func(*types.Env, string) (string, error)) (*extracted, error) {
+	return runExtractorConfig(data, extractor, nil)
+}
+
+// runExtractorConfig is runExtractor with changes to the configuration
+func runExtractorConfig(data []byte, extractor func(*types.Env, string) (string, error),
+	config func(*types.Configuration)) (*extracted, error) {
+	m := types.NewMolly()
+	m.Config.OutDir = "/out"
+	m.Config.FS = util.NewMemFS()
+	if config != nil {
+		config(m.Config)
+	}
+
+	input := types.NewFileData("/out/input", nil)
+	input.Filesize = int64(len(data))
+	env := types.NewEnv(m)
+	env.SetInput(bytes.NewReader(data), input)
+	_, err := extractor(env, "")
+
+	x := &extracted{m: m, input: input, files: make(map[string]*types.FileData)}
+	for name, fd := range m.Files {
+		x.files[strings.TrimPrefix(name, "/out/input_/")] = fd
+	}
+	return x, err
+}
+
+// content returns the contents of an extracted file
+func (x *extracted) content(t *testing.T, name string) []byte {
+	fd, found := x.files[name]
+	if !found {
+		t.Fatalf("%s was not extracted", name)
+	}
+	r, err := x.m.Open(fd)
+	if err != nil {
+		t.Fatalf("could not open %s: %v", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("could not read %s: %v", name, err)
+	}
+	return data
+}
+
+// metadata returns a metadata value of an extracted file
+func (x *extracted) metadata(t *testing.T, name, key string) interface{} {
+	fd, found := x.files[name]
+	if !found {
+		t.Fatalf("%s was not extracted", name)
+	}
+	return fd.Metadata[key]
+}
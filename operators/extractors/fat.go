@@ -0,0 +1,474 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	fatEntrySize   = 32
+	fatMaxDirSize  = 65536 * fatEntrySize
+	fatDeleted     = 0xE5
+	fatAttrVolume  = 0x08
+	fatAttrDir     = 0x10
+	fatAttrLFN     = 0x0F
+	fatLFNLast     = 0x40
+	fatLFNChars    = 13
+	fatLowerBase   = 0x08
+	fatLowerExt    = 0x10
+	fat12Clusters  = 4085
+	fat16Clusters  = 65525
+	fatMaxClusters = 0x0FFFFFF0
+)
+
+type fatBoot struct {
+	Jump              [3]byte
+	OEM               [8]byte
+	BytesPerSector    uint16
+	SectorsPerCluster uint8
+	ReservedSectors   uint16
+	NumFATs           uint8
+	RootEntries       uint16
+	TotalSectors16    uint16
+	Media             uint8
+	FATSize16         uint16
+	SectorsPerTrack   uint16
+	Heads             uint16
+	HiddenSectors     uint32
+	TotalSectors32    uint32
+
+	// FAT32 only
+	FATSize32   uint32
+	ExtFlags    uint16
+	FSVersion   uint16
+	RootCluster uint32
+}
+
+type fatEntry struct {
+	Name         [11]byte
+	Attr         uint8
+	NTRes        uint8
+	CrtTimeTenth uint8
+	CrtTime      uint16
+	CrtDate      uint16
+	LstAccDate   uint16
+	FstClusHI    uint16
+	WrtTime      uint16
+	WrtDate      uint16
+	FstClusLO    uint16
+	FileSize     uint32
+}
+
+// fatContext is shared by FAT and exFAT, which only differ in their boot
+// sector and directory entries
+type fatContext struct {
+	util.Structured
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Mkdir    func(string) (*types.FileData, error)
+	Canceled func() error
+
+	deleted     bool
+	fat32       bool
+	size        int64
+	clusterSize int64
+	dataStart   int64
+	clusters    uint32
+	table       []uint32
+	eoc         uint32
+	dirs        map[uint32]bool
+}
+
+// fatTime converts a DOS date and time, which are in local time
+func fatTime(date, tm uint16) time.Time {
+	return time.Date(1980+int(date>>9), time.Month(date>>5&15), int(date&31),
+		int(tm>>11), int(tm>>5&63), int(tm&31)*2, 0, time.UTC)
+}
+
+// fatChecksum is the checksum of a short name stored in its long name entries
+func fatChecksum(name []byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// fatShortName formats an 8.3 name, lower case flags are from Windows NT
+func fatShortName(e *fatEntry) string {
+	raw := e.Name
+	if raw[0] == 0x05 {
+		raw[0] = fatDeleted
+	}
+	var base, ext []rune
+	for _, c := range bytes.TrimRight(raw[:8], " ") {
+		base = append(base, rune(c))
+	}
+	for _, c := range bytes.TrimRight(raw[8:], " ") {
+		ext = append(ext, rune(c))
+	}
+	name := string(base)
+	if e.NTRes&fatLowerBase != 0 {
+		name = strings.ToLower(name)
+	}
+	if len(ext) > 0 {
+		if e.NTRes&fatLowerExt != 0 {
+			name += "." + strings.ToLower(string(ext))
+		} else {
+			name += "." + string(ext)
+		}
+	}
+	return name
+}
+
+// fatLongName collects the characters of a long name entry
+func fatLongName(ent []byte) []uint16 {
+	var chars []uint16
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for i := r[0]; i < r[1]; i += 2 {
+			chars = append(chars, binary.LittleEndian.Uint16(ent[i:]))
+		}
+	}
+	return chars
+}
+
+// fatName converts a long name, which ends with a NUL or the entry end
+func fatName(chars []uint16) string {
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+// chain returns up to max clusters of a cluster chain
+func (c *fatContext) chain(first uint32, max int64) ([]uint32, error) {
+	var clusters []uint32
+	for n := first; int64(len(clusters)) < max; n = c.table[n] {
+		if n < 2 || n >= c.clusters+2 {
+			return clusters, fmt.Errorf("fat: bad cluster %d in chain", n)
+		}
+		clusters = append(clusters, n)
+		if c.table[n] >= c.eoc {
+			break
+		}
+	}
+	return clusters, nil
+}
+
+// data writes size bytes starting at a cluster, either following its chain
+// or from consecutive clusters
+func (c *fatContext) data(w io.Writer, first uint32, size int64, contiguous bool) error {
+	n := (size + c.clusterSize - 1) / c.clusterSize
+	var clusters []uint32
+	if contiguous {
+		if first < 2 || int64(first)+n > int64(c.clusters)+2 {
+			return fmt.Errorf("fat: bad cluster %d", first)
+		}
+		for i := int64(0); i < n; i++ {
+			clusters = append(clusters, first+uint32(i))
+		}
+	} else if n > 0 {
+		var err error
+		if clusters, err = c.chain(first, n); err != nil {
+			return err
+		}
+		if int64(len(clusters)) < n {
+			return fmt.Errorf("fat: cluster chain at %d is too short", first)
+		}
+	}
+
+	for _, cluster := range clusters {
+		if err := c.Canceled(); err != nil {
+			return err
+		}
+		chunk := c.clusterSize
+		if size < chunk {
+			chunk = size
+		}
+		offset := c.dataStart + int64(cluster-2)*c.clusterSize
+		written, err := io.Copy(w, util.NewSectionReader(c.Reader, offset, chunk))
+		if err == nil && written != chunk {
+			err = fmt.Errorf("fat: cluster %d is outside the image", cluster)
+		}
+		if err != nil {
+			return err
+		}
+		size -= chunk
+	}
+	return nil
+}
+
+// dirData reads a directory stored in a cluster chain
+func (c *fatContext) dirData(first uint32, size int64, contiguous bool, name string) ([]byte, error) {
+	if c.dirs[first] {
+		return nil, fmt.Errorf("fat: directory loop at %s", name)
+	}
+	c.dirs[first] = true
+	if size == 0 {
+		clusters, err := c.chain(first, fatMaxDirSize/c.clusterSize)
+		if err != nil {
+			return nil, err
+		}
+		size = int64(len(clusters)) * c.clusterSize
+	}
+	if size > fatMaxDirSize {
+		return nil, fmt.Errorf("fat: directory %s is too large", name)
+	}
+	var b bytes.Buffer
+	err := c.data(&b, first, size, contiguous)
+	return b.Bytes(), err
+}
+
+// file extracts a regular file, data of deleted files is assumed to be in
+// consecutive clusters since their chains are gone. Deleted files that
+// cannot be recovered are kept with an error
+func (c *fatContext) file(name string, first uint32, size int64, contiguous, deleted bool, mtime time.Time) error {
+	w, fd, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	fd.SetTime(mtime)
+	if deleted {
+		fd.SetMetadata("deleted", true)
+		if err := c.data(w, first, size, true); err != nil {
+			fd.RegisterError(err)
+		}
+		return nil
+	}
+	return c.data(w, first, size, contiguous)
+}
+
+// fatDir extracts the files in a FAT directory
+func (c *fatContext) fatDir(data []byte, name string) error {
+	var lfn []uint16
+	var lfnSum byte
+	var lfnNext int
+	var deletedLFN [][]byte
+	for pos := 0; pos+fatEntrySize <= len(data); pos += fatEntrySize {
+		raw := data[pos : pos+fatEntrySize]
+		if raw[0] == 0 {
+			break
+		}
+
+		// long names are stored in reverse order before the short name
+		if raw[11]&0x3F == fatAttrLFN {
+			if raw[0] == fatDeleted {
+				deletedLFN = append(deletedLFN, raw)
+				continue
+			}
+			ord := int(raw[0] & 0x1F)
+			if raw[0]&fatLFNLast != 0 {
+				lfn, lfnSum, lfnNext = make([]uint16, ord*fatLFNChars), raw[13], ord
+			}
+			if lfn == nil || ord != lfnNext || ord == 0 || raw[13] != lfnSum {
+				lfn = nil
+				continue
+			}
+			copy(lfn[(ord-1)*fatLFNChars:], fatLongName(raw))
+			lfnNext--
+			continue
+		}
+		long, lfnDone := lfn, lfnNext == 0
+		lfn = nil
+		dlfn := deletedLFN
+		deletedLFN = nil
+
+		var ent fatEntry
+		binary.Read(bytes.NewReader(raw), binary.LittleEndian, &ent)
+		if ent.Attr&fatAttrVolume != 0 {
+			continue
+		}
+		deleted := ent.Name[0] == fatDeleted
+		if deleted && !c.deleted {
+			continue
+		}
+
+		if deleted {
+			ent.Name[0] = '_'
+		}
+		ename := fatShortName(&ent)
+		switch {
+		case deleted && len(dlfn) > 0:
+			// the first byte of the name is lost, but the long name is not
+			var chars []uint16
+			for i := len(dlfn) - 1; i >= 0; i-- {
+				chars = append(chars, fatLongName(dlfn[i])...)
+			}
+			ename = fatName(chars)
+		case long != nil && lfnDone && fatChecksum(ent.Name[:]) == lfnSum:
+			ename = fatName(long)
+		}
+		if ename == "." || ename == ".." || ename == "" {
+			continue
+		}
+
+		first := uint32(ent.FstClusLO)
+		if c.fat32 {
+			first |= uint32(ent.FstClusHI) << 16
+		}
+		fullname := path.Join(name, ename)
+		mtime := fatTime(ent.WrtDate, ent.WrtTime)
+		if ent.Attr&fatAttrDir == 0 {
+			if err := c.file(fullname, first, int64(ent.FileSize), false, deleted, mtime); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// deleted directories are usually overwritten, they are not followed
+		if deleted {
+			continue
+		}
+		fd, err := c.Mkdir(fullname)
+		if err != nil {
+			return err
+		}
+		fd.SetTime(mtime)
+		sub, err := c.dirData(first, 0, false, fullname)
+		if err != nil {
+			return err
+		}
+		if err := c.fatDir(sub, fullname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fatTable reads the first FAT, which must be inside the image as must the
+// clusters it describes
+func (c *fatContext) fatTable(offset int64, bits int) error {
+	entries := int64(c.clusters) + 2
+	length := (entries*int64(bits) + 7) / 8
+	if offset < 0 || offset+length > c.size {
+		return fmt.Errorf("fat: FAT is outside the image")
+	}
+	if c.dataStart > c.size || int64(c.clusters) > (c.size-c.dataStart)/c.clusterSize {
+		return fmt.Errorf("fat: %d clusters do not fit in the image", c.clusters)
+	}
+	raw := make([]byte, length+1)
+	if err := c.ReadAt(offset, raw[:len(raw)-1]); err != nil {
+		return err
+	}
+	c.table = make([]uint32, entries)
+	for n := range c.table {
+		switch bits {
+		case 12:
+			v := binary.LittleEndian.Uint16(raw[n+n/2:])
+			if n%2 == 1 {
+				v >>= 4
+			}
+			c.table[n] = uint32(v & 0xFFF)
+		case 16:
+			c.table[n] = uint32(binary.LittleEndian.Uint16(raw[2*n:]))
+		default:
+			c.table[n] = binary.LittleEndian.Uint32(raw[4*n:])
+		}
+	}
+	return nil
+}
+
+func (c *fatContext) fat(prefix string) error {
+	var b fatBoot
+	if err := c.ReadAt(0, &b); err != nil {
+		return err
+	}
+	bps, spc := int64(b.BytesPerSector), int64(b.SectorsPerCluster)
+	if bps < 512 || bps > 4096 || bps&(bps-1) != 0 || spc == 0 || spc&(spc-1) != 0 ||
+		b.NumFATs == 0 || b.ReservedSectors == 0 {
+		return fmt.Errorf("fat: bad boot sector")
+	}
+	fatSize := int64(b.FATSize16)
+	if fatSize == 0 {
+		fatSize = int64(b.FATSize32)
+	}
+	total := int64(b.TotalSectors16)
+	if total == 0 {
+		total = int64(b.TotalSectors32)
+	}
+	rootStart := int64(b.ReservedSectors) + int64(b.NumFATs)*fatSize
+	rootSectors := (int64(b.RootEntries)*fatEntrySize + bps - 1) / bps
+	dataStart := rootStart + rootSectors
+	if fatSize == 0 || total <= dataStart || (total-dataStart)/spc > fatMaxClusters {
+		return fmt.Errorf("fat: bad boot sector")
+	}
+
+	c.clusterSize = spc * bps
+	c.dataStart = dataStart * bps
+	c.clusters = uint32((total - dataStart) / spc)
+	bits := 32
+	switch {
+	case c.clusters < fat12Clusters:
+		bits, c.eoc = 12, 0xFF8
+	case c.clusters < fat16Clusters:
+		bits, c.eoc = 16, 0xFFF8
+	default:
+		c.fat32, c.eoc = true, 0x0FFFFFF8
+	}
+	if (int64(c.clusters)+2)*int64(bits)/8 > fatSize*bps {
+		return fmt.Errorf("fat: FAT is too small")
+	}
+	if err := c.fatTable(int64(b.ReservedSectors)*bps, bits); err != nil {
+		return err
+	}
+	if c.fat32 {
+		for n := range c.table {
+			c.table[n] &= 0x0FFFFFFF
+		}
+	}
+
+	if prefix != "" {
+		if _, err := c.Mkdir(prefix); err != nil {
+			return err
+		}
+	}
+	var root []byte
+	var err error
+	if c.fat32 {
+		root, err = c.dirData(b.RootCluster, 0, false, prefix)
+	} else {
+		root = make([]byte, int(b.RootEntries)*fatEntrySize)
+		err = c.ReadAt(rootStart*bps, root)
+	}
+	if err != nil {
+		return err
+	}
+	return c.fatDir(root, prefix)
+}
+
+// Unfat extracts a FAT12, FAT16, FAT32 or exFAT file system. Deleted files
+// are recovered when enabled in the configuration, they have the metadata
+// "deleted" set
+func Unfat(e *types.Env, prefix string) (string, error) {
+	c := &fatContext{
+		Create:   e.Create,
+		Mkdir:    e.Mkdir,
+		Canceled: e.Canceled,
+		deleted:  e.RecoverDeleted(),
+		size:     int64(e.GetSize()),
+		dirs:     make(map[uint32]bool),
+	}
+	c.Reader = e.Reader
+	c.Order = binary.LittleEndian
+
+	var oem [8]byte
+	if err := c.ReadAt(3, oem[:]); err != nil {
+		return "", err
+	}
+	if string(oem[:]) == exfatOEM {
+		return prefix, c.exfat(prefix)
+	}
+	return prefix, c.fat(prefix)
+}
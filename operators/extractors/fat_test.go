@@ -0,0 +1,262 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/types"
+)
+
+// fatFile describes a file or directory (if files is not nil) in a test image
+type fatFile struct {
+	name    string
+	data    []byte
+	files   []fatFile
+	deleted bool
+}
+
+// fatImage creates small FAT images with one sector per cluster, files
+// are fragmented unless deleted
+type fatImage struct {
+	bits      int
+	img       []byte
+	clusters  uint32
+	table     []uint32
+	next      uint32
+	dataStart int
+	short     int
+}
+
+var fatTestTime = time.Date(2020, 5, 17, 12, 34, 56, 0, time.UTC)
+
+func (f *fatImage) write(data []byte, fragment bool) uint32 {
+	if len(data) == 0 {
+		return 0
+	}
+	n := (len(data) + 511) / 512
+	step := uint32(1)
+	if fragment {
+		step = 2
+	}
+	first := f.next
+	for i := 0; i < n; i++ {
+		c := first + uint32(i)*step
+		copy(f.img[f.dataStart+int(c-2)*512:], data[i*512:])
+		if fragment {
+			f.table[c] = c + step
+			if i == n-1 {
+				f.table[c] = 0x0FFFFFFF & (1<<f.bits - 1)
+			}
+		}
+	}
+	f.next += uint32(n) * step
+	return first
+}
+
+// entries returns the directory entries for a file, with a long name
+// unless the name is a valid short name
+func (f *fatImage) entries(name string, attr uint8, cluster uint32, size int, deleted bool) []byte {
+	var short [11]byte
+	copy(short[:], "           ")
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	long := len(base) > 8 || len(ext) > 3 || strings.ToUpper(name) != name
+	if long {
+		f.short++
+		base = fmt.Sprintf("FILE~%d", f.short)
+	}
+	copy(short[:8], base)
+	copy(short[8:], strings.ToUpper(ext))
+
+	var b bytes.Buffer
+	if long {
+		chars := utf16.Encode([]rune(name))
+		chars = append(chars, 0)
+		for len(chars)%fatLFNChars != 0 {
+			chars = append(chars, 0xFFFF)
+		}
+		n := len(chars) / fatLFNChars
+		for ord := n; ord >= 1; ord-- {
+			ent := make([]byte, fatEntrySize)
+			ent[0] = byte(ord)
+			if ord == n {
+				ent[0] |= fatLFNLast
+			}
+			if deleted {
+				ent[0] = fatDeleted
+			}
+			ent[11], ent[13] = fatAttrLFN, fatChecksum(short[:])
+			part := chars[(ord-1)*fatLFNChars:]
+			for i, pos := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				binary.LittleEndian.PutUint16(ent[pos:], part[i])
+			}
+			b.Write(ent)
+		}
+	}
+	if deleted {
+		short[0] = fatDeleted
+	}
+	t := fatTestTime
+	binary.Write(&b, binary.LittleEndian, fatEntry{
+		Name: short, Attr: attr, FstClusHI: uint16(cluster >> 16), FstClusLO: uint16(cluster),
+		WrtDate:  uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day()),
+		WrtTime:  uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2),
+		FileSize: uint32(size),
+	})
+	return b.Bytes()
+}
+
+func (f *fatImage) dir(files []fatFile, sub bool) []byte {
+	var b bytes.Buffer
+	if sub {
+		b.Write(f.entries(".", fatAttrDir, 0, 0, false))
+		b.Write(f.entries("..", fatAttrDir, 0, 0, false))
+	}
+	for _, file := range files {
+		if file.files != nil {
+			cluster := f.write(f.dir(file.files, true), true)
+			b.Write(f.entries(file.name, fatAttrDir, cluster, 0, false))
+		} else {
+			cluster := f.write(file.data, !file.deleted)
+			b.Write(f.entries(file.name, 0x20, cluster, len(file.data), file.deleted))
+		}
+	}
+	return b.Bytes()
+}
+
+func fatBuild(bits int, clusters uint32, files []fatFile) []byte {
+	reserved, rootEntries := 1, 512
+	if bits == 32 {
+		reserved, rootEntries = 32, 0
+	}
+	fatSectors := (int(clusters+2)*bits/8 + 511) / 512
+	total := reserved + fatSectors + rootEntries*fatEntrySize/512 + int(clusters)
+	f := &fatImage{
+		bits: bits, img: make([]byte, total*512), clusters: clusters,
+		table: make([]uint32, clusters+2), next: 2,
+		dataStart: (reserved + fatSectors + rootEntries*fatEntrySize/512) * 512,
+	}
+
+	boot := fatBoot{
+		Jump: [3]byte{0xEB, 0x3C, 0x90}, BytesPerSector: 512, SectorsPerCluster: 1,
+		ReservedSectors: uint16(reserved), NumFATs: 1, RootEntries: uint16(rootEntries),
+		Media: 0xF8, TotalSectors32: uint32(total),
+	}
+	copy(boot.OEM[:], "mkfs.fat")
+	root := f.dir(files, false)
+	if bits == 32 {
+		boot.FATSize32 = uint32(fatSectors)
+		boot.RootCluster = f.write(append(root, make([]byte, 512)...), true)
+	} else {
+		boot.FATSize16 = uint16(fatSectors)
+		copy(f.img[(reserved+fatSectors)*512:], root)
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &boot)
+	copy(f.img, b.Bytes())
+	f.img[0x1FE], f.img[0x1FF] = 0x55, 0xAA
+
+	fat := f.img[reserved*512:]
+	for n, v := range f.table {
+		switch bits {
+		case 12:
+			pos := n + n/2
+			if n%2 == 0 {
+				fat[pos] = byte(v)
+				fat[pos+1] = fat[pos+1]&0xF0 | byte(v>>8)&0x0F
+			} else {
+				fat[pos] = fat[pos]&0x0F | byte(v<<4)
+				fat[pos+1] = byte(v >> 4)
+			}
+		case 16:
+			binary.LittleEndian.PutUint16(fat[2*n:], uint16(v))
+		default:
+			binary.LittleEndian.PutUint32(fat[4*n:], v)
+		}
+	}
+	return f.img
+}
+
+func TestUnfat(t *testing.T) {
+	big := bytes.Repeat([]byte("fat cluster chain "), 200)
+	files := []fatFile{
+		{name: "README.TXT", data: []byte("hello fat\n")},
+		{name: "Long-File-Name.txt", data: big},
+		{name: "GONE.BIN", data: []byte("deleted data"), deleted: true},
+		{name: "deleted-long-name.txt", data: big[:1000], deleted: true},
+		{name: "DIR", files: []fatFile{
+			{name: "config.json", data: []byte("{}")},
+			{name: "SUB", files: []fatFile{{name: "EMPTY"}}},
+		}},
+	}
+
+	var testdata = []struct {
+		bits     int
+		clusters uint32
+	}{
+		{12, 1000},
+		{16, 5000},
+		{32, 70000},
+	}
+	for _, test := range testdata {
+		img := fatBuild(test.bits, test.clusters, files)
+		x, err := runExtractor(img, Unfat)
+		if err != nil {
+			t.Errorf("FAT%d: extraction failed: %v", test.bits, err)
+			continue
+		}
+		var contents = []struct {
+			name string
+			data []byte
+		}{
+			{"README.TXT", files[0].data},
+			{"Long-File-Name.txt", big},
+			{"DIR/config.json", []byte("{}")},
+			{"DIR/SUB/EMPTY", []byte{}},
+		}
+		for _, c := range contents {
+			if data := x.content(t, c.name); !bytes.Equal(data, c.data) {
+				t.Errorf("FAT%d: %s has wrong content", test.bits, c.name)
+			}
+		}
+		if fd := x.files["README.TXT"]; fd != nil && !fd.GetTime().Equal(fatTestTime) {
+			t.Errorf("FAT%d: wrong time %v", test.bits, fd.GetTime())
+		}
+		if _, found := x.files["_ONE.BIN"]; found || len(x.files) != 6 {
+			t.Errorf("FAT%d: deleted files were extracted", test.bits)
+		}
+
+		// deleted files are recovered when enabled
+		x, err = runExtractorConfig(img, Unfat, func(c *types.Configuration) { c.Deleted = true })
+		if err != nil {
+			t.Errorf("FAT%d: extraction failed: %v", test.bits, err)
+			continue
+		}
+		for name, data := range map[string][]byte{"_ONE.BIN": files[2].data, "deleted-long-name.txt": big[:1000]} {
+			if got := x.content(t, name); !bytes.Equal(got, data) {
+				t.Errorf("FAT%d: deleted %s has wrong content", test.bits, name)
+			}
+			if x.metadata(t, name, "deleted") != true {
+				t.Errorf("FAT%d: %s is not marked as deleted", test.bits, name)
+			}
+		}
+	}
+
+	// the boot sector alone describes a FAT that is not in the image
+	img := fatBuild(32, 70000, files)
+	if _, err := runExtractor(img[:512], Unfat); err == nil {
+		t.Errorf("truncated image was accepted")
+	}
+	// more clusters than fit in the data area
+	binary.LittleEndian.PutUint32(img[32:], binary.LittleEndian.Uint32(img[32:])+10)
+	if _, err := runExtractor(img, Unfat); err == nil {
+		t.Errorf("clusters outside the image were accepted")
+	}
+}
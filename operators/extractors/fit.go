@@ -0,0 +1,183 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+	"github.com/avahidi/molly/util/compress"
+	"github.com/avahidi/molly/util/fdt"
+)
+
+var fitHashes = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// fitDecompress returns a reader for the image data, or nil if the
+// compression is not supported
+func fitDecompress(comp string, data []byte) (io.Reader, error) {
+	r := bytes.NewReader(data)
+	switch comp {
+	case "", "none":
+		return r, nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "bzip2":
+		return bzip2.NewReader(r), nil
+	case "lzma":
+		return compress.NewLzmaReader(r)
+	case "zstd":
+		return compress.NewZstdReader(r)
+	}
+	return nil, nil
+}
+
+// fitData returns the data of an image, which is either in the tree or
+// stored after it
+func fitData(e *types.Env, t *fdt.Tree, img *fdt.Node) ([]byte, error) {
+	if data, found := img.Prop("data"); found {
+		return data, nil
+	}
+	size, found := img.Uint("data-size")
+	if !found {
+		return nil, fmt.Errorf("fit: image %s has no data", img.Name)
+	}
+	offset, found := img.Uint("data-position")
+	if !found {
+		if offset, found = img.Uint("data-offset"); !found {
+			return nil, fmt.Errorf("fit: image %s has no data", img.Name)
+		}
+		offset += uint64(t.TotalSize+3) &^ 3
+	}
+	if size > fdt.MaxSize {
+		return nil, fmt.Errorf("fit: image %s is too large", img.Name)
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(util.NewSectionReader(e.Reader, int64(offset), int64(size)), data)
+	return data, err
+}
+
+// fitCheck verifies the hashes of an image
+func fitCheck(img *fdt.Node, data []byte) (map[string]bool, error) {
+	results := make(map[string]bool)
+	var err error
+	for _, node := range img.Children {
+		if !strings.HasPrefix(node.Name, "hash") {
+			continue
+		}
+		algo := node.String("algo")
+		newHash, found := fitHashes[algo]
+		if !found {
+			continue
+		}
+		value, _ := node.Prop("value")
+		h := newHash()
+		h.Write(data)
+		results[algo] = bytes.Equal(h.Sum(nil), value)
+		if !results[algo] && err == nil {
+			err = fmt.Errorf("fit: bad %s hash for image %s", algo, img.Name)
+		}
+	}
+	return results, err
+}
+
+// fitImage extracts one image and returns what we know about it
+func fitImage(e *types.Env, t *fdt.Tree, img *fdt.Node, name string) (map[string]interface{}, error) {
+	report := map[string]interface{}{}
+	for _, prop := range []string{"description", "type", "arch", "os", "compression"} {
+		if value := img.String(prop); value != "" {
+			report[prop] = value
+		}
+	}
+	for _, prop := range []string{"load", "entry"} {
+		if value, found := img.Uint(prop); found {
+			report[prop] = value
+		}
+	}
+
+	data, err := fitData(e, t, img)
+	if err != nil {
+		return report, err
+	}
+	report["size"] = len(data)
+
+	// hashes are computed over the compressed data
+	hashes, err := fitCheck(img, data)
+	report["hashes"] = hashes
+
+	comp := img.String("compression")
+	r, derr := fitDecompress(comp, data)
+	if derr != nil {
+		return report, derr
+	}
+	if r == nil {
+		r = bytes.NewReader(data)
+		name = name + "." + comp
+	}
+
+	w, fd, werr := e.Create(name)
+	if werr != nil {
+		return report, werr
+	}
+	defer w.Close()
+	if stamp, found := t.Root.Uint("timestamp"); found {
+		fd.SetTime(time.Unix(int64(stamp), 0))
+	}
+	if _, werr := io.Copy(w, r); werr != nil && werr != bzip2Trailing {
+		return report, werr
+	}
+	return report, err
+}
+
+// UnFit extracts the images of an U-Boot FIT image, with compression
+// undone. The images and the outcome of their hash checks are recorded as
+// an analysis of the input. Device trees without images are ignored
+func UnFit(e *types.Env, prefix string) (string, error) {
+	t, err := fdt.Read(e.Reader)
+	if err != nil {
+		return "", err
+	}
+	images := t.Root.Child("images")
+	if images == nil {
+		return "", nil
+	}
+
+	report := map[string]interface{}{
+		"description": t.Root.String("description"),
+	}
+	if configs := t.Root.Child("configurations"); configs != nil {
+		report["default"] = configs.String("default")
+	}
+
+	var first error
+	parts := make(map[string]interface{})
+	for _, img := range images.Children {
+		part, err := fitImage(e, t, img, prefix+img.Name)
+		parts[img.Name] = part
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	report["images"] = parts
+
+	analysis := e.AnalysisName("fit")
+	e.Current.RegisterAnalysis(analysis, report, first)
+	return "", first
+}
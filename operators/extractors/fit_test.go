@@ -0,0 +1,157 @@
+package extractors
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/avahidi/molly/util/fdt"
+)
+
+// fdtBuilder creates flattened device trees
+type fdtBuilder struct {
+	st, strs bytes.Buffer
+	names    map[string]int
+}
+
+func (b *fdtBuilder) begin(name string) {
+	binary.Write(&b.st, binary.BigEndian, uint32(1))
+	b.st.WriteString(name + "\x00")
+	b.st.Write(make([]byte, (4-b.st.Len()%4)%4))
+}
+
+func (b *fdtBuilder) end() {
+	binary.Write(&b.st, binary.BigEndian, uint32(2))
+}
+
+func (b *fdtBuilder) prop(name string, value []byte) {
+	if b.names == nil {
+		b.names = make(map[string]int)
+	}
+	off, found := b.names[name]
+	if !found {
+		off = b.strs.Len()
+		b.names[name] = off
+		b.strs.WriteString(name + "\x00")
+	}
+	binary.Write(&b.st, binary.BigEndian, []uint32{3, uint32(len(value)), uint32(off)})
+	b.st.Write(value)
+	b.st.Write(make([]byte, (4-b.st.Len()%4)%4))
+}
+
+func (b *fdtBuilder) str(name, value string) {
+	b.prop(name, []byte(value+"\x00"))
+}
+
+func (b *fdtBuilder) u32(name string, value uint32) {
+	cell := make([]byte, 4)
+	binary.BigEndian.PutUint32(cell, value)
+	b.prop(name, cell)
+}
+
+func (b *fdtBuilder) bytes() []byte {
+	binary.Write(&b.st, binary.BigEndian, uint32(9))
+	offStruct := 40 + 16
+	offStrings := offStruct + b.st.Len()
+	head := fdt.Header{
+		Magic: fdt.Magic, TotalSize: uint32(offStrings + b.strs.Len()),
+		OffStruct: uint32(offStruct), OffStrings: uint32(offStrings), OffReserved: 40,
+		Version: 17, LastCompVersion: 16,
+		SizeStrings: uint32(b.strs.Len()), SizeStruct: uint32(b.st.Len()),
+	}
+	var out bytes.Buffer
+	binary.Write(&out, binary.BigEndian, &head)
+	out.Write(make([]byte, 16)) // empty reserved memory map
+	out.Write(b.st.Bytes())
+	out.Write(b.strs.Bytes())
+	return out.Bytes()
+}
+
+// fitImageData creates a FIT with a compressed kernel and an external device tree
+func fitImageData(damaged bool) ([]byte, []byte, []byte) {
+	kernel := bytes.Repeat([]byte("linux kernel "), 100)
+	dtb := []byte{0xd0, 0x0d, 0xfe, 0xed, 1, 2, 3, 4}
+	gz := gzipData(kernel)
+	sum := sha1.Sum(gz)
+	if damaged {
+		sum[0] ^= 1
+	}
+
+	var b fdtBuilder
+	b.begin("")
+	b.str("description", "test image")
+	b.u32("timestamp", 1500000000)
+	b.begin("images")
+	b.begin("kernel-1")
+	b.str("type", "kernel")
+	b.str("arch", "arm")
+	b.str("compression", "gzip")
+	b.u32("load", 0x80008000)
+	b.prop("data", gz)
+	b.begin("hash-1")
+	b.str("algo", "sha1")
+	b.prop("value", sum[:])
+	b.end()
+	b.end()
+	b.begin("fdt-1")
+	b.str("type", "flat_dt")
+	b.u32("data-offset", 0)
+	b.u32("data-size", uint32(len(dtb)))
+	b.begin("hash-1")
+	b.str("algo", "crc32")
+	b.u32("value", crc32.ChecksumIEEE(dtb))
+	b.end()
+	b.end()
+	b.end()
+	b.begin("configurations")
+	b.str("default", "conf-1")
+	b.end()
+	b.end()
+
+	image := b.bytes()
+	image = append(image, make([]byte, (4-len(image)%4)%4)...)
+	return append(image, dtb...), kernel, dtb
+}
+
+func TestUnFit(t *testing.T) {
+	image, kernel, dtb := fitImageData(false)
+	x, err := runExtractor(image, UnFit)
+	if err != nil {
+		t.Fatalf("FIT extraction failed: %v", err)
+	}
+	if data := x.content(t, "kernel-1"); !bytes.Equal(data, kernel) {
+		t.Errorf("kernel was not decompressed")
+	}
+	if data := x.content(t, "fdt-1"); !bytes.Equal(data, dtb) {
+		t.Errorf("wrong external data %v", data)
+	}
+
+	a := x.input.Analyses["fit"]
+	if a == nil || a.Error != nil {
+		t.Fatalf("FIT analysis is missing or failed: %v", a)
+	}
+	images := a.Result.(map[string]interface{})["images"].(map[string]interface{})
+	for _, name := range []string{"kernel-1", "fdt-1"} {
+		hashes := images[name].(map[string]interface{})["hashes"].(map[string]bool)
+		if len(hashes) != 1 {
+			t.Errorf("%s: wrong hashes %v", name, hashes)
+		}
+		for algo, ok := range hashes {
+			if !ok {
+				t.Errorf("%s: %s hash failed", name, algo)
+			}
+		}
+	}
+
+	// a bad hash is reported, but the image is still extracted
+	image, _, _ = fitImageData(true)
+	x, err = runExtractor(image, UnFit)
+	if err == nil || x.input.Analyses["fit"].Error == nil {
+		t.Errorf("bad hash was not detected")
+	}
+	if len(x.files) != 2 {
+		t.Errorf("extracted %d files", len(x.files))
+	}
+}
@@ -0,0 +1,232 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	gptSignature     = "EFI PART"
+	gptMinHeaderSize = 92
+	gptEntrySize     = 128
+	gptMaxEntries    = 1024
+	gptMaxEntrySize  = 4096
+)
+
+// some well known partition types
+var gptTypes = map[string]string{
+	"c12a7328-f81f-11d2-ba4b-00a0c93ec93b": "efi-system",
+	"21686148-6449-6e6f-744e-656564454649": "bios-boot",
+	"ebd0a0a2-b9e5-4433-87c0-68b6b72699c7": "basic-data",
+	"e3c9e316-0b5c-4db8-817d-f92df00215ae": "microsoft-reserved",
+	"0fc63daf-8483-4772-8e79-3d69d8477de4": "linux",
+	"0657fd6d-a4ab-43c4-84e5-0933c84b4f4f": "linux-swap",
+	"e6d6d379-f507-44c2-a23c-238f2a3df928": "linux-lvm",
+	"a19d880f-05fc-4d3b-a006-743f0f84911e": "linux-raid",
+	"44479540-f297-41b2-9af7-d131d5f0458a": "linux-root-x86",
+	"4f68bce3-e8cd-4db1-96e7-fbcaf984b709": "linux-root-x86-64",
+	"69dad710-2ce4-4e3c-b16c-21a1d49abed3": "linux-root-arm",
+	"b921b045-1df0-41c3-af44-4c6f280d3fae": "linux-root-arm64",
+	"bc13c2ff-59e6-4262-a352-b275fd6f7172": "linux-boot",
+	"48465300-0000-11aa-aa11-00306543ecac": "apple-hfs",
+	"7c3457ef-0000-11aa-aa11-00306543ecac": "apple-apfs",
+	"516e7cb4-6ecf-11d6-8ff8-00022d09712b": "freebsd",
+}
+
+type gptHeader struct {
+	Signature    [8]byte
+	Revision     uint32
+	HeaderSize   uint32
+	HeaderCRC    uint32
+	Reserved     uint32
+	MyLBA        uint64
+	AlternateLBA uint64
+	FirstUsable  uint64
+	LastUsable   uint64
+	DiskGUID     [16]byte
+	EntriesLBA   uint64
+	NumEntries   uint32
+	EntrySize    uint32
+	EntriesCRC   uint32
+}
+
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+// gptGUID formats a GUID, the first three fields are little endian
+func gptGUID(g [16]byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(g[0:]), binary.LittleEndian.Uint16(g[4:]),
+		binary.LittleEndian.Uint16(g[6:]), g[8:10], g[10:])
+}
+
+func gptName(name [36]uint16) string {
+	n := 0
+	for n < len(name) && name[n] != 0 {
+		n++
+	}
+	return string(utf16.Decode(name[:n]))
+}
+
+// gptReadHeader reads and verifies the header at a sector
+func gptReadHeader(img util.Structured, lba, sectorSize int64) (*gptHeader, error) {
+	raw := make([]byte, gptMinHeaderSize)
+	if err := img.ReadAt(lba*sectorSize, raw); err != nil {
+		return nil, err
+	}
+	var head gptHeader
+	binary.Read(bytes.NewReader(raw), binary.LittleEndian, &head)
+	if string(head.Signature[:]) != gptSignature {
+		return nil, fmt.Errorf("gpt: no header at sector %d", lba)
+	}
+	if head.HeaderSize < gptMinHeaderSize || int64(head.HeaderSize) > sectorSize {
+		return nil, fmt.Errorf("gpt: bad header size %d", head.HeaderSize)
+	}
+
+	// the checksum covers the whole header, with the checksum field cleared
+	raw = make([]byte, head.HeaderSize)
+	if err := img.ReadAt(lba*sectorSize, raw); err != nil {
+		return nil, err
+	}
+	copy(raw[16:20], []byte{0, 0, 0, 0})
+	if crc32.ChecksumIEEE(raw) != head.HeaderCRC {
+		return &head, fmt.Errorf("gpt: bad header checksum at sector %d", lba)
+	}
+	return &head, nil
+}
+
+// gptFindHeader finds a valid header, using the backup header if needed
+func gptFindHeader(img util.Structured, size int64) (*gptHeader, int64, error) {
+	var first error
+	for _, sectorSize := range []int64{512, 4096} {
+		head, err := gptReadHeader(img, 1, sectorSize)
+		if err == nil {
+			return head, sectorSize, nil
+		}
+		if head == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		// the backup is at the last sector of the disk
+		for _, lba := range []int64{int64(head.AlternateLBA), size/sectorSize - 1} {
+			if lba > 1 && lba < size/sectorSize {
+				if backup, err := gptReadHeader(img, lba, sectorSize); err == nil {
+					return backup, sectorSize, first
+				}
+			}
+		}
+	}
+	if first == nil {
+		first = fmt.Errorf("gpt: no GPT header found")
+	}
+	return nil, 0, first
+}
+
+// gptEntries reads and verifies the partition entries, which must be
+// inside a disk of the given size
+func gptEntries(img util.Structured, head *gptHeader, sectorSize, size int64) ([]gptEntry, error) {
+	if head.EntrySize < gptEntrySize || head.EntrySize > gptMaxEntrySize || head.EntrySize%8 != 0 ||
+		head.NumEntries > gptMaxEntries {
+		return nil, fmt.Errorf("gpt: bad partition entries")
+	}
+	length := int64(head.NumEntries) * int64(head.EntrySize)
+	if head.EntriesLBA >= uint64(size/sectorSize) || int64(head.EntriesLBA)*sectorSize+length > size {
+		return nil, fmt.Errorf("gpt: partition entries are outside the disk")
+	}
+	raw := make([]byte, length)
+	if err := img.ReadAt(int64(head.EntriesLBA)*sectorSize, raw); err != nil {
+		return nil, err
+	}
+	var err error
+	if crc32.ChecksumIEEE(raw) != head.EntriesCRC {
+		err = fmt.Errorf("gpt: bad partition entries checksum")
+	}
+	entries := make([]gptEntry, head.NumEntries)
+	for i := range entries {
+		r := bytes.NewReader(raw[i*int(head.EntrySize):])
+		binary.Read(r, binary.LittleEndian, &entries[i])
+	}
+	return entries, err
+}
+
+// Gpt extracts the partitions of a GUID partition table. Partitions are
+// named after their number, name and type and the table is recorded as an
+// analysis of the input, including the outcome of the checksum checks
+func Gpt(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.LittleEndian}
+	filesize := int64(e.GetSize())
+	head, sectorSize, err := gptFindHeader(img, filesize)
+	if head == nil {
+		return "", err
+	}
+	entries, eerr := gptEntries(img, head, sectorSize, filesize)
+	if err == nil {
+		err = eerr
+	}
+
+	var partitions []map[string]interface{}
+	for i, entry := range entries {
+		if entry.TypeGUID != [16]byte{} {
+			partitions = append(partitions, map[string]interface{}{
+				"number":     i + 1,
+				"name":       gptName(entry.Name),
+				"type":       gptGUID(entry.TypeGUID),
+				"guid":       gptGUID(entry.UniqueGUID),
+				"first":      entry.FirstLBA,
+				"last":       entry.LastLBA,
+				"attributes": entry.Attributes,
+			})
+		}
+	}
+	report := map[string]interface{}{
+		"disk-guid":   gptGUID(head.DiskGUID),
+		"sector-size": sectorSize,
+		"partitions":  partitions,
+	}
+	e.Current.RegisterAnalysis("gpt", report, err)
+
+	sectors := uint64(filesize / sectorSize)
+	for i, entry := range entries {
+		if entry.TypeGUID == [16]byte{} || entry.LastLBA < entry.FirstLBA || entry.FirstLBA >= sectors {
+			continue
+		}
+		last := entry.LastLBA
+		if last >= sectors {
+			last = sectors - 1
+		}
+		start, end := int64(entry.FirstLBA)*sectorSize, int64(last+1)*sectorSize
+
+		typ, name := gptGUID(entry.TypeGUID), gptName(entry.Name)
+		filename := fmt.Sprintf("%s%d_%s_%s", prefix, i+1, name, typ)
+		if known, found := gptTypes[typ]; found {
+			filename = fmt.Sprintf("%s%d_%s_%s", prefix, i+1, name, known)
+		}
+		w, fd, cerr := e.Create(filename)
+		if cerr != nil {
+			return "", cerr
+		}
+		fd.SetMetadata("partition-name", name)
+		fd.SetMetadata("partition-type", typ)
+		_, cerr = io.Copy(w, util.NewSectionReader(e.Reader, start, end-start))
+		w.Close()
+		if cerr != nil {
+			return "", cerr
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,126 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/util"
+)
+
+type gptPartition struct {
+	typ, name   string
+	first, last int64
+}
+
+// gptGUIDBytes is the inverse of gptGUID
+func gptGUIDBytes(s string) [16]byte {
+	var g [16]byte
+	var a uint32
+	var b, c uint16
+	var rest [8]byte
+	fmt.Sscanf(s, "%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x", &a, &b, &c,
+		&rest[0], &rest[1], &rest[2], &rest[3], &rest[4], &rest[5], &rest[6], &rest[7])
+	binary.LittleEndian.PutUint32(g[0:], a)
+	binary.LittleEndian.PutUint16(g[4:], b)
+	binary.LittleEndian.PutUint16(g[6:], c)
+	copy(g[8:], rest[:])
+	return g
+}
+
+// gptDisk creates a disk with a protective MBR, a GPT and its backup header
+func gptDisk(partitions []gptPartition) disk {
+	const sectors = 128
+	d := make(disk, sectors*512)
+	d.mbrEntry(0, 0, mbrTypeGpt, 1, sectors-1)
+
+	entries := make([]gptEntry, 128)
+	for i, p := range partitions {
+		entries[i].TypeGUID = gptGUIDBytes(p.typ)
+		entries[i].UniqueGUID[0] = byte(i + 1)
+		entries[i].FirstLBA, entries[i].LastLBA = uint64(p.first), uint64(p.last)
+		copy(entries[i].Name[:], utf16.Encode([]rune(p.name)))
+		d.fill(p.first, p.last, byte('a'+i))
+	}
+	d.put(2, entries)
+
+	for _, lba := range []int64{1, sectors - 1} {
+		head := gptHeader{
+			Revision: 0x10000, HeaderSize: gptMinHeaderSize,
+			MyLBA: uint64(lba), AlternateLBA: uint64(sectors - lba),
+			FirstUsable: 34, LastUsable: sectors - 34, EntriesLBA: 2,
+			NumEntries: 128, EntrySize: gptEntrySize,
+			EntriesCRC: crc32.ChecksumIEEE(d.sectors(2, 33)),
+		}
+		copy(head.Signature[:], gptSignature)
+		d.put(lba, head)
+		head.HeaderCRC = crc32.ChecksumIEEE(d[lba*512 : lba*512+gptMinHeaderSize])
+		d.put(lba, head)
+	}
+	return d
+}
+
+func TestGpt(t *testing.T) {
+	const other = "11223344-5566-7788-99aa-bbccddeeff00"
+	partitions := []gptPartition{
+		{"0fc63daf-8483-4772-8e79-3d69d8477de4", "boot", 40, 49},
+		{other, "system", 50, 69},
+	}
+	d := gptDisk(partitions)
+	x, err := runExtractor(d, Gpt)
+	if err != nil {
+		t.Fatalf("GPT extraction failed: %v", err)
+	}
+
+	var testdata = []struct {
+		name string
+		p    gptPartition
+	}{
+		{"1_boot_linux", partitions[0]},
+		{"2_system_" + other, partitions[1]},
+	}
+	for _, test := range testdata {
+		if data := x.content(t, test.name); !bytes.Equal(data, d.sectors(test.p.first, test.p.last)) {
+			t.Errorf("%s: wrong content", test.name)
+		}
+		if v := x.metadata(t, test.name, "partition-name"); v != test.p.name {
+			t.Errorf("%s: wrong partition name %v", test.name, v)
+		}
+		if v := x.metadata(t, test.name, "partition-type"); v != test.p.typ {
+			t.Errorf("%s: wrong partition type %v", test.name, v)
+		}
+	}
+	if a := x.input.Analyses["gpt"]; a == nil || a.Error != nil {
+		t.Errorf("GPT analysis is missing or failed: %v", a)
+	}
+
+	// with a damaged primary header the backup is used, but it is reported
+	damaged := append(disk{}, d...)
+	damaged[512+40] ^= 1
+	x, err = runExtractor(damaged, Gpt)
+	if err == nil || len(x.files) != 2 {
+		t.Errorf("damaged header: got %v and %d files", err, len(x.files))
+	}
+
+	// damaged entries are reported too
+	damaged = append(disk{}, d...)
+	damaged[2*512+200] ^= 1
+	if _, err := runExtractor(damaged, Gpt); err == nil {
+		t.Errorf("damaged entries were not detected")
+	}
+
+	// entries that are huge or outside the disk are rejected before reading
+	img := util.Structured{Reader: bytes.NewReader(d), Order: binary.LittleEndian}
+	for _, head := range []gptHeader{
+		{EntriesLBA: 2, NumEntries: 1024, EntrySize: 0x80000000},
+		{EntriesLBA: 2, NumEntries: 1024, EntrySize: 4096},
+		{EntriesLBA: 1 << 60, NumEntries: 128, EntrySize: gptEntrySize},
+	} {
+		if _, err := gptEntries(img, &head, 512, int64(len(d))); err == nil {
+			t.Errorf("entries %d x %d at %d were accepted", head.NumEntries, head.EntrySize, head.EntriesLBA)
+		}
+	}
+}
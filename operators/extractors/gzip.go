@@ -4,6 +4,7 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/avahidi/molly/types"
 	"github.com/avahidi/molly/util"
@@ -17,16 +18,7 @@ func Ungzip(e *types.Env, prefix string) (string, error) {
 		return "", err
 	}
 
-	// figure out what extension to use and then compute the name
-	exts := util.Extensions(e.GetFile())
-	var name string
-	if len(exts) > 0 && exts[0] != "gz" && exts[0] != "GZ" {
-		name = fmt.Sprintf("%s.%s", prefix, exts[0])
-	} else if len(exts) > 1 {
-		name = fmt.Sprintf("%s.%s", prefix, exts[1])
-	} else {
-		name = prefix
-	}
+	name := decompressedName(e.GetFile(), prefix, "gz")
 
 	// open output file and unpack gzip to it
 	w, d, err := e.Create(name)
@@ -36,6 +28,25 @@ func Ungzip(e *types.Env, prefix string) (string, error) {
 	defer w.Close()
 
 	d.SetTime(gr.ModTime)
-	io.Copy(w, gr)
+	// trailing data after the last member is common in carved files and not an error
+	if _, err := io.Copy(w, gr); err != nil && err != gzip.ErrHeader {
+		return "", err
+	}
 	return w.Name(), nil
 }
+
+// decompressedName computes the name of a decompressed file. The extension
+// of the compressed file is dropped, so that a.tar.gz becomes prefix.tar
+func decompressedName(filename, prefix string, compressed ...string) string {
+	exts := util.Extensions(filename)
+	for _, c := range compressed {
+		if len(exts) > 0 && strings.EqualFold(exts[0], c) {
+			exts = exts[1:]
+			break
+		}
+	}
+	if len(exts) > 0 {
+		return fmt.Sprintf("%s.%s", prefix, exts[0])
+	}
+	return prefix
+}
@@ -0,0 +1,260 @@
+package extractors
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/avahidi/molly/types"
+)
+
+const (
+	hexMaxSize = 64 << 20
+	hexMaxLine = 1024
+)
+
+// hexChunk is the data of one record, err is set if its checksum is bad
+type hexChunk struct {
+	addr uint64
+	data []byte
+	err  error
+}
+
+// hexImage collects the records of a text firmware file
+type hexImage struct {
+	chunks []hexChunk
+	size   int
+}
+
+func (h *hexImage) add(addr uint64, data []byte, err error) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if h.size += len(data); h.size > hexMaxSize {
+		return fmt.Errorf("hex: data is larger than %d bytes", hexMaxSize)
+	}
+	h.chunks = append(h.chunks, hexChunk{addr, data, err})
+	return nil
+}
+
+// write creates one file for each contiguous address region, the file is
+// named after its address and records with bad checksums are registered
+// as errors on it. Later records overwrite earlier ones at the same address
+func (h *hexImage) write(e *types.Env, prefix, format string, report map[string]interface{}) error {
+	sort.SliceStable(h.chunks, func(i, j int) bool { return h.chunks[i].addr < h.chunks[j].addr })
+
+	var regions []map[string]interface{}
+	for i := 0; i < len(h.chunks); {
+		start := h.chunks[i].addr
+		var data []byte
+		var errs []error
+		for ; i < len(h.chunks) && h.chunks[i].addr <= start+uint64(len(data)); i++ {
+			c := h.chunks[i]
+			offset := int(c.addr - start)
+			if end := offset + len(c.data); end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+			copy(data[offset:], c.data)
+			if c.err != nil {
+				errs = append(errs, c.err)
+			}
+		}
+
+		w, fd, err := e.Create(fmt.Sprintf("%s%08x.bin", prefix, start))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		w.Close()
+		if err != nil {
+			return err
+		}
+		for _, err := range errs {
+			fd.RegisterError(err)
+		}
+		regions = append(regions, map[string]interface{}{
+			"address": start,
+			"size":    len(data),
+			"errors":  len(errs),
+		})
+	}
+	report["regions"] = regions
+
+	e.Current.RegisterAnalysis(e.AnalysisName(format), report, nil)
+	return nil
+}
+
+// hexLines calls fn for each line that is not empty, with its line number
+func hexLines(e *types.Env, fn func(n int, line string) (bool, error)) error {
+	if _, err := e.Reader.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	s := bufio.NewScanner(io.LimitReader(e.Reader, 3*hexMaxSize))
+	s.Buffer(make([]byte, hexMaxLine), hexMaxLine)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if done, err := fn(n, line); done || err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// hexRecord decodes the hex digits of a record and verifies its length
+func hexRecord(n int, digits string, min int) ([]byte, error) {
+	data, err := hex.DecodeString(digits)
+	if err != nil || len(data) < min {
+		return nil, fmt.Errorf("hex: bad record on line %d", n)
+	}
+	return data, nil
+}
+
+// Unihex decodes an Intel HEX file into one file per address region
+func Unihex(e *types.Env, prefix string) (string, error) {
+	var img hexImage
+	var base uint64
+	report := map[string]interface{}{}
+	err := hexLines(e, func(n int, line string) (bool, error) {
+		if line[0] != ':' {
+			return false, fmt.Errorf("ihex: line %d is not a record", n)
+		}
+		rec, err := hexRecord(n, line[1:], 5)
+		if err != nil {
+			return false, err
+		}
+		if int(rec[0])+5 != len(rec) {
+			return false, fmt.Errorf("ihex: bad record length on line %d", n)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			err = fmt.Errorf("ihex: bad checksum on line %d", n)
+		}
+
+		addr, typ, data := uint64(rec[1])<<8|uint64(rec[2]), rec[3], rec[4:len(rec)-1]
+		switch {
+		case typ == 0x00:
+			return false, img.add(base+addr, data, err)
+		case typ == 0x01:
+			return true, nil
+		case typ == 0x02 && len(data) == 2:
+			base = (uint64(data[0])<<8 | uint64(data[1])) << 4
+		case typ == 0x04 && len(data) == 2:
+			base = (uint64(data[0])<<8 | uint64(data[1])) << 16
+		case typ == 0x03 && len(data) == 4:
+			report["start-segment"] = fmt.Sprintf("%04x:%04x", uint16(data[0])<<8|uint16(data[1]),
+				uint16(data[2])<<8|uint16(data[3]))
+		case typ == 0x05 && len(data) == 4:
+			report["entry"] = uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+		default:
+			return false, fmt.Errorf("ihex: bad record type %02x on line %d", typ, n)
+		}
+		if err != nil {
+			e.Current.RegisterError(err)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "", img.write(e, prefix, "ihex", report)
+}
+
+// srecAddressSize is the size of the address of each record type
+var srecAddressSize = map[byte]int{'0': 2, '1': 2, '2': 3, '3': 4, '5': 2, '6': 3, '7': 4, '8': 3, '9': 2}
+
+// Unsrec decodes a Motorola S-record file into one file per address region
+func Unsrec(e *types.Env, prefix string) (string, error) {
+	var img hexImage
+	report := map[string]interface{}{}
+	err := hexLines(e, func(n int, line string) (bool, error) {
+		if len(line) < 2 || line[0] != 'S' || line[1] < '0' || line[1] > '9' || line[1] == '4' {
+			return false, fmt.Errorf("srec: line %d is not a record", n)
+		}
+		rec, err := hexRecord(n, line[2:], 2)
+		if err != nil {
+			return false, err
+		}
+		if int(rec[0])+1 != len(rec) {
+			return false, fmt.Errorf("srec: bad record length on line %d", n)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0xFF {
+			err = fmt.Errorf("srec: bad checksum on line %d", n)
+		}
+
+		typ := line[1]
+		size := srecAddressSize[typ]
+		if len(rec) < size+2 {
+			return false, fmt.Errorf("srec: bad record length on line %d", n)
+		}
+		var addr uint64
+		for _, b := range rec[1 : 1+size] {
+			addr = addr<<8 | uint64(b)
+		}
+		data := rec[1+size : len(rec)-1]
+		switch typ {
+		case '1', '2', '3':
+			return false, img.add(addr, data, err)
+		case '0':
+			report["header"] = strings.TrimRight(string(data), "\x00")
+		case '7', '8', '9':
+			report["entry"] = addr
+		}
+		if err != nil {
+			e.Current.RegisterError(err)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "", img.write(e, prefix, "srec", report)
+}
+
+// Untitxt decodes a TI-TXT file into one file per address region, the
+// format has no checksums
+func Untitxt(e *types.Env, prefix string) (string, error) {
+	var img hexImage
+	var addr uint64
+	started := false
+	err := hexLines(e, func(n int, line string) (bool, error) {
+		switch {
+		case line[0] == '@':
+			a, err := strconv.ParseUint(line[1:], 16, 32)
+			if err != nil {
+				return false, fmt.Errorf("titxt: bad address on line %d", n)
+			}
+			addr, started = a, true
+			return false, nil
+		case line[0] == 'q' || line[0] == 'Q':
+			return true, nil
+		case !started:
+			return false, fmt.Errorf("titxt: data before the first address on line %d", n)
+		}
+		data, err := hexRecord(n, strings.Join(strings.Fields(line), ""), 1)
+		if err != nil {
+			return false, err
+		}
+		start := addr
+		addr += uint64(len(data))
+		return false, img.add(start, data, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	return "", img.write(e, prefix, "titxt", map[string]interface{}{})
+}
@@ -0,0 +1,107 @@
+package extractors
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// ihexRecord creates an Intel HEX record, the checksum is off by bad
+func ihexRecord(typ byte, addr uint16, data []byte, bad byte) string {
+	rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+	var sum byte
+	for _, b := range rec {
+		sum += b
+	}
+	return fmt.Sprintf(":%X%02X\n", rec, -sum+bad)
+}
+
+// srecRecord creates an S-record with an address of size bytes
+func srecRecord(typ byte, size int, addr uint32, data []byte, bad byte) string {
+	rec := []byte{byte(size + len(data) + 1)}
+	for i := size - 1; i >= 0; i-- {
+		rec = append(rec, byte(addr>>(8*i)))
+	}
+	rec = append(rec, data...)
+	var sum byte
+	for _, b := range rec {
+		sum += b
+	}
+	return fmt.Sprintf("S%c%X%02X\r\n", typ, rec, ^sum+bad)
+}
+
+func TestUnihex(t *testing.T) {
+	text := ihexRecord(0x04, 0, []byte{0x08, 0x00}, 0) +
+		ihexRecord(0x00, 0x0000, []byte("first "), 0) +
+		ihexRecord(0x00, 0x0006, []byte("region"), 1) +
+		ihexRecord(0x00, 0x1000, []byte("second"), 0) +
+		ihexRecord(0x05, 0, []byte{0x08, 0x00, 0x01, 0x01}, 0) +
+		ihexRecord(0x01, 0, nil, 0)
+	x, err := runExtractor([]byte(text), Unihex)
+	if err != nil {
+		t.Fatalf("ihex extraction failed: %v", err)
+	}
+	if data := x.content(t, "08000000.bin"); string(data) != "first region" {
+		t.Errorf("wrong first region %q", data)
+	}
+	if data := x.content(t, "08001000.bin"); string(data) != "second" {
+		t.Errorf("wrong second region %q", data)
+	}
+	if errs := x.files["08000000.bin"].Errors; len(errs) != 1 || !strings.Contains(errs[0].Error(), "line 3") {
+		t.Errorf("wrong checksum errors %v", errs)
+	}
+	if errs := x.files["08001000.bin"].Errors; len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	report := x.input.Analyses["ihex"].Result.(map[string]interface{})
+	if report["entry"] != uint32(0x08000101) || len(report["regions"].([]map[string]interface{})) != 2 {
+		t.Errorf("wrong ihex analysis %v", report)
+	}
+
+	if _, err := runExtractor([]byte(":0000000"), Unihex); err == nil {
+		t.Errorf("short record was accepted")
+	}
+}
+
+func TestUnsrec(t *testing.T) {
+	text := srecRecord('0', 2, 0, []byte("HDR"), 0) +
+		srecRecord('3', 4, 0x20000000, []byte("data in "), 0) +
+		srecRecord('3', 4, 0x20000008, []byte("s3"), 0) +
+		srecRecord('1', 2, 0x0100, []byte("low"), 3) +
+		srecRecord('7', 4, 0x20000000, nil, 0)
+	x, err := runExtractor([]byte(text), Unsrec)
+	if err != nil {
+		t.Fatalf("srec extraction failed: %v", err)
+	}
+	if data := x.content(t, "20000000.bin"); string(data) != "data in s3" {
+		t.Errorf("wrong region %q", data)
+	}
+	if data := x.content(t, "00000100.bin"); string(data) != "low" {
+		t.Errorf("wrong region %q", data)
+	}
+	if errs := x.files["00000100.bin"].Errors; len(errs) != 1 {
+		t.Errorf("wrong checksum errors %v", errs)
+	}
+	report := x.input.Analyses["srec"].Result.(map[string]interface{})
+	if report["header"] != "HDR" || report["entry"] != uint64(0x20000000) {
+		t.Errorf("wrong srec analysis %v", report)
+	}
+}
+
+func TestUntitxt(t *testing.T) {
+	text := "@F000\n31 40 00 24\nB0 13\n@FFFE\n00 F0\nq\n"
+	x, err := runExtractor([]byte(text), Untitxt)
+	if err != nil {
+		t.Fatalf("titxt extraction failed: %v", err)
+	}
+	if data := x.content(t, "0000f000.bin"); string(data) != "\x31\x40\x00\x24\xb0\x13" {
+		t.Errorf("wrong region %q", data)
+	}
+	if data := x.content(t, "0000fffe.bin"); string(data) != "\x00\xf0" {
+		t.Errorf("wrong region %q", data)
+	}
+
+	if _, err := runExtractor([]byte("31 40\n@F000\n"), Untitxt); err == nil {
+		t.Errorf("data without address was accepted")
+	}
+}
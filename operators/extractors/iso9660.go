@@ -0,0 +1,685 @@
+package extractors
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	isoSectorSize     = 2048
+	isoFirstVD        = 16
+	isoMaxVD          = 64
+	isoRecordSize     = 33
+	isoMaxDirSize     = 1 << 24
+	isoMaxContinues   = 16
+	isoFlagDir        = 0x02
+	isoFlagMultiple   = 0x80
+	isoBootRecord     = 0
+	isoPrimary        = 1
+	isoSupplementary  = 2
+	isoTerminator     = 255
+	isoElToritoID     = "EL TORITO SPECIFICATION"
+	isoCatalogEntries = isoSectorSize / 32
+)
+
+// isoRecord is a directory record, files larger than 4G are split into
+// several records with the same name
+type isoRecord struct {
+	extents []uint32
+	sizes   []uint32
+	flags   byte
+	name    string
+	time    time.Time
+	su      []byte
+}
+
+// isoRockRidge holds the Rock Ridge extensions of a directory record
+type isoRockRidge struct {
+	name      string
+	hasName   bool
+	mode      uint32
+	hasMode   bool
+	uid, gid  uint32
+	link      string
+	hasLink   bool
+	linkCont  bool
+	dev       [2]uint32
+	hasDev    bool
+	mtime     time.Time
+	relocated bool
+	child     uint32
+	hasChild  bool
+}
+
+type isoContext struct {
+	util.Structured
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Link     func(string, string, bool) (*types.FileData, error)
+	Node     func(string, string) (*types.FileData, error)
+	Mkdir    func(string) (*types.FileData, error)
+	Canceled func() error
+
+	blockSize int64
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+	dirs      map[uint32]bool
+
+	// sizes has the size of files by their first block, for boot images
+	sizes map[uint32]int64
+}
+
+// isoTime7 converts the time of a directory record
+func isoTime7(b []byte) time.Time {
+	if len(b) < 7 || b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone).UTC()
+}
+
+// isoTime17 converts the time of a volume descriptor
+func isoTime17(b []byte) time.Time {
+	if len(b) < 17 {
+		return time.Time{}
+	}
+	digits := func(pos, n int) int {
+		v, _ := strconv.Atoi(string(b[pos : pos+n]))
+		return v
+	}
+	if digits(4, 2) == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[16]))*15*60)
+	return time.Date(digits(0, 4), time.Month(digits(4, 2)), digits(6, 2), digits(8, 2),
+		digits(10, 2), digits(12, 2), digits(14, 2)*10*1000*1000, zone).UTC()
+}
+
+// isoString returns a padded string of a volume descriptor
+func isoString(b []byte, joliet bool) string {
+	if joliet {
+		return strings.TrimRight(isoUCS2(b), " \x00")
+	}
+	return strings.TrimRight(string(b), " \x00")
+}
+
+// isoUCS2 decodes a Joliet name
+func isoUCS2(b []byte) string {
+	chars := make([]uint16, len(b)/2)
+	for i := range chars {
+		chars[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(chars))
+}
+
+// record parses a directory record
+func (c *isoContext) record(b []byte) (*isoRecord, error) {
+	if len(b) < isoRecordSize || int(b[0]) > len(b) || int(b[0]) < isoRecordSize+int(b[32]) {
+		return nil, fmt.Errorf("iso9660: bad directory record")
+	}
+	b = b[:b[0]]
+	r := &isoRecord{
+		extents: []uint32{binary.LittleEndian.Uint32(b[2:]) + uint32(b[1])},
+		sizes:   []uint32{binary.LittleEndian.Uint32(b[10:])},
+		flags:   b[25],
+		time:    isoTime7(b[18:25]),
+	}
+	name := b[isoRecordSize : isoRecordSize+int(b[32])]
+	switch {
+	case len(name) == 1 && name[0] == 0:
+		r.name = "."
+	case len(name) == 1 && name[0] == 1:
+		r.name = ".."
+	case c.joliet:
+		r.name = isoUCS2(name)
+	default:
+		r.name = string(name)
+	}
+	// the version is not part of the name, nor is the dot of a name
+	// without an extension
+	if r.name != "." && r.name != ".." {
+		if i := strings.LastIndex(r.name, ";"); i > 0 {
+			r.name = r.name[:i]
+		}
+		if len(r.name) > 1 && r.flags&isoFlagDir == 0 {
+			r.name = strings.TrimSuffix(r.name, ".")
+		}
+	}
+	su := isoRecordSize + len(name)
+	if su%2 != 0 {
+		su++
+	}
+	if su < len(b) {
+		r.su = b[su:]
+	}
+	return r, nil
+}
+
+// susp parses the system use entries of a record, the Rock Ridge entries
+// can continue in another block
+func (c *isoContext) susp(su []byte, rr *isoRockRidge, depth int) error {
+	if depth > isoMaxContinues {
+		return fmt.Errorf("iso9660: too many continuation areas")
+	}
+	for pos := 0; pos+4 <= len(su); {
+		sig, size := string(su[pos:pos+2]), int(su[pos+2])
+		if size < 4 || pos+size > len(su) {
+			break
+		}
+		data := su[pos : pos+size]
+		pos += size
+
+		switch sig {
+		case "ST":
+			return nil
+		case "CE":
+			if size < 28 {
+				continue
+			}
+			block := binary.LittleEndian.Uint32(data[4:])
+			offset := binary.LittleEndian.Uint32(data[12:])
+			length := binary.LittleEndian.Uint32(data[20:])
+			if length > isoSectorSize {
+				return fmt.Errorf("iso9660: bad continuation area")
+			}
+			area := make([]byte, length)
+			if err := c.ReadAt(int64(block)*c.blockSize+int64(offset), area); err != nil {
+				return err
+			}
+			if err := c.susp(area, rr, depth+1); err != nil {
+				return err
+			}
+		case "NM":
+			if size < 5 || data[4]&0x06 != 0 {
+				continue
+			}
+			rr.name += string(data[5:])
+			rr.hasName = true
+		case "PX":
+			if size < 36 {
+				continue
+			}
+			rr.mode = binary.LittleEndian.Uint32(data[4:])
+			rr.uid = binary.LittleEndian.Uint32(data[20:])
+			rr.gid = binary.LittleEndian.Uint32(data[28:])
+			rr.hasMode = true
+		case "PN":
+			if size < 20 {
+				continue
+			}
+			rr.dev = [2]uint32{binary.LittleEndian.Uint32(data[4:]), binary.LittleEndian.Uint32(data[12:])}
+			rr.hasDev = true
+		case "SL":
+			if size < 5 {
+				continue
+			}
+			rr.hasLink = true
+			for comps := data[5:]; len(comps) >= 2 && 2+int(comps[1]) <= len(comps); {
+				flags, content := comps[0], comps[2:2+int(comps[1])]
+				comps = comps[2+len(content):]
+				part := string(content)
+				switch {
+				case flags&0x02 != 0:
+					part = "."
+				case flags&0x04 != 0:
+					part = ".."
+				case flags&0x08 != 0:
+					part = "/"
+				}
+				if rr.link != "" && !rr.linkCont && !strings.HasSuffix(rr.link, "/") {
+					rr.link += "/"
+				}
+				rr.link += part
+				rr.linkCont = flags&0x01 != 0
+			}
+		case "TF":
+			if size < 5 {
+				continue
+			}
+			flags, stamp := data[4], 7
+			if flags&0x80 != 0 {
+				stamp = 17
+			}
+			start := 5
+			if flags&0x01 != 0 {
+				start += stamp
+			}
+			if flags&0x02 != 0 && start+stamp <= size {
+				if stamp == 7 {
+					rr.mtime = isoTime7(data[start:])
+				} else {
+					rr.mtime = isoTime17(data[start:])
+				}
+			}
+		case "CL":
+			if size >= 12 {
+				rr.child = binary.LittleEndian.Uint32(data[4:])
+				rr.hasChild = true
+			}
+		case "RE":
+			rr.relocated = true
+		}
+	}
+	return nil
+}
+
+// extensions returns the Rock Ridge extensions of a record if there are any
+func (c *isoContext) extensions(r *isoRecord) (*isoRockRidge, error) {
+	if !c.rockRidge || len(r.su) <= c.suspSkip {
+		return nil, nil
+	}
+	rr := &isoRockRidge{}
+	if err := c.susp(r.su[c.suspSkip:], rr, 0); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+// readDir returns the records of a directory, multi-extent files are merged
+func (c *isoContext) readDir(extent, size uint32) ([]*isoRecord, error) {
+	if size > isoMaxDirSize {
+		return nil, fmt.Errorf("iso9660: directory is too large")
+	}
+	data := make([]byte, size)
+	if err := c.ReadAt(int64(extent)*c.blockSize, data); err != nil {
+		return nil, err
+	}
+	var records []*isoRecord
+	var pending *isoRecord
+	for pos := 0; pos < len(data); {
+		// records do not cross sector boundaries
+		if data[pos] == 0 {
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		r, err := c.record(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		pos += int(data[pos])
+		if pending != nil && pending.name == r.name {
+			pending.extents = append(pending.extents, r.extents...)
+			pending.sizes = append(pending.sizes, r.sizes...)
+			pending.flags = r.flags
+		} else {
+			pending = r
+			records = append(records, r)
+		}
+		if r.flags&isoFlagMultiple == 0 {
+			pending = nil
+		}
+	}
+	return records, nil
+}
+
+// setInfo records file information as metadata
+func (c *isoContext) setInfo(fd *types.FileData, r *isoRecord, rr *isoRockRidge) {
+	fd.SetTime(r.time)
+	if rr == nil {
+		return
+	}
+	if !rr.mtime.IsZero() {
+		fd.SetTime(rr.mtime)
+	}
+	if rr.hasMode {
+		fd.SetMetadata("mode", int64(rr.mode&07777))
+		fd.SetMetadata("uid", int64(rr.uid))
+		fd.SetMetadata("gid", int64(rr.gid))
+	}
+}
+
+func (c *isoContext) dir(extent, size uint32, name string) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
+	// directories are never linked, seeing one twice means the image is broken
+	if c.dirs[extent] {
+		return fmt.Errorf("iso9660: directory loop at %s", name)
+	}
+	c.dirs[extent] = true
+
+	records, err := c.readDir(extent, size)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.name == "." || r.name == ".." {
+			continue
+		}
+		rr, err := c.extensions(r)
+		if err != nil {
+			return err
+		}
+		if rr != nil && rr.relocated {
+			continue
+		}
+		fname := r.name
+		if rr != nil && rr.hasName {
+			fname = rr.name
+		}
+		if fname == "" || fname == "." || fname == ".." || strings.Contains(fname, "/") {
+			return fmt.Errorf("iso9660: bad name in %s", name)
+		}
+		if err := c.file(r, rr, path.Join(name, fname)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *isoContext) file(r *isoRecord, rr *isoRockRidge, name string) error {
+	// relocated directories are found through the child link
+	if rr != nil && rr.hasChild {
+		records, err := c.readDir(rr.child, isoSectorSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 || records[0].name != "." {
+			return fmt.Errorf("iso9660: bad relocated directory %s", name)
+		}
+		r = &isoRecord{extents: records[0].extents, sizes: records[0].sizes,
+			flags: isoFlagDir, time: r.time}
+	}
+
+	if r.flags&isoFlagDir != 0 {
+		fd, err := c.Mkdir(name)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, r, rr)
+		return c.dir(r.extents[0], r.sizes[0], name)
+	}
+
+	if rr != nil && rr.hasLink {
+		fd, err := c.Link(name, rr.link, false)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, r, rr)
+		return nil
+	}
+	if rr != nil && rr.hasMode && rr.mode&0xF000 != 0x8000 {
+		var typ string
+		switch rr.mode & 0xF000 {
+		case 0x6000:
+			typ = "blockdev"
+		case 0x2000:
+			typ = "chardev"
+		case 0x1000:
+			typ = "fifo"
+		case 0xC000:
+			typ = "socket"
+		default:
+			return fmt.Errorf("iso9660: unknown file type %o for %s", rr.mode, name)
+		}
+		fd, err := c.Node(name, typ)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, r, rr)
+		if rr.hasDev {
+			major, minor := rr.dev[0], rr.dev[1]
+			if major == 0 {
+				major, minor = (minor>>8)&0xFFF, minor&0xFF|(minor>>12)&0xFFF00
+			}
+			fd.SetMetadata("major", int64(major))
+			fd.SetMetadata("minor", int64(minor))
+		}
+		return nil
+	}
+
+	w, fd, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	c.setInfo(fd, r, rr)
+	var total int64
+	for i, extent := range r.extents {
+		size := int64(r.sizes[i])
+		total += size
+		n, err := io.Copy(w, util.NewSectionReader(c.Reader, int64(extent)*c.blockSize, size))
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("iso9660: %s is outside the image", name)
+		}
+	}
+	c.sizes[r.extents[0]] = total
+	return nil
+}
+
+// isoPlatforms names the platforms of El Torito boot entries
+var isoPlatforms = map[byte]string{0: "x86", 1: "ppc", 2: "mac", 0xEF: "efi"}
+
+// isoMedia names the emulated media of El Torito boot entries
+var isoMedia = []string{"no-emulation", "floppy-1.2M", "floppy-1.44M", "floppy-2.88M", "hard-disk"}
+
+// bootSize figures out the size of a boot image, the catalog only has the
+// number of sectors loaded by the BIOS. Boot images are usually also files,
+// otherwise the size of hard disks is taken from their partition table and
+// EFI images are FAT file systems
+func (c *isoContext) bootSize(media byte, rba uint32, count uint16) int64 {
+	if size, found := c.sizes[rba]; found && size > int64(count)*512 {
+		return size
+	}
+	switch media {
+	case 1:
+		return 1200 * 1024
+	case 2:
+		return 1440 * 1024
+	case 3:
+		return 2880 * 1024
+	}
+	var mbr [512]byte
+	if err := c.ReadAt(int64(rba)*c.blockSize, mbr[:]); err != nil || mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return int64(count) * 512
+	}
+	if media == 4 {
+		start := binary.LittleEndian.Uint32(mbr[0x1BE+8:])
+		sectors := binary.LittleEndian.Uint32(mbr[0x1BE+12:])
+		return (int64(start) + int64(sectors)) * 512
+	}
+	if binary.LittleEndian.Uint16(mbr[11:]) == 512 {
+		if sectors := binary.LittleEndian.Uint16(mbr[19:]); sectors != 0 {
+			return int64(sectors) * 512
+		}
+		if sectors := binary.LittleEndian.Uint32(mbr[32:]); sectors != 0 {
+			return int64(sectors) * 512
+		}
+	}
+	return int64(count) * 512
+}
+
+// elTorito extracts the boot images listed in the boot catalog
+func (c *isoContext) elTorito(e *types.Env, catalog uint32) ([]map[string]interface{}, error) {
+	var data [isoSectorSize]byte
+	if err := c.ReadAt(int64(catalog)*c.blockSize, data[:]); err != nil {
+		return nil, err
+	}
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(data[i:])
+	}
+	if data[0] != 1 || data[30] != 0x55 || data[31] != 0xAA || sum != 0 {
+		return nil, fmt.Errorf("iso9660: bad boot catalog")
+	}
+
+	var entries []map[string]interface{}
+	platform := data[1]
+	entry := func(ent []byte) error {
+		media := ent[1] & 0x0F
+		if ent[0] != 0x88 && ent[0] != 0x00 || int(media) >= len(isoMedia) {
+			return fmt.Errorf("iso9660: bad boot catalog entry")
+		}
+		rba := binary.LittleEndian.Uint32(ent[8:])
+		size := c.bootSize(media, rba, binary.LittleEndian.Uint16(ent[6:]))
+		pname, found := isoPlatforms[platform]
+		if !found {
+			pname = fmt.Sprintf("%02x", platform)
+		}
+		info := map[string]interface{}{
+			"platform":     pname,
+			"media":        isoMedia[media],
+			"bootable":     ent[0] == 0x88,
+			"load-segment": binary.LittleEndian.Uint16(ent[2:]),
+			"sector":       rba,
+			"size":         size,
+		}
+		entries = append(entries, info)
+
+		w, fd, err := e.Create(fmt.Sprintf("eltorito_%d_%s.img", len(entries)-1, pname))
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		fd.SetMetadata("platform", pname)
+		fd.SetMetadata("media", isoMedia[media])
+		n, err := io.Copy(w, util.NewSectionReader(c.Reader, int64(rba)*c.blockSize, size))
+		if err == nil && n != size {
+			err = fmt.Errorf("iso9660: boot image is outside the image")
+		}
+		return err
+	}
+	if err := entry(data[32:]); err != nil {
+		return entries, err
+	}
+
+	// section headers are followed by their entries, 0x91 marks the last one
+	for i := 2; i < isoCatalogEntries; i++ {
+		head := data[i*32:]
+		if head[0] != 0x90 && head[0] != 0x91 {
+			break
+		}
+		platform = head[1]
+		count := int(binary.LittleEndian.Uint16(head[2:]))
+		for ; count > 0 && i+1 < isoCatalogEntries; count-- {
+			i++
+			ent := data[i*32:]
+			if err := entry(ent); err != nil {
+				return entries, err
+			}
+			// extension entries follow when bit 5 is set
+			for ent[12]&0x20 != 0 && i+1 < isoCatalogEntries && data[(i+1)*32] == 0x44 {
+				i++
+				ent = data[i*32:]
+			}
+		}
+		if head[0] == 0x91 {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// Uniso9660 extracts an ISO 9660 image. Rock Ridge names are preferred over
+// Joliet names, which are preferred over plain ISO 9660 names.
+//
+// El Torito boot images are extracted next to the file system so that boot
+// loaders are also scanned, the boot entries and the volume are recorded as
+// the analysis "iso9660"
+func Uniso9660(e *types.Env, prefix string) (string, error) {
+	c := &isoContext{
+		Create:   e.Create,
+		Link:     e.Link,
+		Node:     e.Node,
+		Mkdir:    e.Mkdir,
+		Canceled: e.Canceled,
+		dirs:     make(map[uint32]bool),
+		sizes:    make(map[uint32]int64),
+	}
+	c.Reader = e.Reader
+	c.Order = binary.LittleEndian
+
+	var primary, joliet []byte
+	var catalog uint32
+	var hasCatalog bool
+	for n := isoFirstVD; n < isoFirstVD+isoMaxVD; n++ {
+		vd := make([]byte, isoSectorSize)
+		if err := c.ReadAt(int64(n)*isoSectorSize, vd); err != nil {
+			return "", err
+		}
+		if string(vd[1:6]) != "CD001" {
+			return "", fmt.Errorf("iso9660: bad volume descriptor at sector %d", n)
+		}
+		if vd[0] == isoTerminator {
+			break
+		}
+		switch vd[0] {
+		case isoBootRecord:
+			if isoString(vd[7:39], false) == isoElToritoID {
+				catalog, hasCatalog = binary.LittleEndian.Uint32(vd[0x47:]), true
+			}
+		case isoPrimary:
+			if primary == nil {
+				primary = vd
+			}
+		case isoSupplementary:
+			if vd[88] == '%' && vd[89] == '/' && (vd[90] == '@' || vd[90] == 'C' || vd[90] == 'E') {
+				joliet = vd
+			}
+		}
+	}
+	if primary == nil {
+		return "", fmt.Errorf("file is not ISO 9660")
+	}
+	c.blockSize = int64(binary.LittleEndian.Uint16(primary[128:]))
+	if c.blockSize != 512 && c.blockSize != 1024 && c.blockSize != 2048 {
+		return "", fmt.Errorf("iso9660: bad block size %d", c.blockSize)
+	}
+
+	// Rock Ridge is announced in the first record of the root directory
+	vd := primary
+	root, err := c.record(primary[156:])
+	if err != nil {
+		return "", err
+	}
+	records, err := c.readDir(root.extents[0], isoSectorSize)
+	if err != nil {
+		return "", err
+	}
+	if len(records) > 0 && len(records[0].su) >= 7 && string(records[0].su[:2]) == "SP" &&
+		records[0].su[4] == 0xBE && records[0].su[5] == 0xEF {
+		c.rockRidge, c.suspSkip = true, int(records[0].su[6])
+	} else if joliet != nil {
+		vd, c.joliet = joliet, true
+		if root, err = c.record(joliet[156:]); err != nil {
+			return "", err
+		}
+	}
+
+	report := map[string]interface{}{
+		"system":     isoString(vd[8:40], c.joliet),
+		"volume":     isoString(vd[40:72], c.joliet),
+		"publisher":  isoString(vd[318:446], c.joliet),
+		"created":    isoTime17(vd[813:830]),
+		"joliet":     joliet != nil,
+		"rock-ridge": c.rockRidge,
+	}
+	analysis := e.AnalysisName("iso9660")
+	if prefix != "" {
+		fd, err := c.Mkdir(prefix)
+		if err != nil {
+			return "", err
+		}
+		fd.SetTime(root.time)
+	}
+	err = c.dir(root.extents[0], root.sizes[0], prefix)
+
+	var bootErr error
+	if hasCatalog {
+		report["boot"], bootErr = c.elTorito(e, catalog)
+	}
+	e.Current.RegisterAnalysis(analysis, report, bootErr)
+	return prefix, err
+}
@@ -0,0 +1,110 @@
+package extractors
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUniso9660(t *testing.T) {
+	if _, err := exec.LookPath("bsdtar"); err != nil {
+		t.Skip("bsdtar not found, skipping test")
+	}
+	files := map[string][]byte{
+		"hello.txt":                     []byte("hello iso\n"),
+		"Long-File-Name.txt":            []byte("long"),
+		"boot/loader.bin":               bytes.Repeat([]byte("boot loader "), 1000),
+		"dir/sub/big.bin":               bytes.Repeat([]byte("0123456789abcdef"), 10000),
+		"deep/a/b/c/d/e/f/g/h/file.txt": []byte("relocated"),
+	}
+	root := t.TempDir()
+	for name, data := range files {
+		filename := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../hello.txt", filepath.Join(root, "dir/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// deep directories are relocated by Rock Ridge, otherwise they are
+	// left out
+	var testdata = []struct {
+		options string
+		names   map[string]string
+	}{
+		{"boot=boot/loader.bin,boot-type=no-emulation,joliet,rockridge", nil},
+		{"joliet,!rockridge", nil},
+		{"!joliet,!rockridge", map[string]string{
+			"hello.txt": "HELLO.TXT", "Long-File-Name.txt": "LONG_FIL.TXT",
+			"boot/loader.bin": "BOOT/LOADER.BIN", "dir/sub/big.bin": "DIR/SUB/BIG.BIN",
+		}},
+	}
+	for _, test := range testdata {
+		image := filepath.Join(t.TempDir(), "image.iso")
+		rockRidge := strings.Contains(test.options, ",rockridge")
+		args := []string{"--format", "iso9660", "--options", test.options, "-cf", image}
+		if !rockRidge {
+			args = append(args, "--exclude", "deep")
+		}
+		cmd := exec.Command("bsdtar", append(args, ".")...)
+		cmd.Dir = root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Logf("bsdtar %s failed, skipping test: %v %s", test.options, err, out)
+			continue
+		}
+		data, err := os.ReadFile(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := runExtractor(data, Uniso9660)
+		if err != nil {
+			t.Errorf("%s: extraction failed: %v", test.options, err)
+			continue
+		}
+		for name, content := range files {
+			if name[:4] == "deep" && !rockRidge {
+				continue
+			}
+			if n, found := test.names[name]; found {
+				name = n
+			}
+			if got := x.content(t, name); !bytes.Equal(got, content) {
+				t.Errorf("%s: %s has wrong content", test.options, name)
+			}
+		}
+
+		report := x.input.Analyses["iso9660"].Result.(map[string]interface{})
+		if test.names == nil && report["joliet"] != true {
+			t.Errorf("%s: Joliet was not detected", test.options)
+		}
+		if report["rock-ridge"] != rockRidge {
+			t.Errorf("%s: wrong Rock Ridge detection", test.options)
+		}
+		if !rockRidge {
+			continue
+		}
+		if v := x.metadata(t, "dir/link", "link"); v != "../hello.txt" {
+			t.Errorf("%s: symlink has target %v", test.options, v)
+		}
+		// bsdtar makes files read-only
+		if v := x.metadata(t, "hello.txt", "mode"); v != int64(0444) {
+			t.Errorf("%s: hello.txt has mode %v", test.options, v)
+		}
+
+		// the boot image is as large as the file it was made from
+		if got := x.content(t, "eltorito_0_x86.img"); !bytes.Equal(got, files["boot/loader.bin"]) {
+			t.Errorf("%s: boot image has wrong content", test.options)
+		}
+		if boot := report["boot"].([]map[string]interface{}); len(boot) != 1 || boot[0]["media"] != "no-emulation" {
+			t.Errorf("%s: wrong boot entries %v", test.options, boot)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"compress/zlib"
 	"encoding/binary"
 	"fmt"
-	"os"
 	"path"
 	"sort"
 	"time"
@@ -157,8 +156,11 @@ type jdnode struct {
 // jcontext is our internal context holder
 type jcontext struct {
 	util.Structured
-	Create  func(string) (*os.File, *types.FileData, error)
-	nodemap map[uint32]*jdnode
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Link     func(string, string, bool) (*types.FileData, error)
+	Canceled func() error
+	nodemap  map[uint32]*jdnode
+	end      int64 // end of the last node
 }
 
 type jffs2Header struct {
@@ -168,6 +170,7 @@ type jffs2Header struct {
 	Crc    uint32
 }
 
+const jffsHeaderSize = 12 // sizeof(jffs2Header)
 const jffsDirentSize = 40 // sizeof(jffs2Header) + sizeof(jffs2Dirent)
 type jffs2Dirent struct {
 	Pino     uint32
@@ -202,12 +205,18 @@ type jffs2Inode struct {
 func (c *jcontext) scan(prefix string, offset int64) error {
 	var head jffs2Header
 	for {
+		if err := c.Canceled(); err != nil {
+			return err
+		}
 		if err := c.ReadAt(offset, &head); err != nil {
 			return nil // not really an error...
 		}
 		if head.Magic != jffs2Magic {
 			return nil
 		}
+		if head.Length < jffsHeaderSize {
+			return fmt.Errorf("JFFS2 node at offset %08x has invalid length %d", offset, head.Length)
+		}
 
 		if (head.Type & jffs2NodeAccurate) == jffs2NodeAccurate {
 			switch head.Type & jffs2NodetypeMask {
@@ -265,6 +274,9 @@ func (c *jcontext) scan(prefix string, offset int64) error {
 		}
 		// update offset to next 32-bit aligned position
 		offset = offset + int64(head.Length)
+		if offset > c.end {
+			c.end = offset
+		}
 		offset = (offset + 3) & ^int64(3)
 	}
 }
@@ -294,16 +306,14 @@ func (c *jcontext) writeLink(prefix string, j *jdnode) error {
 	if err != nil {
 		return err
 	}
-	file, _, err := c.Create(path.Join(prefix, j.name+".link"))
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	_, err = file.Write(data)
+	_, err = c.Link(path.Join(prefix, j.name), string(data), false)
 	return err
 }
 
 func (c *jcontext) create(prefix string, j *jdnode) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
 	switch int(j.typ) {
 	case DT_DIR:
 		for _, ch := range j.children {
@@ -348,9 +358,9 @@ func (c jcontext) findPageSize(filesize int64) (int64, error) {
 //
 // It is based on Woodhouse's paper + kernel headers.
 //
-// NOTE: link files are created as regular files named <name>.link
+// NOTE: links are not created, they are recorded as metadata on the file
 func Unjffs2(e *types.Env, prefix string) (string, error) {
-	ctx := &jcontext{Create: e.Create, nodemap: make(map[uint32]*jdnode)}
+	ctx := &jcontext{Create: e.Create, Link: e.Link, Canceled: e.Canceled, nodemap: make(map[uint32]*jdnode)}
 	ctx.Reader = e.Reader
 
 	// endian?
@@ -381,5 +391,6 @@ func Unjffs2(e *types.Env, prefix string) (string, error) {
 		}
 	}
 
+	e.SetExtent(ctx.end)
 	return "", nil
 }
@@ -4,51 +4,116 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
 )
 
-// TODO: this currently handles simplified LBA without looking at the extended partition
+const (
+	mbrSectorSize   = 512
+	mbrMaxLogical   = 128
+	mbrTypeGpt      = 0xEE
+	mbrPartitionOff = 0x1BE
+)
 
-// MbrLba extracts a drive based on LBA parameters in the MBR
-func MbrLba(e *types.Env, name string) (string, error) {
-	var partition struct {
-		State     uint8
-		Beginning [3]uint8
-		Typ       uint8
-		End       [3]uint8
-		LbaStart  uint32
-		LbaSize   uint32
+type mbrPartition struct {
+	State     uint8
+	Beginning [3]uint8
+	Typ       uint8
+	End       [3]uint8
+	LbaStart  uint32
+	LbaSize   uint32
+}
+
+// mbrExtended returns true for partitions that contain an EBR chain
+func mbrExtended(typ uint8) bool {
+	return typ == 0x05 || typ == 0x0F || typ == 0x85
+}
+
+// mbrTable reads the four partition entries of a MBR or EBR
+func mbrTable(r io.ReadSeeker, sector int64) ([4]mbrPartition, error) {
+	var table [4]mbrPartition
+	img := util.Structured{Reader: r, Order: binary.LittleEndian}
+	err := img.ReadAt(sector*mbrSectorSize+mbrPartitionOff, &table)
+	return table, err
+}
+
+// mbrCreate extracts a partition, parts outside the file are ignored
+func mbrCreate(e *types.Env, name string, start, end int64) error {
+	filesize := int64(e.GetSize())
+	if end > filesize {
+		end = filesize
 	}
+	w, _, err := e.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, err = io.Copy(w, util.NewSectionReader(e.Reader, start, end-start))
+	return err
+}
 
+// mbrLogical extracts the logical partitions in an extended partition. Each
+// EBR describes one partition relative to itself and links to the next EBR
+// relative to the start of the extended partition
+func mbrLogical(e *types.Env, name string, extended int64) error {
 	filesize := int64(e.GetSize())
-	for i := 0; i < 4; i++ {
-		if _, err := e.Reader.Seek(int64(0x1BE+i*16), os.SEEK_SET); err != nil {
-			return "", err
+	seen := make(map[int64]bool)
+	ebr := extended
+	for n := 5; n < 5+mbrMaxLogical; n++ {
+		if seen[ebr] || ebr*mbrSectorSize >= filesize {
+			return fmt.Errorf("mbr: bad EBR chain at sector %d", ebr)
 		}
-		if err := binary.Read(e.Reader, binary.LittleEndian, &partition); err != nil {
-			return "", err
+		seen[ebr] = true
+		table, err := mbrTable(e.Reader, ebr)
+		if err != nil {
+			return err
 		}
 
-		start := int64(partition.LbaStart) * 512
-		end := start + int64(partition.LbaSize)*512
-		if end > start && start < filesize {
-			filename := fmt.Sprintf("%s%d_%x_%x_%02x", name, i+1, start, end, partition.Typ)
-			w, _, err := e.Create(filename)
-			if err != nil {
-				return "", err
+		p := table[0]
+		start := (ebr + int64(p.LbaStart)) * mbrSectorSize
+		end := start + int64(p.LbaSize)*mbrSectorSize
+		if p.LbaSize != 0 && start < filesize {
+			filename := fmt.Sprintf("%s%d_%x_%x_%02x", name, n, start, end, p.Typ)
+			if err := mbrCreate(e, filename, start, end); err != nil {
+				return err
 			}
-			defer w.Close()
+		}
 
-			if _, err := e.Reader.Seek(start, os.SEEK_SET); err != nil {
+		next := table[1]
+		if next.LbaStart == 0 || !mbrExtended(next.Typ) {
+			return nil
+		}
+		ebr = extended + int64(next.LbaStart)
+	}
+	return fmt.Errorf("mbr: more than %d logical partitions", mbrMaxLogical)
+}
+
+// MbrLba extracts a drive based on LBA parameters in the MBR, including the
+// logical partitions in an extended partition. GPT disks are left to the
+// gpt extractor
+func MbrLba(e *types.Env, name string) (string, error) {
+	table, err := mbrTable(e.Reader, 0)
+	if err != nil {
+		return "", err
+	}
+
+	filesize := int64(e.GetSize())
+	for i, partition := range table {
+		start := int64(partition.LbaStart) * mbrSectorSize
+		end := start + int64(partition.LbaSize)*mbrSectorSize
+		if end <= start || start >= filesize || partition.Typ == mbrTypeGpt {
+			continue
+		}
+		if mbrExtended(partition.Typ) {
+			if err := mbrLogical(e, name, int64(partition.LbaStart)); err != nil {
 				return "", err
 			}
-			// XXX: if some parts are missing, ignore them
-			if end > filesize {
-				end = filesize
-			}
-			io.CopyN(w, e.Reader, end-start)
+			continue
+		}
+		filename := fmt.Sprintf("%s%d_%x_%x_%02x", name, i+1, start, end, partition.Typ)
+		if err := mbrCreate(e, filename, start, end); err != nil {
+			return "", err
 		}
 	}
 	return "", nil
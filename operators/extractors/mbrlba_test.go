@@ -0,0 +1,77 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// disk is a disk image with 512 byte sectors
+type disk []byte
+
+func (d disk) put(lba int64, v interface{}) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, v)
+	copy(d[lba*512:], b.Bytes())
+}
+
+// fill writes a pattern to the sectors of a partition
+func (d disk) fill(first, last int64, c byte) {
+	copy(d[first*512:(last+1)*512], bytes.Repeat([]byte{c}, int(last-first+1)*512))
+}
+
+func (d disk) sectors(first, last int64) []byte {
+	return d[first*512 : (last+1)*512]
+}
+
+// mbrEntry writes a partition entry in a MBR or EBR
+func (d disk) mbrEntry(lba int64, i int, typ uint8, start, size uint32) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, mbrPartition{Typ: typ, LbaStart: start, LbaSize: size})
+	copy(d[lba*512+mbrPartitionOff+int64(i)*16:], b.Bytes())
+	copy(d[lba*512+0x1FE:], []byte{0x55, 0xAA})
+}
+
+func TestMbrLba(t *testing.T) {
+	d := make(disk, 64*512)
+	d.mbrEntry(0, 0, 0x83, 2, 4)
+	d.mbrEntry(0, 1, 0x05, 10, 40)
+	d.fill(2, 5, 'a')
+
+	// the first EBR points to the second, relative to the extended partition
+	d.mbrEntry(10, 0, 0x83, 1, 3)
+	d.mbrEntry(10, 1, 0x05, 20, 10)
+	d.fill(11, 13, 'b')
+	d.mbrEntry(30, 0, 0x0b, 2, 5)
+	d.fill(32, 36, 'c')
+
+	x, err := runExtractor(d, MbrLba)
+	if err != nil {
+		t.Fatalf("MBR extraction failed: %v", err)
+	}
+	var testdata = []struct {
+		number      int
+		first, last int64
+		typ         uint8
+	}{
+		{1, 2, 5, 0x83},
+		{5, 11, 13, 0x83},
+		{6, 32, 36, 0x0b},
+	}
+	for _, test := range testdata {
+		name := fmt.Sprintf("%d_%x_%x_%02x", test.number, test.first*512, (test.last+1)*512, test.typ)
+		if data := x.content(t, name); !bytes.Equal(data, d.sectors(test.first, test.last)) {
+			t.Errorf("%s: wrong content", name)
+		}
+	}
+	if len(x.files) != len(testdata) {
+		t.Errorf("extracted %d files, expected %d", len(x.files), len(testdata))
+	}
+
+	// an EBR that links to itself
+	d.mbrEntry(30, 1, 0x05, 20, 10)
+	if _, err := runExtractor(d, MbrLba); err == nil {
+		t.Errorf("EBR loop was not detected")
+	}
+}
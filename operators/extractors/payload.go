@@ -0,0 +1,387 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+	"github.com/avahidi/molly/util/compress"
+)
+
+const (
+	payloadMagic       = "CrAU"
+	payloadVersion     = 2
+	payloadHeadSize    = 24
+	payloadMaxManifest = 64 << 20
+
+	payloadReplace   = 0
+	payloadReplaceBz = 1
+	payloadZero      = 6
+	payloadDiscard   = 7
+	payloadReplaceXz = 8
+)
+
+var payloadOpNames = map[uint64]string{
+	0: "REPLACE", 1: "REPLACE_BZ", 2: "MOVE", 3: "BSDIFF", 4: "SOURCE_COPY",
+	5: "SOURCE_BSDIFF", 6: "ZERO", 7: "DISCARD", 8: "REPLACE_XZ", 9: "PUFFDIFF",
+	10: "BROTLI_BSDIFF", 11: "ZUCCHINI", 12: "LZ4DIFF_BSDIFF", 13: "LZ4DIFF_PUFFDIFF",
+}
+
+// pbField is a field of a protobuf message, varints and fixed size values
+// are stored in value and length delimited fields in data
+type pbField struct {
+	num   uint64
+	value uint64
+	data  []byte
+}
+
+// pbFields splits a protobuf message into its fields
+func pbFields(msg []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, fmt.Errorf("payload: bad protobuf key")
+		}
+		msg = msg[n:]
+		f := pbField{num: key >> 3}
+		switch key & 7 {
+		case 0:
+			if f.value, n = binary.Uvarint(msg); n <= 0 {
+				return nil, fmt.Errorf("payload: bad protobuf varint")
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return nil, fmt.Errorf("payload: truncated protobuf message")
+			}
+			f.value, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 5:
+			if len(msg) < 4 {
+				return nil, fmt.Errorf("payload: truncated protobuf message")
+			}
+			f.value, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return nil, fmt.Errorf("payload: truncated protobuf message")
+			}
+			f.data, msg = msg[n:n+int(size)], msg[n+int(size):]
+		default:
+			return nil, fmt.Errorf("payload: unknown protobuf wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+type payloadExtent struct {
+	start, blocks uint64
+}
+
+// payloadOp is an InstallOperation, data is relative to the end of the
+// metadata signature
+type payloadOp struct {
+	typ            uint64
+	offset, length uint64
+	dst            []payloadExtent
+	hash           []byte
+}
+
+// payloadPartition is a PartitionUpdate with the size and hash of the new
+// partition
+type payloadPartition struct {
+	name string
+	size uint64
+	hash []byte
+	ops  []payloadOp
+}
+
+func payloadParseOp(msg []byte) (payloadOp, error) {
+	var op payloadOp
+	fields, err := pbFields(msg)
+	if err != nil {
+		return op, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			op.typ = f.value
+		case 2:
+			op.offset = f.value
+		case 3:
+			op.length = f.value
+		case 6:
+			extent, err := pbFields(f.data)
+			if err != nil {
+				return op, err
+			}
+			var ext payloadExtent
+			for _, e := range extent {
+				switch e.num {
+				case 1:
+					ext.start = e.value
+				case 2:
+					ext.blocks = e.value
+				}
+			}
+			op.dst = append(op.dst, ext)
+		case 8:
+			op.hash = f.data
+		}
+	}
+	return op, nil
+}
+
+func payloadParsePartition(msg []byte) (payloadPartition, error) {
+	var part payloadPartition
+	fields, err := pbFields(msg)
+	if err != nil {
+		return part, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			part.name = string(f.data)
+		case 7:
+			info, err := pbFields(f.data)
+			if err != nil {
+				return part, err
+			}
+			for _, i := range info {
+				switch i.num {
+				case 1:
+					part.size = i.value
+				case 2:
+					part.hash = i.data
+				}
+			}
+		case 8:
+			op, err := payloadParseOp(f.data)
+			if err != nil {
+				return part, err
+			}
+			part.ops = append(part.ops, op)
+		}
+	}
+	if part.name == "" {
+		return part, fmt.Errorf("payload: partition without a name")
+	}
+	return part, nil
+}
+
+// payloadPiece is an extent written by an operation, skip is where the
+// extent starts in the output of the operation
+type payloadPiece struct {
+	start, blocks uint64
+	op            int
+	skip          uint64
+}
+
+// payloadData reads the data of an operation, checks its hash and returns
+// a reader of the decompressed data. Zero and discard operations have no
+// reader
+func payloadData(e *types.Env, base int64, op payloadOp) (io.Reader, bool, error) {
+	if op.typ == payloadZero || op.typ == payloadDiscard {
+		return nil, true, nil
+	}
+	if op.offset > e.GetSize() || op.length > e.GetSize() || uint64(base)+op.offset+op.length > e.GetSize() {
+		return nil, false, fmt.Errorf("operation data is outside the payload")
+	}
+	raw := make([]byte, op.length)
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	if err := img.ReadAt(base+int64(op.offset), raw); err != nil {
+		return nil, false, err
+	}
+	sum := sha256.Sum256(raw)
+	valid := len(op.hash) == 0 || bytes.Equal(sum[:], op.hash)
+
+	switch op.typ {
+	case payloadReplaceBz:
+		return bzip2.NewReader(bytes.NewReader(raw)), valid, nil
+	case payloadReplaceXz:
+		r, err := compress.NewXzReader(bytes.NewReader(raw))
+		return r, valid, err
+	}
+	return bytes.NewReader(raw), valid, nil
+}
+
+// payloadWrite writes a partition by sorting the extents of all operations,
+// blocks that are not written by any operation are zero. The data of an
+// operation is streamed into its extents
+func payloadWrite(e *types.Env, prefix string, base int64, blockSize uint64, part payloadPartition) error {
+	var pieces []payloadPiece
+	for i, op := range part.ops {
+		skip := uint64(0)
+		for _, ext := range op.dst {
+			pieces = append(pieces, payloadPiece{ext.start, ext.blocks, i, skip})
+			skip += ext.blocks * blockSize
+		}
+	}
+	sort.SliceStable(pieces, func(i, j int) bool { return pieces[i].start < pieces[j].start })
+
+	w, fd, err := e.Create(prefix + part.name + ".img")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	sum := sha256.New()
+	out := io.MultiWriter(w, sum)
+
+	// operations with extents out of order are read again from the start
+	var data io.Reader
+	current, pos, written := -1, uint64(0), uint64(0)
+	invalid := map[int]bool{}
+	for _, p := range pieces {
+		if err := e.Canceled(); err != nil {
+			return err
+		}
+		if p.start*blockSize < written {
+			return fmt.Errorf("payload: operations of %s overlap", part.name)
+		}
+		if err := writeZeros(out, int64(p.start*blockSize-written)); err != nil {
+			return err
+		}
+		if p.op != current || p.skip < pos {
+			var valid bool
+			if data, valid, err = payloadData(e, base, part.ops[p.op]); err != nil {
+				return fmt.Errorf("payload: %s: %v", part.name, err)
+			}
+			if !valid && !invalid[p.op] {
+				invalid[p.op] = true
+				fd.RegisterError(fmt.Errorf("payload: operation %d of %s has bad hash", p.op, part.name))
+			}
+			current, pos = p.op, 0
+		}
+
+		// short data is padded with zeros
+		size := p.blocks * blockSize
+		n := int64(0)
+		if data != nil {
+			skipped, err := io.CopyN(io.Discard, data, int64(p.skip-pos))
+			pos += uint64(skipped)
+			if err == nil {
+				n, err = io.CopyN(out, data, int64(size))
+				pos += uint64(n)
+			}
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("payload: %s: %w", part.name, err)
+			}
+		}
+		if err := writeZeros(out, int64(size)-n); err != nil {
+			return err
+		}
+		written = (p.start + p.blocks) * blockSize
+	}
+	if written < part.size {
+		if err := writeZeros(out, int64(part.size-written)); err != nil {
+			return err
+		}
+	}
+	if len(part.hash) > 0 && !bytes.Equal(sum.Sum(nil), part.hash) {
+		fd.RegisterError(fmt.Errorf("payload: %s has bad hash", part.name))
+	}
+	return nil
+}
+
+// Unpayload extracts the partitions of a full A/B OTA payload. Partitions
+// updated with delta operations are not extracted but listed as unsupported
+// in the analysis "payload"
+func Unpayload(e *types.Env, prefix string) (string, error) {
+	var head struct {
+		Magic        [4]byte
+		Version      uint64
+		ManifestSize uint64
+		SigSize      uint32
+	}
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	if err := img.ReadAt(0, &head); err != nil {
+		return "", err
+	}
+	if string(head.Magic[:]) != payloadMagic {
+		return "", fmt.Errorf("file is not an OTA payload")
+	}
+	if head.Version != payloadVersion {
+		return "", fmt.Errorf("payload: unsupported version %d", head.Version)
+	}
+	if head.ManifestSize > payloadMaxManifest || payloadHeadSize+head.ManifestSize > e.GetSize() {
+		return "", fmt.Errorf("payload: bad manifest size %d", head.ManifestSize)
+	}
+	manifest := make([]byte, head.ManifestSize)
+	if err := img.ReadAt(payloadHeadSize, manifest); err != nil {
+		return "", err
+	}
+	fields, err := pbFields(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	report := map[string]interface{}{"version": head.Version}
+	blockSize := uint64(4096)
+	var parts []payloadPartition
+	for _, f := range fields {
+		switch f.num {
+		case 3:
+			blockSize = f.value
+		case 12:
+			report["minor-version"] = f.value
+		case 13:
+			part, err := payloadParsePartition(f.data)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		case 18:
+			report["security-patch-level"] = string(f.data)
+		}
+	}
+	if blockSize == 0 || blockSize%512 != 0 {
+		return "", fmt.Errorf("payload: bad block size %d", blockSize)
+	}
+	report["block-size"] = blockSize
+
+	analysis := e.AnalysisName("payload")
+	base := payloadHeadSize + int64(head.ManifestSize) + int64(head.SigSize)
+	var partitions []map[string]interface{}
+	for _, part := range parts {
+		info := map[string]interface{}{
+			"name": part.name, "size": part.size,
+			"hash": hex.EncodeToString(part.hash), "operations": len(part.ops),
+		}
+		partitions = append(partitions, info)
+
+		var unsupported []string
+		seen := map[string]bool{}
+		for _, op := range part.ops {
+			switch op.typ {
+			case payloadReplace, payloadReplaceBz, payloadReplaceXz, payloadZero, payloadDiscard:
+			default:
+				name, found := payloadOpNames[op.typ]
+				if !found {
+					name = fmt.Sprintf("%d", op.typ)
+				}
+				if !seen[name] {
+					seen[name] = true
+					unsupported = append(unsupported, name)
+				}
+			}
+		}
+		if len(unsupported) > 0 {
+			info["unsupported"] = unsupported
+			continue
+		}
+		if err = payloadWrite(e, prefix, base, blockSize, part); err != nil {
+			break
+		}
+	}
+	report["partitions"] = partitions
+	e.Current.RegisterAnalysis(analysis, report, err)
+	return "", err
+}
@@ -0,0 +1,154 @@
+package extractors
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/avahidi/molly/types"
+)
+
+// pbMessage creates protobuf messages
+type pbMessage struct {
+	bytes.Buffer
+}
+
+func (m *pbMessage) varint(num, value uint64) *pbMessage {
+	var b [binary.MaxVarintLen64]byte
+	m.Write(b[:binary.PutUvarint(b[:], num<<3)])
+	m.Write(b[:binary.PutUvarint(b[:], value)])
+	return m
+}
+
+func (m *pbMessage) bytes(num uint64, data []byte) *pbMessage {
+	var b [binary.MaxVarintLen64]byte
+	m.Write(b[:binary.PutUvarint(b[:], num<<3|2)])
+	m.Write(b[:binary.PutUvarint(b[:], uint64(len(data)))])
+	m.Write(data)
+	return m
+}
+
+// payloadImage creates a payload with the blobs of the operations stored
+// in order, the extents are given as start and number of blocks
+type payloadImage struct {
+	partitions []*pbMessage
+	blobs      bytes.Buffer
+}
+
+func (p *payloadImage) op(part *pbMessage, typ uint64, data []byte, extents ...uint64) {
+	op := (&pbMessage{}).varint(1, typ)
+	if data != nil {
+		sum := sha256.Sum256(data)
+		op.varint(2, uint64(p.blobs.Len())).varint(3, uint64(len(data))).bytes(8, sum[:])
+		p.blobs.Write(data)
+	}
+	for i := 0; i < len(extents); i += 2 {
+		op.bytes(6, (&pbMessage{}).varint(1, extents[i]).varint(2, extents[i+1]).Bytes())
+	}
+	part.bytes(8, op.Bytes())
+}
+
+func (p *payloadImage) bytes() []byte {
+	manifest := (&pbMessage{}).varint(3, 512).varint(12, 0)
+	for _, part := range p.partitions {
+		manifest.bytes(13, part.Bytes())
+	}
+	manifest.bytes(18, []byte("2021-03-05"))
+	signature := []byte("signature")
+
+	var b bytes.Buffer
+	b.WriteString(payloadMagic)
+	binary.Write(&b, binary.BigEndian, uint64(payloadVersion))
+	binary.Write(&b, binary.BigEndian, uint64(manifest.Len()))
+	binary.Write(&b, binary.BigEndian, uint32(len(signature)))
+	b.Write(manifest.Bytes())
+	b.Write(signature)
+	b.Write(p.blobs.Bytes())
+	return b.Bytes()
+}
+
+func TestUnpayload(t *testing.T) {
+	xz, _ := base64.StdEncoding.DecodeString(xzTestData)
+	bz, _ := base64.StdEncoding.DecodeString(bzip2TestData)
+	raw := bytes.Repeat([]byte("raw data"), 128)
+	block := func(data []byte) []byte {
+		return append(append([]byte{}, data...), make([]byte, 512-len(data)%512)...)
+	}
+	// the extents are written out of order and the last block is implicit
+	want := bytes.Join([][]byte{raw[:512], block([]byte(testData)), block([]byte(testData)),
+		raw[512:], make([]byte, 2*512)}, nil)
+	sum := sha256.Sum256(want)
+
+	build := func(corrupt bool) []byte {
+		var p payloadImage
+		boot := (&pbMessage{}).bytes(1, []byte("boot"))
+		boot.bytes(7, (&pbMessage{}).varint(1, uint64(len(want))).bytes(2, sum[:]).Bytes())
+		p.op(boot, payloadReplaceXz, xz, 1, 1)
+		p.op(boot, payloadReplace, raw, 0, 1, 3, 1)
+		p.op(boot, payloadZero, nil, 4, 1)
+		p.op(boot, payloadReplaceBz, bz, 2, 1)
+		system := (&pbMessage{}).bytes(1, []byte("system"))
+		p.op(system, 4, nil, 0, 1)
+		p.op(system, 3, []byte("diff"), 1, 1)
+		p.partitions = []*pbMessage{boot, system}
+		img := p.bytes()
+		if corrupt {
+			img[bytes.Index(img, raw)] ^= 0xFF
+		}
+		return img
+	}
+
+	x, err := runExtractor(build(false), Unpayload)
+	if err != nil {
+		t.Fatalf("payload extraction failed: %v", err)
+	}
+	if got := x.content(t, "boot.img"); !bytes.Equal(got, want) {
+		t.Errorf("boot partition has wrong content")
+	}
+	if errs := x.files["boot.img"].Errors; len(errs) != 0 {
+		t.Errorf("boot partition has errors %v", errs)
+	}
+	if _, found := x.files["system.img"]; found {
+		t.Errorf("delta partition was extracted")
+	}
+
+	report := x.input.Analyses["payload"].Result.(map[string]interface{})
+	parts := report["partitions"].([]map[string]interface{})
+	if len(parts) != 2 || parts[0]["size"] != uint64(len(want)) || parts[0]["operations"] != 4 ||
+		report["security-patch-level"] != "2021-03-05" {
+		t.Fatalf("wrong analysis %v", report)
+	}
+	if unsupported := parts[1]["unsupported"].([]string); len(unsupported) != 2 ||
+		unsupported[0] != "SOURCE_COPY" || unsupported[1] != "BSDIFF" {
+		t.Errorf("wrong unsupported operations %v", unsupported)
+	}
+
+	// a corrupt blob is reported for both the operation and the partition
+	x, err = runExtractor(build(true), Unpayload)
+	if err != nil {
+		t.Fatalf("payload extraction failed: %v", err)
+	}
+	if errs := x.files["boot.img"].Errors; len(errs) != 2 {
+		t.Errorf("corrupt partition has errors %v", errs)
+	}
+}
+
+func TestUnpayloadLimit(t *testing.T) {
+	// the extents of an operation are streamed, so a huge partition stops
+	// at the file size limit
+	xz, _ := base64.StdEncoding.DecodeString(xzTestData)
+	var p payloadImage
+	boot := (&pbMessage{}).bytes(1, []byte("boot"))
+	p.op(boot, payloadReplaceXz, xz, 0, 1<<30)
+	p.partitions = []*pbMessage{boot}
+	x, err := runExtractorConfig(p.bytes(), Unpayload, func(c *types.Configuration) { c.MaxFileSize = 64 << 10 })
+	if err == nil || !errors.Is(err, types.ErrLimit) {
+		t.Errorf("limit was not reached: %v", err)
+	}
+	if got := x.content(t, "boot.img"); len(got) != 64<<10 || !bytes.HasPrefix(got, []byte(testData)) {
+		t.Errorf("boot partition has wrong content")
+	}
+}
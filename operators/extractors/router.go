@@ -0,0 +1,478 @@
+package extractors
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	trxMagic         = 0x30524448
+	seamaMagic       = 0x5EA3A417
+	seamaHeaderSize  = 28
+	shrsMagic        = "SHRS"
+	shrsDataOffset   = 0x6DC
+	tplinkHeaderSize = 0x200
+	chkMagic         = 0x2A23245E
+	chkHeaderSize    = 40
+	zynosHeaderSize  = 0x30
+	zynosSignature   = "SIG"
+	routerMaxMeta    = 64 * 1024
+)
+
+// shrsKey is the AES key of D-Link SHRS images, it is the same in all of them
+var shrsKey, _ = hex.DecodeString("c05fbf1936c99429ce2a0781f08d6ad8")
+
+// routerPart copies a part of a container to a new file
+func routerPart(e *types.Env, name string, offset, size int64) (*types.FileData, error) {
+	if offset < 0 || size < 0 || offset+size > int64(e.GetSize()) {
+		return nil, fmt.Errorf("%s is outside the image", name)
+	}
+	w, fd, err := e.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	_, err = io.Copy(w, util.NewSectionReader(e.Reader, offset, size))
+	return fd, err
+}
+
+// routerHash returns a hash of a part of the input
+func routerHash(e *types.Env, h io.Writer, offset, size int64) error {
+	_, err := io.Copy(h, util.NewSectionReader(e.Reader, offset, size))
+	return err
+}
+
+type trxHeader struct {
+	Magic   uint32
+	Length  uint32
+	CRC     uint32
+	Flags   uint16
+	Version uint16
+	Offsets [4]uint32
+}
+
+// trxNames are the usual contents of TRX partitions by their number
+var trxNames = map[int][]string{
+	1: {"kernel"},
+	2: {"kernel", "rootfs"},
+	3: {"loader", "kernel", "rootfs"},
+}
+
+// Untrx splits a Broadcom TRX image into its partitions. Version 1 images
+// have three partitions and version 2 adds a fourth for the bin header
+func Untrx(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.LittleEndian}
+	var head trxHeader
+	if err := img.ReadAt(0, &head); err != nil || head.Magic != trxMagic {
+		return "", fmt.Errorf("file is not a TRX image")
+	}
+	if head.Version != 1 && head.Version != 2 {
+		return "", fmt.Errorf("trx: unknown version %d", head.Version)
+	}
+	headerSize := int64(16 + 4*(head.Version+2))
+	if int64(head.Length) < headerSize || uint64(head.Length) > e.GetSize() {
+		return "", fmt.Errorf("trx: bad length %d", head.Length)
+	}
+
+	// the CRC starts with the flags and is not inverted at the end
+	h := crc32.NewIEEE()
+	err := routerHash(e, h, 12, int64(head.Length)-12)
+	report := map[string]interface{}{
+		"version": head.Version,
+		"flags":   head.Flags,
+		"length":  head.Length,
+		"crc":     err == nil && ^h.Sum32() == head.CRC,
+	}
+	if err == nil && report["crc"] != true {
+		err = fmt.Errorf("trx: bad checksum")
+	}
+	e.Current.RegisterAnalysis(e.AnalysisName("trx"), report, err)
+
+	var offsets []int64
+	for _, offset := range head.Offsets[:head.Version+2] {
+		if offset != 0 {
+			offsets = append(offsets, int64(offset))
+		}
+	}
+	names := trxNames[len(offsets)]
+	if head.Version == 2 && head.Offsets[3] != 0 {
+		names = append(append([]string{}, trxNames[len(offsets)-1]...), "binheader")
+	}
+	for i, offset := range offsets {
+		end := int64(head.Length)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		name := fmt.Sprintf("part%d", i)
+		if i < len(names) {
+			name = names[i]
+		}
+		if offset < headerSize || end < offset {
+			return "", fmt.Errorf("trx: bad offset of %s", name)
+		}
+		if _, err := routerPart(e, prefix+name, offset, end-offset); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+type seamaHeader struct {
+	Magic    uint32
+	Reserved uint16
+	MetaSize uint16
+	Size     uint32
+	MD5      [16]byte
+}
+
+// Unseama extracts the image of a D-Link Seama container. The metadata is
+// recorded as the analysis "seama" and the MD5 of the image is verified.
+// Sealed containers have no image of their own and are followed by others
+func Unseama(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	var head seamaHeader
+	if err := img.ReadAt(0, &head); err != nil || head.Magic != seamaMagic {
+		return "", fmt.Errorf("file is not a Seama image")
+	}
+	meta := make([]byte, head.MetaSize)
+	if err := img.ReadAt(seamaHeaderSize, meta); err != nil {
+		return "", err
+	}
+	var metadata []string
+	for _, s := range strings.Split(string(meta), "\x00") {
+		if s != "" {
+			metadata = append(metadata, s)
+		}
+	}
+
+	offset, size := int64(seamaHeaderSize)+int64(head.MetaSize), int64(head.Size)
+	report := map[string]interface{}{"metadata": metadata, "size": head.Size}
+	if size == 0 {
+		size = int64(e.GetSize()) - offset
+		report["sealed"] = true
+		e.Current.RegisterAnalysis(e.AnalysisName("seama"), report, nil)
+		_, err := routerPart(e, prefix+"image", offset, size)
+		return "", err
+	}
+
+	h := md5.New()
+	err := routerHash(e, h, offset, size)
+	report["md5"] = err == nil && bytes.Equal(h.Sum(nil), head.MD5[:])
+	if err == nil && report["md5"] != true {
+		err = fmt.Errorf("seama: bad checksum")
+	}
+	e.Current.RegisterAnalysis(e.AnalysisName("seama"), report, err)
+	_, err = routerPart(e, prefix+"image", offset, size)
+	return "", err
+}
+
+type shrsHeader struct {
+	Magic     [4]byte
+	Size      uint32
+	Encrypted uint32
+	IV        [16]byte
+}
+
+// Unshrs decrypts a D-Link SHRS image, the signature is not verified
+func Unshrs(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	var head shrsHeader
+	if err := img.ReadAt(0, &head); err != nil || string(head.Magic[:]) != shrsMagic {
+		return "", fmt.Errorf("file is not a SHRS image")
+	}
+	if head.Encrypted%aes.BlockSize != 0 || head.Size > head.Encrypted ||
+		uint64(shrsDataOffset)+uint64(head.Encrypted) > e.GetSize() {
+		return "", fmt.Errorf("shrs: bad size %d", head.Encrypted)
+	}
+	e.Current.RegisterAnalysis(e.AnalysisName("shrs"), map[string]interface{}{"size": head.Size}, nil)
+
+	data := make([]byte, head.Encrypted)
+	if err := img.ReadAt(shrsDataOffset, data); err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(shrsKey)
+	if err != nil {
+		return "", err
+	}
+	cipher.NewCBCDecrypter(block, head.IV[:]).CryptBlocks(data, data)
+
+	w, _, err := e.Create(prefix + "image")
+	if err != nil {
+		return "", err
+	}
+	defer w.Close()
+	_, err = w.Write(data[:head.Size])
+	return "", err
+}
+
+type tplinkHeader struct {
+	Version   uint32
+	Vendor    [24]byte
+	Firmware  [36]byte
+	HwID      uint32
+	HwRev     uint32
+	Region    uint32
+	MD5       [16]byte
+	Unknown2  uint32
+	MD5Boot   [16]byte
+	Unknown3  uint32
+	KernelLA  uint32
+	KernelEP  uint32
+	Length    uint32
+	KernelOfs uint32
+	KernelLen uint32
+	RootfsOfs uint32
+	RootfsLen uint32
+	BootOfs   uint32
+	BootLen   uint32
+}
+
+// tplinkSalt replaces the MD5 in the header when it is computed, images with
+// a bootloader use tplinkBootSalt instead
+var (
+	tplinkSalt     = []byte{0xdc, 0xd7, 0x3a, 0xa5, 0xc3, 0x95, 0x98, 0xfb, 0xdd, 0xf9, 0xe7, 0xf4, 0x0e, 0xae, 0x47, 0x38}
+	tplinkBootSalt = []byte{0x8c, 0xef, 0x33, 0x5b, 0xd5, 0xc5, 0xce, 0xfa, 0xa7, 0x9c, 0x28, 0xda, 0xb2, 0xe9, 0x0f, 0x42}
+)
+
+// Untplink splits a TP-Link firmware with a version 1 header into the
+// kernel, rootfs and bootloader. The header is recorded as the analysis
+// "tplink" and the salted MD5 of the image is verified
+func Untplink(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	var raw [tplinkHeaderSize]byte
+	if err := img.ReadAt(0, raw[:]); err != nil {
+		return "", fmt.Errorf("file is not a TP-Link image")
+	}
+	var head tplinkHeader
+	binary.Read(bytes.NewReader(raw[:]), img.Order, &head)
+	if head.Version != 1 {
+		return "", fmt.Errorf("tplink: unknown header version %d", head.Version)
+	}
+	if head.Length < tplinkHeaderSize || uint64(head.Length) > e.GetSize() {
+		return "", fmt.Errorf("tplink: bad length %d", head.Length)
+	}
+
+	h := md5.New()
+	if head.BootLen != 0 {
+		copy(raw[76:92], tplinkBootSalt)
+	} else {
+		copy(raw[76:92], tplinkSalt)
+	}
+	h.Write(raw[:])
+	err := routerHash(e, h, tplinkHeaderSize, int64(head.Length)-tplinkHeaderSize)
+	report := map[string]interface{}{
+		"vendor":   util.AsciizToString(head.Vendor[:]),
+		"firmware": util.AsciizToString(head.Firmware[:]),
+		"hw-id":    fmt.Sprintf("%08x", head.HwID),
+		"hw-rev":   head.HwRev,
+		"load":     head.KernelLA,
+		"entry":    head.KernelEP,
+		"md5":      err == nil && bytes.Equal(h.Sum(nil), head.MD5[:]),
+	}
+	if err == nil && report["md5"] != true {
+		err = fmt.Errorf("tplink: bad checksum")
+	}
+	e.Current.RegisterAnalysis(e.AnalysisName("tplink"), report, err)
+
+	for _, part := range []struct {
+		name        string
+		offset, len uint32
+	}{{"kernel", head.KernelOfs, head.KernelLen}, {"rootfs", head.RootfsOfs, head.RootfsLen}, {"boot", head.BootOfs, head.BootLen}} {
+		if part.len == 0 {
+			continue
+		}
+		if _, err := routerPart(e, prefix+part.name, int64(part.offset), int64(part.len)); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+type chkHeader struct {
+	Magic          uint32
+	HeaderLen      uint32
+	Reserved       [8]byte
+	KernelChecksum uint32
+	RootfsChecksum uint32
+	KernelLen      uint32
+	RootfsLen      uint32
+	ImageChecksum  uint32
+	HeaderChecksum uint32
+}
+
+// chkChecksum is the Fletcher-like checksum of Netgear images
+type chkChecksum struct {
+	c0, c1 uint32
+}
+
+func (c *chkChecksum) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.c0 += uint32(b)
+		c.c1 += c.c0
+	}
+	return len(p), nil
+}
+
+func (c *chkChecksum) Sum32() uint32 {
+	fold := func(v uint32) uint32 {
+		v = v&0xFFFF + v>>16
+		return (v>>16 + v) & 0xFFFF
+	}
+	return fold(c.c1)<<16 | fold(c.c0)
+}
+
+// Unchk splits a Netgear CHK image into the kernel and rootfs. The board id
+// and the outcome of the checksum checks are recorded as the analysis "chk"
+func Unchk(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	var head chkHeader
+	if err := img.ReadAt(0, &head); err != nil || head.Magic != chkMagic {
+		return "", fmt.Errorf("file is not a CHK image")
+	}
+	if head.HeaderLen < chkHeaderSize || head.HeaderLen > routerMaxMeta {
+		return "", fmt.Errorf("chk: bad header length %d", head.HeaderLen)
+	}
+	kernel, rootfs := int64(head.HeaderLen), int64(head.HeaderLen)+int64(head.KernelLen)
+	if uint64(rootfs)+uint64(head.RootfsLen) > e.GetSize() {
+		return "", fmt.Errorf("chk: image is larger than the file")
+	}
+	raw := make([]byte, head.HeaderLen)
+	if err := img.ReadAt(0, raw); err != nil {
+		return "", err
+	}
+
+	var sums [4]chkChecksum
+	copy(raw[36:40], []byte{0, 0, 0, 0})
+	sums[0].Write(raw)
+	err := routerHash(e, &sums[1], kernel, int64(head.KernelLen))
+	if err == nil {
+		err = routerHash(e, &sums[2], rootfs, int64(head.RootfsLen))
+	}
+	if err == nil {
+		err = routerHash(e, &sums[3], kernel, int64(head.KernelLen)+int64(head.RootfsLen))
+	}
+	report := map[string]interface{}{
+		"board-id":        util.AsciizToString(raw[chkHeaderSize:]),
+		"header-checksum": sums[0].Sum32() == head.HeaderChecksum,
+		"kernel-checksum": sums[1].Sum32() == head.KernelChecksum,
+		"image-checksum":  sums[3].Sum32() == head.ImageChecksum,
+	}
+	// images without a rootfs have no rootfs checksum
+	if head.RootfsLen != 0 {
+		report["rootfs-checksum"] = sums[2].Sum32() == head.RootfsChecksum
+	}
+	for _, key := range []string{"header-checksum", "kernel-checksum", "rootfs-checksum", "image-checksum"} {
+		if v, found := report[key]; err == nil && found && v != true {
+			err = fmt.Errorf("chk: bad %s", strings.Replace(key, "-", " ", 1))
+		}
+	}
+	e.Current.RegisterAnalysis(e.AnalysisName("chk"), report, err)
+
+	if _, err := routerPart(e, prefix+"kernel", kernel, int64(head.KernelLen)); err != nil {
+		return "", err
+	}
+	if head.RootfsLen != 0 {
+		if _, err := routerPart(e, prefix+"rootfs", rootfs, int64(head.RootfsLen)); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+type zynosHeader struct {
+	Addr     uint32
+	Type     uint8
+	Sig      [3]byte
+	Osize    uint32
+	Csize    uint32
+	Flags    uint8
+	Unknown0 uint8
+	Ocsum    uint16
+	Ccsum    uint16
+	Version  [15]byte
+}
+
+const (
+	zynosFlagCompressed = 0x80
+	zynosFlagOcsum      = 0x40
+	zynosFlagCcsum      = 0x20
+)
+
+// zynosChecksum is the 16 bit ones' complement sum of ZyNOS images
+type zynosChecksum struct {
+	sum uint32
+	odd bool
+	tmp byte
+}
+
+func (c *zynosChecksum) Write(p []byte) (int, error) {
+	add := func(v uint32) {
+		if c.sum += v; c.sum > 0xFFFF {
+			c.sum = (c.sum + 1) & 0xFFFF
+		}
+	}
+	for _, b := range p {
+		if c.odd {
+			add(uint32(c.tmp)<<8 | uint32(b))
+		} else {
+			c.tmp = b
+		}
+		c.odd = !c.odd
+	}
+	return len(p), nil
+}
+
+func (c *zynosChecksum) Sum16() uint16 {
+	if c.odd {
+		c.Write([]byte{0})
+	}
+	return uint16(c.sum)
+}
+
+// Unzynos extracts the ROMBIN object of a ZyXEL ZyNOS firmware and verifies
+// its checksum, compressed objects are written as they are
+func Unzynos(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	var head zynosHeader
+	if err := img.ReadAt(0, &head); err != nil || string(head.Sig[:]) != zynosSignature {
+		return "", fmt.Errorf("file is not a ZyNOS image")
+	}
+	size, sum, check := head.Osize, head.Ocsum, head.Flags&zynosFlagOcsum != 0
+	if head.Flags&zynosFlagCompressed != 0 {
+		size, sum, check = head.Csize, head.Ccsum, head.Flags&zynosFlagCcsum != 0
+	}
+	if uint64(zynosHeaderSize)+uint64(size) > e.GetSize() {
+		return "", fmt.Errorf("zynos: object is larger than the file")
+	}
+
+	report := map[string]interface{}{
+		"load":       head.Addr,
+		"type":       head.Type,
+		"version":    util.AsciizToString(head.Version[:]),
+		"compressed": head.Flags&zynosFlagCompressed != 0,
+	}
+	var err error
+	if check {
+		var c zynosChecksum
+		err = routerHash(e, &c, zynosHeaderSize, int64(size))
+		report["checksum"] = err == nil && c.Sum16() == sum
+		if err == nil && report["checksum"] != true {
+			err = fmt.Errorf("zynos: bad checksum")
+		}
+	}
+	e.Current.RegisterAnalysis(e.AnalysisName("zynos"), report, err)
+
+	_, err = routerPart(e, fmt.Sprintf("%sras_%08x", prefix, head.Addr), zynosHeaderSize, int64(size))
+	return "", err
+}
@@ -0,0 +1,185 @@
+package extractors
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/avahidi/molly/types"
+)
+
+var (
+	routerKernel = bytes.Repeat([]byte("kernel"), 50)
+	routerRootfs = bytes.Repeat([]byte("rootfs"), 70)
+	routerLoader = bytes.Repeat([]byte("loader"), 20)
+)
+
+// trxImage creates a TRX image with the given partitions, version 1 has a
+// 28 byte header with three offsets and version 2 a 32 byte one with four
+func trxImage(version uint16, parts ...[]byte) []byte {
+	head := trxHeader{Magic: trxMagic, Version: version}
+	size := uint32(16 + 4*(version+2))
+	for i, part := range parts {
+		head.Offsets[i] = size
+		size += uint32(len(part))
+	}
+	head.Length = size
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &head)
+	b.Truncate(16 + 4*int(version+2))
+	for _, part := range parts {
+		b.Write(part)
+	}
+	binary.LittleEndian.PutUint32(b.Bytes()[8:], ^crc32.ChecksumIEEE(b.Bytes()[12:]))
+	return b.Bytes()
+}
+
+func seamaImage() []byte {
+	meta := []byte("dev=/dev/mtdblock/2\x00type=firmware\x00\x00\x00")
+	head := seamaHeader{Magic: seamaMagic, MetaSize: uint16(len(meta)), Size: uint32(len(routerKernel))}
+	head.MD5 = md5.Sum(routerKernel)
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &head)
+	b.Write(meta)
+	b.Write(routerKernel)
+	return b.Bytes()
+}
+
+func shrsImage() []byte {
+	head := shrsHeader{Size: uint32(len(routerKernel)), Encrypted: uint32(len(routerKernel)+15) &^ 15}
+	copy(head.Magic[:], shrsMagic)
+	copy(head.IV[:], "0123456789abcdef")
+	data := make([]byte, head.Encrypted)
+	copy(data, routerKernel)
+	block, _ := aes.NewCipher(shrsKey)
+	cipher.NewCBCEncrypter(block, head.IV[:]).CryptBlocks(data, data)
+
+	b := make([]byte, shrsDataOffset)
+	var h bytes.Buffer
+	binary.Write(&h, binary.BigEndian, &head)
+	copy(b, h.Bytes())
+	return append(b, data...)
+}
+
+func tplinkImage() []byte {
+	head := tplinkHeader{Version: 1, KernelLA: 0x80060000, KernelEP: 0x80060000,
+		KernelOfs: tplinkHeaderSize, KernelLen: uint32(len(routerKernel)),
+		RootfsOfs: tplinkHeaderSize + uint32(len(routerKernel)), RootfsLen: uint32(len(routerRootfs))}
+	head.Length = head.RootfsOfs + head.RootfsLen
+	copy(head.Vendor[:], "TP-LINK Technologies")
+	copy(head.Firmware[:], "ver. 1.0")
+	copy(head.MD5[:], tplinkSalt)
+	b := make([]byte, tplinkHeaderSize)
+	var h bytes.Buffer
+	binary.Write(&h, binary.BigEndian, &head)
+	copy(b, h.Bytes())
+	b = append(append(b, routerKernel...), routerRootfs...)
+	sum := md5.Sum(b)
+	copy(b[76:], sum[:])
+	return b
+}
+
+func chkImage() []byte {
+	board := "U12H139T00_NETGEAR"
+	head := chkHeader{Magic: chkMagic, HeaderLen: uint32(chkHeaderSize + len(board)),
+		KernelLen: uint32(len(routerKernel)), RootfsLen: uint32(len(routerRootfs))}
+	var sums [4]chkChecksum
+	sums[1].Write(routerKernel)
+	sums[2].Write(routerRootfs)
+	sums[3].Write(append(append([]byte{}, routerKernel...), routerRootfs...))
+	head.KernelChecksum, head.RootfsChecksum, head.ImageChecksum = sums[1].Sum32(), sums[2].Sum32(), sums[3].Sum32()
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &head)
+	b.WriteString(board)
+	sums[0].Write(b.Bytes())
+	binary.BigEndian.PutUint32(b.Bytes()[36:], sums[0].Sum32())
+	b.Write(routerKernel)
+	b.Write(routerRootfs)
+	return b.Bytes()
+}
+
+func zynosImage() []byte {
+	head := zynosHeader{Addr: 0x80010000, Type: 4, Osize: uint32(len(routerKernel) + 1), Flags: zynosFlagOcsum}
+	copy(head.Sig[:], zynosSignature)
+	copy(head.Version[:], "V3.40(AAJ.1)")
+	data := append(append([]byte{}, routerKernel...), 'x')
+	var c zynosChecksum
+	c.Write(data)
+	head.Ocsum = c.Sum16()
+
+	b := make([]byte, zynosHeaderSize)
+	var h bytes.Buffer
+	binary.Write(&h, binary.BigEndian, &head)
+	copy(b, h.Bytes())
+	return append(b, data...)
+}
+
+func TestRouterImages(t *testing.T) {
+	var testdata = []struct {
+		format    string
+		extractor func(*types.Env, string) (string, error)
+		image     []byte
+		files     map[string][]byte
+		corrupt   int
+	}{
+		{"trx", Untrx, trxImage(1, routerKernel, routerRootfs), map[string][]byte{"kernel": routerKernel, "rootfs": routerRootfs}, 40},
+		{"trx", Untrx, trxImage(1, routerLoader, routerKernel, routerRootfs),
+			map[string][]byte{"loader": routerLoader, "kernel": routerKernel, "rootfs": routerRootfs}, 40},
+		{"trx", Untrx, trxImage(2, routerLoader, routerKernel, routerRootfs, []byte("bin header")),
+			map[string][]byte{"loader": routerLoader, "kernel": routerKernel, "rootfs": routerRootfs, "binheader": []byte("bin header")}, 40},
+		{"seama", Unseama, seamaImage(), map[string][]byte{"image": routerKernel}, 100},
+		{"shrs", Unshrs, shrsImage(), map[string][]byte{"image": routerKernel}, -1},
+		{"tplink", Untplink, tplinkImage(), map[string][]byte{"kernel": routerKernel, "rootfs": routerRootfs}, 0x300},
+		{"chk", Unchk, chkImage(), map[string][]byte{"kernel": routerKernel, "rootfs": routerRootfs}, 0x200},
+		{"zynos", Unzynos, zynosImage(), map[string][]byte{"ras_80010000": append(append([]byte{}, routerKernel...), 'x')}, 0x40},
+	}
+	for _, test := range testdata {
+		x, err := runExtractor(test.image, test.extractor)
+		if err != nil {
+			t.Errorf("%s: extraction failed: %v", test.format, err)
+			continue
+		}
+		for name, want := range test.files {
+			if data := x.content(t, name); !bytes.Equal(data, want) {
+				t.Errorf("%s: wrong %s", test.format, name)
+			}
+		}
+		a := x.input.Analyses[test.format]
+		if a == nil || a.Error != nil {
+			t.Errorf("%s: analysis is missing or failed: %v", test.format, a)
+		}
+
+		// a changed byte in the data is found by the checksum
+		if test.corrupt < 0 {
+			continue
+		}
+		image := append([]byte{}, test.image...)
+		image[test.corrupt] ^= 0xFF
+		x, err = runExtractor(image, test.extractor)
+		if err != nil {
+			t.Errorf("%s: extraction of a corrupt image failed: %v", test.format, err)
+		} else if a := x.input.Analyses[test.format]; a == nil || a.Error == nil {
+			t.Errorf("%s: bad checksum was not found", test.format)
+		}
+	}
+}
+
+func TestRouterChecksums(t *testing.T) {
+	// ZyNOS sums 16 bit words with the carry added back
+	var z zynosChecksum
+	z.Write([]byte{0xFF, 0xFF, 0x00, 0x02, 0x01})
+	if sum := z.Sum16(); sum != 0x0102 {
+		t.Errorf("zynos checksum is %04x", sum)
+	}
+
+	var c chkChecksum
+	c.Write([]byte{1, 2, 3})
+	if sum := c.Sum32(); sum != 0x000a0006 {
+		t.Errorf("chk checksum is %08x", sum)
+	}
+}
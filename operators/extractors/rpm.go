@@ -0,0 +1,152 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+	"github.com/avahidi/molly/util/compress"
+)
+
+const (
+	rpmLeadMagic   = 0xEDABEEDB
+	rpmHeaderMagic = 0x8EADE8
+	rpmLeadSize    = 96
+	rpmMaxIndex    = 1 << 16
+	rpmMaxStore    = 64 << 20
+
+	rpmTagName        = 1000
+	rpmTagVersion     = 1001
+	rpmTagRelease     = 1002
+	rpmTagEpoch       = 1003
+	rpmTagOs          = 1021
+	rpmTagArch        = 1022
+	rpmTagFormat      = 1124
+	rpmTagCompressor  = 1125
+	rpmTypeInt32      = 4
+	rpmTypeString     = 6
+	rpmTypeI18NString = 9
+)
+
+type rpmHeaderIntro struct {
+	Magic    [3]byte
+	Version  uint8
+	Reserved uint32
+	Count    uint32
+	Size     uint32
+}
+
+type rpmIndexEntry struct {
+	Tag    uint32
+	Type   uint32
+	Offset uint32
+	Count  uint32
+}
+
+// rpmHeader reads the header at offset and returns the tags with a string or
+// integer value together with the offset of the next header
+func rpmHeader(img util.Structured, offset int64) (map[uint32]interface{}, int64, error) {
+	var intro rpmHeaderIntro
+	if err := img.ReadAt(offset, &intro); err != nil {
+		return nil, 0, err
+	}
+	magic := uint32(intro.Magic[0])<<16 | uint32(intro.Magic[1])<<8 | uint32(intro.Magic[2])
+	if magic != rpmHeaderMagic || intro.Version != 1 {
+		return nil, 0, fmt.Errorf("rpm: bad header at %d", offset)
+	}
+	if intro.Count > rpmMaxIndex || intro.Size > rpmMaxStore {
+		return nil, 0, fmt.Errorf("rpm: header at %d is too large", offset)
+	}
+
+	index := make([]rpmIndexEntry, intro.Count)
+	if err := img.ReadAt(offset+16, index); err != nil {
+		return nil, 0, err
+	}
+	store := make([]byte, intro.Size)
+	if err := img.ReadAt(offset+16+16*int64(intro.Count), store); err != nil {
+		return nil, 0, err
+	}
+
+	tags := map[uint32]interface{}{}
+	for _, entry := range index {
+		if entry.Offset >= intro.Size {
+			continue
+		}
+		data := store[entry.Offset:]
+		switch entry.Type {
+		case rpmTypeString, rpmTypeI18NString:
+			if n := bytes.IndexByte(data, 0); n != -1 {
+				tags[entry.Tag] = string(data[:n])
+			}
+		case rpmTypeInt32:
+			if len(data) >= 4 {
+				tags[entry.Tag] = uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+			}
+		}
+	}
+	return tags, offset + 16 + 16*int64(intro.Count) + int64(intro.Size), nil
+}
+
+// rpmPayload opens the decompressor of the payload
+func rpmPayload(compressor string, r io.Reader) (io.Reader, error) {
+	switch compressor {
+	case "gzip", "":
+		return gzip.NewReader(r)
+	case "bzip2":
+		return bzip2.NewReader(r), nil
+	case "xz":
+		return compress.NewXzReader(r)
+	case "lzma":
+		return compress.NewLzmaReader(r)
+	case "zstd":
+		return compress.NewZstdReader(r)
+	}
+	return nil, fmt.Errorf("rpm: %s compressed payloads are not supported", compressor)
+}
+
+// Unrpm extracts the cpio payload of an RPM package. The name, version and
+// architecture of the package are recorded as the analysis "package"
+func Unrpm(e *types.Env, prefix string) (string, error) {
+	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
+	var lead uint32
+	if err := img.ReadAt(0, &lead); err != nil || lead != rpmLeadMagic {
+		return "", fmt.Errorf("file is not an RPM package")
+	}
+
+	// the signature header is padded to 8 bytes, the main header is not
+	_, offset, err := rpmHeader(img, rpmLeadSize)
+	if err != nil {
+		return "", err
+	}
+	offset = (offset + 7) &^ 7
+	tags, offset, err := rpmHeader(img, offset)
+	if err != nil {
+		return "", err
+	}
+
+	report := map[string]interface{}{"format": "rpm"}
+	for tag, key := range map[uint32]string{rpmTagName: "name", rpmTagVersion: "version",
+		rpmTagRelease: "release", rpmTagEpoch: "epoch", rpmTagArch: "arch", rpmTagOs: "os",
+		rpmTagCompressor: "compressor"} {
+		if value, found := tags[tag]; found {
+			report[key] = value
+		}
+	}
+	analysis := e.AnalysisName("package")
+	e.Current.RegisterAnalysis(analysis, report, nil)
+
+	if format, found := tags[rpmTagFormat]; found && format != "cpio" {
+		return "", fmt.Errorf("rpm: %v payloads are not supported", format)
+	}
+	compressor, _ := tags[rpmTagCompressor].(string)
+	r, err := rpmPayload(compressor, util.NewSectionReader(e.Reader, offset, int64(e.GetSize())-offset))
+	if err != nil {
+		return "", err
+	}
+	return "", cpioExtract(e, r, prefix)
+}
@@ -0,0 +1,85 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// cpioNewc creates a newc cpio archive with regular files
+func cpioNewc(files ...[2]string) []byte {
+	var b bytes.Buffer
+	pad := func() {
+		for b.Len()%4 != 0 {
+			b.WriteByte(0)
+		}
+	}
+	for i, f := range append(files, [2]string{"TRAILER!!!", ""}) {
+		fmt.Fprintf(&b, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			i+1, 0100644, 0, 0, 1, 1600000000, len(f[1]), 0, 0, 0, 0, len(f[0])+1, 0)
+		b.WriteString(f[0] + "\x00")
+		pad()
+		b.WriteString(f[1])
+		pad()
+	}
+	return b.Bytes()
+}
+
+// rpmTestHeader creates a header with string tags
+func rpmTestHeader(tags map[uint32]string) []byte {
+	var index, store bytes.Buffer
+	for tag := uint32(1000); tag < 1200; tag++ {
+		if value, found := tags[tag]; found {
+			binary.Write(&index, binary.BigEndian, rpmIndexEntry{tag, rpmTypeString, uint32(store.Len()), 1})
+			store.WriteString(value + "\x00")
+		}
+	}
+	var b bytes.Buffer
+	b.Write([]byte{0x8E, 0xAD, 0xE8, 0x01, 0, 0, 0, 0})
+	binary.Write(&b, binary.BigEndian, []uint32{uint32(index.Len() / 16), uint32(store.Len())})
+	b.Write(index.Bytes())
+	b.Write(store.Bytes())
+	return b.Bytes()
+}
+
+func TestUnrpm(t *testing.T) {
+	lead := make([]byte, rpmLeadSize)
+	copy(lead, []byte{0xED, 0xAB, 0xEE, 0xDB, 3, 0})
+
+	var rpm bytes.Buffer
+	rpm.Write(lead)
+	rpm.Write(rpmTestHeader(map[uint32]string{1000: "x"}))
+	for rpm.Len()%8 != 0 {
+		rpm.WriteByte(0)
+	}
+	rpm.Write(rpmTestHeader(map[uint32]string{rpmTagName: "molly", rpmTagVersion: "1.2",
+		rpmTagRelease: "3", rpmTagArch: "aarch64", rpmTagOs: "linux", rpmTagFormat: "cpio"}))
+	rpm.Write(gzipData(cpioNewc([2]string{"./usr/bin/molly", "binary"}, [2]string{"./etc/molly.conf", "conf\n"})))
+
+	x, err := runExtractor(rpm.Bytes(), Unrpm)
+	if err != nil {
+		t.Fatalf("rpm extraction failed: %v", err)
+	}
+	if data := x.content(t, "usr/bin/molly"); string(data) != "binary" {
+		t.Errorf("wrong usr/bin/molly %q", data)
+	}
+	if data := x.content(t, "etc/molly.conf"); string(data) != "conf\n" {
+		t.Errorf("wrong etc/molly.conf %q", data)
+	}
+
+	a := x.input.Analyses["package"]
+	if a == nil || a.Error != nil {
+		t.Fatalf("package analysis is missing or failed: %v", a)
+	}
+	report := a.Result.(map[string]interface{})
+	if report["format"] != "rpm" || report["name"] != "molly" || report["version"] != "1.2" ||
+		report["release"] != "3" || report["arch"] != "aarch64" || report["os"] != "linux" {
+		t.Errorf("wrong package analysis %v", report)
+	}
+
+	rpm.Truncate(rpmLeadSize + 4)
+	if _, err := runExtractor(rpm.Bytes(), Unrpm); err == nil {
+		t.Errorf("truncated header was accepted")
+	}
+}
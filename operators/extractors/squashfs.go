@@ -0,0 +1,557 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+	"github.com/avahidi/molly/util/compress"
+)
+
+const (
+	sqfsMagic        = 0x73717368
+	sqfsMetaSize     = 8192
+	sqfsMetaStored   = 0x8000
+	sqfsBlockStored  = 1 << 24
+	sqfsNoFragment   = 0xFFFFFFFF
+	sqfsMaxLinkSize  = 4096
+	sqfsDirMaxCount  = 256
+	sqfsInodeDir     = 1
+	sqfsInodeFile    = 2
+	sqfsInodeSymlink = 3
+	sqfsInodeBlock   = 4
+	sqfsInodeChar    = 5
+	sqfsInodeFifo    = 6
+	sqfsInodeSocket  = 7
+	sqfsInodeLDir    = 8
+	sqfsInodeLFile   = 9
+	sqfsInodeLast    = 14
+)
+
+var sqfsCompression = map[uint16]string{
+	1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+
+type sqfsSuper struct {
+	Magic       uint32
+	Inodes      uint32
+	MkfsTime    uint32
+	BlockSize   uint32
+	Fragments   uint32
+	Compression uint16
+	BlockLog    uint16
+	Flags       uint16
+	NoIds       uint16
+	Major       uint16
+	Minor       uint16
+	RootInode   uint64
+	BytesUsed   uint64
+	IDTable     uint64
+	XattrTable  uint64
+	InodeTable  uint64
+	DirTable    uint64
+	FragTable   uint64
+	ExportTable uint64
+}
+
+type sqfsInode struct {
+	Type   uint16
+	Mode   uint16
+	UID    uint16
+	GID    uint16
+	Mtime  uint32
+	Number uint32
+}
+
+type sqfsFragment struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+type sqfsMeta struct {
+	data []byte
+	next int64
+}
+
+type sqfsContext struct {
+	util.Structured
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Link     func(string, string, bool) (*types.FileData, error)
+	Node     func(string, string) (*types.FileData, error)
+	Mkdir    func(string) (*types.FileData, error)
+	Canceled func() error
+
+	super      sqfsSuper
+	decompress func(src []byte, max int) ([]byte, error)
+	meta       map[int64]*sqfsMeta
+	dirs       map[uint64]bool
+	frag       uint32
+	fragData   []byte
+}
+
+// readLimited reads all data from r, which must not be more than max bytes
+func readLimited(r io.Reader, max int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err == nil && len(data) > max {
+		err = fmt.Errorf("decompressed block is larger than %d bytes", max)
+	}
+	return data, err
+}
+
+// sqfsDecompressor returns the decompression function for a compression id
+func sqfsDecompressor(id uint16) (func([]byte, int) ([]byte, error), error) {
+	var open func(io.Reader) (io.Reader, error)
+	switch id {
+	case 1:
+		open = func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }
+	case 2:
+		open = compress.NewLzmaReader
+	case 3:
+		return compress.Lzo1xDecompress, nil
+	case 4:
+		open = compress.NewXzReader
+	case 6:
+		open = compress.NewZstdReader
+	default:
+		if name, found := sqfsCompression[id]; found {
+			return nil, fmt.Errorf("squashfs: %s compression is not supported", name)
+		}
+		return nil, fmt.Errorf("squashfs: unknown compression %d", id)
+	}
+	return func(src []byte, max int) ([]byte, error) {
+		r, err := open(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		return readLimited(r, max)
+	}, nil
+}
+
+// metaBlock returns a metadata block and the position of the next one
+func (c *sqfsContext) metaBlock(pos int64) (*sqfsMeta, error) {
+	if m, found := c.meta[pos]; found {
+		return m, nil
+	}
+	var head uint16
+	if err := c.ReadAt(pos, &head); err != nil {
+		return nil, err
+	}
+	data := make([]byte, head&^sqfsMetaStored)
+	if err := c.Read(data); err != nil {
+		return nil, err
+	}
+	if head&sqfsMetaStored == 0 {
+		var err error
+		if data, err = c.decompress(data, sqfsMetaSize); err != nil {
+			return nil, err
+		}
+	}
+	m := &sqfsMeta{data: data, next: pos + 2 + int64(len(data))}
+	if head&sqfsMetaStored == 0 {
+		m.next = pos + 2 + int64(head)
+	}
+	c.meta[pos] = m
+	return m, nil
+}
+
+// sqfsMetaReader reads data that spans metadata blocks
+type sqfsMetaReader struct {
+	c    *sqfsContext
+	next int64
+	data []byte
+}
+
+func (c *sqfsContext) metaReader(pos int64, offset int) (*sqfsMetaReader, error) {
+	m, err := c.metaBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	if offset > len(m.data) {
+		return nil, fmt.Errorf("squashfs: bad metadata offset %d", offset)
+	}
+	return &sqfsMetaReader{c: c, next: m.next, data: m.data[offset:]}, nil
+}
+
+func (r *sqfsMetaReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		m, err := r.c.metaBlock(r.next)
+		if err != nil {
+			return 0, err
+		}
+		if len(m.data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.data, r.next = m.data, m.next
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// tableEntry reads entry i from a table of metadata blocks, such as the id table
+func (c *sqfsContext) tableEntry(table uint64, i int, data interface{}) error {
+	size := binary.Size(data)
+	perBlock := sqfsMetaSize / size
+	var pos uint64
+	if err := c.ReadAt(int64(table)+int64(8*(i/perBlock)), &pos); err != nil {
+		return err
+	}
+	r, err := c.metaReader(int64(pos), (i%perBlock)*size)
+	if err != nil {
+		return err
+	}
+	return binary.Read(r, c.Order, data)
+}
+
+// dataBlock reads a data or fragment block, size is the on-disk size and flag
+func (c *sqfsContext) dataBlock(pos int64, size uint32) ([]byte, error) {
+	// blocks are stored uncompressed if compression does not make them smaller
+	if size&^sqfsBlockStored > c.super.BlockSize {
+		return nil, fmt.Errorf("squashfs: bad block size %d", size&^sqfsBlockStored)
+	}
+	data := make([]byte, size&^sqfsBlockStored)
+	if err := c.ReadAt(pos, data); err != nil {
+		return nil, err
+	}
+	if size&sqfsBlockStored != 0 {
+		return data, nil
+	}
+	return c.decompress(data, int(c.super.BlockSize))
+}
+
+func (c *sqfsContext) fragment(index uint32) ([]byte, error) {
+	if c.fragData != nil && c.frag == index {
+		return c.fragData, nil
+	}
+	if index >= c.super.Fragments {
+		return nil, fmt.Errorf("squashfs: bad fragment %d", index)
+	}
+	var frag sqfsFragment
+	if err := c.tableEntry(c.super.FragTable, int(index), &frag); err != nil {
+		return nil, err
+	}
+	data, err := c.dataBlock(int64(frag.Start), frag.Size)
+	if err != nil {
+		return nil, err
+	}
+	c.frag, c.fragData = index, data
+	return data, nil
+}
+
+// setInfo records file information as metadata
+func (c *sqfsContext) setInfo(fd *types.FileData, inode *sqfsInode) {
+	fd.SetTime(time.Unix(int64(inode.Mtime), 0))
+	fd.SetMetadata("mode", int64(inode.Mode&07777))
+	for name, idx := range map[string]uint16{"uid": inode.UID, "gid": inode.GID} {
+		var id uint32
+		if idx < c.super.NoIds && c.tableEntry(c.super.IDTable, int(idx), &id) == nil {
+			fd.SetMetadata(name, int64(id))
+		}
+	}
+}
+
+func (c *sqfsContext) inodeDir(r io.Reader, inode *sqfsInode, ref uint64, name string) error {
+	// directories are never linked, seeing one twice means the image is broken
+	if c.dirs[ref] {
+		return fmt.Errorf("squashfs: directory loop at %s", name)
+	}
+	c.dirs[ref] = true
+
+	var start, size uint32
+	var offset uint16
+	if inode.Type == sqfsInodeDir {
+		var dir struct {
+			Start  uint32
+			Nlink  uint32
+			Size   uint16
+			Offset uint16
+			Parent uint32
+		}
+		if err := binary.Read(r, c.Order, &dir); err != nil {
+			return err
+		}
+		start, size, offset = dir.Start, uint32(dir.Size), dir.Offset
+	} else {
+		var dir struct {
+			Nlink  uint32
+			Size   uint32
+			Start  uint32
+			Parent uint32
+			Index  uint16
+			Offset uint16
+			Xattr  uint32
+		}
+		if err := binary.Read(r, c.Order, &dir); err != nil {
+			return err
+		}
+		start, size, offset = dir.Start, dir.Size, dir.Offset
+	}
+
+	if name != "" {
+		fd, err := c.Mkdir(name)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, inode)
+	}
+	// the size includes the "." and ".." entries, which are not stored
+	if size <= 3 {
+		return nil
+	}
+	dr, err := c.metaReader(int64(c.super.DirTable)+int64(start), int(offset))
+	if err != nil {
+		return err
+	}
+	lr := &io.LimitedReader{R: dr, N: int64(size) - 3}
+	for lr.N > 0 {
+		var head struct {
+			Count uint32
+			Start uint32
+			Inode uint32
+		}
+		if err := binary.Read(lr, c.Order, &head); err != nil {
+			return err
+		}
+		if head.Count >= sqfsDirMaxCount {
+			return fmt.Errorf("squashfs: bad directory header in %s", name)
+		}
+		for i := uint32(0); i <= head.Count; i++ {
+			var entry struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				Size        uint16
+			}
+			if err := binary.Read(lr, c.Order, &entry); err != nil {
+				return err
+			}
+			ename := make([]byte, int(entry.Size)+1)
+			if _, err := io.ReadFull(lr, ename); err != nil {
+				return err
+			}
+			ref := uint64(head.Start)<<16 | uint64(entry.Offset)
+			if err := c.inode(ref, path.Join(name, string(ename))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *sqfsContext) inodeFile(r io.Reader, inode *sqfsInode, name string) error {
+	var start, size int64
+	var frag, offset uint32
+	if inode.Type == sqfsInodeFile {
+		var file struct {
+			Start    uint32
+			Fragment uint32
+			Offset   uint32
+			Size     uint32
+		}
+		if err := binary.Read(r, c.Order, &file); err != nil {
+			return err
+		}
+		start, size, frag, offset = int64(file.Start), int64(file.Size), file.Fragment, file.Offset
+	} else {
+		var file struct {
+			Start    uint64
+			Size     uint64
+			Sparse   uint64
+			Nlink    uint32
+			Fragment uint32
+			Offset   uint32
+			Xattr    uint32
+		}
+		if err := binary.Read(r, c.Order, &file); err != nil {
+			return err
+		}
+		start, size, frag, offset = int64(file.Start), int64(file.Size), file.Fragment, file.Offset
+	}
+
+	w, fd, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	c.setInfo(fd, inode)
+
+	// full blocks come first, the tail may be stored in a fragment
+	blockSize := int64(c.super.BlockSize)
+	blocks := size / blockSize
+	if frag == sqfsNoFragment && size%blockSize != 0 {
+		blocks++
+	}
+	for i := int64(0); i < blocks; i++ {
+		if err := c.Canceled(); err != nil {
+			return err
+		}
+		var bsize uint32
+		if err := binary.Read(r, c.Order, &bsize); err != nil {
+			return err
+		}
+		n := blockSize
+		if size < n {
+			n = size
+		}
+		data := make([]byte, n)
+		if bsize&^sqfsBlockStored != 0 {
+			block, err := c.dataBlock(start, bsize)
+			if err != nil {
+				return err
+			}
+			if int64(len(block)) < n {
+				return fmt.Errorf("squashfs: short block in %s", name)
+			}
+			data = block[:n]
+			start += int64(bsize &^ sqfsBlockStored)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		size -= n
+	}
+
+	if frag == sqfsNoFragment || size == 0 {
+		return nil
+	}
+	data, err := c.fragment(frag)
+	if err != nil {
+		return err
+	}
+	if int64(offset)+size > int64(len(data)) {
+		return fmt.Errorf("squashfs: bad fragment offset in %s", name)
+	}
+	_, err = w.Write(data[offset : int64(offset)+size])
+	return err
+}
+
+func (c *sqfsContext) inodeLink(r io.Reader, inode *sqfsInode, name string) error {
+	var link struct {
+		Nlink uint32
+		Size  uint32
+	}
+	if err := binary.Read(r, c.Order, &link); err != nil {
+		return err
+	}
+	if link.Size > sqfsMaxLinkSize {
+		return fmt.Errorf("squashfs: bad link size in %s", name)
+	}
+	target := make([]byte, link.Size)
+	if _, err := io.ReadFull(r, target); err != nil {
+		return err
+	}
+	fd, err := c.Link(name, string(target), false)
+	if err != nil {
+		return err
+	}
+	c.setInfo(fd, inode)
+	return nil
+}
+
+func (c *sqfsContext) inodeNode(r io.Reader, inode *sqfsInode, name string) error {
+	var node struct {
+		Nlink  uint32
+		Device uint32
+	}
+	var typ string
+	switch (inode.Type-1)%7 + 1 {
+	case sqfsInodeBlock:
+		typ = "blockdev"
+	case sqfsInodeChar:
+		typ = "chardev"
+	case sqfsInodeFifo:
+		typ = "fifo"
+	default:
+		typ = "socket"
+	}
+	var err error
+	if typ == "blockdev" || typ == "chardev" {
+		err = binary.Read(r, c.Order, &node)
+	}
+	if err != nil {
+		return err
+	}
+
+	fd, err := c.Node(name, typ)
+	if err != nil {
+		return err
+	}
+	c.setInfo(fd, inode)
+	if typ == "blockdev" || typ == "chardev" {
+		fd.SetMetadata("major", int64((node.Device>>8)&0xFFF))
+		fd.SetMetadata("minor", int64(node.Device&0xFF|(node.Device>>12)&0xFFF00))
+	}
+	return nil
+}
+
+func (c *sqfsContext) inode(ref uint64, name string) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
+	r, err := c.metaReader(int64(c.super.InodeTable)+int64(ref>>16), int(ref&0xFFFF))
+	if err != nil {
+		return err
+	}
+	var inode sqfsInode
+	if err := binary.Read(r, c.Order, &inode); err != nil {
+		return err
+	}
+
+	switch inode.Type {
+	case sqfsInodeDir, sqfsInodeLDir:
+		return c.inodeDir(r, &inode, ref, name)
+	case sqfsInodeFile, sqfsInodeLFile:
+		return c.inodeFile(r, &inode, name)
+	case sqfsInodeSymlink, sqfsInodeSymlink + 7:
+		return c.inodeLink(r, &inode, name)
+	default:
+		if inode.Type > sqfsInodeLast {
+			return fmt.Errorf("squashfs: unknown inode type %d for %s", inode.Type, name)
+		}
+		return c.inodeNode(r, &inode, name)
+	}
+}
+
+// Unsquashfs extracts a squashfs 4.x image.
+//
+// Links and device nodes are not created, they are recorded as metadata.
+// Extended attributes are ignored
+func Unsquashfs(e *types.Env, prefix string) (string, error) {
+	c := &sqfsContext{
+		Create:   e.Create,
+		Link:     e.Link,
+		Node:     e.Node,
+		Mkdir:    e.Mkdir,
+		Canceled: e.Canceled,
+		meta:     make(map[int64]*sqfsMeta),
+		dirs:     make(map[uint64]bool),
+	}
+	c.Reader = e.Reader
+	c.Order = binary.LittleEndian
+
+	s := &c.super
+	if err := c.ReadAt(0, s); err != nil {
+		return "", err
+	}
+	if s.Magic != sqfsMagic {
+		return "", fmt.Errorf("file is not a squashfs")
+	}
+	if s.Major != 4 {
+		return "", fmt.Errorf("squashfs: version %d.%d is not supported", s.Major, s.Minor)
+	}
+	if s.BlockLog < 12 || s.BlockLog > 20 || s.BlockSize != 1<<s.BlockLog {
+		return "", fmt.Errorf("squashfs: bad block size %d", s.BlockSize)
+	}
+
+	var err error
+	if c.decompress, err = sqfsDecompressor(s.Compression); err != nil {
+		return "", err
+	}
+	return prefix, c.inode(s.RootInode, prefix)
+}
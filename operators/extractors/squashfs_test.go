@@ -0,0 +1,207 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+// sqfsBuilder creates small squashfs images with one metadata block per table
+type sqfsBuilder struct {
+	data, inodes, dirs bytes.Buffer
+	count              uint32
+}
+
+func sqfsPut(b *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		binary.Write(b, binary.LittleEndian, v)
+	}
+}
+
+func sqfsZlib(data []byte) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+// sqfsMetaBlock returns a metadata block, compressed or stored
+func sqfsMetaBlock(data []byte, compressed bool) []byte {
+	var b bytes.Buffer
+	if compressed {
+		data = sqfsZlib(data)
+		sqfsPut(&b, uint16(len(data)))
+	} else {
+		sqfsPut(&b, uint16(len(data))|sqfsMetaStored)
+	}
+	b.Write(data)
+	return b.Bytes()
+}
+
+// inode adds an inode and returns its reference
+func (s *sqfsBuilder) inode(typ, mode, uid uint16, values ...interface{}) uint32 {
+	ref := uint32(s.inodes.Len())
+	s.count++
+	sqfsPut(&s.inodes, typ, mode, uid, uint16(0), uint32(1500000000), s.count)
+	sqfsPut(&s.inodes, values...)
+	return ref
+}
+
+type sqfsEntry struct {
+	name string
+	typ  uint16
+	ref  uint32
+}
+
+// dir adds a directory listing, it returns its offset and size
+func (s *sqfsBuilder) dir(entries ...sqfsEntry) (uint16, uint16) {
+	offset := s.dirs.Len()
+	sqfsPut(&s.dirs, uint32(len(entries)-1), uint32(0), uint32(0))
+	for _, e := range entries {
+		sqfsPut(&s.dirs, uint16(e.ref), int16(0), e.typ, uint16(len(e.name)-1))
+		s.dirs.WriteString(e.name)
+	}
+	return uint16(offset), uint16(s.dirs.Len()-offset) + 3
+}
+
+// squashfsImage creates an image with a few files, if loop is set the
+// root directory also contains itself
+func squashfsImage(loop bool) ([]byte, []byte) {
+	const blockSize = 4096
+	s := &sqfsBuilder{}
+	s.data.Write(make([]byte, 96))
+
+	// big.bin has a compressed, a stored and a sparse block and a tail
+	big := make([]byte, 3*blockSize+100)
+	for i := range big[:2*blockSize] {
+		big[i] = byte(i * 7 / 3)
+	}
+	copy(big[3*blockSize:], "the tail is stored in a fragment")
+	bigStart := s.data.Len()
+	block0 := sqfsZlib(big[:blockSize])
+	s.data.Write(block0)
+	s.data.Write(big[blockSize : 2*blockSize])
+
+	hello := []byte("hello squashfs\n")
+	frag := append(append([]byte{}, hello...), big[3*blockSize:]...)
+	fragStart := s.data.Len()
+	fragData := sqfsZlib(frag)
+	s.data.Write(fragData)
+
+	helloRef := s.inode(sqfsInodeFile, 0644, 0,
+		uint32(0), uint32(0), uint32(0), uint32(len(hello)))
+	bigRef := s.inode(sqfsInodeLFile, 04755, 1,
+		uint64(bigStart), uint64(len(big)), uint64(blockSize), uint32(1), uint32(0), uint32(len(hello)), uint32(0xFFFFFFFF),
+		uint32(len(block0)), uint32(blockSize|sqfsBlockStored), uint32(0))
+	linkRef := s.inode(sqfsInodeSymlink, 0777, 0, uint32(1), uint32(12))
+	s.inodes.WriteString("../hello.txt")
+	nullRef := s.inode(sqfsInodeChar, 0666, 0, uint32(1), uint32(1<<8|3))
+
+	offset, size := s.dir(
+		sqfsEntry{"big.bin", sqfsInodeFile, bigRef},
+		sqfsEntry{"link", sqfsInodeSymlink, linkRef})
+	dirRef := s.inode(sqfsInodeDir, 0755, 0, uint32(0), uint32(2), size, offset, uint32(0))
+
+	rootRef := uint32(s.inodes.Len())
+	entries := []sqfsEntry{
+		{"dir", sqfsInodeDir, dirRef},
+		{"hello.txt", sqfsInodeFile, helloRef},
+		{"null", sqfsInodeChar, nullRef}}
+	if loop {
+		entries = append(entries, sqfsEntry{"self", sqfsInodeDir, rootRef})
+	}
+	offset, size = s.dir(entries...)
+	s.inode(sqfsInodeDir, 0755, 0, uint32(0), uint32(3), size, offset, uint32(0))
+
+	inodeTable := s.data.Len()
+	s.data.Write(sqfsMetaBlock(s.inodes.Bytes(), true))
+	dirTable := s.data.Len()
+	s.data.Write(sqfsMetaBlock(s.dirs.Bytes(), false))
+
+	var table bytes.Buffer
+	sqfsPut(&table, uint64(fragStart), uint32(len(fragData)), uint32(0))
+	fragMeta := s.data.Len()
+	s.data.Write(sqfsMetaBlock(table.Bytes(), false))
+	fragTable := s.data.Len()
+	sqfsPut(&s.data, uint64(fragMeta))
+
+	table.Reset()
+	sqfsPut(&table, uint32(0), uint32(1000))
+	idMeta := s.data.Len()
+	s.data.Write(sqfsMetaBlock(table.Bytes(), true))
+	idTable := s.data.Len()
+	sqfsPut(&s.data, uint64(idMeta))
+
+	super := sqfsSuper{
+		Magic: sqfsMagic, Inodes: s.count, MkfsTime: 1500000000,
+		BlockSize: blockSize, Fragments: 1, Compression: 1, BlockLog: 12,
+		NoIds: 2, Major: 4, RootInode: uint64(rootRef),
+		BytesUsed: uint64(s.data.Len()), IDTable: uint64(idTable),
+		XattrTable: ^uint64(0), InodeTable: uint64(inodeTable),
+		DirTable: uint64(dirTable), FragTable: uint64(fragTable),
+		ExportTable: ^uint64(0),
+	}
+	image := s.data.Bytes()
+	var head bytes.Buffer
+	sqfsPut(&head, &super)
+	copy(image, head.Bytes())
+	return image, big
+}
+
+func TestUnsquashfs(t *testing.T) {
+	image, big := squashfsImage(false)
+	x, err := runExtractor(image, Unsquashfs)
+	if err != nil {
+		t.Fatalf("squashfs extraction failed: %v", err)
+	}
+
+	if data := x.content(t, "hello.txt"); string(data) != "hello squashfs\n" {
+		t.Errorf("hello.txt: wrong content %q", data)
+	}
+	if data := x.content(t, "dir/big.bin"); !bytes.Equal(data, big) {
+		t.Errorf("big.bin: wrong content")
+	}
+
+	var testdata = []struct {
+		file, key string
+		value     interface{}
+	}{
+		{"hello.txt", "mode", int64(0644)},
+		{"hello.txt", "uid", int64(0)},
+		{"dir/big.bin", "mode", int64(04755)},
+		{"dir/big.bin", "uid", int64(1000)},
+		{"dir/big.bin", "gid", int64(0)},
+		{"dir/link", "type", "symlink"},
+		{"dir/link", "link", "../hello.txt"},
+		{"null", "type", "chardev"},
+		{"null", "major", int64(1)},
+		{"null", "minor", int64(3)},
+		{"dir", "mode", int64(0755)},
+	}
+	for _, test := range testdata {
+		if v := x.metadata(t, test.file, test.key); v != test.value {
+			t.Errorf("%s: wanted %s=%v, got %v", test.file, test.key, test.value, v)
+		}
+	}
+	if y := x.files["hello.txt"].GetTime().Unix(); y != 1500000000 {
+		t.Errorf("hello.txt: wrong time %d", y)
+	}
+}
+
+func TestUnsquashfsBroken(t *testing.T) {
+	image, _ := squashfsImage(true)
+	if _, err := runExtractor(image, Unsquashfs); err == nil {
+		t.Errorf("directory loop was not detected")
+	}
+
+	// damaged images should fail, but not crash or hang
+	image, _ = squashfsImage(false)
+	for i := 0; i < len(image); i += 5 {
+		runExtractor(image[:i], Unsquashfs)
+		damaged := append([]byte{}, image...)
+		damaged[i] ^= 0x55
+		runExtractor(damaged, Unsquashfs)
+	}
+}
@@ -12,6 +12,9 @@ func Untar(e *types.Env, prefix string) (string, error) {
 
 	tr := tar.NewReader(r)
 	for {
+		if err := e.Canceled(); err != nil {
+			return "", err
+		}
 		h, err := tr.Next()
 		if err == io.EOF {
 			return "", nil // not really an error...
@@ -20,7 +23,13 @@ func Untar(e *types.Env, prefix string) (string, error) {
 			return "", err
 		}
 
-		if !h.FileInfo().IsDir() {
+		switch {
+		case h.Typeflag == tar.TypeSymlink || h.Typeflag == tar.TypeLink:
+			// links are recorded, not created
+			if _, err := e.Link(prefix+h.Name, h.Linkname, h.Typeflag == tar.TypeLink); err != nil {
+				return "", err
+			}
+		case !h.FileInfo().IsDir():
 			w, d, err := e.Create(prefix + h.Name)
 			if err != nil {
 				return "", err
@@ -0,0 +1,345 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	ubiECMagic       = 0x55424923 // UBI#
+	ubiVIDMagic      = 0x55424921 // UBI!
+	ubiHeaderSize    = 64
+	ubiLayoutVolume  = 0x7FFFEFFF
+	ubiMaxVolumes    = 128
+	ubiVtblEntrySize = 172
+	ubiVolumeDynamic = 1
+	ubiMinPebSize    = 1 << 12
+	ubiMaxPebSize    = 1 << 24
+)
+
+type ubiECHeader struct {
+	Magic        uint32
+	Version      uint8
+	Padding1     [3]uint8
+	EC           uint64
+	VIDHdrOffset uint32
+	DataOffset   uint32
+	ImageSeq     uint32
+	Padding2     [32]uint8
+	HdrCRC       uint32
+}
+
+type ubiVIDHeader struct {
+	Magic    uint32
+	Version  uint8
+	VolType  uint8
+	CopyFlag uint8
+	Compat   uint8
+	VolID    uint32
+	Lnum     uint32
+	Padding1 [4]uint8
+	DataSize uint32
+	UsedEBs  uint32
+	DataPad  uint32
+	DataCRC  uint32
+	Padding2 [4]uint8
+	Sqnum    uint64
+	Padding3 [12]uint8
+	HdrCRC   uint32
+}
+
+type ubiVtblRecord struct {
+	ReservedPEBs uint32
+	Alignment    uint32
+	DataPad      uint32
+	VolType      uint8
+	UpdMarker    uint8
+	NameLen      uint16
+	Name         [128]byte
+	Flags        uint8
+	Padding      [23]uint8
+	CRC          uint32
+}
+
+// ubiCRC is the CRC32 used by UBI and UBIFS, which is not inverted
+func ubiCRC(data []byte) uint32 {
+	return ^crc32.ChecksumIEEE(data)
+}
+
+// ubiPeb is a physical erase block mapped to a logical one
+type ubiPeb struct {
+	offset int64
+	vid    ubiVIDHeader
+}
+
+type ubiContext struct {
+	util.Structured
+	pebSize    int64
+	dataOffset int64
+	imageSeq   uint32
+	badEC      int
+	badVID     int
+
+	// volumes maps a volume id to its LEBs
+	volumes map[uint32]map[uint32][]*ubiPeb
+}
+
+// ecHeader reads and verifies an erase counter header
+func (c *ubiContext) ecHeader(offset int64) (*ubiECHeader, error) {
+	var raw [ubiHeaderSize]byte
+	if err := c.ReadAt(offset, raw[:]); err != nil {
+		return nil, err
+	}
+	var ec ubiECHeader
+	binary.Read(bytes.NewReader(raw[:]), binary.BigEndian, &ec)
+	if ec.Magic != ubiECMagic || ubiCRC(raw[:ubiHeaderSize-4]) != ec.HdrCRC {
+		return nil, fmt.Errorf("ubi: bad EC header at %x", offset)
+	}
+	return &ec, nil
+}
+
+// findPebSize finds the erase block size, which is the smallest power of
+// two with a valid EC header at that offset
+func (c *ubiContext) findPebSize(filesize int64) int64 {
+	for size := int64(ubiMinPebSize); size <= ubiMaxPebSize && size < filesize; size *= 2 {
+		if _, err := c.ecHeader(size); err == nil {
+			return size
+		}
+	}
+	// images with only one erase block
+	return filesize
+}
+
+// scan reads the headers of all erase blocks
+func (c *ubiContext) scan(e *types.Env, filesize int64) error {
+	for offset := int64(0); offset+c.pebSize <= filesize; offset += c.pebSize {
+		if err := e.Canceled(); err != nil {
+			return err
+		}
+		ec, err := c.ecHeader(offset)
+		if err != nil {
+			c.badEC++
+			continue
+		}
+		if ec.ImageSeq != c.imageSeq || int64(ec.VIDHdrOffset)+ubiHeaderSize > c.pebSize {
+			continue
+		}
+
+		var raw [ubiHeaderSize]byte
+		if err := c.ReadAt(offset+int64(ec.VIDHdrOffset), raw[:]); err != nil {
+			return err
+		}
+		peb := &ubiPeb{offset: offset + int64(ec.DataOffset)}
+		binary.Read(bytes.NewReader(raw[:]), binary.BigEndian, &peb.vid)
+		if peb.vid.Magic != ubiVIDMagic {
+			// erased blocks are not an error
+			if peb.vid.Magic != 0xFFFFFFFF {
+				c.badVID++
+			}
+			continue
+		}
+		if ubiCRC(raw[:ubiHeaderSize-4]) != peb.vid.HdrCRC {
+			c.badVID++
+			continue
+		}
+		if c.volumes[peb.vid.VolID] == nil {
+			c.volumes[peb.vid.VolID] = make(map[uint32][]*ubiPeb)
+		}
+		lebs := c.volumes[peb.vid.VolID]
+		lebs[peb.vid.Lnum] = append(lebs[peb.vid.Lnum], peb)
+	}
+	return nil
+}
+
+// leb returns the data of a logical erase block. If it was being moved
+// when the image was made there are two copies, the newest is used unless
+// its data is damaged
+func (c *ubiContext) leb(pebs []*ubiPeb, static bool) ([]byte, error) {
+	sort.Slice(pebs, func(i, j int) bool { return pebs[i].vid.Sqnum > pebs[j].vid.Sqnum })
+	var data []byte
+	for _, peb := range pebs {
+		full := c.pebSize - c.dataOffset - int64(peb.vid.DataPad)
+		size := full
+		if static || peb.vid.CopyFlag != 0 {
+			size = int64(peb.vid.DataSize)
+		}
+		if size < 0 || size > full {
+			return nil, fmt.Errorf("ubi: bad data size at %x", peb.offset)
+		}
+		data = make([]byte, size)
+		if err := c.ReadAt(peb.offset, data); err != nil {
+			return nil, err
+		}
+		if peb.vid.CopyFlag != 0 && ubiCRC(data) != peb.vid.DataCRC {
+			continue
+		}
+		// the data size of moved blocks in dynamic volumes excludes the
+		// erased end of the block
+		if !static {
+			data = append(data, bytes.Repeat([]byte{0xFF}, int(full-size))...)
+		}
+		return data, nil
+	}
+	return data, fmt.Errorf("ubi: bad data checksum in a moved erase block")
+}
+
+// vtbl reads the volume table, the layout volume has two copies
+func (c *ubiContext) vtbl() ([]ubiVtblRecord, error) {
+	layout := c.volumes[ubiLayoutVolume]
+	if layout == nil {
+		return nil, fmt.Errorf("ubi: no volume table")
+	}
+	var first error
+	for lnum := uint32(0); lnum < 2; lnum++ {
+		if layout[lnum] == nil {
+			continue
+		}
+		data, err := c.leb(layout[lnum], false)
+		if err != nil {
+			return nil, err
+		}
+		var records []ubiVtblRecord
+		for pos := 0; pos+ubiVtblEntrySize <= len(data) && len(records) < ubiMaxVolumes; pos += ubiVtblEntrySize {
+			var rec ubiVtblRecord
+			binary.Read(bytes.NewReader(data[pos:]), binary.BigEndian, &rec)
+			if ubiCRC(data[pos:pos+ubiVtblEntrySize-4]) != rec.CRC {
+				err = fmt.Errorf("ubi: bad volume table checksum")
+				break
+			}
+			records = append(records, rec)
+		}
+		if err == nil {
+			return records, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
+// volume writes the LEBs of a volume, unmapped LEBs of dynamic volumes
+// read as erased flash. LEBs beyond the reserved PEBs are ignored
+func (c *ubiContext) volume(e *types.Env, w io.Writer, lebs map[uint32][]*ubiPeb, reserved uint32, static bool) error {
+	end := uint32(0)
+	for lnum := range lebs {
+		if lnum < reserved && lnum >= end {
+			end = lnum + 1
+		}
+	}
+	for lnum := uint32(0); lnum < end; lnum++ {
+		if err := e.Canceled(); err != nil {
+			return err
+		}
+		pebs := lebs[lnum]
+		if pebs == nil {
+			if static {
+				return fmt.Errorf("ubi: LEB %d of a static volume is missing", lnum)
+			}
+			size := c.pebSize - c.dataOffset
+			if _, err := w.Write(bytes.Repeat([]byte{0xFF}, int(size))); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := c.leb(pebs, static)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unubi extracts the volumes of an UBI image, the volumes are named after
+// their names in the volume table. The volumes and the number of damaged
+// headers are recorded as the analysis "ubi"
+func Unubi(e *types.Env, prefix string) (string, error) {
+	c := &ubiContext{volumes: make(map[uint32]map[uint32][]*ubiPeb)}
+	c.Reader = e.Reader
+	c.Order = binary.BigEndian
+
+	ec, err := c.ecHeader(0)
+	if err != nil {
+		return "", err
+	}
+	filesize := int64(e.GetSize())
+	c.pebSize = c.findPebSize(filesize)
+	c.dataOffset = int64(ec.DataOffset)
+	c.imageSeq = ec.ImageSeq
+	if c.dataOffset >= c.pebSize || int64(ec.VIDHdrOffset)+ubiHeaderSize > c.dataOffset {
+		return "", fmt.Errorf("ubi: bad EC header")
+	}
+	if err := c.scan(e, filesize); err != nil {
+		return "", err
+	}
+
+	records, err := c.vtbl()
+	report := map[string]interface{}{
+		"peb-size":  c.pebSize,
+		"leb-size":  c.pebSize - c.dataOffset,
+		"image-seq": c.imageSeq,
+		"bad-ec":    c.badEC,
+		"bad-vid":   c.badVID,
+	}
+	analysis := e.AnalysisName("ubi")
+	e.Current.RegisterAnalysis(analysis, report, err)
+	if err != nil {
+		return "", err
+	}
+
+	var volumes []map[string]interface{}
+	for id, rec := range records {
+		lebs := c.volumes[uint32(id)]
+		if rec.ReservedPEBs == 0 || lebs == nil {
+			continue
+		}
+		n := int(rec.NameLen)
+		if n > len(rec.Name) {
+			n = len(rec.Name)
+		}
+		name := string(rec.Name[:n])
+		if name == "" {
+			name = fmt.Sprintf("volume%d", id)
+		}
+		typ := "static"
+		if rec.VolType == ubiVolumeDynamic {
+			typ = "dynamic"
+		}
+		volumes = append(volumes, map[string]interface{}{
+			"id":            id,
+			"name":          name,
+			"type":          typ,
+			"reserved-pebs": rec.ReservedPEBs,
+			"mapped-lebs":   len(lebs),
+		})
+
+		w, fd, err := e.Create(prefix + name)
+		if err != nil {
+			return "", err
+		}
+		fd.SetMetadata("volume-id", int64(id))
+		fd.SetMetadata("volume-name", name)
+		for lnum := range lebs {
+			if lnum >= rec.ReservedPEBs {
+				fd.RegisterError(fmt.Errorf("ubi: LEB %d is beyond the %d reserved PEBs", lnum, rec.ReservedPEBs))
+			}
+		}
+		err = c.volume(e, w, lebs, rec.ReservedPEBs, rec.VolType != ubiVolumeDynamic)
+		w.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	report["volumes"] = volumes
+	return "", nil
+}
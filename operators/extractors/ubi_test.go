@@ -0,0 +1,131 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	ubiTestPebSize    = 16384
+	ubiTestDataOffset = 128
+	ubiTestLebSize    = ubiTestPebSize - ubiTestDataOffset
+)
+
+// ubiImage creates UBI images with one erase block per LEB
+type ubiImage struct {
+	bytes.Buffer
+	sqnum uint64
+}
+
+// ubiHeader serializes a header and sets its checksum
+func ubiHeader(header interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, header)
+	raw := b.Bytes()
+	binary.BigEndian.PutUint32(raw[len(raw)-4:], ubiCRC(raw[:len(raw)-4]))
+	return raw
+}
+
+func (u *ubiImage) peb(vid *ubiVIDHeader, data []byte) {
+	peb := bytes.Repeat([]byte{0xFF}, ubiTestPebSize)
+	copy(peb, ubiHeader(&ubiECHeader{
+		Magic: ubiECMagic, Version: 1, EC: 1, ImageSeq: 0x1234,
+		VIDHdrOffset: ubiHeaderSize, DataOffset: ubiTestDataOffset,
+	}))
+	if vid != nil {
+		u.sqnum++
+		vid.Magic, vid.Version = ubiVIDMagic, 1
+		if vid.Sqnum == 0 {
+			vid.Sqnum = u.sqnum
+		}
+		copy(peb[ubiHeaderSize:], ubiHeader(vid))
+		copy(peb[ubiTestDataOffset:], data)
+	}
+	u.Write(peb)
+}
+
+func (u *ubiImage) layout(volumes map[int]ubiVtblRecord) {
+	var vtbl bytes.Buffer
+	for i := 0; i < ubiMaxVolumes; i++ {
+		rec := volumes[i]
+		vtbl.Write(ubiHeader(&rec))
+	}
+	for lnum := uint32(0); lnum < 2; lnum++ {
+		u.peb(&ubiVIDHeader{VolType: ubiVolumeDynamic, VolID: ubiLayoutVolume, Lnum: lnum}, vtbl.Bytes())
+	}
+}
+
+func TestUnubi(t *testing.T) {
+	leb := func(c byte) []byte { return bytes.Repeat([]byte{c}, ubiTestLebSize) }
+	kernel := bytes.Repeat([]byte("kernel"), 3000)
+
+	volumes := map[int]ubiVtblRecord{
+		0: {ReservedPEBs: 10, Alignment: 1, VolType: ubiVolumeDynamic, NameLen: 6},
+		1: {ReservedPEBs: 4, Alignment: 1, VolType: 2, NameLen: 6},
+	}
+	for id, name := range []string{"rootfs", "kernel"} {
+		rec := volumes[id]
+		copy(rec.Name[:], name)
+		volumes[id] = rec
+	}
+
+	var u ubiImage
+	u.layout(volumes)
+	u.peb(&ubiVIDHeader{VolType: ubiVolumeDynamic, VolID: 0, Lnum: 0}, leb('a'))
+	u.peb(&ubiVIDHeader{VolType: ubiVolumeDynamic, VolID: 0, Lnum: 1}, leb('x'))
+	u.peb(nil, nil)
+	u.peb(&ubiVIDHeader{VolType: ubiVolumeDynamic, VolID: 0, Lnum: 3}, leb('d'))
+
+	// LEB 1 was moved, the new copy has the copy flag and a data checksum
+	moved := leb('b')[:1000]
+	u.peb(&ubiVIDHeader{VolType: ubiVolumeDynamic, VolID: 0, Lnum: 1, CopyFlag: 1,
+		DataSize: uint32(len(moved)), DataCRC: ubiCRC(moved)}, moved)
+
+	// a static volume stores the size of each LEB
+	for lnum, part := range [][]byte{kernel[:ubiTestLebSize], kernel[ubiTestLebSize:]} {
+		u.peb(&ubiVIDHeader{VolType: 2, VolID: 1, Lnum: uint32(lnum), UsedEBs: 2,
+			DataSize: uint32(len(part)), DataCRC: ubiCRC(part)}, part)
+	}
+	// a LEB beyond the reserved PEBs is ignored
+	u.peb(&ubiVIDHeader{VolType: ubiVolumeDynamic, VolID: 0, Lnum: 0xFFFFFFFF}, leb('z'))
+	img := u.Bytes()
+
+	x, err := runExtractor(img, Unubi)
+	if err != nil {
+		t.Fatalf("UBI extraction failed: %v", err)
+	}
+	erased := bytes.Repeat([]byte{0xFF}, ubiTestLebSize-len(moved))
+	rootfs := bytes.Join([][]byte{leb('a'), moved, erased, bytes.Repeat([]byte{0xFF}, ubiTestLebSize), leb('d')}, nil)
+	if data := x.content(t, "rootfs"); !bytes.Equal(data, rootfs) {
+		t.Errorf("rootfs has wrong content")
+	}
+	if errs := x.files["rootfs"].Errors; len(errs) != 1 {
+		t.Errorf("rootfs has errors %v", errs)
+	}
+	if data := x.content(t, "kernel"); !bytes.Equal(data, kernel) {
+		t.Errorf("kernel has wrong content")
+	}
+	if v := x.metadata(t, "kernel", "volume-id"); v != int64(1) {
+		t.Errorf("kernel has volume id %v", v)
+	}
+	a := x.input.Analyses["ubi"]
+	if a == nil || a.Error != nil {
+		t.Fatalf("UBI analysis is missing or failed: %v", a)
+	}
+	report := a.Result.(map[string]interface{})
+	if report["peb-size"] != int64(ubiTestPebSize) || report["bad-ec"] != 0 {
+		t.Errorf("wrong UBI analysis %v", report)
+	}
+
+	// a damaged moved copy falls back to the old one
+	damaged := append([]byte{}, img...)
+	damaged[6*ubiTestPebSize+ubiTestDataOffset] ^= 1
+	x, err = runExtractor(damaged, Unubi)
+	if err != nil {
+		t.Fatalf("UBI extraction failed: %v", err)
+	}
+	if data := x.content(t, "rootfs"); !bytes.Equal(data[ubiTestLebSize:2*ubiTestLebSize], leb('x')) {
+		t.Errorf("damaged copy was used")
+	}
+}
@@ -0,0 +1,500 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+	"github.com/avahidi/molly/util/compress"
+)
+
+const (
+	ubifsMagic        = 0x06101831
+	ubifsHeaderSize   = 24
+	ubifsBlockSize    = 4096
+	ubifsRootInode    = 1
+	ubifsMinLebSize   = 15 * 1024
+	ubifsMaxIdxSize   = 1 << 20
+	ubifsMaxLevels    = 64
+	ubifsMaxLinkSize  = 4096
+	ubifsKeySize      = 8
+	ubifsFlagAuth     = 0x20
+	ubifsFlagEncrypt  = 0x10
+	ubifsInodeNode    = 0
+	ubifsDataNode     = 1
+	ubifsDentNode     = 2
+	ubifsPadNode      = 5
+	ubifsSuperNode    = 6
+	ubifsMasterNode   = 7
+	ubifsIndexNode    = 9
+	ubifsInoNodeSize  = 160
+	ubifsDataNodeSize = 48
+	ubifsDentNodeSize = 56
+)
+
+type ubifsHeader struct {
+	Magic     uint32
+	CRC       uint32
+	Sqnum     uint64
+	Len       uint32
+	NodeType  uint8
+	GroupType uint8
+	Padding   [2]uint8
+}
+
+type ubifsSuper struct {
+	ubifsHeader
+	Padding      [2]uint8
+	KeyHash      uint8
+	KeyFmt       uint8
+	Flags        uint32
+	MinIOSize    uint32
+	LebSize      uint32
+	LebCnt       uint32
+	MaxLebCnt    uint32
+	MaxBudBytes  uint64
+	LogLebs      uint32
+	LptLebs      uint32
+	OrphLebs     uint32
+	JheadCnt     uint32
+	Fanout       uint32
+	LsaveCnt     uint32
+	FmtVersion   uint32
+	DefaultCompr uint16
+}
+
+type ubifsMaster struct {
+	ubifsHeader
+	HighestInum uint64
+	CmtNo       uint64
+	Flags       uint32
+	LogLnum     uint32
+	RootLnum    uint32
+	RootOffs    uint32
+	RootLen     uint32
+}
+
+type ubifsInode struct {
+	ubifsHeader
+	Key        [16]byte
+	CreatSqnum uint64
+	Size       uint64
+	Atime      uint64
+	Ctime      uint64
+	Mtime      uint64
+	AtimeNsec  uint32
+	CtimeNsec  uint32
+	MtimeNsec  uint32
+	Nlink      uint32
+	UID        uint32
+	GID        uint32
+	Mode       uint32
+	Flags      uint32
+	DataLen    uint32
+}
+
+// ubifsRef is the location of a node
+type ubifsRef struct {
+	lnum, offs, len uint32
+}
+
+// ubifsDent is a directory entry
+type ubifsDent struct {
+	name string
+	inum uint64
+}
+
+type ubifsContext struct {
+	util.Structured
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Link     func(string, string, bool) (*types.FileData, error)
+	Node     func(string, string) (*types.FileData, error)
+	Mkdir    func(string) (*types.FileData, error)
+	Canceled func() error
+
+	lebSize int64
+	minIO   int64
+	inodes  map[uint64]ubifsRef
+	dents   map[uint64][]ubifsDent
+	data    map[uint64]map[uint32]ubifsRef
+	dirs    map[uint64]bool
+	files   map[uint64]string
+	visited map[ubifsRef]bool
+}
+
+// node reads and verifies a node
+func (c *ubifsContext) node(ref ubifsRef) ([]byte, error) {
+	if ref.len < ubifsHeaderSize || ref.len > ubifsMaxIdxSize ||
+		int64(ref.offs)+int64(ref.len) > c.lebSize {
+		return nil, fmt.Errorf("ubifs: bad node reference %d:%x", ref.lnum, ref.offs)
+	}
+	data := make([]byte, ref.len)
+	if err := c.ReadAt(int64(ref.lnum)*c.lebSize+int64(ref.offs), data); err != nil {
+		return nil, err
+	}
+	var head ubifsHeader
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &head)
+	if head.Magic != ubifsMagic || head.Len != ref.len {
+		return nil, fmt.Errorf("ubifs: no node at %d:%x", ref.lnum, ref.offs)
+	}
+	if ubiCRC(data[8:]) != head.CRC {
+		return nil, fmt.Errorf("ubifs: bad node checksum at %d:%x", ref.lnum, ref.offs)
+	}
+	return data, nil
+}
+
+// master finds the newest master node, there are copies in LEB 1 and 2.
+// Each copy is padded to the min. I/O unit
+func (c *ubifsContext) master() (*ubifsMaster, error) {
+	var best *ubifsMaster
+	for _, lnum := range []uint32{1, 2} {
+		for offs := int64(0); offs+ubifsHeaderSize <= c.lebSize; {
+			var head ubifsHeader
+			if err := c.ReadAt(int64(lnum)*c.lebSize+offs, &head); err != nil {
+				break
+			}
+			if head.Magic != ubifsMagic {
+				// small gaps are filled with zeros instead of a padding node
+				if offs%c.minIO == 0 {
+					break
+				}
+				offs += c.minIO - offs%c.minIO
+				continue
+			}
+			if head.Len < ubifsHeaderSize {
+				break
+			}
+			switch head.NodeType {
+			case ubifsPadNode:
+				var padLen uint32
+				if err := c.ReadAt(int64(lnum)*c.lebSize+offs+ubifsHeaderSize, &padLen); err != nil {
+					return nil, err
+				}
+				offs += int64(head.Len) + int64(padLen)
+				continue
+			case ubifsMasterNode:
+				// damaged copies are ignored
+				if data, err := c.node(ubifsRef{lnum, uint32(offs), head.Len}); err == nil {
+					m := &ubifsMaster{}
+					binary.Read(bytes.NewReader(data), binary.LittleEndian, m)
+					if best == nil || m.Sqnum > best.Sqnum {
+						best = m
+					}
+				}
+			}
+			offs += (int64(head.Len) + 7) &^ 7
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("ubifs: no master node")
+	}
+	return best, nil
+}
+
+// index walks the index tree and records where the leaf nodes are, index
+// nodes that are shared by several branches are only walked once
+func (c *ubifsContext) index(ref ubifsRef, level int) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
+	if level > ubifsMaxLevels {
+		return fmt.Errorf("ubifs: index is too deep")
+	}
+	if c.visited[ubifsRef{ref.lnum, ref.offs, 0}] {
+		return nil
+	}
+	c.visited[ubifsRef{ref.lnum, ref.offs, 0}] = true
+	data, err := c.node(ref)
+	if err != nil {
+		return err
+	}
+	if data[20] != ubifsIndexNode || len(data) < ubifsHeaderSize+4 {
+		return fmt.Errorf("ubifs: bad index node at %d:%x", ref.lnum, ref.offs)
+	}
+	count := int(binary.LittleEndian.Uint16(data[24:]))
+	nodeLevel := binary.LittleEndian.Uint16(data[26:])
+	const branchSize = 12 + ubifsKeySize
+	if 28+count*branchSize > len(data) {
+		return fmt.Errorf("ubifs: bad index node at %d:%x", ref.lnum, ref.offs)
+	}
+	for i := 0; i < count; i++ {
+		br := data[28+i*branchSize:]
+		child := ubifsRef{
+			lnum: binary.LittleEndian.Uint32(br),
+			offs: binary.LittleEndian.Uint32(br[4:]),
+			len:  binary.LittleEndian.Uint32(br[8:]),
+		}
+		if nodeLevel > 0 {
+			if err := c.index(child, level+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// the key has the inode number and the type with a block number or hash
+		inum := uint64(binary.LittleEndian.Uint32(br[12:]))
+		second := binary.LittleEndian.Uint32(br[16:])
+		switch second >> 29 {
+		case ubifsInodeNode:
+			c.inodes[inum] = child
+		case ubifsDataNode:
+			if c.data[inum] == nil {
+				c.data[inum] = make(map[uint32]ubifsRef)
+			}
+			c.data[inum][second&0x1FFFFFFF] = child
+		case ubifsDentNode:
+			dent, err := c.node(child)
+			if err != nil {
+				return err
+			}
+			if len(dent) < ubifsDentNodeSize {
+				return fmt.Errorf("ubifs: bad directory entry at %d:%x", child.lnum, child.offs)
+			}
+			n := int(binary.LittleEndian.Uint16(dent[50:]))
+			if ubifsDentNodeSize+n > len(dent) {
+				return fmt.Errorf("ubifs: bad directory entry at %d:%x", child.lnum, child.offs)
+			}
+			c.dents[inum] = append(c.dents[inum], ubifsDent{
+				name: string(dent[ubifsDentNodeSize : ubifsDentNodeSize+n]),
+				inum: binary.LittleEndian.Uint64(dent[40:]),
+			})
+		}
+	}
+	return nil
+}
+
+// ubifsDecompress undoes the compression of a data node
+func ubifsDecompress(typ uint16, data []byte, size int) ([]byte, error) {
+	switch typ {
+	case 0:
+		return data, nil
+	case 1:
+		return compress.Lzo1xDecompress(data, size)
+	case 2:
+		return readLimited(flate.NewReader(bytes.NewReader(data)), size)
+	case 3:
+		r, err := compress.NewZstdReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return readLimited(r, size)
+	}
+	return nil, fmt.Errorf("ubifs: unknown compression %d", typ)
+}
+
+// fileData writes the blocks of a file, missing blocks are holes
+func (c *ubifsContext) fileData(w io.Writer, inum uint64, size int64) error {
+	blocks := c.data[inum]
+	numbers := make([]int, 0, len(blocks))
+	for n := range blocks {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+
+	var written int64
+	for _, n := range numbers {
+		if err := c.Canceled(); err != nil {
+			return err
+		}
+		start := int64(n) * ubifsBlockSize
+		if start >= size {
+			break
+		}
+		node, err := c.node(blocks[uint32(n)])
+		if err != nil {
+			return err
+		}
+		if len(node) < ubifsDataNodeSize || node[20] != ubifsDataNode {
+			return fmt.Errorf("ubifs: bad data node for inode %d", inum)
+		}
+		dsize := int(binary.LittleEndian.Uint32(node[40:]))
+		if dsize > ubifsBlockSize {
+			return fmt.Errorf("ubifs: bad data node for inode %d", inum)
+		}
+		typ := binary.LittleEndian.Uint16(node[44:])
+		block, err := ubifsDecompress(typ, node[ubifsDataNodeSize:], dsize)
+		if err != nil {
+			return err
+		}
+		if start+int64(len(block)) > size {
+			block = block[:size-start]
+		}
+		if err := writeZeros(w, start-written); err != nil {
+			return err
+		}
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+		written = start + int64(len(block))
+	}
+	return writeZeros(w, size-written)
+}
+
+// setInfo records file information as metadata
+func (c *ubifsContext) setInfo(fd *types.FileData, ino *ubifsInode) {
+	fd.SetTime(time.Unix(int64(ino.Mtime), int64(ino.MtimeNsec)))
+	fd.SetMetadata("mode", int64(ino.Mode&07777))
+	fd.SetMetadata("uid", int64(ino.UID))
+	fd.SetMetadata("gid", int64(ino.GID))
+}
+
+func (c *ubifsContext) file(inum uint64, name string) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
+	ref, found := c.inodes[inum]
+	if !found {
+		return fmt.Errorf("ubifs: inode %d of %s is missing", inum, name)
+	}
+	data, err := c.node(ref)
+	if err != nil {
+		return err
+	}
+	if len(data) < ubifsInoNodeSize || data[20] != ubifsInodeNode {
+		return fmt.Errorf("ubifs: bad inode %d", inum)
+	}
+	ino := &ubifsInode{}
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, ino)
+	extra := data[ubifsInoNodeSize:]
+	if int(ino.DataLen) < len(extra) {
+		extra = extra[:ino.DataLen]
+	}
+
+	switch ino.Mode & 0xF000 {
+	case 0x4000:
+		// directories are never linked, seeing one twice means the image is broken
+		if c.dirs[inum] {
+			return fmt.Errorf("ubifs: directory loop at %s", name)
+		}
+		c.dirs[inum] = true
+		if name != "" {
+			fd, err := c.Mkdir(name)
+			if err != nil {
+				return err
+			}
+			c.setInfo(fd, ino)
+		}
+		for _, dent := range c.dents[inum] {
+			if err := c.file(dent.inum, path.Join(name, dent.name)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case 0x8000:
+		if first, found := c.files[inum]; found {
+			fd, err := c.Link(name, first, true)
+			if err != nil {
+				return err
+			}
+			c.setInfo(fd, ino)
+			return nil
+		}
+		if ino.Nlink > 1 {
+			c.files[inum] = name
+		}
+		w, fd, err := c.Create(name)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		c.setInfo(fd, ino)
+		return c.fileData(w, inum, int64(ino.Size))
+
+	case 0xA000:
+		if len(extra) > ubifsMaxLinkSize {
+			return fmt.Errorf("ubifs: bad link size in %s", name)
+		}
+		fd, err := c.Link(name, string(extra), false)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, ino)
+		return nil
+	}
+
+	var typ string
+	switch ino.Mode & 0xF000 {
+	case 0x6000:
+		typ = "blockdev"
+	case 0x2000:
+		typ = "chardev"
+	case 0x1000:
+		typ = "fifo"
+	case 0xC000:
+		typ = "socket"
+	default:
+		return fmt.Errorf("ubifs: unknown file type %o for %s", ino.Mode, name)
+	}
+	fd, err := c.Node(name, typ)
+	if err != nil {
+		return err
+	}
+	c.setInfo(fd, ino)
+	if (typ == "blockdev" || typ == "chardev") && len(extra) >= 4 {
+		device := binary.LittleEndian.Uint32(extra)
+		fd.SetMetadata("major", int64((device>>8)&0xFFF))
+		fd.SetMetadata("minor", int64(device&0xFF|(device>>12)&0xFFF00))
+	}
+	return nil
+}
+
+// Unubifs extracts an UBIFS volume, as extracted from an UBI image.
+//
+// Only the index is read, the journal is not replayed. Links and device
+// nodes are recorded as metadata together with the mode and owner of files
+func Unubifs(e *types.Env, prefix string) (string, error) {
+	c := &ubifsContext{
+		Create:   e.Create,
+		Link:     e.Link,
+		Node:     e.Node,
+		Mkdir:    e.Mkdir,
+		Canceled: e.Canceled,
+		inodes:   make(map[uint64]ubifsRef),
+		dents:    make(map[uint64][]ubifsDent),
+		data:     make(map[uint64]map[uint32]ubifsRef),
+		dirs:     make(map[uint64]bool),
+		files:    make(map[uint64]string),
+		visited:  make(map[ubifsRef]bool),
+	}
+	c.Reader = e.Reader
+	c.Order = binary.LittleEndian
+
+	var sb ubifsSuper
+	if err := c.ReadAt(0, &sb); err != nil {
+		return "", err
+	}
+	if sb.Magic != ubifsMagic || sb.NodeType != ubifsSuperNode {
+		return "", fmt.Errorf("file is not UBIFS")
+	}
+	if sb.LebSize < ubifsMinLebSize || sb.LebSize > ubiMaxPebSize ||
+		sb.MinIOSize < 8 || sb.MinIOSize > sb.LebSize {
+		return "", fmt.Errorf("ubifs: bad superblock")
+	}
+	if sb.Flags&ubifsFlagAuth != 0 {
+		return "", fmt.Errorf("ubifs: authenticated file systems are not supported")
+	}
+	if sb.Flags&ubifsFlagEncrypt != 0 {
+		e.Current.RegisterWarning("ubifs: encrypted files are extracted as they are")
+	}
+	c.lebSize, c.minIO = int64(sb.LebSize), int64(sb.MinIOSize)
+	if _, err := c.node(ubifsRef{0, 0, sb.Len}); err != nil {
+		return "", err
+	}
+
+	m, err := c.master()
+	if err != nil {
+		return "", err
+	}
+	if err := c.index(ubifsRef{m.RootLnum, m.RootOffs, m.RootLen}, 0); err != nil {
+		return "", err
+	}
+	return prefix, c.file(ubifsRootInode, prefix)
+}
@@ -0,0 +1,238 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+const ubifsTestLebSize = 16384
+
+// ubifsImage creates UBIFS volumes with the leaf nodes in LEB 3 and the
+// index in LEB 4
+type ubifsImage struct {
+	img   []byte
+	offs  [5]int
+	sqnum uint64
+}
+
+// node serializes a node, sets its checksum and writes it to a LEB
+func (u *ubifsImage) node(lnum int, typ uint8, body []byte) ubifsRef {
+	u.sqnum++
+	node := make([]byte, ubifsHeaderSize, ubifsHeaderSize+len(body))
+	node = append(node, body...)
+	binary.LittleEndian.PutUint32(node, ubifsMagic)
+	binary.LittleEndian.PutUint64(node[8:], u.sqnum)
+	binary.LittleEndian.PutUint32(node[16:], uint32(len(node)))
+	node[20] = typ
+	binary.LittleEndian.PutUint32(node[4:], ubiCRC(node[8:]))
+
+	ref := ubifsRef{uint32(lnum), uint32(u.offs[lnum]), uint32(len(node))}
+	copy(u.img[lnum*ubifsTestLebSize+u.offs[lnum]:], node)
+	u.offs[lnum] += (len(node) + 7) &^ 7
+	return ref
+}
+
+// leaf adds a leaf node and returns its index branch
+func (u *ubifsImage) leaf(typ uint8, inum uint32, value uint32, body []byte) []byte {
+	key := make([]byte, 16)
+	binary.LittleEndian.PutUint32(key, inum)
+	binary.LittleEndian.PutUint32(key[4:], uint32(typ)<<29|value)
+	ref := u.node(3, typ, append(key, body...))
+	return ubifsBranch(ref, key[:ubifsKeySize])
+}
+
+func ubifsBranch(ref ubifsRef, key []byte) []byte {
+	br := make([]byte, 12, 12+ubifsKeySize)
+	binary.LittleEndian.PutUint32(br, ref.lnum)
+	binary.LittleEndian.PutUint32(br[4:], ref.offs)
+	binary.LittleEndian.PutUint32(br[8:], ref.len)
+	return append(br, key...)
+}
+
+func (u *ubifsImage) inode(inum uint32, mode uint32, nlink uint32, size int, extra []byte) []byte {
+	body := make([]byte, ubifsInoNodeSize-ubifsHeaderSize-16)
+	binary.LittleEndian.PutUint64(body[8:], uint64(size))
+	binary.LittleEndian.PutUint64(body[32:], 1589718896)
+	binary.LittleEndian.PutUint32(body[52:], nlink)
+	binary.LittleEndian.PutUint32(body[56:], 1000)
+	binary.LittleEndian.PutUint32(body[60:], 100)
+	binary.LittleEndian.PutUint32(body[64:], mode)
+	binary.LittleEndian.PutUint32(body[72:], uint32(len(extra)))
+	return u.leaf(ubifsInodeNode, inum, 0, append(body, extra...))
+}
+
+func (u *ubifsImage) dent(parent uint32, name string, inum uint32, hash uint32) []byte {
+	body := make([]byte, ubifsDentNodeSize-ubifsHeaderSize-16)
+	binary.LittleEndian.PutUint64(body, uint64(inum))
+	binary.LittleEndian.PutUint16(body[10:], uint16(len(name)))
+	return u.leaf(ubifsDentNode, parent, hash, append(append(body, name...), 0))
+}
+
+func (u *ubifsImage) data(inum uint32, block uint32, compr uint16, size int, data []byte) []byte {
+	body := make([]byte, ubifsDataNodeSize-ubifsHeaderSize-16)
+	binary.LittleEndian.PutUint32(body, uint32(size))
+	binary.LittleEndian.PutUint16(body[4:], compr)
+	return u.leaf(ubifsDataNode, inum, block, append(body, data...))
+}
+
+// index adds index nodes with at most two branches per node
+func (u *ubifsImage) index(branches [][]byte) ubifsRef {
+	level := uint16(0)
+	for {
+		var next [][]byte
+		for i := 0; i < len(branches); i += 2 {
+			n := 2
+			if i+n > len(branches) {
+				n = len(branches) - i
+			}
+			body := make([]byte, 4)
+			binary.LittleEndian.PutUint16(body, uint16(n))
+			binary.LittleEndian.PutUint16(body[2:], level)
+			body = append(body, bytes.Join(branches[i:i+n], nil)...)
+			ref := u.node(4, ubifsIndexNode, body)
+			next = append(next, ubifsBranch(ref, branches[i][12:]))
+			if len(branches) <= 2 {
+				return ref
+			}
+		}
+		branches = next
+		level++
+	}
+}
+
+func (u *ubifsImage) master(lnum int, root ubifsRef) {
+	body := make([]byte, 36)
+	binary.LittleEndian.PutUint32(body[24:], root.lnum)
+	binary.LittleEndian.PutUint32(body[28:], root.offs)
+	binary.LittleEndian.PutUint32(body[32:], root.len)
+	u.node(lnum, ubifsMasterNode, body)
+}
+
+func ubifsBuild() ([]byte, []byte) {
+	u := &ubifsImage{img: make([]byte, 5*ubifsTestLebSize)}
+
+	sb := make([]byte, 64)
+	binary.LittleEndian.PutUint32(sb[8:], 8)
+	binary.LittleEndian.PutUint32(sb[12:], ubifsTestLebSize)
+	binary.LittleEndian.PutUint32(sb[16:], 5)
+	u.node(0, ubifsSuperNode, sb)
+
+	// a compressed block, a hole and a block compressed with LZO literals
+	hello := bytes.Repeat([]byte("hello ubifs "), 1000)[:2*ubifsBlockSize+100]
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write(hello[:ubifsBlockSize])
+	fw.Close()
+	for i := ubifsBlockSize; i < 2*ubifsBlockSize; i++ {
+		hello[i] = 0
+	}
+	lzo := append(append([]byte{17 + 100}, hello[2*ubifsBlockSize:]...), 0x11, 0, 0)
+
+	// a zstd frame with a single raw block
+	zdata := []byte("zstandard compressed block")
+	zstd := []byte{0x28, 0xB5, 0x2F, 0xFD, 0x20, byte(len(zdata))}
+	zstd = append(zstd, byte(len(zdata)<<3|1), 0, 0)
+	zstd = append(zstd, zdata...)
+
+	branches := [][]byte{
+		u.inode(1, 0x4000|0755, 3, 0, nil),
+		u.dent(1, "hello.txt", 2, 1),
+		u.dent(1, "dir", 3, 2),
+		u.dent(1, "symlink", 5, 3),
+		u.dent(1, "tty", 6, 4),
+		u.inode(2, 0x8000|0644, 2, len(hello), nil),
+		u.data(2, 0, 2, ubifsBlockSize, deflated.Bytes()),
+		u.data(2, 2, 1, 100, lzo),
+		u.inode(3, 0x4000|0700, 2, 0, nil),
+		u.dent(3, "hard-link", 2, 1),
+		u.dent(3, "zstd.bin", 4, 2),
+		u.inode(4, 0x8000|04755, 1, len(zdata), nil),
+		u.data(4, 0, 3, len(zdata), zstd),
+		u.inode(5, 0xA000|0777, 1, 9, []byte("hello.txt")),
+		u.inode(6, 0x2000|0600, 1, 0, []byte{0x05, 0x04, 0, 0}),
+	}
+	root := u.index(branches)
+
+	// an older master node points nowhere, the copy in LEB 2 follows padding
+	u.master(1, ubifsRef{4, 8, 100})
+	u.master(1, root)
+	pad := make([]byte, 4)
+	binary.LittleEndian.PutUint32(pad, 100)
+	u.node(2, ubifsPadNode, pad)
+	u.offs[2] += 100
+	u.master(2, root)
+	return u.img, hello
+}
+
+func TestUnubifs(t *testing.T) {
+	img, hello := ubifsBuild()
+	x, err := runExtractor(img, Unubifs)
+	if err != nil {
+		t.Fatalf("UBIFS extraction failed: %v", err)
+	}
+	var testdata = []struct {
+		name string
+		data []byte
+	}{
+		{"hello.txt", hello},
+		{"dir/zstd.bin", []byte("zstandard compressed block")},
+	}
+	for _, test := range testdata {
+		if data := x.content(t, test.name); !bytes.Equal(data, test.data) {
+			t.Errorf("%s has wrong content", test.name)
+		}
+	}
+
+	var metadata = []struct {
+		file, key string
+		value     interface{}
+	}{
+		{"dir/zstd.bin", "mode", int64(04755)},
+		{"dir/zstd.bin", "uid", int64(1000)},
+		{"symlink", "type", "symlink"},
+		{"symlink", "link", "hello.txt"},
+		{"dir/hard-link", "type", "hardlink"},
+		{"tty", "type", "chardev"},
+		{"tty", "major", int64(4)},
+		{"tty", "minor", int64(5)},
+	}
+	for _, test := range metadata {
+		if v := x.metadata(t, test.file, test.key); v != test.value {
+			t.Errorf("%s has %s %v, wanted %v", test.file, test.key, v, test.value)
+		}
+	}
+
+	// damaged nodes are detected
+	damaged := append([]byte{}, img...)
+	damaged[3*ubifsTestLebSize+200] ^= 1
+	if _, err := runExtractor(damaged, Unubifs); err == nil {
+		t.Errorf("damaged node was not detected")
+	}
+}
+
+func TestUnubifsSharedIndex(t *testing.T) {
+	u := &ubifsImage{img: make([]byte, 5*ubifsTestLebSize)}
+	sb := make([]byte, 64)
+	binary.LittleEndian.PutUint32(sb[8:], 8)
+	binary.LittleEndian.PutUint32(sb[12:], ubifsTestLebSize)
+	binary.LittleEndian.PutUint32(sb[16:], 5)
+	u.node(0, ubifsSuperNode, sb)
+
+	// every index node has two branches to the same child, walking all
+	// paths would take 2^40 steps
+	branch := u.inode(1, 0x4000|0755, 2, 0, nil)
+	for level := 0; level < 40; level++ {
+		body := make([]byte, 4)
+		binary.LittleEndian.PutUint16(body, 2)
+		binary.LittleEndian.PutUint16(body[2:], uint16(level))
+		body = append(append(body, branch...), branch...)
+		branch = ubifsBranch(u.node(4, ubifsIndexNode, body), branch[12:])
+	}
+	u.master(1, ubifsRef{binary.LittleEndian.Uint32(branch), binary.LittleEndian.Uint32(branch[4:]),
+		binary.LittleEndian.Uint32(branch[8:])})
+	if _, err := runExtractor(u.img, Unubifs); err != nil {
+		t.Errorf("UBIFS extraction failed: %v", err)
+	}
+}
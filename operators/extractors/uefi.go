@@ -0,0 +1,688 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util/compress"
+)
+
+const (
+	uefiMaxSize     = 256 << 20
+	uefiMaxDepth    = 8
+	fvSignature     = "_FVH"
+	fvHeaderSize    = 56
+	fvErasePolarity = 0x800
+	ffsHeaderSize   = 24
+	ffsHeader2Size  = 32
+	ffsAttrLarge    = 0x01
+	ffsAttrChecksum = 0x40
+	ffsStateDeleted = 0x10
+	ffsTypeRaw      = 0x01
+	ffsTypePad      = 0xF0
+	capsuleMinSize  = 28
+
+	sectionCompression  = 0x01
+	sectionGUIDDefined  = 0x02
+	sectionDisposable   = 0x03
+	sectionVersion      = 0x14
+	sectionUI           = 0x15
+	sectionFreeform     = 0x18
+	guidedProcessingReq = 0x01
+)
+
+// known GUIDs of file systems, GUID defined sections and capsules
+const (
+	guidFFS2        = "8c8ce578-8a3d-4f1c-9935-896185c32dd3"
+	guidFFS3        = "5473c07a-3dcb-4dca-bd6f-1e9689e7349a"
+	guidLzma        = "ee4e5898-3914-4259-9d6e-dc7bd79403cf"
+	guidLzmaF86     = "d42ae6bd-1352-4bfb-909a-ca72a6eae889"
+	guidTiano       = "a31280ad-481e-41b6-95e8-127f4c984779"
+	guidCRC32       = "fc1bcdb0-7d31-49aa-936a-a4600d9dd083"
+	guidCapsuleEFI  = "3b6686bd-0d76-4030-b70e-b5519e2fc5a0"
+	guidCapsuleUEFI = "539182b9-abb5-4391-b69a-e3a943f72fcc"
+	guidCapsuleFMP  = "6dcbd5ed-e82d-4c44-bda1-7194199ad92a"
+	guidCapsuleAMI  = "4a3ca68b-7723-48fb-803d-578cc1fec44d"
+	guidCertPKCS7   = "4aafd29d-68df-49ee-8aa9-347d375665a7"
+)
+
+var ffsTypes = map[uint8]string{
+	0x01: "raw",
+	0x02: "freeform",
+	0x03: "sec-core",
+	0x04: "pei-core",
+	0x05: "dxe-core",
+	0x06: "peim",
+	0x07: "driver",
+	0x08: "combined-peim-driver",
+	0x09: "application",
+	0x0A: "mm",
+	0x0B: "volume-image",
+	0x0C: "combined-mm-dxe",
+	0x0D: "mm-core",
+	0x0E: "mm-standalone",
+	0x0F: "mm-core-standalone",
+	0xF0: "pad",
+}
+
+// sectionNames are the names of the files created for leaf sections
+var sectionNames = map[uint8]string{
+	0x10: "pe32.efi",
+	0x11: "pic.efi",
+	0x12: "te.efi",
+	0x13: "dxe.depex",
+	0x16: "csm16.bin",
+	0x17: "volume.fv",
+	0x18: "freeform.bin",
+	0x19: "raw.bin",
+	0x1B: "pei.depex",
+	0x1C: "mm.depex",
+}
+
+type fvHeader struct {
+	ZeroVector [16]byte
+	FileSystem [16]byte
+	Length     uint64
+	Signature  [4]byte
+	Attributes uint32
+	HeaderLen  uint16
+	Checksum   uint16
+	ExtOffset  uint16
+	Reserved   uint8
+	Revision   uint8
+}
+
+type ffsHeader struct {
+	Name           [16]byte
+	HeaderChecksum uint8
+	FileChecksum   uint8
+	Type           uint8
+	Attributes     uint8
+	Size           [3]uint8
+	State          uint8
+}
+
+// uefiSum8 is the 8 bit sum used by the checksums of FFS files
+func uefiSum8(data []byte) uint8 {
+	var sum uint8
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+func uefiSize24(size [3]uint8) int {
+	return int(size[0]) | int(size[1])<<8 | int(size[2])<<16
+}
+
+func uefiAlign(n, align int) int {
+	return (n + align - 1) &^ (align - 1)
+}
+
+// uefiVolume is the state of a volume during extraction, budget is what is
+// left of the uefiMaxSize bytes that its sections may decompress to
+type uefiVolume struct {
+	e      *types.Env
+	prefix string
+	budget int
+	dirs   map[string]int
+	err    error
+}
+
+// uefiFile is an FFS file, its leaf sections are written as they are decoded
+type uefiFile struct {
+	v           *uefiVolume
+	guid, dir   string
+	ui, version string
+	seen        map[string]int
+	fds         []*types.FileData
+	errs        []error
+}
+
+// add writes a leaf section, the directory of the file is created with the
+// first one. Names that repeat get a number
+func (f *uefiFile) add(name string, data []byte) error {
+	if f.dir == "" {
+		f.dir = f.guid
+		if f.ui != "" {
+			f.dir += "_" + strings.Replace(f.ui, "/", "_", -1)
+		}
+		if f.v.dirs[f.dir]++; f.v.dirs[f.dir] > 1 {
+			f.dir = fmt.Sprintf("%s_%d", f.dir, f.v.dirs[f.dir]-1)
+		}
+		f.seen = map[string]int{}
+	}
+	if f.seen[name]++; f.seen[name] > 1 {
+		name = fmt.Sprintf("%d_%s", f.seen[name]-1, name)
+	}
+	w, fd, err := f.v.e.Create(f.v.prefix + f.dir + "/" + name)
+	if err == nil {
+		f.fds = append(f.fds, fd)
+		_, err = w.Write(data)
+		w.Close()
+	}
+	if err != nil {
+		f.v.err = err
+	}
+	return err
+}
+
+// finish registers the errors of a file on its outputs, or on the input
+// when nothing was written
+func (f *uefiFile) finish() {
+	for _, err := range f.errs {
+		if len(f.fds) == 0 {
+			f.v.e.Current.RegisterError(fmt.Errorf("%s%s: %v", f.v.prefix, f.guid, err))
+		}
+		for _, fd := range f.fds {
+			fd.RegisterError(err)
+		}
+	}
+}
+
+// uefiSectionStart tells if data starts with a plausible section header
+func uefiSectionStart(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	size := uefiSize24([3]uint8{data[0], data[1], data[2]})
+	return size == 0xFFFFFF || (size >= 4 && size <= len(data))
+}
+
+// decompress decompresses the data of compression and GUID defined
+// sections, the output is taken from the budget of the volume. EFI 1.1 and
+// Tiano compression look the same, the other one is tried when the output
+// is not sections
+func (v *uefiVolume) decompress(method string, data []byte) ([]byte, error) {
+	var out []byte
+	var err error
+	switch method {
+	case "efi", "tiano":
+		if len(data) >= 8 && int(binary.LittleEndian.Uint32(data[4:])) > v.budget {
+			return nil, fmt.Errorf("uefi: more than %d bytes decompressed", uefiMaxSize)
+		}
+		tiano := method == "tiano"
+		out, err = compress.EfiDecompress(data, v.budget, tiano)
+		if err != nil || !uefiSectionStart(out) {
+			if other, err2 := compress.EfiDecompress(data, v.budget, !tiano); err2 == nil && uefiSectionStart(other) {
+				out, err = other, nil
+			}
+		}
+	default:
+		var r io.Reader
+		if r, err = compress.NewLzmaReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		if method == "lzmaf86" {
+			r = compress.NewX86Reader(r)
+		}
+		if out, err = readLimited(r, v.budget); err != nil && len(out) > v.budget {
+			err = fmt.Errorf("uefi: more than %d bytes decompressed", uefiMaxSize)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.budget -= len(out)
+	return out, nil
+}
+
+// ffsSection is a section header and its data
+type ffsSection struct {
+	typ           uint8
+	headSize      int
+	section, body []byte
+}
+
+// ffsSections splits data into sections, the ones before an error are
+// returned with it
+func ffsSections(data []byte) ([]ffsSection, error) {
+	var list []ffsSection
+	for offset := 0; offset+4 <= len(data); offset = uefiAlign(offset, 4) {
+		size, headSize := uefiSize24([3]uint8{data[offset], data[offset+1], data[offset+2]}), 4
+		if size == 0xFFFFFF && offset+8 <= len(data) {
+			size, headSize = int(binary.LittleEndian.Uint32(data[offset+4:])), 8
+		}
+		if size < headSize || size > len(data)-offset {
+			return list, fmt.Errorf("uefi: bad section size at %d", offset)
+		}
+		list = append(list, ffsSection{data[offset+3], headSize, data[offset : offset+size], data[offset+headSize : offset+size]})
+		offset += size
+	}
+	return list, nil
+}
+
+// sections parses the sections of a file, leaf sections are written and
+// encapsulation sections are parsed recursively
+func (f *uefiFile) sections(data []byte, depth int) error {
+	if depth > uefiMaxDepth {
+		return fmt.Errorf("uefi: sections are nested too deep")
+	}
+	list, err := ffsSections(data)
+
+	// the UI section names the directory, so it is read before any leaf
+	for _, s := range list {
+		switch s.typ {
+		case sectionUI:
+			f.ui = uefiString(s.body)
+		case sectionVersion:
+			if len(s.body) >= 2 {
+				f.version = uefiString(s.body[2:])
+			}
+		}
+	}
+
+	for _, s := range list {
+		if f.v.err != nil {
+			return f.v.err
+		}
+		if e := f.v.e.Canceled(); e != nil {
+			return e
+		}
+		section, body := s.section, s.body
+		switch s.typ {
+		case sectionCompression:
+			if len(body) < 5 {
+				return fmt.Errorf("uefi: bad compression section")
+			}
+			inner := body[5:]
+			if body[4] != 0 {
+				var e error
+				if inner, e = f.v.decompress("efi", inner); e != nil {
+					f.errs = append(f.errs, fmt.Errorf("uefi: compression section: %v", e))
+					continue
+				}
+			}
+			if e := f.sections(inner, depth+1); e != nil {
+				return e
+			}
+		case sectionGUIDDefined:
+			if len(body) < 20 {
+				return fmt.Errorf("uefi: bad GUID defined section")
+			}
+			var guid [16]byte
+			copy(guid[:], body)
+			dataOffset := int(binary.LittleEndian.Uint16(body[16:]))
+			attributes := binary.LittleEndian.Uint16(body[18:])
+			if dataOffset < s.headSize+20 || dataOffset > len(section) {
+				return fmt.Errorf("uefi: bad GUID defined section")
+			}
+			inner, e := f.guided(gptGUID(guid), section[dataOffset:], body[20:])
+			if e != nil {
+				f.errs = append(f.errs, e)
+				continue
+			}
+			if inner == nil {
+				if attributes&guidedProcessingReq != 0 {
+					if e := f.add(fmt.Sprintf("guided_%s.bin", gptGUID(guid)), section[dataOffset:]); e != nil {
+						return e
+					}
+					continue
+				}
+				inner = section[dataOffset:]
+			}
+			if e := f.sections(inner, depth+1); e != nil {
+				return e
+			}
+		case sectionDisposable, sectionUI, sectionVersion:
+		case sectionFreeform:
+			if len(body) >= 16 {
+				if e := f.add(sectionNames[s.typ], body[16:]); e != nil {
+					return e
+				}
+			}
+		default:
+			name, found := sectionNames[s.typ]
+			if !found {
+				name = fmt.Sprintf("section_%02x.bin", s.typ)
+			}
+			if e := f.add(name, body); e != nil {
+				return e
+			}
+		}
+	}
+	return err
+}
+
+// guided processes the data of a GUID defined section, it returns nil for
+// sections that are not known
+func (f *uefiFile) guided(guid string, data, extra []byte) ([]byte, error) {
+	switch guid {
+	case guidLzma:
+		return f.v.decompress("lzma", data)
+	case guidLzmaF86:
+		return f.v.decompress("lzmaf86", data)
+	case guidTiano:
+		return f.v.decompress("tiano", data)
+	case guidCRC32:
+		if len(extra) >= 4 && crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(extra) {
+			f.errs = append(f.errs, fmt.Errorf("uefi: bad CRC32 section checksum"))
+		}
+		return data, nil
+	}
+	return nil, nil
+}
+
+// uefiString decodes a zero terminated UCS-2 string
+func uefiString(data []byte) string {
+	var s []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+	}
+	return string(utf16.Decode(s))
+}
+
+// uefiRead reads the first size bytes of the input, which has a size
+// given by its header. Anything after it is left alone
+func uefiRead(e *types.Env, size uint64) ([]byte, error) {
+	if size > uefiMaxSize {
+		return nil, fmt.Errorf("uefi: image is larger than %d bytes", uefiMaxSize)
+	}
+	if _, err := e.Reader.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(e.Reader, data)
+	return data, err
+}
+
+// Unuefifv extracts the files of a UEFI firmware volume. Each file gets a
+// directory named by its GUID and the name in its UI section, with the PE,
+// TE and other leaf sections inside. Compressed and GUID defined sections
+// are decoded and nested volumes are written as volume.fv. The volume and
+// its files are recorded as the analysis "uefifv"
+func Unuefifv(e *types.Env, prefix string) (string, error) {
+	if _, err := e.Reader.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	var head fvHeader
+	if binary.Read(e.Reader, binary.LittleEndian, &head) != nil || string(head.Signature[:]) != fvSignature {
+		return "", fmt.Errorf("file is not a firmware volume")
+	}
+	if head.HeaderLen < fvHeaderSize || head.Length < uint64(head.HeaderLen) || head.Length > e.GetSize() {
+		return "", fmt.Errorf("uefi: bad volume size %d", head.Length)
+	}
+	data, err := uefiRead(e, head.Length)
+	if err != nil {
+		return "", err
+	}
+
+	// the 16 bit sum of the header is zero
+	var sum uint16
+	for i := 0; i+1 < int(head.HeaderLen); i += 2 {
+		sum += binary.LittleEndian.Uint16(data[i:])
+	}
+	fs := gptGUID(head.FileSystem)
+	report := map[string]interface{}{
+		"filesystem": fs,
+		"size":       head.Length,
+		"attributes": head.Attributes,
+		"revision":   head.Revision,
+		"checksum":   sum == 0,
+	}
+	analysis := e.AnalysisName("uefifv")
+
+	start := int(head.HeaderLen)
+	if head.ExtOffset != 0 && int(head.ExtOffset)+20 <= len(data) {
+		var name [16]byte
+		copy(name[:], data[head.ExtOffset:])
+		report["name"] = gptGUID(name)
+		start = int(head.ExtOffset) + int(binary.LittleEndian.Uint32(data[head.ExtOffset+16:]))
+	}
+	if fs != guidFFS2 && fs != guidFFS3 {
+		// not a file system, such as NVRAM
+		var err error
+		if sum != 0 {
+			err = fmt.Errorf("uefi: bad volume header checksum")
+		}
+		e.Current.RegisterAnalysis(analysis, report, err)
+		w, _, err := e.Create(prefix + "volume.bin")
+		if err != nil {
+			return "", err
+		}
+		defer w.Close()
+		_, err = w.Write(data[head.HeaderLen:])
+		return "", err
+	}
+
+	files, err := uefiFiles(e, prefix, data, start, head.Attributes&fvErasePolarity != 0, fs == guidFFS3)
+	report["files"] = files
+	if err == nil && sum != 0 {
+		err = fmt.Errorf("uefi: bad volume header checksum")
+	}
+	e.Current.RegisterAnalysis(analysis, report, err)
+	return "", nil
+}
+
+// uefiFiles extracts the FFS files of a volume, errors in a file are
+// registered on its outputs
+func uefiFiles(e *types.Env, prefix string, data []byte, start int, erased, ffs3 bool) ([]map[string]interface{}, error) {
+	erase := byte(0)
+	if erased {
+		erase = 0xFF
+	}
+	var files []map[string]interface{}
+	v := &uefiVolume{e: e, prefix: prefix, budget: uefiMaxSize, dirs: map[string]int{}}
+	for offset := uefiAlign(start, 8); offset+ffsHeaderSize <= len(data); offset = uefiAlign(offset, 8) {
+		if err := e.Canceled(); err != nil {
+			return files, err
+		}
+		raw := data[offset : offset+ffsHeaderSize]
+		if bytes.Count(raw, []byte{erase}) == ffsHeaderSize {
+			// free space
+			break
+		}
+		var head ffsHeader
+		binary.Read(bytes.NewReader(raw), binary.LittleEndian, &head)
+		size, headSize := uefiSize24(head.Size), ffsHeaderSize
+		if ffs3 && head.Attributes&ffsAttrLarge != 0 && offset+ffsHeader2Size <= len(data) {
+			size, headSize = int(binary.LittleEndian.Uint64(data[offset+ffsHeaderSize:])), ffsHeader2Size
+		}
+		if size < headSize || size > len(data)-offset {
+			return files, fmt.Errorf("uefi: bad file size at %d", offset)
+		}
+		file := data[offset : offset+size]
+		offset += size
+
+		state := head.State
+		if erased {
+			state = ^state
+		}
+		if state&ffsStateDeleted != 0 || head.Type == ffsTypePad {
+			continue
+		}
+
+		// checksums are computed without the state and the file checksum
+		f := &uefiFile{v: v, guid: gptGUID(head.Name)}
+		header := append([]byte{}, file[:headSize]...)
+		header[17], header[23] = 0, 0
+		if uefiSum8(header) != 0 {
+			f.errs = append(f.errs, fmt.Errorf("uefi: bad header checksum"))
+		}
+		if head.Attributes&ffsAttrChecksum != 0 && uefiSum8(file[headSize:])+head.FileChecksum != 0 {
+			f.errs = append(f.errs, fmt.Errorf("uefi: bad file checksum"))
+		}
+
+		var err error
+		if head.Type == ffsTypeRaw || head.Type >= 0xC0 {
+			err = f.add("raw.bin", file[headSize:])
+		} else {
+			err = f.sections(file[headSize:], 0)
+		}
+		if v.err != nil {
+			return files, v.err
+		}
+		if cerr := e.Canceled(); cerr != nil {
+			return files, cerr
+		}
+		if err != nil {
+			f.errs = append(f.errs, err)
+		}
+		f.finish()
+
+		info := map[string]interface{}{"guid": f.guid, "type": ffsTypes[head.Type], "size": size}
+		if info["type"] == nil {
+			info["type"] = fmt.Sprintf("%02x", head.Type)
+		}
+		if f.ui != "" {
+			info["ui"] = f.ui
+		}
+		if f.version != "" {
+			info["version"] = f.version
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+type capsuleHeader struct {
+	GUID       [16]byte
+	HeaderSize uint32
+	Flags      uint32
+	ImageSize  uint32
+}
+
+// capsuleFMP extracts the drivers and payloads of a firmware management
+// capsule, authenticated payloads are written without the signature
+func capsuleFMP(e *types.Env, prefix string, data []byte, report map[string]interface{}) error {
+	le := binary.LittleEndian
+	if len(data) < 8 {
+		return fmt.Errorf("capsule: FMP header is truncated")
+	}
+	drivers, payloads := int(le.Uint16(data[4:])), int(le.Uint16(data[6:]))
+	if 8+8*(drivers+payloads) > len(data) {
+		return fmt.Errorf("capsule: FMP item list is truncated")
+	}
+	offsets := make([]int, drivers+payloads+1)
+	for i := range offsets[:drivers+payloads] {
+		offsets[i] = int(le.Uint64(data[8+8*i:]))
+		if offsets[i] > len(data) || offsets[i] < 0 {
+			return fmt.Errorf("capsule: bad FMP item offset")
+		}
+	}
+	offsets[drivers+payloads] = len(data)
+
+	write := func(name string, data []byte) error {
+		w, _, err := e.Create(prefix + name)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		_, err = w.Write(data)
+		return err
+	}
+	for i := 0; i < drivers; i++ {
+		if offsets[i+1] < offsets[i] {
+			return fmt.Errorf("capsule: bad FMP driver offset")
+		}
+		if err := write(fmt.Sprintf("driver_%d.efi", i), data[offsets[i]:offsets[i+1]]); err != nil {
+			return err
+		}
+	}
+
+	var items []map[string]interface{}
+	for i := 0; i < payloads; i++ {
+		item := data[offsets[drivers+i]:]
+		if len(item) < 32 {
+			return fmt.Errorf("capsule: FMP payload header is truncated")
+		}
+		headSize := map[uint32]int{1: 32, 2: 40}[le.Uint32(item)]
+		if headSize == 0 {
+			headSize = 48
+		}
+		size := int(le.Uint32(item[24:]))
+		if headSize > len(item) || size > len(item)-headSize {
+			return fmt.Errorf("capsule: FMP payload is truncated")
+		}
+		var guid [16]byte
+		copy(guid[:], item[4:])
+		image := item[headSize : headSize+size]
+		info := map[string]interface{}{"type": gptGUID(guid), "index": item[20], "size": size}
+
+		// EFI_FIRMWARE_IMAGE_AUTHENTICATION with a PKCS7 signature
+		if len(image) >= 40 && le.Uint16(image[12:]) == 0x0200 && le.Uint16(image[14:]) == 0x0EF1 {
+			copy(guid[:], image[16:])
+			if n := 8 + int(le.Uint32(image[8:])); gptGUID(guid) == guidCertPKCS7 && n <= len(image) {
+				image = image[n:]
+				info["authenticated"] = true
+			}
+		}
+		items = append(items, info)
+		if err := write(fmt.Sprintf("payload_%d.bin", i), image); err != nil {
+			return err
+		}
+	}
+	report["drivers"] = drivers
+	report["payloads"] = items
+	return nil
+}
+
+// Uncapsule extracts the payload of a UEFI capsule. Firmware management
+// capsules are split into drivers and payloads and AMI Aptio capsules into
+// the ROM image. The header is recorded as the analysis "capsule"
+func Uncapsule(e *types.Env, prefix string) (string, error) {
+	if _, err := e.Reader.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	var head capsuleHeader
+	if binary.Read(e.Reader, binary.LittleEndian, &head) != nil {
+		return "", fmt.Errorf("file is not a capsule")
+	}
+	if head.HeaderSize < capsuleMinSize || head.ImageSize < head.HeaderSize || uint64(head.ImageSize) > e.GetSize() {
+		return "", fmt.Errorf("capsule: bad size %d", head.ImageSize)
+	}
+	data, err := uefiRead(e, uint64(head.ImageSize))
+	if err != nil {
+		return "", err
+	}
+	guid := gptGUID(head.GUID)
+	report := map[string]interface{}{
+		"guid":        guid,
+		"flags":       head.Flags,
+		"header-size": head.HeaderSize,
+		"image-size":  head.ImageSize,
+	}
+	analysis := e.AnalysisName("capsule")
+
+	payload := data[head.HeaderSize:head.ImageSize]
+	switch guid {
+	case guidCapsuleFMP:
+		report["type"] = "fmp"
+		err := capsuleFMP(e, prefix, payload, report)
+		e.Current.RegisterAnalysis(analysis, report, err)
+		return "", err
+	case guidCapsuleAMI:
+		// the ROM image starts after the ROM layout table
+		report["type"] = "aptio"
+		if head.ImageSize < capsuleMinSize+2 {
+			return "", fmt.Errorf("capsule: Aptio header is truncated")
+		}
+		romImage := int(binary.LittleEndian.Uint16(data[28:]))
+		if romImage < capsuleMinSize || romImage > int(head.ImageSize) {
+			return "", fmt.Errorf("capsule: bad ROM image offset %d", romImage)
+		}
+		payload = data[romImage:head.ImageSize]
+	case guidCapsuleEFI, guidCapsuleUEFI:
+		report["type"] = "uefi"
+	}
+	e.Current.RegisterAnalysis(analysis, report, nil)
+
+	w, _, err := e.Create(prefix + "payload.bin")
+	if err != nil {
+		return "", err
+	}
+	defer w.Close()
+	_, err = io.Copy(w, bytes.NewReader(payload))
+	return "", err
+}
@@ -0,0 +1,357 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	uefiTestDriver = "0b6a8de0-6281-40a2-8e9a-09f1a18a6d40"
+	uefiTestTiano  = "a2f436ea-a127-4ef8-957c-8048606ff670"
+	uefiTestCRC    = "1b45cc0a-156a-428a-af62-49864da0e6e6"
+	uefiTestRaw    = "3b42ef57-16d3-44cb-8632-9fdb06b41451"
+)
+
+// uefiSection creates a section, padded to four bytes
+func uefiSection(typ byte, body []byte) []byte {
+	size := 4 + len(body)
+	s := append([]byte{byte(size), byte(size >> 8), byte(size >> 16), typ}, body...)
+	return append(s, make([]byte, uefiAlign(size, 4)-size)...)
+}
+
+func uefiUCS2(s string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, utf16.Encode([]rune(s+"\x00")))
+	return b.Bytes()
+}
+
+// uefiGuided creates a GUID defined section with extra header data
+func uefiGuided(guid string, attributes uint16, extra, data []byte) []byte {
+	g := gptGUIDBytes(guid)
+	body := append(g[:], 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(body[16:], uint16(4+20+len(extra)))
+	binary.LittleEndian.PutUint16(body[18:], attributes)
+	return uefiSection(sectionGUIDDefined, append(append(body, extra...), data...))
+}
+
+// uefiTiano compresses data with Tiano, every byte is a block with a
+// single literal
+func uefiTiano(data []byte) []byte {
+	var bits []bool
+	put := func(v uint32, n uint) {
+		for i := n; i > 0; i-- {
+			bits = append(bits, v&(1<<(i-1)) != 0)
+		}
+	}
+	for _, c := range data {
+		put(1, 16)
+		put(0, 5)
+		put(0, 5)
+		put(0, 9)
+		put(uint32(c), 9)
+		put(0, 5)
+		put(0, 5)
+	}
+	out := make([]byte, 8+(len(bits)+7)/8)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)-8))
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(data)))
+	for i, bit := range bits {
+		if bit {
+			out[8+i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
+
+// uefiFFS creates a file in a volume with erase polarity, the header
+// checksum is off by bad
+func uefiFFS(guid string, typ, attributes byte, data []byte, bad byte) []byte {
+	g := gptGUIDBytes(guid)
+	size := ffsHeaderSize + len(data)
+	head := append(g[:], 0, 0xAA, typ, attributes, byte(size), byte(size>>8), byte(size>>16), ^byte(0x07))
+	if attributes&ffsAttrChecksum != 0 {
+		head[17] = -uefiSum8(data)
+	}
+	head[16] = -(uefiSum8(head) - head[17] - head[23]) + bad
+	file := append(head, data...)
+	return append(file, bytes.Repeat([]byte{0xFF}, uefiAlign(size, 8)-size)...)
+}
+
+// uefiFV creates an FFS2 volume with free space after the files
+func uefiFV(files ...[]byte) []byte {
+	data := bytes.Join(files, nil)
+	length := uefiAlign(72+len(data)+64, 0x100)
+	head := fvHeader{Length: uint64(length), Attributes: fvErasePolarity | 0x4FEFF, HeaderLen: 72, Revision: 2}
+	head.FileSystem = gptGUIDBytes(guidFFS2)
+	copy(head.Signature[:], fvSignature)
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &head)
+	binary.Write(&b, binary.LittleEndian, []uint32{uint32(length / 0x100), 0x100, 0, 0})
+	var sum uint16
+	for i := 0; i < 72; i += 2 {
+		sum += binary.LittleEndian.Uint16(b.Bytes()[i:])
+	}
+	binary.LittleEndian.PutUint16(b.Bytes()[50:], -sum)
+	b.Write(data)
+	b.Write(bytes.Repeat([]byte{0xFF}, length-b.Len()))
+	return b.Bytes()
+}
+
+func uefiTestVolume() []byte {
+	compressed := append([]byte{9, 0, 0, 0, 0}, uefiSection(0x10, []byte("MZ driver"))...)
+	driver := bytes.Join([][]byte{
+		uefiSection(sectionUI, uefiUCS2("TestDriver")),
+		uefiSection(sectionVersion, append([]byte{1, 0}, uefiUCS2("1.0")...)),
+		uefiSection(sectionCompression, compressed),
+	}, nil)
+	tiano := uefiGuided(guidTiano, guidedProcessingReq, nil, uefiTiano(bytes.Join([][]byte{
+		uefiSection(0x10, []byte("MZ tiano")),
+		uefiSection(sectionUI, uefiUCS2("Tiano")),
+	}, nil)))
+	crc := uefiGuided(guidCRC32, 0x02, []byte{1, 2, 3, 4}, uefiSection(0x19, []byte("raw data")))
+
+	return uefiFV(
+		uefiFFS(uefiTestDriver, 0x07, ffsAttrChecksum, driver, 0),
+		uefiFFS(uefiTestTiano, 0x07, 0, tiano, 0),
+		uefiFFS("00000000-0000-0000-0000-000000000000", ffsTypePad, 0, make([]byte, 16), 0),
+		uefiFFS(uefiTestCRC, 0x02, 0, crc, 0),
+		uefiFFS(uefiTestRaw, ffsTypeRaw, 0, []byte("raw file"), 1),
+	)
+}
+
+func TestUnuefifv(t *testing.T) {
+	volume := uefiTestVolume()
+	x, err := runExtractor(volume, Unuefifv)
+	if err != nil {
+		t.Fatalf("volume extraction failed: %v", err)
+	}
+	var testdata = []struct {
+		name   string
+		data   string
+		errors int
+	}{
+		{uefiTestDriver + "_TestDriver/pe32.efi", "MZ driver", 0},
+		{uefiTestTiano + "_Tiano/pe32.efi", "MZ tiano", 0},
+		{uefiTestCRC + "/raw.bin", "raw data", 1},
+		{uefiTestRaw + "/raw.bin", "raw file", 1},
+	}
+	for _, test := range testdata {
+		if data := x.content(t, test.name); string(data) != test.data {
+			t.Errorf("wrong %s %q", test.name, data)
+		}
+		if errs := x.files[test.name].Errors; len(errs) != test.errors {
+			t.Errorf("%s has errors %v", test.name, errs)
+		}
+	}
+
+	a := x.input.Analyses["uefifv"]
+	if a == nil || a.Error != nil {
+		t.Fatalf("volume analysis is missing or failed: %v", a)
+	}
+	report := a.Result.(map[string]interface{})
+	files := report["files"].([]map[string]interface{})
+	if len(files) != 4 || report["filesystem"] != guidFFS2 {
+		t.Fatalf("wrong volume analysis %v", report)
+	}
+	if files[0]["ui"] != "TestDriver" || files[0]["version"] != "1.0" || files[0]["type"] != "driver" {
+		t.Errorf("wrong driver analysis %v", files[0])
+	}
+
+	// a bad header checksum is an analysis error
+	volume[20] ^= 0x01
+	x, err = runExtractor(volume, Unuefifv)
+	if err != nil {
+		t.Errorf("extraction of a corrupt volume failed: %v", err)
+	} else if a := x.input.Analyses["uefifv"]; a == nil || a.Error == nil {
+		t.Errorf("bad volume checksum was not found")
+	}
+
+	if _, err := runExtractor(volume[:40], Unuefifv); err == nil {
+		t.Errorf("truncated volume was accepted")
+	}
+}
+
+// uefiCapsule creates a capsule with a 28 byte header
+func uefiCapsule(guid string, payload []byte) []byte {
+	head := capsuleHeader{GUID: gptGUIDBytes(guid), HeaderSize: capsuleMinSize, ImageSize: uint32(capsuleMinSize + len(payload))}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &head)
+	b.Write(make([]byte, capsuleMinSize-b.Len()))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func TestUncapsule(t *testing.T) {
+	le := binary.LittleEndian
+	driver := []byte("MZ update driver")
+	image := []byte("firmware image")
+
+	// the payload is signed with a PKCS7 certificate
+	cert := []byte("signature")
+	auth := make([]byte, 8+24)
+	le.PutUint32(auth[8:], uint32(24+len(cert)))
+	le.PutUint16(auth[12:], 0x0200)
+	le.PutUint16(auth[14:], 0x0EF1)
+	pkcs7 := gptGUIDBytes(guidCertPKCS7)
+	copy(auth[16:], pkcs7[:])
+	signed := append(append(auth, cert...), image...)
+
+	item := make([]byte, 40)
+	le.PutUint32(item, 2)
+	g := gptGUIDBytes(uefiTestDriver)
+	copy(item[4:], g[:])
+	item[20] = 1
+	le.PutUint32(item[24:], uint32(len(signed)))
+	item = append(item, signed...)
+
+	fmp := make([]byte, 8+16)
+	le.PutUint32(fmp, 1)
+	le.PutUint16(fmp[4:], 1)
+	le.PutUint16(fmp[6:], 1)
+	le.PutUint64(fmp[8:], uint64(len(fmp)))
+	le.PutUint64(fmp[16:], uint64(len(fmp)+len(driver)))
+	fmp = append(append(fmp, driver...), item...)
+
+	var testdata = []struct {
+		capsule []byte
+		kind    string
+		files   map[string][]byte
+	}{
+		{uefiCapsule(guidCapsuleFMP, fmp), "fmp", map[string][]byte{"driver_0.efi": driver, "payload_0.bin": image}},
+		{uefiCapsule(guidCapsuleUEFI, image), "uefi", map[string][]byte{"payload.bin": image}},
+	}
+	for _, test := range testdata {
+		x, err := runExtractor(test.capsule, Uncapsule)
+		if err != nil {
+			t.Errorf("%s: extraction failed: %v", test.kind, err)
+			continue
+		}
+		for name, want := range test.files {
+			if data := x.content(t, name); !bytes.Equal(data, want) {
+				t.Errorf("%s: wrong %s %q", test.kind, name, data)
+			}
+		}
+		a := x.input.Analyses["capsule"]
+		if a == nil || a.Error != nil || a.Result.(map[string]interface{})["type"] != test.kind {
+			t.Errorf("%s: wrong capsule analysis %v", test.kind, a)
+		}
+	}
+
+	if _, err := runExtractor(uefiCapsule(guidCapsuleFMP, fmp)[:60], Uncapsule); err == nil {
+		t.Errorf("truncated capsule was accepted")
+	}
+}
+
+func TestUefiSections(t *testing.T) {
+	// a GUID defined section that is not known is kept as a file and a
+	// good CRC32 section gives no error
+	raw := uefiSection(0x19, []byte("raw"))
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(raw))
+	sections := append(uefiGuided("11111111-2222-3333-4444-555555555555", guidedProcessingReq, nil, []byte("opaque")),
+		uefiGuided(guidCRC32, 0x02, sum, raw)...)
+	x, err := runExtractor(uefiFV(uefiFFS(uefiTestDriver, 0x07, 0, sections, 0)), Unuefifv)
+	if err != nil {
+		t.Fatalf("volume extraction failed: %v", err)
+	}
+	if data := x.content(t, uefiTestDriver+"/guided_11111111-2222-3333-4444-555555555555.bin"); string(data) != "opaque" {
+		t.Errorf("wrong unknown guided section %q", data)
+	}
+	if errs := x.files[uefiTestDriver+"/raw.bin"].Errors; len(errs) != 0 {
+		t.Errorf("good CRC32 section has errors %v", errs)
+	}
+
+	// a bad section size is an error of the file, with nothing written it
+	// is registered on the input
+	x, err = runExtractor(uefiFV(uefiFFS(uefiTestRaw, 0x07, 0, []byte{0x40, 0, 0, 0x10, 1, 2, 3, 4}, 0)), Unuefifv)
+	if err != nil || len(x.files) != 0 || len(x.input.Errors) != 1 || !strings.Contains(x.input.Errors[0].Error(), "section size") {
+		t.Errorf("bad section size was accepted: %v %v", err, x.input.Errors)
+	}
+}
+
+func TestUefiBudget(t *testing.T) {
+	// sections can not decompress to more than the budget of the volume
+	v := &uefiVolume{budget: 100}
+	data := uefiTiano(bytes.Repeat([]byte{0x55}, 60))
+	if out, err := v.decompress("tiano", data); err != nil || len(out) != 60 || v.budget != 40 {
+		t.Errorf("decompression failed: %v, budget %d", err, v.budget)
+	}
+	if _, err := v.decompress("tiano", data); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("budget was not enforced: %v", err)
+	}
+
+	// the original size in the header is not trusted
+	huge := append([]byte{0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0x7F}, data[8:]...)
+	if _, err := (&uefiVolume{budget: uefiMaxSize}).decompress("efi", huge); err == nil {
+		t.Errorf("huge original size was accepted")
+	}
+}
+
+// uefiPadded is an image followed by a lot of zeros
+type uefiPadded struct {
+	data      []byte
+	size, pos int64
+}
+
+func (p *uefiPadded) Read(b []byte) (int, error) {
+	if p.pos >= p.size {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.size-p.pos {
+		b = b[:p.size-p.pos]
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	if p.pos < int64(len(p.data)) {
+		copy(b, p.data[p.pos:])
+	}
+	p.pos += int64(len(b))
+	return len(b), nil
+}
+
+func (p *uefiPadded) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += p.pos
+	case io.SeekEnd:
+		offset += p.size
+	}
+	p.pos = offset
+	return offset, nil
+}
+
+func TestUefiTrailingData(t *testing.T) {
+	// images carved from a large dump are only as large as their header says
+	var testdata = []struct {
+		data      []byte
+		extractor func(*types.Env, string) (string, error)
+	}{
+		{uefiTestVolume(), Unuefifv},
+		{uefiCapsule(guidCapsuleUEFI, []byte("image")), Uncapsule},
+	}
+	for _, test := range testdata {
+		m := types.NewMolly()
+		m.Config.OutDir = "/out"
+		m.Config.FS = util.NewMemFS()
+		input := types.NewFileData("/out/input", nil)
+		input.Filesize = uefiMaxSize + 4096
+		env := types.NewEnv(m)
+		env.SetInput(&uefiPadded{data: test.data, size: input.Filesize}, input)
+		if _, err := test.extractor(env, ""); err != nil {
+			t.Errorf("Extraction failed: %v", err)
+		}
+		if len(m.Files) == 0 {
+			t.Errorf("Nothing was extracted")
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package extractors
 
 import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"time"
 
 	"github.com/avahidi/molly/types"
 	"github.com/avahidi/molly/util"
+	"github.com/avahidi/molly/util/compress"
 )
 
 const (
@@ -15,34 +20,126 @@ const (
 	uimageHeaderSize = 64
 	uimageTypeKernel = 2
 	uimageTypeMulti  = 4
+	uimageMaxImages  = 64
+	fdtMagic         = 0xd00dfeed
 )
 
-var uimageComp = map[uint8]string{1: "gz", 2: "bz2", 3: "lzma", 4: "lzo"}
+var uimageComp = map[uint8]string{1: "gz", 2: "bz2", 3: "lzma", 4: "lzo", 5: "lz4", 6: "zst"}
 var uimageOs = map[uint8]string{
 	5: "linux", 13: "lynxos", 14: "vxworks", 16: "qnx", 17: "uboot", 22: "ose"}
 var uimageArch = map[uint8]string{2: "arm", 3: "i386", 4: "ia64", 5: "mips"}
+var uimageType = map[uint8]string{
+	1: "standalone", 2: "kernel", 3: "ramdisk", 4: "multi", 5: "firmware",
+	6: "script", 7: "filesystem", 8: "flat_dt"}
 
-// UnUimage extracts u-boot uimage files
+type uimageHeader struct {
+	Magic    uint32
+	Hcrc     uint32
+	Time     uint32
+	Size     uint32
+	LoadAdr  uint32
+	EntryAdr uint32
+	Dcrc     uint32
+	OS       uint8
+	Arch     uint8
+	Type     uint8
+	Comp     uint8
+	Name     [32]byte
+}
+
+// uimageDecompress returns a reader for the payload if the compression is known
+func uimageDecompress(comp uint8, r io.Reader) (io.Reader, error) {
+	switch comp {
+	case 1:
+		return gzip.NewReader(r)
+	case 2:
+		return bzip2.NewReader(r), nil
+	case 3:
+		return compress.NewLzmaReader(r)
+	case 6:
+		return compress.NewZstdReader(r)
+	}
+	return nil, nil
+}
+
+// uimageCreate writes an image to a new file. Compressed images are
+// decompressed so the contents can be scanned, others are written as is
+func uimageCreate(e *types.Env, head *uimageHeader, name string, comp uint8, offset, size int64) error {
+	data := util.NewSectionReader(e.Reader, offset, size)
+	r, err := uimageDecompress(comp, data)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		r = data
+		if ext, found := uimageComp[comp]; found {
+			name = name + "." + ext
+		}
+	}
+
+	w, fd, err := e.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	fd.SetTime(time.Unix(int64(head.Time), 0))
+	if _, err = io.Copy(w, r); err != nil && err != bzip2Trailing {
+		return err
+	}
+	return nil
+}
+
+// uimageImages reads the size table of a multi-file image, which ends with a zero
+func uimageImages(img util.Structured, head *uimageHeader) ([]uint32, error) {
+	var sizes []uint32
+	total := int64(0)
+	for {
+		var size uint32
+		if err := img.ReadAt(int64(uimageHeaderSize+4*len(sizes)), &size); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			break
+		}
+		if len(sizes) == uimageMaxImages {
+			return nil, fmt.Errorf("uimage: too many images")
+		}
+		sizes = append(sizes, size)
+		total += (int64(size) + 3) &^ 3
+	}
+	if total+int64(4*len(sizes)+4) > int64(head.Size) {
+		return nil, fmt.Errorf("uimage: images are larger than the data")
+	}
+	return sizes, nil
+}
+
+// uimageCheck verifies header and data checksums
+func uimageCheck(e *types.Env, raw []byte, head *uimageHeader) (bool, bool, error) {
+	zeroed := append([]byte{}, raw...)
+	copy(zeroed[4:8], []byte{0, 0, 0, 0})
+	hcrc := crc32.ChecksumIEEE(zeroed) == head.Hcrc
+
+	h := crc32.NewIEEE()
+	data := util.NewSectionReader(e.Reader, uimageHeaderSize, int64(head.Size))
+	if _, err := io.Copy(h, data); err != nil {
+		return hcrc, false, err
+	}
+	return hcrc, h.Sum32() == head.Dcrc, nil
+}
+
+// UnUimage extracts u-boot uimage files. Compressed images are decompressed
+// and multi-file images are split into their parts. The header is recorded
+// as an analysis of the input, including the outcome of the checksum checks
 func UnUimage(e *types.Env, prefix string) (string, error) {
 	img := util.Structured{Reader: e.Reader, Order: binary.BigEndian}
-	var head struct {
-		Magic    uint32
-		Hcrc     uint32
-		Time     uint32
-		Size     uint32
-		LoadAdr  uint32
-		EntryAdr uint32
-		Dcrc     uint32
-		OS       uint8
-		Arch     uint8
-		Type     uint8
-		Comp     uint8
-		Name     [32]byte
-	}
-
-	if err := img.ReadAt(0, &head); err != nil {
+
+	var raw [uimageHeaderSize]byte
+	if err := img.ReadAt(0, raw[:]); err != nil {
 		return "", err
 	}
+	var head uimageHeader
+	binary.Read(bytes.NewReader(raw[:]), img.Order, &head)
 	if head.Magic != uimageMagic {
 		return "", fmt.Errorf("uimage: file is not an uimage")
 	}
@@ -58,22 +155,60 @@ func UnUimage(e *types.Env, prefix string) (string, error) {
 	if head.Type != uimageTypeMulti && head.LoadAdr != 0 {
 		name = fmt.Sprintf("%s_%08x", name, head.LoadAdr)
 	}
-	if ext, found := uimageComp[head.Comp]; found {
-		name = name + "." + ext
-	}
 
-	// multi-image?
-	if head.Type == uimageTypeMulti {
-		return "", fmt.Errorf("TODO: implement multi image uimage")
+	// record what we know about it
+	report := map[string]interface{}{
+		"name":  util.AsciizToString(head.Name[:]),
+		"time":  time.Unix(int64(head.Time), 0).UTC(),
+		"size":  head.Size,
+		"load":  head.LoadAdr,
+		"entry": head.EntryAdr,
+		"os":    uimageOs[head.OS],
+		"arch":  uimageArch[head.Arch],
+		"type":  uimageType[head.Type],
+		"comp":  uimageComp[head.Comp],
+	}
+	hcrc, dcrc, err := uimageCheck(e, raw[:], &head)
+	report["header-crc"], report["data-crc"] = hcrc, dcrc
+	if err == nil && !hcrc {
+		err = fmt.Errorf("uimage: bad header checksum")
+	} else if err == nil && !dcrc {
+		err = fmt.Errorf("uimage: bad data checksum")
 	}
 
+	analysis := e.AnalysisName("uimage")
+	e.Current.RegisterAnalysis(analysis, report, err)
+
 	// single image
-	w, fd, err := e.Create(name)
+	if head.Type != uimageTypeMulti {
+		return "", uimageCreate(e, &head, name, head.Comp, uimageHeaderSize, int64(head.Size))
+	}
+
+	// multi-image, typically a kernel, a ramdisk and a device tree
+	sizes, err := uimageImages(img, &head)
 	if err != nil {
 		return "", err
 	}
+	report["images"] = sizes
+	offset := int64(uimageHeaderSize + 4*len(sizes) + 4)
+	for i, size := range sizes {
+		var magic uint32
+		img.ReadAt(offset, &magic)
 
-	fd.SetTime(time.Unix(int64(head.Time), 0))
-	_, err = io.CopyN(w, img.Reader, int64(head.Size))
-	return "", err
+		// only the kernel is compressed
+		part, comp := fmt.Sprintf("%s_%d", name, i), uint8(0)
+		switch {
+		case i == 0:
+			part, comp = name+"_kernel", head.Comp
+		case magic == fdtMagic:
+			part = name + "_dtb"
+		case i == 1:
+			part = name + "_ramdisk"
+		}
+		if err := uimageCreate(e, &head, part, comp, offset, int64(size)); err != nil {
+			return "", err
+		}
+		offset += (int64(size) + 3) &^ 3
+	}
+	return "", nil
 }
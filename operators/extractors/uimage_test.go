@@ -0,0 +1,100 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// uimage creates an uimage with correct checksums
+func uimage(typ, comp uint8, data []byte) []byte {
+	head := uimageHeader{
+		Magic: uimageMagic, Time: 1500000000, Size: uint32(len(data)),
+		LoadAdr: 0x80008000, EntryAdr: 0x80008000, Dcrc: crc32.ChecksumIEEE(data),
+		OS: 5, Arch: 2, Type: typ, Comp: comp,
+	}
+	copy(head.Name[:], "test")
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &head)
+	binary.BigEndian.PutUint32(b.Bytes()[4:], crc32.ChecksumIEEE(b.Bytes()))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func gzipData(data []byte) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func TestUnUimage(t *testing.T) {
+	kernel := bytes.Repeat([]byte("linux kernel "), 100)
+	x, err := runExtractor(uimage(uimageTypeKernel, 1, gzipData(kernel)), UnUimage)
+	if err != nil {
+		t.Fatalf("uimage extraction failed: %v", err)
+	}
+	if data := x.content(t, "test_arm_linux_80008000"); !bytes.Equal(data, kernel) {
+		t.Errorf("kernel was not decompressed")
+	}
+	a := x.input.Analyses["uimage"]
+	if a == nil || a.Error != nil {
+		t.Fatalf("uimage analysis is missing or failed: %v", a)
+	}
+	report := a.Result.(map[string]interface{})
+	if report["header-crc"] != true || report["data-crc"] != true || report["type"] != "kernel" {
+		t.Errorf("wrong uimage analysis %v", report)
+	}
+}
+
+func TestUnUimageMulti(t *testing.T) {
+	kernel := bytes.Repeat([]byte("linux kernel "), 100)
+	ramdisk := []byte("ramdisk")
+	dtb := []byte{0xd0, 0x0d, 0xfe, 0xed, 1, 2, 3, 4}
+
+	// a size table followed by images, padded to 4 bytes
+	var b bytes.Buffer
+	gz := gzipData(kernel)
+	for _, size := range []int{len(gz), len(ramdisk), len(dtb), 0} {
+		binary.Write(&b, binary.BigEndian, uint32(size))
+	}
+	for _, data := range [][]byte{gz, ramdisk, dtb} {
+		b.Write(data)
+		b.Write(make([]byte, (4-len(data)%4)%4))
+	}
+	image := uimage(uimageTypeMulti, 1, b.Bytes())
+
+	x, err := runExtractor(image, UnUimage)
+	if err != nil {
+		t.Fatalf("uimage extraction failed: %v", err)
+	}
+	var testdata = []struct {
+		name string
+		data []byte
+	}{
+		{"test_arm_linux_kernel", kernel},
+		{"test_arm_linux_ramdisk", ramdisk},
+		{"test_arm_linux_dtb", dtb},
+	}
+	for _, test := range testdata {
+		if data := x.content(t, test.name); !bytes.Equal(data, test.data) {
+			t.Errorf("%s: wrong content %q", test.name, data)
+		}
+	}
+
+	// damaged header and data are reported, but the files are still extracted
+	for _, pos := range []int{20, len(image) - 1} {
+		damaged := append([]byte{}, image...)
+		damaged[pos] ^= 1
+		x, _ := runExtractor(damaged, UnUimage)
+		if a := x.input.Analyses["uimage"]; a == nil || a.Error == nil {
+			t.Errorf("damage at %d was not detected", pos)
+		}
+		if len(x.files) != 3 {
+			t.Errorf("damage at %d: extracted %d files", pos, len(x.files))
+		}
+	}
+}
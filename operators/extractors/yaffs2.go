@@ -0,0 +1,471 @@
+package extractors
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
+)
+
+const (
+	yaffsTagsSize        = 16
+	yaffsHeaderSize      = 512
+	yaffsChunkHeaderFlag = 0x80000000
+	yaffsObjectTypeMask  = 0xF0000000
+	yaffsLowestSeq       = 0x00001000
+	yaffsHighestSeq      = 0xEFFFFF00
+	yaffsMaxLayoutChecks = 8
+
+	// object ids
+	yaffsRootID      = 1
+	yaffsLostFoundID = 2
+	yaffsUnlinkedID  = 3
+	yaffsDeletedID   = 4
+
+	// object types
+	yaffsTypeFile     = 1
+	yaffsTypeSymlink  = 2
+	yaffsTypeDir      = 3
+	yaffsTypeHardlink = 4
+	yaffsTypeSpecial  = 5
+)
+
+// yaffsTags are the packed tags of a chunk, for object headers the chunk
+// id has a flag and the top bits of the object id hold the object type
+type yaffsTags struct {
+	SeqNumber uint32
+	ObjID     uint32
+	ChunkID   uint32
+	NBytes    uint32
+}
+
+type yaffsObjectHeader struct {
+	Type                uint32
+	ParentObjID         uint32
+	SumNoLongerUsed     uint16
+	Name                [256]byte
+	Padding             [2]byte
+	Mode                uint32
+	UID                 uint32
+	GID                 uint32
+	Atime               uint32
+	Mtime               uint32
+	Ctime               uint32
+	FileSizeLow         uint32
+	EquivID             uint32
+	Alias               [160]byte
+	Rdev                uint32
+	WinTimes            [6]uint32
+	InbandShadowedObjID uint32
+	InbandIsShrink      uint32
+	FileSizeHigh        uint32
+}
+
+// yaffsLayout describes how pages and their spare area are stored. Dumps
+// either have the spare area after each page or the tags at the end of
+// the page (inband tags)
+type yaffsLayout struct {
+	pageSize  int64
+	spareSize int64
+	tagOffset int64
+	inband    bool
+}
+
+func (l yaffsLayout) chunkSize() int64 { return l.pageSize + l.spareSize }
+
+func (l yaffsLayout) dataSize() int64 {
+	if l.inband {
+		return l.pageSize - yaffsTagsSize
+	}
+	return l.pageSize
+}
+
+func (l yaffsLayout) tags() int64 {
+	if l.inband {
+		return l.pageSize - yaffsTagsSize
+	}
+	return l.pageSize + l.tagOffset
+}
+
+// yaffsChunk is the newest copy of a chunk, copies are ordered by their
+// block sequence number and then by their position in the block
+type yaffsChunk struct {
+	offset int64
+	seq    uint32
+	nbytes uint32
+}
+
+type yaffsObject struct {
+	header   yaffsObjectHeader
+	children []uint32
+}
+
+type yaffsContext struct {
+	util.Structured
+	Create   func(string) (*types.FileWriter, *types.FileData, error)
+	Link     func(string, string, bool) (*types.FileData, error)
+	Node     func(string, string) (*types.FileData, error)
+	Mkdir    func(string) (*types.FileData, error)
+	Canceled func() error
+
+	layout  yaffsLayout
+	headers map[uint32]yaffsChunk
+	chunks  map[uint32]map[uint32]yaffsChunk
+	objects map[uint32]*yaffsObject
+	paths   map[uint32]string
+	dirs    map[uint32]bool
+}
+
+// readTags reads the tags of a chunk, erased is true for unused chunks
+func (c *yaffsContext) readTags(offset int64) (tags yaffsTags, erased bool, err error) {
+	if err = c.ReadAt(offset+c.layout.tags(), &tags); err != nil {
+		return
+	}
+	if tags.SeqNumber == 0xFFFFFFFF && tags.ObjID == 0xFFFFFFFF {
+		return tags, true, nil
+	}
+	if tags.SeqNumber < yaffsLowestSeq || tags.SeqNumber > yaffsHighestSeq {
+		return tags, false, fmt.Errorf("yaffs2: bad sequence number at %x", offset)
+	}
+	if tags.ChunkID&yaffsChunkHeaderFlag != 0 {
+		tags.ChunkID = 0
+		tags.ObjID &^= yaffsObjectTypeMask
+	}
+	if tags.ObjID == 0 || (tags.ChunkID != 0 && int64(tags.NBytes) > c.layout.dataSize()) {
+		return tags, false, fmt.Errorf("yaffs2: bad tags at %x", offset)
+	}
+	return tags, false, nil
+}
+
+// findEndian figures out what endian we have, the image starts with an
+// object header
+func (c *yaffsContext) findEndian() error {
+	for _, c.Order = range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var header yaffsObjectHeader
+		if err := c.ReadAt(0, &header); err != nil {
+			return err
+		}
+		if header.Type >= yaffsTypeFile && header.Type <= yaffsTypeSpecial {
+			return nil
+		}
+	}
+	return fmt.Errorf("file is not YAFFS2")
+}
+
+// findLayout figures out page size and where the tags are by trying the
+// common layouts until the first chunks have valid tags
+func (c *yaffsContext) findLayout(filesize int64) error {
+	for page := int64(512); page <= 16384; page *= 2 {
+		for _, c.layout = range []yaffsLayout{
+			{pageSize: page, spareSize: page / 32},
+			{pageSize: page, spareSize: page / 32, tagOffset: 2},
+			{pageSize: page, inband: true},
+		} {
+			if c.layout.chunkSize() > filesize || c.layout.tags()+yaffsTagsSize > c.layout.chunkSize() {
+				continue
+			}
+			if c.layout.dataSize() < yaffsHeaderSize {
+				continue
+			}
+			if tags, _, err := c.readTags(0); err != nil || tags.ChunkID != 0 || tags.SeqNumber == 0xFFFFFFFF {
+				continue
+			}
+			valid := true
+			for i := int64(1); i < yaffsMaxLayoutChecks && (i+1)*c.layout.chunkSize() <= filesize; i++ {
+				if _, _, err := c.readTags(i * c.layout.chunkSize()); err != nil {
+					valid = false
+					break
+				}
+			}
+			if valid {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("yaffs2: unknown page layout")
+}
+
+// scan reads the tags of all chunks and keeps the newest copy of each
+func (c *yaffsContext) scan(filesize int64) error {
+	newer := func(old yaffsChunk, found bool, seq uint32) bool {
+		return !found || seq >= old.seq
+	}
+	for offset := int64(0); offset+c.layout.chunkSize() <= filesize; offset += c.layout.chunkSize() {
+		if err := c.Canceled(); err != nil {
+			return err
+		}
+		tags, erased, err := c.readTags(offset)
+		if erased || err != nil {
+			// damaged chunks are left out like the kernel does
+			continue
+		}
+		chunk := yaffsChunk{offset: offset, seq: tags.SeqNumber, nbytes: tags.NBytes}
+		if tags.ChunkID == 0 {
+			if old, found := c.headers[tags.ObjID]; newer(old, found, chunk.seq) {
+				c.headers[tags.ObjID] = chunk
+			}
+			continue
+		}
+		if c.chunks[tags.ObjID] == nil {
+			c.chunks[tags.ObjID] = make(map[uint32]yaffsChunk)
+		}
+		if old, found := c.chunks[tags.ObjID][tags.ChunkID]; newer(old, found, chunk.seq) {
+			c.chunks[tags.ObjID][tags.ChunkID] = chunk
+		}
+	}
+	return nil
+}
+
+// tree reads the object headers and links objects to their parents.
+// Objects without a parent are placed in lost+found, unlinked and deleted
+// objects are left out
+func (c *yaffsContext) tree() error {
+	for id, chunk := range c.headers {
+		obj := &yaffsObject{}
+		if err := c.ReadAt(chunk.offset, &obj.header); err != nil {
+			return err
+		}
+		c.objects[id] = obj
+	}
+	for _, id := range []uint32{yaffsRootID, yaffsLostFoundID} {
+		if c.objects[id] == nil {
+			c.objects[id] = &yaffsObject{header: yaffsObjectHeader{Type: yaffsTypeDir, Mode: 0x4000 | 0755}}
+		}
+	}
+	copy(c.objects[yaffsLostFoundID].header.Name[:], "lost+found\x00")
+	c.objects[yaffsLostFoundID].header.ParentObjID = yaffsRootID
+
+	ids := make([]int, 0, len(c.objects))
+	for id := range c.objects {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		obj := c.objects[uint32(id)]
+		parent := obj.header.ParentObjID
+		switch {
+		case id == yaffsRootID:
+			continue
+		case parent == yaffsUnlinkedID || parent == yaffsDeletedID:
+			continue
+		case c.objects[parent] == nil || c.objects[parent].header.Type != yaffsTypeDir:
+			parent = yaffsLostFoundID
+		}
+		c.objects[parent].children = append(c.objects[parent].children, uint32(id))
+	}
+	return nil
+}
+
+// fileData writes the data chunks of a file, missing chunks are holes
+func (c *yaffsContext) fileData(w io.Writer, id uint32, size int64) error {
+	chunks := c.chunks[id]
+	numbers := make([]int, 0, len(chunks))
+	for n := range chunks {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+
+	var written int64
+	for _, n := range numbers {
+		if err := c.Canceled(); err != nil {
+			return err
+		}
+		start := int64(n-1) * c.layout.dataSize()
+		if start >= size {
+			break
+		}
+		chunk := chunks[uint32(n)]
+		length := int64(chunk.nbytes)
+		if start+length > size {
+			length = size - start
+		}
+		if err := writeZeros(w, start-written); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, util.NewSectionReader(c.Reader, chunk.offset, length)); err != nil {
+			return err
+		}
+		written = start + length
+	}
+	return writeZeros(w, size-written)
+}
+
+// setInfo records file information as metadata
+func (c *yaffsContext) setInfo(fd *types.FileData, header *yaffsObjectHeader) {
+	fd.SetTime(time.Unix(int64(header.Mtime), 0))
+	fd.SetMetadata("mode", int64(header.Mode&07777))
+	fd.SetMetadata("uid", int64(header.UID))
+	fd.SetMetadata("gid", int64(header.GID))
+}
+
+func yaffsString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// object creates an object and its children, hard links are created
+// later since their target may not exist yet
+func (c *yaffsContext) object(id uint32, name string, hardlinks *[]uint32) error {
+	if err := c.Canceled(); err != nil {
+		return err
+	}
+	obj := c.objects[id]
+	header := &obj.header
+	c.paths[id] = name
+
+	switch header.Type {
+	case yaffsTypeDir:
+		if c.dirs[id] {
+			return fmt.Errorf("yaffs2: directory loop at %s", name)
+		}
+		c.dirs[id] = true
+		if id == yaffsLostFoundID && len(obj.children) == 0 {
+			return nil
+		}
+		if name != "" {
+			fd, err := c.Mkdir(name)
+			if err != nil {
+				return err
+			}
+			c.setInfo(fd, header)
+		}
+		sort.Slice(obj.children, func(i, j int) bool {
+			return yaffsString(c.objects[obj.children[i]].header.Name[:]) <
+				yaffsString(c.objects[obj.children[j]].header.Name[:])
+		})
+		for _, child := range obj.children {
+			cname := yaffsString(c.objects[child].header.Name[:])
+			if cname == "" || cname == "." || cname == ".." {
+				return fmt.Errorf("yaffs2: bad name in %s", name)
+			}
+			if err := c.object(child, path.Join(name, cname), hardlinks); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case yaffsTypeFile:
+		w, fd, err := c.Create(name)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		c.setInfo(fd, header)
+		size := int64(header.FileSizeLow)
+		if header.FileSizeHigh != 0xFFFFFFFF {
+			size |= int64(header.FileSizeHigh) << 32
+		}
+		return c.fileData(w, id, size)
+
+	case yaffsTypeSymlink:
+		fd, err := c.Link(name, yaffsString(header.Alias[:]), false)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, header)
+		return nil
+
+	case yaffsTypeHardlink:
+		*hardlinks = append(*hardlinks, id)
+		return nil
+
+	case yaffsTypeSpecial:
+		var typ string
+		switch header.Mode & 0xF000 {
+		case 0x6000:
+			typ = "blockdev"
+		case 0x2000:
+			typ = "chardev"
+		case 0x1000:
+			typ = "fifo"
+		case 0xC000:
+			typ = "socket"
+		default:
+			return fmt.Errorf("yaffs2: unknown file type %o for %s", header.Mode, name)
+		}
+		fd, err := c.Node(name, typ)
+		if err != nil {
+			return err
+		}
+		c.setInfo(fd, header)
+		if typ == "blockdev" || typ == "chardev" {
+			fd.SetMetadata("major", int64((header.Rdev>>8)&0xFFF))
+			fd.SetMetadata("minor", int64(header.Rdev&0xFF|(header.Rdev>>12)&0xFFF00))
+		}
+		return nil
+	}
+	return fmt.Errorf("yaffs2: unknown object type %d for %s", header.Type, name)
+}
+
+// Unyaffs2 extracts a YAFFS2 image as made by mkyaffs2image or dumped from
+// NAND flash.
+//
+// The page size and where the tags are stored is detected from the first
+// chunks. Links and device nodes are recorded as metadata together with
+// the mode and owner of files
+func Unyaffs2(e *types.Env, prefix string) (string, error) {
+	c := &yaffsContext{
+		Create:   e.Create,
+		Link:     e.Link,
+		Node:     e.Node,
+		Mkdir:    e.Mkdir,
+		Canceled: e.Canceled,
+		headers:  make(map[uint32]yaffsChunk),
+		chunks:   make(map[uint32]map[uint32]yaffsChunk),
+		objects:  make(map[uint32]*yaffsObject),
+		paths:    make(map[uint32]string),
+		dirs:     make(map[uint32]bool),
+	}
+	c.Reader = e.Reader
+
+	if err := c.findEndian(); err != nil {
+		return "", err
+	}
+	filesize := int64(e.GetSize())
+	if err := c.findLayout(filesize); err != nil {
+		return "", err
+	}
+	report := map[string]interface{}{
+		"page-size":  c.layout.pageSize,
+		"spare-size": c.layout.spareSize,
+		"tag-offset": c.layout.tags() - c.layout.pageSize,
+		"inband":     c.layout.inband,
+		"bigendian":  c.Order == binary.BigEndian,
+	}
+	analysis := e.AnalysisName("yaffs2")
+	e.Current.RegisterAnalysis(analysis, report, nil)
+
+	if err := c.scan(filesize); err != nil {
+		return "", err
+	}
+	if err := c.tree(); err != nil {
+		return "", err
+	}
+
+	var hardlinks []uint32
+	if err := c.object(yaffsRootID, prefix, &hardlinks); err != nil {
+		return "", err
+	}
+	for _, id := range hardlinks {
+		header := &c.objects[id].header
+		target, found := c.paths[header.EquivID]
+		if !found || c.objects[header.EquivID].header.Type != yaffsTypeFile {
+			return "", fmt.Errorf("yaffs2: hard link %s has no target", c.paths[id])
+		}
+		fd, err := c.Link(c.paths[id], target, true)
+		if err != nil {
+			return "", err
+		}
+		c.setInfo(fd, header)
+	}
+	return prefix, nil
+}
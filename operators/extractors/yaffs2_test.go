@@ -0,0 +1,145 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// yaffsImage creates YAFFS2 images in the given layout
+type yaffsImage struct {
+	bytes.Buffer
+	layout yaffsLayout
+	order  binary.ByteOrder
+}
+
+func (y *yaffsImage) chunk(data []byte, tags yaffsTags) {
+	chunk := bytes.Repeat([]byte{0xFF}, int(y.layout.chunkSize()))
+	copy(chunk, data)
+	var b bytes.Buffer
+	binary.Write(&b, y.order, &tags)
+	copy(chunk[y.layout.tags():], b.Bytes())
+	y.Write(chunk)
+}
+
+func (y *yaffsImage) header(id uint32, seq uint32, h yaffsObjectHeader, name string) {
+	h.SumNoLongerUsed = 0xFFFF
+	h.Mtime = 1589718896
+	h.UID, h.GID = 1000, 100
+	copy(h.Name[:], name)
+	var b bytes.Buffer
+	binary.Write(&b, y.order, &h)
+	y.chunk(b.Bytes(), yaffsTags{SeqNumber: seq, ObjID: id | h.Type<<28,
+		ChunkID: yaffsChunkHeaderFlag | h.ParentObjID, NBytes: h.FileSizeLow})
+}
+
+func (y *yaffsImage) file(id, parent uint32, name string, data []byte) {
+	y.header(id, yaffsLowestSeq, yaffsObjectHeader{Type: yaffsTypeFile, ParentObjID: parent,
+		Mode: 0x8000 | 0644, FileSizeLow: uint32(len(data))}, name)
+	size := int(y.layout.dataSize())
+	for n := 0; n*size < len(data); n++ {
+		part := data[n*size:]
+		if len(part) > size {
+			part = part[:size]
+		}
+		y.chunk(part, yaffsTags{SeqNumber: yaffsLowestSeq, ObjID: id, ChunkID: uint32(n + 1), NBytes: uint32(len(part))})
+	}
+}
+
+func yaffsBuild(layout yaffsLayout, order binary.ByteOrder, big []byte) []byte {
+	y := &yaffsImage{layout: layout, order: order}
+	y.file(257, yaffsRootID, "hello.txt", []byte("hello yaffs\n"))
+	y.header(258, yaffsLowestSeq, yaffsObjectHeader{Type: yaffsTypeDir, ParentObjID: yaffsRootID, Mode: 0x4000 | 0755}, "dir")
+
+	// the second chunk is rewritten in a newer block
+	old := append([]byte{}, big...)
+	size := int(layout.dataSize())
+	copy(old[size:], bytes.Repeat([]byte{'x'}, size))
+	y.file(259, 258, "big.bin", old)
+	y.chunk(nil, yaffsTags{SeqNumber: 0xFFFFFFFF, ObjID: 0xFFFFFFFF, ChunkID: 0xFFFFFFFF, NBytes: 0xFFFFFFFF})
+
+	link := yaffsObjectHeader{Type: yaffsTypeSymlink, ParentObjID: yaffsRootID, Mode: 0xA000 | 0777}
+	copy(link.Alias[:], "hello.txt")
+	y.header(260, yaffsLowestSeq, link, "link")
+	y.header(261, yaffsLowestSeq, yaffsObjectHeader{Type: yaffsTypeHardlink, ParentObjID: 258, EquivID: 257}, "hard")
+	y.header(262, yaffsLowestSeq, yaffsObjectHeader{Type: yaffsTypeSpecial, ParentObjID: yaffsRootID,
+		Mode: 0x2000 | 0600, Rdev: 4<<8 | 5}, "tty")
+	y.file(263, yaffsDeletedID, "deleted", []byte("deleted data"))
+	y.file(264, yaffsRootID, "old-name", []byte("renamed"))
+	y.file(265, 999, "orphan", []byte("orphan"))
+
+	y.chunk(big[size:2*size], yaffsTags{SeqNumber: yaffsLowestSeq + 1, ObjID: 259, ChunkID: 2, NBytes: uint32(size)})
+	y.header(264, yaffsLowestSeq+1, yaffsObjectHeader{Type: yaffsTypeFile, ParentObjID: 258,
+		Mode: 0x8000 | 0644, FileSizeLow: 7}, "new-name")
+	return y.Bytes()
+}
+
+func TestUnyaffs2(t *testing.T) {
+	var testdata = []struct {
+		layout yaffsLayout
+		order  binary.ByteOrder
+	}{
+		{yaffsLayout{pageSize: 2048, spareSize: 64}, binary.LittleEndian},
+		{yaffsLayout{pageSize: 2048, spareSize: 64, tagOffset: 2}, binary.LittleEndian},
+		{yaffsLayout{pageSize: 512, spareSize: 16}, binary.LittleEndian},
+		{yaffsLayout{pageSize: 4096, spareSize: 128}, binary.BigEndian},
+		{yaffsLayout{pageSize: 4096, inband: true}, binary.LittleEndian},
+	}
+	big := bytes.Repeat([]byte("yaffs2 data chunk "), 1000)
+	for _, test := range testdata {
+		img := yaffsBuild(test.layout, test.order, big)
+		x, err := runExtractor(img, Unyaffs2)
+		if err != nil {
+			t.Errorf("%+v: extraction failed: %v", test.layout, err)
+			continue
+		}
+		report := x.input.Analyses["yaffs2"].Result.(map[string]interface{})
+		if report["page-size"] != test.layout.pageSize || report["inband"] != test.layout.inband ||
+			report["tag-offset"] != test.layout.tags()-test.layout.pageSize {
+			t.Errorf("%+v: wrong layout %v", test.layout, report)
+		}
+
+		var contents = []struct {
+			name string
+			data []byte
+		}{
+			{"hello.txt", []byte("hello yaffs\n")},
+			{"dir/big.bin", big},
+			{"dir/new-name", []byte("renamed")},
+			{"lost+found/orphan", []byte("orphan")},
+		}
+		for _, c := range contents {
+			if data := x.content(t, c.name); !bytes.Equal(data, c.data) {
+				t.Errorf("%+v: %s has wrong content", test.layout, c.name)
+			}
+		}
+		for _, name := range []string{"deleted", "old-name"} {
+			if _, found := x.files[name]; found {
+				t.Errorf("%+v: %s was extracted", test.layout, name)
+			}
+		}
+
+		var metadata = []struct {
+			file, key string
+			value     interface{}
+		}{
+			{"hello.txt", "mode", int64(0644)},
+			{"hello.txt", "uid", int64(1000)},
+			{"link", "link", "hello.txt"},
+			{"dir/hard", "type", "hardlink"},
+			{"tty", "type", "chardev"},
+			{"tty", "major", int64(4)},
+			{"tty", "minor", int64(5)},
+		}
+		for _, m := range metadata {
+			if v := x.metadata(t, m.file, m.key); v != m.value {
+				t.Errorf("%+v: %s has %s %v, wanted %v", test.layout, m.file, m.key, v, m.value)
+			}
+		}
+	}
+
+	// files that are not YAFFS2 are rejected
+	if _, err := runExtractor(bytes.Repeat([]byte{1, 0, 0, 0}, 4096), Unyaffs2); err == nil {
+		t.Errorf("bad image was accepted")
+	}
+}
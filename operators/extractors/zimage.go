@@ -0,0 +1,169 @@
+package extractors
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util/compress"
+)
+
+const (
+	zimageMaxSize  = 128 << 20
+	zimageMaxTries = 64
+	zimageArmMagic = 0x016F2818
+	zimageHdrS     = "HdrS"
+)
+
+// zimageCompressor is a payload format of a compressed kernel
+type zimageCompressor struct {
+	name  string
+	magic string
+	open  func(io.Reader) (io.Reader, error)
+}
+
+var zimageCompressors = []zimageCompressor{
+	{"gzip", "\x1f\x8b\x08", func(r io.Reader) (io.Reader, error) {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		z.Multistream(false)
+		return z, nil
+	}},
+	{"xz", "\xfd7zXZ\x00", compress.NewXzReader},
+	{"zstd", "\x28\xb5\x2f\xfd", compress.NewZstdReader},
+	{"bzip2", "BZh", func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }},
+	{"lzma", "\x5d\x00\x00", compress.NewLzmaReader},
+	{"lzo", "\x89LZO\x00", nil},
+	{"lz4", "\x02\x21\x4c\x18", nil},
+}
+
+type zimageCandidate struct {
+	offset int
+	comp   *zimageCompressor
+}
+
+// zimageFind finds the compressed kernel by trying each compression magic
+// in the order they appear, the decompressor may contain false matches
+func zimageFind(data []byte) (int, *zimageCompressor, error) {
+	var candidates []zimageCandidate
+	for i := range zimageCompressors {
+		comp := &zimageCompressors[i]
+		for offset, found := 0, 0; found < zimageMaxTries; offset, found = offset+1, found+1 {
+			n := bytes.Index(data[offset:], []byte(comp.magic))
+			if n == -1 {
+				break
+			}
+			offset += n
+			candidates = append(candidates, zimageCandidate{offset, comp})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].offset < candidates[j].offset })
+
+	var unsupported *zimageCompressor
+	buf := make([]byte, 64*1024)
+	for i, c := range candidates {
+		if i == zimageMaxTries {
+			break
+		}
+		if c.comp.open == nil {
+			if unsupported == nil {
+				unsupported = c.comp
+			}
+			continue
+		}
+		r, err := c.comp.open(bytes.NewReader(data[c.offset:]))
+		if err != nil {
+			continue
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF || err == bzip2Trailing) {
+			return c.offset, c.comp, nil
+		}
+	}
+	if unsupported != nil {
+		return 0, nil, fmt.Errorf("zimage: %s compressed kernels are not supported", unsupported.name)
+	}
+	return 0, nil, fmt.Errorf("zimage: no compressed kernel found")
+}
+
+// zimagePayload returns where the compressed kernel is in the image
+func zimagePayload(data []byte, report map[string]interface{}) (int, int, error) {
+	le := binary.LittleEndian
+	if len(data) >= 0x250 && le.Uint16(data[0x1FE:]) == 0xAA55 && string(data[0x202:0x206]) == zimageHdrS {
+		version := le.Uint16(data[0x206:])
+		report["type"] = "bzImage"
+		report["protocol"] = fmt.Sprintf("%d.%02d", version>>8, version&0xFF)
+		if version < 0x208 {
+			return 0, 0, fmt.Errorf("zimage: boot protocol %s has no payload", report["protocol"])
+		}
+		setup := int(data[0x1F1])
+		if setup == 0 {
+			setup = 4
+		}
+		start := (setup+1)*512 + int(le.Uint32(data[0x248:]))
+		end := start + int(le.Uint32(data[0x24C:]))
+		if start > end || end > len(data) {
+			return 0, 0, fmt.Errorf("zimage: payload is outside the image")
+		}
+		return start, end, nil
+	}
+	if len(data) >= 0x30 && le.Uint32(data[0x24:]) == zimageArmMagic {
+		report["type"] = "zImage"
+		if end := int(le.Uint32(data[0x2C:]) - le.Uint32(data[0x28:])); end > 0 && end < len(data) {
+			return 0, end, nil
+		}
+		return 0, len(data), nil
+	}
+	return 0, 0, fmt.Errorf("file is not a zImage or bzImage")
+}
+
+// Unzimage decompresses the kernel in an ARM zImage or x86 bzImage. The
+// image type and the compression are recorded as the analysis "zimage"
+func Unzimage(e *types.Env, prefix string) (string, error) {
+	if _, err := e.Reader.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	data, err := readLimited(e.Reader, zimageMaxSize)
+	if err != nil {
+		return "", err
+	}
+
+	report := map[string]interface{}{}
+	analysis := e.AnalysisName("zimage")
+	start, end, err := zimagePayload(data, report)
+	if err != nil {
+		return "", err
+	}
+	offset, comp, err := zimageFind(data[start:end])
+	if err == nil {
+		report["compression"] = comp.name
+		report["offset"] = start + offset
+	}
+	e.Current.RegisterAnalysis(analysis, report, err)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := comp.open(bytes.NewReader(data[start+offset : end]))
+	if err != nil {
+		return "", err
+	}
+	w, _, err := e.Create(prefix)
+	if err != nil {
+		return "", err
+	}
+	defer w.Close()
+	// the decompressed size often follows the payload
+	if _, err := io.Copy(w, r); err != nil && err != bzip2Trailing {
+		return "", err
+	}
+	return w.Name(), nil
+}
@@ -0,0 +1,67 @@
+package extractors
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// zImage creates an ARM zImage, the decompressor contains false matches
+// for lzma and gzip
+func zImage(payload []byte) []byte {
+	img := make([]byte, 0x30)
+	img = append(img, "\x5d\x00\x00 decompressor \x1f\x8b\x08 code"...)
+	img = append(img, payload...)
+	img = append(img, 1, 2, 3, 4)
+	binary.LittleEndian.PutUint32(img[0x24:], zimageArmMagic)
+	binary.LittleEndian.PutUint32(img[0x2C:], uint32(len(img)))
+	return img
+}
+
+// bzImage creates an x86 bzImage with one setup sector
+func bzImage(payload []byte) []byte {
+	img := make([]byte, 1024+0x40)
+	img[0x1F1] = 1
+	binary.LittleEndian.PutUint16(img[0x1FE:], 0xAA55)
+	copy(img[0x202:], zimageHdrS)
+	binary.LittleEndian.PutUint16(img[0x206:], 0x020F)
+	binary.LittleEndian.PutUint32(img[0x248:], 0x40)
+	binary.LittleEndian.PutUint32(img[0x24C:], uint32(len(payload)))
+	return append(append(img, payload...), 1, 2, 3, 4)
+}
+
+func TestUnzimage(t *testing.T) {
+	kernel := []byte("Linux version 5.10.0 (builder@host) #1 SMP\n" + strings.Repeat("kernel code ", 10000))
+	xz, _ := base64.StdEncoding.DecodeString(xzTestData)
+	var testdata = []struct {
+		img          []byte
+		typ, comp    string
+		offset       int
+		decompressed []byte
+	}{
+		{zImage(gzipData(kernel)), "zImage", "gzip", 0x30 + 25, kernel},
+		{bzImage(xz), "bzImage", "xz", 1024 + 0x40, []byte(testData)},
+	}
+	for _, test := range testdata {
+		x, err := runExtractor(test.img, Unzimage)
+		if err != nil {
+			t.Errorf("%s: extraction failed: %v", test.typ, err)
+			continue
+		}
+		if got := x.content(t, "noname"); !bytes.Equal(got, test.decompressed) {
+			t.Errorf("%s: wrong kernel", test.typ)
+		}
+		report := x.input.Analyses["zimage"].Result.(map[string]interface{})
+		if report["type"] != test.typ || report["compression"] != test.comp || report["offset"] != test.offset {
+			t.Errorf("%s: wrong analysis %v", test.typ, report)
+		}
+	}
+
+	// kernels with unsupported compression are reported
+	_, err := runExtractor(zImage([]byte("\x02\x21\x4c\x18 lz4 data")), Unzimage)
+	if err == nil || !strings.Contains(err.Error(), "lz4") {
+		t.Errorf("lz4 kernel gave %v", err)
+	}
+}
@@ -3,8 +3,10 @@ package extractors
 import (
 	"archive/zip"
 	"io"
+	"os"
 
 	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
 )
 
 func extractOneFile(e *types.Env, f *zip.File, prefix string) error {
@@ -14,6 +16,16 @@ func extractOneFile(e *types.Env, f *zip.File, prefix string) error {
 	}
 	defer rc.Close()
 
+	// links are recorded, not created
+	if f.Mode()&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return err
+		}
+		_, err = e.Link(prefix+f.Name, string(target), false)
+		return err
+	}
+
 	// in reality, we should use f.Mode() but we are replacing it
 	// with our own default permissions
 	if !f.FileInfo().IsDir() {
@@ -33,13 +45,16 @@ func extractOneFile(e *types.Env, f *zip.File, prefix string) error {
 }
 
 func Unzip(e *types.Env, prefix string) (string, error) {
-	r, err := zip.OpenReader(e.GetFile())
+	// read from the input rather than the file, it may be a carved region
+	r, err := zip.NewReader(util.NewReaderAt(e.Reader), int64(e.GetSize()))
 	if err != nil {
 		return "", err
 	}
-	defer r.Close()
 
 	for _, f := range r.File {
+		if err := e.Canceled(); err != nil {
+			return "", err
+		}
 		if err := extractOneFile(e, f, prefix); err != nil {
 			return "", err
 		}
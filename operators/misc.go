@@ -31,7 +31,7 @@ func systemFunction(e *types.Env, format string, args ...interface{}) (string, e
 	fmt.Println("EXECUTING", cmd, "...") // DEBUG
 
 	// now execute it:
-	out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	out, err := exec.CommandContext(e.Context(), cmd[0], cmd[1:]...).CombinedOutput()
 	if err == nil {
 		return string(out), nil
 	}
@@ -23,9 +23,10 @@ func ExtractFlatMatch(m *types.Match) []*types.FlatMatch {
 			return true // we will takes its children instead
 		}
 		var flat = &types.FlatMatch{
-			Rule: match.Rule,
-			Name: match.Rule.ID,
-			Vars: make(map[string]interface{}),
+			Rule:   match.Rule,
+			Name:   match.Rule.ID,
+			Vars:   make(map[string]interface{}),
+			Offset: m.Offset,
 		}
 		flattenMatch(match, flat)
 		ret = append(ret, flat)
@@ -109,3 +109,104 @@ func TestLoadRuleMetadata(t *testing.T) {
 		t.Errorf("Missing string metadata")
 	}
 }
+
+func TestRuleSignatures(t *testing.T) {
+	molly := New()
+	names, texts := LoadBuiltinRules()
+	for i, name := range names {
+		if err := LoadRulesFromText(molly, name, texts[i]); err != nil {
+			t.Fatalf("Could not load builtin rules: %v", err)
+		}
+	}
+
+	var testdata = []struct {
+		rule   string
+		offset int64
+		data   string
+	}{
+		{"ELF", 0, "\x7FELF"},
+		{"gzip", 0, "\x1f\x8b\x08"},
+		{"jffs2", 0, "\x85\x19"},
+		{"yaffs2", 4, "\x01\x00\x00\x00\xff\xff"},
+		{"yaffs2_be", 4, "\x00\x00\x00\x01\xff\xff"},
+		{"UImage", 0, "\x27\x05\x19\x56"},
+		{"DalvikDex", 0, "dex\n"},
+		{"AndroidBinaryXML", 0, "\x03\x00\x08\x00"},
+		{"APK", 0, "PK\x03\x04"},
+		{"AndroidBoot", 0, "ANDROID!"},
+		{"AndroidVendorBoot", 0, "VNDRBOOT"},
+		{"AndroidSparse", 0, "\x3a\xff\x26\xed"},
+		{"AndroidPayload", 0, "CrAU"},
+		{"cramfs", 16, "Compressed ROMFS"},
+		{"squashfs", 0, "hsqs"},
+		{"ext", 0x438, "\x53\xef"},
+		{"fat", 0x1FE, "\x55\xaa"},
+		{"exfat", 3, "EXFAT   "},
+		{"ubi", 0, "UBI#"},
+		{"ubifs", 0, "\x31\x18\x10\x06"},
+		{"iso9660", 0x8001, "CD001"},
+		{"ar", 0, "!<arch>\n"},
+		{"rpm", 0, "\xed\xab\xee\xdb"},
+		{"TiTxt", 0, "@"},
+		{"TRX", 0, "HDR0"},
+		{"Seama", 0, "\x5e\xa3\xa4\x17"},
+		{"SHRS", 0, "SHRS"},
+		{"TPLink", 4, "TP-LINK"},
+		{"NetgearCHK", 0, "*#$^"},
+		{"ZyNOS", 5, "SIG"},
+		{"UEFIVolume", 40, "_FVH"},
+		{"xz", 0, "\xfd7zXZ\x00"},
+		{"zstd", 0, "\x28\xb5\x2f\xfd"},
+		{"bzip2", 4, "1AY&SY"},
+		{"LZMA_lzip", 0, "LZIP"},
+		{"FDT", 0, "\xd0\x0d\xfe\xed"},
+		{"LinuxZImage", 0x24, "\x18\x28\x6f\x01"},
+		{"LinuxBzImage", 0x202, "HdrS"},
+	}
+	for _, test := range testdata {
+		rule, found := molly.Rules.Top[test.rule]
+		if !found {
+			t.Errorf("Builtin rule %s not found", test.rule)
+			continue
+		}
+		if len(rule.Signatures) != 1 {
+			t.Errorf("Rule %s has signatures %v", test.rule, rule.Signatures)
+			continue
+		}
+		sig := rule.Signatures[0]
+		if sig.Offset != test.offset || string(sig.Data) != test.data {
+			t.Errorf("Rule %s has signature %d:%q, wanted %d:%q",
+				test.rule, sig.Offset, sig.Data, test.offset, test.data)
+		}
+	}
+
+	// alternatives in a condition give multiple signatures
+	if rule := molly.Rules.Top["squashfs_le"]; len(rule.Signatures) != 1 {
+		t.Errorf("squashfs_le has signatures %v", rule.Signatures)
+	}
+	if rule := molly.Rules.Top["LZMA_7z"]; len(rule.Signatures) != 2 {
+		t.Errorf("LZMA_7z has signatures %v", rule.Signatures)
+	}
+	if rule := molly.Rules.Top["cpio_ascii_old"]; len(rule.Signatures) != 1 {
+		t.Errorf("cpio_ascii_old has signatures %v", rule.Signatures)
+	}
+	if rule := molly.Rules.Top["cpio_ascii_new"]; len(rule.Signatures) != 2 {
+		t.Errorf("cpio_ascii_new has signatures %v", rule.Signatures)
+	}
+	if rule := molly.Rules.Top["IntelHex"]; len(rule.Signatures) != 3 {
+		t.Errorf("IntelHex has signatures %v", rule.Signatures)
+	}
+	if rule := molly.Rules.Top["SRecord"]; len(rule.Signatures) != 4 {
+		t.Errorf("SRecord has signatures %v", rule.Signatures)
+	}
+	if rule := molly.Rules.Top["UEFICapsule"]; len(rule.Signatures) != 4 {
+		t.Errorf("UEFICapsule has signatures %v", rule.Signatures)
+	}
+	if rule := molly.Rules.Top["UEFIImage"]; len(rule.Signatures) != 2 {
+		t.Errorf("UEFIImage has signatures %v", rule.Signatures)
+	}
+	// conditions on the file name give no signature
+	if rule := molly.Rules.Top["LinuxKernel"]; len(rule.Signatures) != 0 {
+		t.Errorf("LinuxKernel has signatures %v", rule.Signatures)
+	}
+}
@@ -2,12 +2,14 @@ package molly
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 
 	"github.com/avahidi/molly/report"
 	"github.com/avahidi/molly/scan"
 	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
 )
 
 // processMatch will process a match on a rule
@@ -32,49 +34,194 @@ func processTags(c *types.Configuration, fr *types.FileData) {
 	}
 }
 
+// scanRule evaluates one top-level rule against the current input
+func scanRule(m *types.Molly, env *types.Env, rule *types.Rule, data *types.FileData) {
+	if env.Canceled() != nil {
+		return
+	}
+	env.StartRule(rule)
+	match, errs := scan.AnalyzeFile(rule, env)
+	if match != nil {
+		match.Offset = env.Offset
+		data.Matches = append(data.Matches, match)
+		processMatch(m.Config, data, match)
+	}
+	for _, err := range errs {
+		data.RegisterError(err)
+	}
+}
+
+// extents are the regions of an input that extractors have used
+type extents [][2]int64
+
+// add records the extent of the last extraction, if any
+func (x *extents) add(env *types.Env) {
+	if n := env.TakeExtent(); n > 0 {
+		*x = append(*x, [2]int64{env.Offset, env.Offset + n})
+	}
+}
+
+// skip returns the first offset at or after offset that is not used
+func (x extents) skip(offset int64) int64 {
+	for moved := true; moved; {
+		moved = false
+		for _, r := range x {
+			if offset >= r[0] && offset < r[1] {
+				offset, moved = r[1], true
+			}
+		}
+	}
+	return offset
+}
+
+// carveInput evaluates carve-able rules at aligned offsets inside the input.
+// Offset 0 is not considered since that has already been covered by a normal
+// scan, neither are regions that extractors have already used
+func carveInput(m *types.Molly, env *types.Env, reader io.ReadSeeker,
+	data *types.FileData, rules []*types.Rule, used *extents) {
+	align := m.Config.CarveAlign
+	if align <= 0 {
+		align = 1
+	}
+
+	// rules with signatures are only evaluated where their signature was found
+	var candidates []types.CarveCandidate
+	var blind []*types.Rule
+	for _, rule := range rules {
+		if m.Rules.Index == nil || rule.Signatures == nil {
+			blind = append(blind, rule)
+		}
+	}
+	if m.Rules.Index != nil && len(blind) != len(rules) {
+		var err error
+		candidates, err = m.Rules.Index.CarveCandidates(reader)
+		if err != nil {
+			data.RegisterError(err)
+		}
+	}
+	inpass := make(map[*types.Rule]bool)
+	for _, rule := range rules {
+		inpass[rule] = true
+	}
+
+	next := 0
+	for offset := align; offset < data.Filesize && env.Canceled() == nil; offset += align {
+		if end := used.skip(offset); end > offset {
+			offset = (end+align-1)/align*align - align
+			continue
+		}
+
+		// skip ahead if there is nothing to do until the next candidate
+		if len(blind) == 0 {
+			if next >= len(candidates) {
+				break
+			}
+			if c := candidates[next].Offset; c > offset {
+				offset = (c + align - 1) / align * align
+			}
+		}
+		env.SetInputAt(reader, data, offset)
+		for ; next < len(candidates) && candidates[next].Offset <= offset; next++ {
+			if c := candidates[next]; c.Offset == offset && inpass[c.Rule] {
+				scanRule(m, env, c.Rule, data)
+				used.add(env)
+			}
+		}
+		for _, rule := range blind {
+			scanRule(m, env, rule, data)
+			used.add(env)
+		}
+	}
+	env.SetInput(reader, data)
+}
+
 func scanInput(m *types.Molly, env *types.Env, reader io.ReadSeeker, data *types.FileData) {
 
+	// find rules that can possibly match
+	var possible map[*types.Rule]bool
+	if m.Rules.Index != nil {
+		var err error
+		if possible, err = m.Rules.Index.Candidates(reader); err != nil {
+			data.RegisterError(err)
+			possible = nil
+		}
+	}
+
 	env.SetInput(reader, data)
+	var used extents
 	for pass := types.RulePassMin; pass <= types.RulePassMax; pass++ {
+		var carve []*types.Rule
 		for _, rule := range m.Rules.Top {
+			if env.Canceled() != nil {
+				break
+			}
 			if p, _ := rule.Metadata.Get("pass", int64(types.RulePassMin)); p != int64(pass) {
 				continue
 			}
-			env.StartRule(rule)
-			match, errs := scan.AnalyzeFile(rule, env)
-			if match != nil {
-				data.Matches = append(data.Matches, match)
-				processMatch(m.Config, data, match)
+			if c, _ := rule.Metadata.GetBoolean("carve", false); c {
+				carve = append(carve, rule)
 			}
-			for _, err := range errs {
-				data.RegisterError(err)
+			if possible != nil && rule.Signatures != nil && !possible[rule] {
+				continue
 			}
+			scanRule(m, env, rule, data)
+			used.add(env)
+		}
+		if m.Config.Carve && len(carve) > 0 {
+			carveInput(m, env, reader, data, carve, &used)
 		}
 	}
 	processTags(m.Config, data)
+}
 
-	// this file may have created new files, scan them too
-	for _, offspring := range data.Children {
-		scanFile(m, env, offspring.Filename, data)
+// scanInputContext scans the input until done or the context (or the per-file timeout) expires
+func scanInputContext(ctx context.Context, m *types.Molly, env *types.Env,
+	reader io.ReadSeeker, data *types.FileData) {
+	if m.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Config.Timeout)
+		defer cancel()
+	}
+
+	env.SetContext(ctx)
+	scanInput(m, env, util.NewContextReader(ctx, reader), data)
+	env.SetContext(context.Background())
+
+	switch err := ctx.Err(); {
+	case err == context.DeadlineExceeded && m.Config.Timeout > 0:
+		data.RegisterErrorf("scan timed out after %v", m.Config.Timeout)
+	case err != nil:
+		data.RegisterErrorf("scan stopped: %v", err)
 	}
 }
 
 // ScanData scans a byte vector for matches.
 func ScanData(m *types.Molly, data []byte) error {
+	return ScanDataContext(context.Background(), m, data)
+}
+
+// ScanDataContext scans a byte vector for matches until done or the context expires.
+func ScanDataContext(ctx context.Context, m *types.Molly, data []byte) error {
 
 	// we need a dummy file name that is unique:
 	var fd *types.FileData
-	for i := 0; fd == nil; i++ {
+	for i := 0; ; i++ {
+		var created bool
 		dummyname := fmt.Sprintf("nopath/nofile_%04d", i)
-		if _, found := m.Files[dummyname]; !found {
-			fd = types.NewFileData(dummyname, nil)
-			m.Files[dummyname] = fd
+		if fd, created = m.AddFile(dummyname, nil); created {
+			break
 		}
 	}
 	fd.Filesize = int64(len(data))
+	fd.FilenameOut = suggestBaseName(m.Config, fd)
+	m.MarkProcessed(fd)
 
 	env := types.NewEnv(m)
 	reader := bytes.NewReader(data)
-	scanInput(m, env, reader, fd)
-	return nil
+	scanInputContext(ctx, m, env, reader, fd)
+
+	// files extracted from the data are scanned like any other file
+	s := newScheduler(ctx, m)
+	s.pushChildren(fd)
+	return s.run()
 }
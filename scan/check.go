@@ -57,6 +57,12 @@ func checkRule(r *types.Rule) error {
 	var cs = constraint{
 		"tag":       {reflect.String, nil},
 		"bigendian": {reflect.Bool, nil},
+		"carve": {reflect.Bool, func(name string, data interface{}) error {
+			if r.Parent != nil {
+				return fmt.Errorf("Only parent rules can have 'carve'")
+			}
+			return nil
+		}},
 		"pass": {reflect.Int64, func(name string, data interface{}) error {
 			if r.Parent != nil {
 				return fmt.Errorf("Only parent rules can have 'pass'")
@@ -94,6 +94,14 @@ func addParsedToSet(rs *types.RuleSet, parsed []*parsedRule) error {
 		}
 	}
 
+	// 6. update the prefilter with signatures from the new top-level rules
+	for _, pr := range parsed {
+		if pr.parentRule == nil {
+			pr.rule.Signatures = exp.RuleSignatures(pr.rule)
+		}
+	}
+	rs.Index = types.NewRuleIndex(rs.Top)
+
 	return nil
 }
 
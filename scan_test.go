@@ -1,10 +1,20 @@
 package molly
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/avahidi/molly/operators"
 	"github.com/avahidi/molly/report"
 	"github.com/avahidi/molly/types"
+	"github.com/avahidi/molly/util"
 )
 
 func getVar(match *types.Match, name string) (interface{}, bool) {
@@ -168,3 +178,297 @@ func TestScanHas(t *testing.T) {
 		t.Errorf("has match failed (2)")
 	}
 }
+
+func TestScanCarve(t *testing.T) {
+	ruletext := `
+	rule magic (carve = true) {
+		var id = String(0, 4);
+		var val = Byte(4);
+		var off = $offset;
+		if id == "ABCD";
+	}
+	`
+	input := []byte("xxxxABCD\x07xxxABCD\x09")
+
+	for _, carve := range []bool{false, true} {
+		molly := New()
+		molly.Config.Carve = carve
+		molly.Config.CarveAlign = 1
+		if err := LoadRulesFromText(molly, "<test>", ruletext); err != nil {
+			t.Fatalf("Could not load rule from text: %v", err)
+		}
+		if err := ScanData(molly, input); err != nil {
+			t.Fatal(err)
+		}
+
+		mr := ExtractReport(molly)
+		if !carve {
+			if len(mr.Files) != 0 {
+				t.Errorf("Carved rule matched without carving")
+			}
+			continue
+		}
+
+		if len(mr.Files) != 1 || len(mr.Files[0].Matches) != 2 {
+			t.Fatalf("Incorrect number of carved matches")
+		}
+		for i, want := range []struct {
+			offset int64
+			val    uint8
+		}{{4, 7}, {12, 9}} {
+			match := mr.Files[0].Matches[i]
+			if match.Offset != want.offset {
+				t.Errorf("Carved match at %d, wanted %d", match.Offset, want.offset)
+			}
+			matchCheck(t, match, "off", want.offset)
+			matchCheck(t, match, "val", want.val)
+		}
+	}
+}
+
+// jffs2Image creates a little endian JFFS2 image with one node per file
+// and one for its data
+func jffs2Image(files ...string) []byte {
+	var b bytes.Buffer
+	node := func(typ uint16, body interface{}, tail string) {
+		var n bytes.Buffer
+		binary.Write(&n, binary.LittleEndian, body)
+		n.WriteString(tail)
+		binary.Write(&b, binary.LittleEndian, []uint16{0x1985, typ})
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(12 + n.Len()), 0})
+		b.Write(n.Bytes())
+		for b.Len()%4 != 0 {
+			b.WriteByte(0xFF)
+		}
+	}
+	for i, name := range files {
+		ino := uint32(i + 2)
+		node(0xE001, []uint32{1, 1, ino, 0, uint32(len(name)) | 0x08<<8, 0, 0}, name)
+		data := "data of " + name
+		node(0xE002, []uint32{ino, 1, 0100644, 0, uint32(len(data)), 0, 0, 0, 0,
+			uint32(len(data)), uint32(len(data)), 0, 0, 0}, data)
+	}
+	return b.Bytes()
+}
+
+func TestScanCarveExtent(t *testing.T) {
+	ruletext := `
+	rule jffs2 (bigendian = false, carve = true) {
+		var magic = Short(0);
+		var type = Short(2) & 0x0FF00;
+		if magic == 0x1985 && (type & 0x2FF0) == 0x2000;
+		extract("jffs2", "jffs2");
+	}
+	`
+	// every node of the image has the magic, but it is extracted once
+	input := append([]byte("not jffs2 data.."), jffs2Image("a", "b", "c")...)
+	molly := New()
+	molly.Config.Carve = true
+	molly.Config.CarveAlign = 4
+	molly.Config.FS = util.NewMemFS()
+	if err := LoadRulesFromText(molly, "<test>", ruletext); err != nil {
+		t.Fatalf("Could not load rule from text: %v", err)
+	}
+	if err := ScanData(molly, input); err != nil {
+		t.Fatal(err)
+	}
+
+	var matches, files int
+	for _, file := range molly.Files {
+		if file.Parent == nil {
+			matches += len(file.Matches)
+		} else if file.Filesize > 0 {
+			files++
+		}
+	}
+	if matches != 1 || files != 3 {
+		t.Errorf("JFFS2 image matched %d times with %d files, expected 1 and 3", matches, files)
+	}
+}
+
+// dtbImage creates an empty device tree for the given boot CPU
+func dtbImage(cpu uint32) []byte {
+	head := []uint32{0xd00dfeed, 56, 40, 56, 40, 17, 16, cpu, 0, 16}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, head)
+	binary.Write(&b, binary.BigEndian, []uint32{1, 0, 2, 9})
+	return b.Bytes()
+}
+
+func TestScanCarveAnalysis(t *testing.T) {
+	ruletext := `
+	rule FDT (carve = true) {
+		if Long(0) == 0xd00dfeed;
+		analyze("dtb", "");
+	}
+	`
+	// each device tree gets its own analysis
+	input := make([]byte, 0x200)
+	copy(input, dtbImage(1))
+	copy(input[0x100:], dtbImage(2))
+	molly := New()
+	molly.Config.Carve = true
+	molly.Config.CarveAlign = 0x10
+	molly.Config.FS = util.NewMemFS()
+	if err := LoadRulesFromText(molly, "<test>", ruletext); err != nil {
+		t.Fatalf("Could not load rule from text: %v", err)
+	}
+	if err := ScanData(molly, input); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range molly.Files {
+		if file.Parent != nil {
+			continue
+		}
+		for name, cpu := range map[string]uint32{"dtb": 1, "dtb_00000100": 2} {
+			analysis, found := file.Analyses[name]
+			if !found || analysis.Error != nil {
+				t.Errorf("Analysis %s is missing: %v", name, file.Analyses)
+				continue
+			}
+			if got := analysis.Result.(map[string]interface{})["boot-cpu"]; got != cpu {
+				t.Errorf("Analysis %s has boot CPU %v, expected %d", name, got, cpu)
+			}
+		}
+	}
+}
+
+func TestScanIndex(t *testing.T) {
+	ruletext := `
+	rule magic { var m = String(2, 2); if m == "AB" || m == "CD"; }
+	rule number (bigendian = false) { if Short(0) == 0x4241; }
+	rule blind { if Byte(0) > 0x40; }
+	`
+	inputs := [][]byte{
+		[]byte("ABAB"), []byte("xxCD"), []byte("xxAC"), []byte("\x01"), {},
+	}
+
+	for _, input := range inputs {
+		var names [2]map[string]bool
+		for i := range names {
+			molly := New()
+			if err := LoadRulesFromText(molly, "<test>", ruletext); err != nil {
+				t.Fatalf("Could not load rule from text: %v", err)
+			}
+			if i == 1 {
+				molly.Rules.Index = nil
+			}
+			if err := ScanData(molly, input); err != nil {
+				t.Fatal(err)
+			}
+			names[i] = make(map[string]bool)
+			for _, f := range ExtractReport(molly).Files {
+				for _, m := range f.Matches {
+					names[i][m.Rule.ID] = true
+				}
+			}
+		}
+		if !reflect.DeepEqual(names[0], names[1]) {
+			t.Errorf("Index changed matches on %q: %v vs %v", input, names[0], names[1])
+		}
+	}
+}
+
+func TestScanContext(t *testing.T) {
+	// waitcancel blocks until the scan is stopped
+	operators.Register("waitcancel", func(e *types.Env) (bool, error) {
+		<-e.Context().Done()
+		return false, e.Canceled()
+	})
+
+	ruletext := `
+	rule p0 (pass = 0) { var a = waitcancel(); }
+	rule p1 (pass = 1) { }
+	`
+	testdata := []struct {
+		timeout time.Duration
+		cancel  bool
+		err     error
+		msg     string
+	}{
+		{50 * time.Millisecond, false, nil, "scan timed out after 50ms"},
+		{0, true, context.Canceled, "scan stopped: context canceled"},
+	}
+
+	for i, test := range testdata {
+		molly := New()
+		molly.Config.Timeout = test.timeout
+		if err := LoadRulesFromText(molly, "<test>", ruletext); err != nil {
+			t.Fatalf("Could not load rule from text: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel {
+			cancel()
+		}
+		err := ScanDataContext(ctx, molly, []byte{})
+		cancel()
+		if err != test.err {
+			t.Errorf("%d: expected error %v got %v", i, test.err, err)
+		}
+
+		mr := ExtractReport(molly)
+		if len(mr.Files) != 1 {
+			t.Fatalf("%d: Incorrect number of files", i)
+		}
+		fd := mr.Files[0]
+		if len(fd.Matches) != 0 {
+			t.Errorf("%d: rules evaluated after the scan was stopped", i)
+		}
+		if n := len(fd.Errors); n == 0 || fd.Errors[n-1].Error() != test.msg {
+			t.Errorf("%d: expected error '%s' got %v", i, test.msg, fd.Errors)
+		}
+	}
+}
+
+func TestScanMemFS(t *testing.T) {
+	indir, outdir := t.TempDir(), filepath.Join(t.TempDir(), "out")
+	files := map[string]string{
+		"a.txt":     "first file",
+		"dir/b.txt": "second file",
+	}
+	createTarGz(t, filepath.Join(indir, "test.tar.gz"), files)
+	data, err := os.ReadFile(filepath.Join(indir, "test.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	molly := New()
+	molly.Config.OutDir = outdir
+	molly.Config.FS = util.NewMemFS()
+	names, texts := LoadBuiltinRules()
+	for i, name := range names {
+		if err := LoadRulesFromText(molly, name, texts[i]); err != nil {
+			t.Fatalf("Could not load builtin rules: %v", err)
+		}
+	}
+	if err := ScanData(molly, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing should have been written to disk
+	if _, err := os.Stat(outdir); err == nil {
+		t.Errorf("Output folder was created on disk")
+	}
+
+	// but we should be able to read extracted files
+	found := make(map[string]string)
+	for _, file := range molly.Files {
+		if len(file.Children) != 0 || file.Parent == nil {
+			continue
+		}
+		r, err := molly.Open(file)
+		if err != nil {
+			t.Fatalf("Could not open %s: %v", file.Filename, err)
+		}
+		content, _ := io.ReadAll(r)
+		r.Close()
+
+		name, _ := filepath.Rel(file.Parent.Filename+"_", file.Filename)
+		found[filepath.ToSlash(name)] = string(content)
+	}
+	if !reflect.DeepEqual(found, files) {
+		t.Errorf("Extracted %v, expected %v", found, files)
+	}
+}
@@ -0,0 +1,150 @@
+package types
+
+import (
+	"sync/atomic"
+
+	"github.com/avahidi/molly/util"
+)
+
+// AddHash records the checksum of a file and returns the original of the
+// files seen with it, and true if file is a duplicate of that original.
+// The original is the file that comes first in scan order, not the first
+// one hashed. When file comes before the current original they swap places
+// and the old original is demoted, see ResolveDuplicates
+func (m *Molly) AddHash(hash string, file *FileData) (*FileData, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	file.hash = hash
+	org, found := m.FilesByHash[hash]
+	if !found || org == file {
+		m.FilesByHash[hash] = file
+		return file, false
+	}
+	if org.before(file) {
+		file.DuplicateOf = org
+		m.duplicates[hash] = append(m.duplicates[hash], file)
+		m.pending[file] = true
+		return org, true
+	}
+
+	// file is the new original, everything pointing to the old one moves over
+	m.FilesByHash[hash] = file
+	for _, dup := range m.duplicates[hash] {
+		dup.DuplicateOf = file
+	}
+	org.DuplicateOf = file
+	m.duplicates[hash] = append(m.duplicates[hash], org)
+	m.pending[org] = true
+	m.demoted = append(m.demoted, org)
+	return file, false
+}
+
+// ResolveDuplicates is called when no files are being scanned. It undoes
+// the scan of originals that were demoted by AddHash: files extracted from
+// them are forgotten and removed from the output. If this removes the
+// original of other duplicates, the first of these becomes the new original.
+// These files are returned and should be scanned again
+func (m *Molly) ResolveDuplicates() []*FileData {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.demoted) == 0 {
+		return nil
+	}
+
+	demoted := make(map[*FileData]bool)
+	for _, file := range m.demoted {
+		demoted[file] = true
+	}
+	m.demoted = nil
+
+	// forget everything extracted from a demoted file
+	lost := make(map[string]bool)
+	for name, file := range m.Files {
+		parent := file.Parent
+		for parent != nil && !demoted[parent] {
+			parent = parent.Parent
+		}
+		if parent == nil {
+			continue
+		}
+		delete(m.Files, name)
+		delete(m.pending, file)
+		atomic.AddInt64(&m.extracted, -file.extracted)
+		if file.hash == "" {
+			continue
+		}
+		if m.FilesByHash[file.hash] == file {
+			delete(m.FilesByHash, file.hash)
+			lost[file.hash] = true
+		} else {
+			m.removeDuplicate(file)
+		}
+	}
+
+	// demoted files that are still around look like they were never scanned
+	for file := range demoted {
+		if _, found := m.Files[file.Filename]; !found {
+			continue
+		}
+		for _, log := range file.Logs {
+			m.Config.FS.Remove(log)
+		}
+		util.RemoveAll(m.Config.FS, file.FilenameOut+"_")
+		atomic.AddInt64(&m.extracted, -file.extracted)
+		file.extracted = 0
+		file.Children = nil
+		file.Matches = nil
+		file.Errors = nil
+		file.Warnings = nil
+		file.Logs = nil
+		checksum := file.Analyses["checksum"]
+		file.Analyses = map[string]*Analysis{"checksum": checksum}
+	}
+
+	// the first remaining duplicate replaces a lost original
+	var promoted []*FileData
+	for hash := range lost {
+		var org *FileData
+		for _, dup := range m.duplicates[hash] {
+			if org == nil || dup.before(org) {
+				org = dup
+			}
+		}
+		if org == nil {
+			continue
+		}
+		m.removeDuplicate(org)
+		delete(m.pending, org)
+		m.FilesByHash[hash] = org
+		for _, dup := range m.duplicates[hash] {
+			dup.DuplicateOf = org
+		}
+		org.DuplicateOf = nil
+		org.Processed = false
+		promoted = append(promoted, org)
+	}
+	return promoted
+}
+
+// removeDuplicate removes a file from the duplicates of its checksum
+func (m *Molly) removeDuplicate(file *FileData) {
+	dups := m.duplicates[file.hash]
+	for i, dup := range dups {
+		if dup == file {
+			m.duplicates[file.hash] = append(dups[:i:i], dups[i+1:]...)
+			return
+		}
+	}
+}
+
+// TakeDuplicates returns the files found to be duplicates since the last call
+func (m *Molly) TakeDuplicates() []*FileData {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]*FileData, 0, len(m.pending))
+	for dup := range m.pending {
+		ret = append(ret, dup)
+	}
+	m.pending = make(map[*FileData]bool)
+	return ret
+}
@@ -0,0 +1,57 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/avahidi/molly/util"
+)
+
+func TestResolveDuplicates(t *testing.T) {
+	m := NewMolly()
+	m.Config.FS = util.NewMemFS()
+	var roots []*FileData
+	for _, name := range []string{"r0", "r1", "r2"} {
+		root, _ := m.AddFile(name, nil)
+		root.FilenameOut = "output/" + name
+		roots = append(roots, root)
+	}
+
+	// r1 is hashed and extracted before r0, which has the same contents
+	if _, dup := m.AddHash("h", roots[1]); dup {
+		t.Fatalf("r1 is a duplicate")
+	}
+	w, child, err := m.CreateFile(roots[1], "c", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("child"))
+	w.Close()
+	m.AddHash("x", child)
+	if org, dup := m.AddHash("x", roots[2]); !dup || org != child {
+		t.Fatalf("r2 should be a duplicate of %s", child.Filename)
+	}
+	if org, dup := m.AddHash("h", roots[0]); dup || org != roots[0] {
+		t.Fatalf("r0 should be the original, got %v %v", org.Filename, dup)
+	}
+	if roots[1].DuplicateOf != roots[0] {
+		t.Fatalf("r1 should be a duplicate of r0")
+	}
+
+	// r1 was demoted, so c is gone and r2 must be scanned
+	promoted := m.ResolveDuplicates()
+	if len(promoted) != 1 || promoted[0] != roots[2] {
+		t.Fatalf("Promoted %v, expected r2", promoted)
+	}
+	if _, found := m.Files[child.Filename]; found || len(roots[1].Children) != 0 {
+		t.Errorf("%s was not removed", child.Filename)
+	}
+	if util.Exists(m.Config.FS, child.Filename) {
+		t.Errorf("%s was not removed from the output", child.Filename)
+	}
+	if roots[2].DuplicateOf != nil || roots[2].Processed || m.FilesByHash["x"] != roots[2] {
+		t.Errorf("r2 was not promoted")
+	}
+	if promoted := m.ResolveDuplicates(); len(promoted) != 0 {
+		t.Errorf("Promoted %v again", promoted)
+	}
+}
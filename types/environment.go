@@ -1,31 +1,55 @@
 package types
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/avahidi/molly/util"
 )
 
 // Env is the current environment during scanning
 type Env struct {
-	m *Molly
+	m   *Molly
+	ctx context.Context
 
 	// Input is valid while we are scanning a file
 	Reader  io.ReadSeeker
 	Current *FileData
 
+	// Offset is where Reader starts in the current file, non-zero when carving
+	Offset int64
+
+	// extent is how much of the input an extractor has used, see SetExtent
+	extent int64
+
 	// Scope is valid while we are scanning a file and a rule
 	Scope *Scope
 }
 
 func NewEnv(m *Molly) *Env {
 	return &Env{
-		m: m,
+		m:   m,
+		ctx: context.Background(),
 	}
 }
 
+// SetContext sets the context for scanning the current input
+func (e *Env) SetContext(ctx context.Context) {
+	e.ctx = ctx
+}
+
+// Context returns the context for scanning the current input
+func (e Env) Context() context.Context {
+	return e.ctx
+}
+
+// Canceled returns an error if scanning of the current input should stop.
+// Long running operators should check this regularly
+func (e Env) Canceled() error {
+	return e.ctx.Err()
+}
+
 func (e *Env) StartRule(rule *Rule) {
 	e.Scope = NewScope(rule, nil)
 }
@@ -51,30 +75,97 @@ func (e Env) String() string {
 func (e *Env) SetInput(r io.ReadSeeker, d *FileData) {
 	e.Reader = r
 	e.Current = d
+	e.Offset = 0
+	e.extent = 0
+}
+
+// SetInputAt is similar to SetInput but the input is rebased so that
+// position 0 of the reader becomes offset in the file
+func (e *Env) SetInputAt(r io.ReadSeeker, d *FileData, offset int64) {
+	e.SetInput(r, d)
+	if offset != 0 {
+		e.Reader = util.NewSectionReader(r, offset, d.Filesize-offset)
+		e.Offset = offset
+	}
+}
+
+// SetExtent records that an extractor has used the first n bytes of the
+// input, carving does not look for other matches inside them
+func (e *Env) SetExtent(n int64) {
+	if n > e.extent {
+		e.extent = n
+	}
+}
+
+// TakeExtent returns and clears what SetExtent recorded
+func (e *Env) TakeExtent() int64 {
+	n := e.extent
+	e.extent = 0
+	return n
 }
 
 func (e Env) GetFile() string {
 	return e.Current.Filename
 }
 
+// GetSize returns size of the input, which is less than file size when carving
 func (e Env) GetSize() uint64 {
-	return uint64(e.Current.Filesize)
+	return uint64(e.Current.Filesize - e.Offset)
+}
+
+// Get is similar to FileData.Get but is aware of the current offset
+func (e Env) Get(name string) (interface{}, bool) {
+	switch name {
+	case "offset":
+		return e.Offset, true
+	case "filesize":
+		return e.Current.Filesize - e.Offset, true
+	default:
+		return e.Current.Get(name)
+	}
+}
+
+// carvedName puts files created from a carved region in their own folder
+func (e Env) carvedName(name string) string {
+	if e.Offset == 0 {
+		return name
+	}
+	return fmt.Sprintf("%08x/%s", e.Offset, name)
+}
+
+// AnalysisName returns the name of an analysis of the input. When carving
+// the offset is added, so analyses of different regions do not replace each other
+func (e Env) AnalysisName(name string) string {
+	if e.Offset == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s_%08x", name, e.Offset)
 }
 
 func (e *Env) New(name string, islog bool) (*FileData, error) {
-	return e.m.New(e.Current, name, false, islog)
+	return e.m.New(e.Current, e.carvedName(name), false, islog)
+}
+
+func (e *Env) Create(name string) (*FileWriter, *FileData, error) {
+	return e.m.CreateFile(e.Current, e.carvedName(name), false)
 }
 
-func (e *Env) Create(name string) (*os.File, *FileData, error) {
-	return e.m.CreateFile(e.Current, name, false)
+// Link records a symbolic or hard link, see Molly.CreateLink
+func (e *Env) Link(name, target string, hard bool) (*FileData, error) {
+	return e.m.CreateLink(e.Current, e.carvedName(name), target, hard)
+}
+
+// Node records a special file such as a device, see Molly.CreateNode
+func (e *Env) Node(name, typ string) (*FileData, error) {
+	return e.m.CreateNode(e.Current, e.carvedName(name), typ)
 }
 
 func (e *Env) Mkdir(path string) (*FileData, error) {
-	return e.m.CreateDir(e.Current, path)
+	return e.m.CreateDir(e.Current, e.carvedName(path))
 }
 
 // CreateLog creates a new log
-func (e *Env) CreateLog(name string) (*os.File, error) {
+func (e *Env) CreateLog(name string) (*FileWriter, error) {
 	newfile, _, err := e.m.CreateFile(e.Current, name, true)
 	return newfile, err
 }
@@ -82,3 +173,8 @@ func (e *Env) CreateLog(name string) (*os.File, error) {
 func (e Env) HasPermission(p Permission) bool {
 	return e.m.Config.HasPermission(p)
 }
+
+// RecoverDeleted returns true if extractors should also recover deleted files
+func (e Env) RecoverDeleted() bool {
+	return e.m.Config.Deleted
+}
@@ -37,6 +37,17 @@ type FileData struct {
 	Warnings  []string
 	Logs      []string
 	Analyses  map[string]*Analysis
+
+	// Metadata is what extractors know about a file beyond its contents,
+	// such as link targets. These are also available to rules as $name
+	Metadata map[string]interface{}
+
+	// bytes extracted from this file, see Configuration.MaxRatio
+	extracted int64
+
+	// position in the extraction tree and checksum, used to order duplicates
+	order []int
+	hash  string
 }
 
 func NewFileData(filename string, parent *FileData) *FileData {
@@ -55,6 +66,20 @@ func NewFileData(filename string, parent *FileData) *FileData {
 	return fd
 }
 
+// before returns true if fd comes before other when the files are scanned
+// depth first in the order they were registered
+func (fd *FileData) before(other *FileData) bool {
+	for i := 0; i < len(fd.order) && i < len(other.order); i++ {
+		if fd.order[i] != other.order[i] {
+			return fd.order[i] < other.order[i]
+		}
+	}
+	if len(fd.order) != len(other.order) {
+		return len(fd.order) < len(other.order)
+	}
+	return fd.Filename < other.Filename
+}
+
 func (fd *FileData) SetTime(t time.Time) {
 	fd.time = t
 	if fd.Parent != nil && t.After(fd.Parent.time) {
@@ -89,6 +114,14 @@ func (fd *FileData) RegisterAnalysis(name string, data interface{}, err error) {
 	fd.Analyses[name] = &Analysis{Name: name, Result: data, Error: err}
 }
 
+// SetMetadata records information about a file found by an extractor
+func (fd *FileData) SetMetadata(name string, value interface{}) {
+	if fd.Metadata == nil {
+		fd.Metadata = make(map[string]interface{})
+	}
+	fd.Metadata[name] = value
+}
+
 // Get returns variables associated with this file.
 // These can be referensed in rules as $name or
 // in the actions as {name}
@@ -130,14 +163,15 @@ func (fd FileData) Get(name string) (interface{}, bool) {
 	case "num_logs":
 		return len(fd.Logs), true
 	default:
-		return nil, false
+		val, found := fd.Metadata[name]
+		return val, found
 	}
 }
 
 // FileDataGetHelp dump help about the special variables such as $time
 func FileDataGetHelp() {
 	list := []string{
-		"time",
+		"time", "offset",
 		"filename", "shortname", "dirname", "ext", "basename",
 		"filesize", "depth", "parent",
 		"num_matches", "num_errors", "num_logs",
@@ -146,4 +180,5 @@ func FileDataGetHelp() {
 	for _, v := range list {
 		fmt.Printf("\t%s\n", v)
 	}
+	fmt.Printf("Extracted files may also have metadata such as $type and $link\n")
 }
@@ -0,0 +1,105 @@
+package types
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/avahidi/molly/util"
+)
+
+// SignatureMaxEnd is how far into a file a signature may reach
+const SignatureMaxEnd = 64 * 1024
+
+// Signature is a sequence of bytes a rule requires at some offset
+type Signature struct {
+	Offset int64
+	Data   []byte
+}
+
+// CarveCandidate is a position where a carve-able rule may match
+type CarveCandidate struct {
+	Rule   *Rule
+	Offset int64
+}
+
+type indexEntry struct {
+	rule   *Rule
+	offset int64
+}
+
+// RuleIndex is a prefilter over rule signatures, used to avoid
+// evaluating rules that cannot possibly match
+type RuleIndex struct {
+	headSize  int64
+	head      *util.Matcher
+	headList  []indexEntry
+	carve     *util.Matcher
+	carveList []indexEntry
+}
+
+// NewRuleIndex builds an index for a set of top-level rules
+func NewRuleIndex(rules map[string]*Rule) *RuleIndex {
+	ri := &RuleIndex{}
+	var head, carve [][]byte
+	for _, rule := range rules {
+		carveable, _ := rule.Metadata.GetBoolean("carve", false)
+		for _, sig := range rule.Signatures {
+			head = append(head, sig.Data)
+			ri.headList = append(ri.headList, indexEntry{rule: rule, offset: sig.Offset})
+			if end := sig.Offset + int64(len(sig.Data)); end > ri.headSize {
+				ri.headSize = end
+			}
+			if carveable {
+				carve = append(carve, sig.Data)
+				ri.carveList = append(ri.carveList, indexEntry{rule: rule, offset: sig.Offset})
+			}
+		}
+	}
+	ri.head = util.NewMatcher(head)
+	ri.carve = util.NewMatcher(carve)
+	return ri
+}
+
+// Candidates returns the rules that have one of their signatures
+// at the start of the input. Rules without signatures are not included
+func (ri *RuleIndex) Candidates(r io.ReadSeeker) (map[*Rule]bool, error) {
+	ret := make(map[*Rule]bool)
+	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	err := ri.head.Find(io.LimitReader(r, ri.headSize), func(id int, offset int64) bool {
+		if e := ri.headList[id]; e.offset == offset {
+			ret[e.rule] = true
+		}
+		return true
+	})
+	return ret, err
+}
+
+// CarveCandidates searches the input for signatures of carve-able rules.
+// The candidates are sorted by offset and never include offset 0
+func (ri *RuleIndex) CarveCandidates(r io.ReadSeeker) ([]CarveCandidate, error) {
+	var ret []CarveCandidate
+	seen := make(map[CarveCandidate]bool)
+	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	err := ri.carve.Find(r, func(id int, offset int64) bool {
+		e := ri.carveList[id]
+		c := CarveCandidate{Rule: e.rule, Offset: offset - e.offset}
+		if c.Offset > 0 && !seen[c] {
+			seen[c] = true
+			ret = append(ret, c)
+		}
+		return true
+	})
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Offset != ret[j].Offset {
+			return ret[i].Offset < ret[j].Offset
+		}
+		return ret[i].Rule.ID < ret[j].Rule.ID
+	})
+	return ret, err
+}
@@ -2,8 +2,9 @@ package types
 
 // Match represents a rule match on a file
 type Match struct {
-	Rule *Rule
-	Vars map[string]interface{}
+	Rule   *Rule
+	Vars   map[string]interface{}
+	Offset int64 // where in the file the match was found, see carving
 
 	Children []*Match
 	Parent   *Match `json:"-"` // this will avoid circular marshalling
@@ -26,9 +27,10 @@ func (me *Match) Walk(visitor func(*Match) bool) bool {
 
 // FlatMatch is a flatten version of Match
 type FlatMatch struct {
-	Rule *Rule `json:"-"` // dont need this for the reports
-	Name string
-	Vars map[string]interface{}
+	Rule   *Rule `json:"-"` // dont need this for the reports
+	Name   string
+	Vars   map[string]interface{}
+	Offset int64
 }
 
 // Report contains all matches for all files
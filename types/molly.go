@@ -2,8 +2,11 @@ package types
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/avahidi/molly/util"
 )
@@ -22,6 +25,33 @@ type Configuration struct {
 	MaxDepth    int
 	Verbose     bool
 	Permissions Permission
+
+	// FS is where extracted files are stored, below OutDir
+	FS util.FileSystem
+
+	// Workers is the number of files scanned in parallel
+	Workers int
+
+	// Timeout is the max time spent on scanning one file, 0 means no limit
+	Timeout time.Duration
+
+	// Extraction limits, 0 means no limit. MaxFileSize is the max size of an
+	// extracted file and MaxTotalSize the max bytes extracted during the scan.
+	// MaxChildren is the max number of files extracted from one file and MaxRatio
+	// the max ratio between bytes extracted from a file and its size
+	MaxFileSize  int64
+	MaxTotalSize int64
+	MaxChildren  int
+	MaxRatio     int64
+
+	// Carve enables scanning for carve-able rules inside files,
+	// at offsets that are multiples of CarveAlign
+	Carve      bool
+	CarveAlign int64
+
+	// Deleted enables recovery of deleted files in extractors that support it
+	Deleted bool
+
 	OnMatchRule func(file *FileData, match *Match)
 	OnMatchTag  func(file *FileData, tag string)
 }
@@ -41,7 +71,9 @@ func (c *Configuration) SetPermission(p Permission, val bool) {
 	}
 }
 
-// Molly represents the context of a molly program
+// Molly represents the context of a molly program.
+// Files and FilesByHash are shared between workers while scanning,
+// use the methods below to access them until the scan is done
 type Molly struct {
 	Config *Configuration
 	Rules  *RuleSet
@@ -49,14 +81,26 @@ type Molly struct {
 	Files map[string]*FileData
 	// FilesByHash is mainly need to ignore duplicate files
 	FilesByHash map[string]*FileData
+
+	lock      sync.Mutex
+	extracted int64
+	roots     int
+
+	// see AddHash
+	duplicates map[string][]*FileData
+	pending    map[*FileData]bool
+	demoted    []*FileData
 }
 
 // NewMolly creates a new Molly context
 func NewMolly() *Molly {
 	config := &Configuration{
 		OutDir:      "output",
+		FS:          util.NewDiskFS(),
 		MaxDepth:    12,
 		Permissions: Create,
+		CarveAlign:  512,
+		Workers:     1,
 	}
 
 	return &Molly{
@@ -64,7 +108,45 @@ func NewMolly() *Molly {
 		Rules:       NewRuleSet(),
 		Files:       make(map[string]*FileData),
 		FilesByHash: make(map[string]*FileData),
+		duplicates:  make(map[string][]*FileData),
+		pending:     make(map[*FileData]bool),
+	}
+}
+
+// AddFile returns data for a file, which is created if this is a new file
+func (m *Molly) AddFile(filename string, parent *FileData) (*FileData, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if fd, found := m.Files[filename]; found {
+		return fd, false
+	}
+	fd := NewFileData(filename, parent)
+	if parent == nil {
+		fd.order = []int{m.roots}
+		m.roots++
+	} else {
+		fd.order = childOrder(parent)
+	}
+	m.Files[filename] = fd
+	return fd, true
+}
+
+// childOrder returns the order of the next child of parent
+func childOrder(parent *FileData) []int {
+	order := make([]int, len(parent.order), len(parent.order)+1)
+	copy(order, parent.order)
+	return append(order, len(parent.Children))
+}
+
+// MarkProcessed marks a file as processed, it returns false if it already was
+func (m *Molly) MarkProcessed(file *FileData) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if file.Processed {
+		return false
 	}
+	file.Processed = true
+	return true
 }
 
 func (m *Molly) New(parent *FileData, name string, isdir, islog bool) (*FileData, error) {
@@ -72,7 +154,18 @@ func (m *Molly) New(parent *FileData, name string, isdir, islog bool) (*FileData
 		return nil, fmt.Errorf("Not allowed to create files/dirs")
 	}
 
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if max := m.Config.MaxChildren; max > 0 && !islog && len(parent.Children) >= max {
+		return nil, fmt.Errorf("%w: more than %d files extracted from %s",
+			ErrLimit, max, parent.Filename)
+	}
+
 	name = util.SanitizeFilename(name)
+	if name == "" && !isdir {
+		name = "noname"
+	}
 	var newname string
 	var newdata *FileData
 
@@ -91,21 +184,27 @@ func (m *Molly) New(parent *FileData, name string, isdir, islog bool) (*FileData
 				newname = fmt.Sprintf("%s_/%04d_%s", parent.FilenameOut, i, name)
 			}
 		}
-		if _, found := m.Files[newname]; !found && util.GetPathType(newname) == util.NoFile {
+		if _, found := m.Files[newname]; !found && !util.Exists(m.Config.FS, newname) {
 			break
 		}
 	}
 
+	// the name may come from an untrusted source, make sure it stays in our tree
+	if err := util.SafePath(m.Config.FS, m.Config.OutDir, newname); err != nil {
+		return nil, err
+	}
+
 	// make sure parent folders exist
 	if isdir {
-		util.Mkdir(newname)
+		m.Config.FS.Mkdir(newname)
 	} else {
 		base, _ := path.Split(newname)
-		util.Mkdir(base)
+		m.Config.FS.Mkdir(base)
 	}
 
 	// remember it:
 	newdata = NewFileData(newname, parent)
+	newdata.order = childOrder(parent)
 	if islog {
 		parent.Logs = append(parent.Logs, newname)
 	} else {
@@ -116,18 +215,63 @@ func (m *Molly) New(parent *FileData, name string, isdir, islog bool) (*FileData
 	return newdata, nil
 }
 
-func (m *Molly) CreateFile(parent *FileData, name string, islog bool) (file *os.File, data *FileData, err error) {
-	data, err = m.New(parent, name, false, islog)
+// CreateFile creates a new file, writes to it are limited by the configuration
+func (m *Molly) CreateFile(parent *FileData, name string, islog bool) (*FileWriter, *FileData, error) {
+	data, err := m.New(parent, name, false, islog)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := m.Config.FS.Create(data.Filename)
+	if err != nil {
+		return nil, data, err
+	}
+	return &FileWriter{m: m, w: file, data: data, islog: islog}, data, nil
+}
+
+// CreateLink records a link found by an extractor. The link is not created,
+// instead the new file gets the link type and target as metadata
+func (m *Molly) CreateLink(parent *FileData, name, target string, hard bool) (*FileData, error) {
+	typ := "symlink"
+	if hard {
+		typ = "hardlink"
+	}
+	data, err := m.CreateNode(parent, name, typ)
 	if err == nil {
-		file, err = util.CreateFile(data.Filename)
+		data.SetMetadata("link", target)
 	}
-	return
+	return data, err
+}
+
+// CreateNode records a special file such as a device or a fifo. Like links,
+// the file is not created and its type is stored as metadata
+func (m *Molly) CreateNode(parent *FileData, name, typ string) (*FileData, error) {
+	data, err := m.New(parent, name, false, false)
+	if err != nil {
+		return nil, err
+	}
+	data.SetMetadata("type", typ)
+
+	// there is nothing to scan
+	m.MarkProcessed(data)
+	return data, nil
 }
 
 func (m *Molly) CreateDir(parent *FileData, name string) (data *FileData, err error) {
 	data, err = m.New(parent, name, true, false)
 	if err == nil {
-		err = util.Mkdir(data.Filename)
+		err = m.Config.FS.Mkdir(data.Filename)
 	}
 	return
 }
+
+// Open opens a file for reading. Files created by molly are read from
+// the output file system while files given by the user are read from disk
+func (m *Molly) Open(file *FileData) (io.ReadSeekCloser, error) {
+	if file.DuplicateOf != nil {
+		file = file.DuplicateOf
+	}
+	if file.Parent == nil {
+		return os.Open(file.Filename)
+	}
+	return m.Config.FS.Open(file.Filename)
+}
@@ -25,6 +25,10 @@ type Rule struct {
 	Conditions []Expression
 	Actions    []Action
 	Variables  map[string]Expression
+
+	// Signatures lists the alternative byte sequences one of which
+	// must be present for the rule to match, nil if not known
+	Signatures []Signature `json:"-"`
 }
 
 // NewRule creates a new rule with the given ID
@@ -42,6 +46,7 @@ type RuleSet struct {
 	Files map[string][]*Rule
 	Top   map[string]*Rule
 	Flat  map[string]*Rule
+	Index *RuleIndex `json:"-"`
 }
 
 // NewRuleSet creates a new set of rules, to be populated by a rule scanner
@@ -0,0 +1,113 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ErrLimit is returned when one of the extraction limits in the configuration is reached
+var ErrLimit = errors.New("extraction limit reached")
+
+// ratioMinSize is the number of bytes that can always be extracted from a file,
+// regardless of the compression ratio limit
+const ratioMinSize = 1024 * 1024
+
+// FileWriter writes a file created by molly and enforces the extraction limits.
+// Once a limit is reached all writes fail and the file is marked as truncated
+type FileWriter struct {
+	m       *Molly
+	w       io.WriteCloser
+	data    *FileData
+	islog   bool
+	written int64
+	err     error
+}
+
+// Write implements io.Writer
+func (w *FileWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.islog {
+		return w.w.Write(p)
+	}
+
+	n := int64(len(p))
+	if err := w.m.reserve(w.data, w.written, &n); err != nil {
+		w.err = err
+		w.data.RegisterErrorf("file truncated: %w", err)
+	}
+
+	written, err := w.w.Write(p[:n])
+	w.written += int64(written)
+	if err == nil {
+		err = w.err
+	}
+	return written, err
+}
+
+// Close implements io.Closer
+func (w *FileWriter) Close() error {
+	return w.w.Close()
+}
+
+// Name returns the name of the file
+func (w *FileWriter) Name() string {
+	return w.data.Filename
+}
+
+// reserve checks if n more bytes can be written to a file that already has
+// the given size. If not, n is reduced to what can be written and an error is returned
+func (m *Molly) reserve(data *FileData, size int64, n *int64) error {
+	c := m.Config
+	var err error
+	if c.MaxFileSize > 0 && size+*n > c.MaxFileSize {
+		*n = c.MaxFileSize - size
+		if *n < 0 {
+			*n = 0
+		}
+		err = fmt.Errorf("%w: file larger than %d bytes", ErrLimit, c.MaxFileSize)
+	}
+
+	var parent *FileData
+	if c.MaxRatio > 0 && data.Parent != nil {
+		parent = data.Parent
+		max := c.MaxRatio * parent.Filesize
+		if max < ratioMinSize {
+			max = ratioMinSize
+		}
+		if granted := take(&parent.extracted, *n, max); granted != *n {
+			*n = granted
+			err = fmt.Errorf("%w: more than %d bytes extracted from %s (ratio %d)",
+				ErrLimit, max, parent.Filename, c.MaxRatio)
+			parent.RegisterWarning("%s truncated, more than %d bytes extracted (ratio %d)",
+				data.Filename, max, c.MaxRatio)
+		}
+	}
+
+	if c.MaxTotalSize > 0 {
+		if granted := take(&m.extracted, *n, c.MaxTotalSize); granted != *n {
+			if parent != nil {
+				atomic.AddInt64(&parent.extracted, granted-*n)
+			}
+			*n = granted
+			err = fmt.Errorf("%w: more than %d bytes extracted in total", ErrLimit, c.MaxTotalSize)
+		}
+	}
+	return err
+}
+
+// take adds up to n to a counter without going above max, it returns what was added
+func take(counter *int64, n, max int64) int64 {
+	total := atomic.AddInt64(counter, n)
+	if over := total - max; over > 0 {
+		if over > n {
+			over = n
+		}
+		atomic.AddInt64(counter, -over)
+		return n - over
+	}
+	return n
+}
@@ -0,0 +1,255 @@
+package compress
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// bcjFilter converts branch addresses in buf back to relative form, pos
+// is the offset of buf in the stream. It returns the number of bytes that
+// are done, the rest is given again with more data
+type bcjFilter interface {
+	convert(buf []byte, pos uint32) int
+}
+
+// bcjReader applies a BCJ filter to the data from r
+type bcjReader struct {
+	r      io.Reader
+	filter bcjFilter
+	pos    uint32
+	buf    []byte
+	start  int // start of converted data that has not been read
+	done   int // end of converted data
+	end    int // end of data in buf
+	err    error
+}
+
+func newBcjReader(r io.Reader, filter bcjFilter, start uint32) *bcjReader {
+	return &bcjReader{r: r, filter: filter, pos: start, buf: make([]byte, 1<<16)}
+}
+
+func (br *bcjReader) Read(p []byte) (int, error) {
+	for br.start == br.done {
+		if br.err != nil {
+			return 0, br.err
+		}
+		// keep the unconverted data and fill up the buffer
+		copy(br.buf, br.buf[br.done:br.end])
+		br.end -= br.done
+		br.start, br.done = 0, 0
+		n, err := io.ReadAtLeast(br.r, br.buf[br.end:], 1)
+		br.end += n
+		if err != nil {
+			// the tail is never converted
+			br.err = err
+			br.done = br.end
+			continue
+		}
+		br.done = br.filter.convert(br.buf[:br.end], br.pos)
+		br.pos += uint32(br.done)
+	}
+	n := copy(p, br.buf[br.start:br.done])
+	br.start += n
+	return n, nil
+}
+
+// NewX86Reader reverses the x86 BCJ filter on a stream that starts at
+// address 0, as in the LZMA sections of UEFI images
+func NewX86Reader(r io.Reader) io.Reader {
+	return newBcjReader(r, &bcjX86{}, 0)
+}
+
+// x86 filter
+type bcjX86 struct {
+	prevMask uint32
+}
+
+func bcjX86TestMsByte(b byte) bool {
+	return b == 0x00 || b == 0xFF
+}
+
+func (f *bcjX86) convert(buf []byte, pos uint32) int {
+	maskAllowed := [8]bool{true, true, true, false, true, false, false, false}
+	maskBitNum := [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+
+	if len(buf) <= 4 {
+		return 0
+	}
+	size := len(buf) - 4
+	prevPos := -1
+	prevMask := f.prevMask
+	i := 0
+	for ; i < size; i++ {
+		if buf[i]&0xFE != 0xE8 {
+			continue
+		}
+		prevPos = i - prevPos
+		if prevPos > 3 {
+			prevMask = 0
+		} else {
+			prevMask = (prevMask << (prevPos - 1)) & 7
+			if prevMask != 0 {
+				b := buf[i+4-int(maskBitNum[prevMask])]
+				if !maskAllowed[prevMask] || bcjX86TestMsByte(b) {
+					prevPos = i
+					prevMask = prevMask<<1 | 1
+					continue
+				}
+			}
+		}
+		prevPos = i
+
+		if !bcjX86TestMsByte(buf[i+4]) {
+			prevMask = prevMask<<1 | 1
+			continue
+		}
+		src := binary.LittleEndian.Uint32(buf[i+1:])
+		var dest uint32
+		for {
+			dest = src - (pos + uint32(i) + 5)
+			if prevMask == 0 {
+				break
+			}
+			j := maskBitNum[prevMask] * 8
+			if !bcjX86TestMsByte(byte(dest >> (24 - j))) {
+				break
+			}
+			src = dest ^ (1<<(32-j) - 1)
+		}
+		dest &= 0x01FFFFFF
+		dest |= 0 - (dest & 0x01000000)
+		binary.LittleEndian.PutUint32(buf[i+1:], dest)
+		i += 4
+	}
+
+	prevPos = i - prevPos
+	if prevPos > 3 {
+		f.prevMask = 0
+	} else {
+		f.prevMask = prevMask << (prevPos - 1)
+	}
+	return i
+}
+
+// PowerPC filter
+type bcjPPC struct{}
+
+func (bcjPPC) convert(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		instr := binary.BigEndian.Uint32(buf[i:])
+		if instr&0xFC000003 == 0x48000001 {
+			instr &= 0x03FFFFFC
+			instr -= pos + uint32(i)
+			instr &= 0x03FFFFFC
+			instr |= 0x48000001
+			binary.BigEndian.PutUint32(buf[i:], instr)
+		}
+	}
+	return i
+}
+
+// ARM filter
+type bcjARM struct{}
+
+func (bcjARM) convert(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		if buf[i+3] == 0xEB {
+			addr := uint32(buf[i]) | uint32(buf[i+1])<<8 | uint32(buf[i+2])<<16
+			addr <<= 2
+			addr -= pos + uint32(i) + 8
+			addr >>= 2
+			buf[i], buf[i+1], buf[i+2] = byte(addr), byte(addr>>8), byte(addr>>16)
+		}
+	}
+	return i
+}
+
+// ARM Thumb filter
+type bcjARMThumb struct{}
+
+func (bcjARMThumb) convert(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 2 {
+		if buf[i+1]&0xF8 == 0xF0 && buf[i+3]&0xF8 == 0xF8 {
+			addr := uint32(buf[i+1]&7)<<19 | uint32(buf[i])<<11 |
+				uint32(buf[i+3]&7)<<8 | uint32(buf[i+2])
+			addr <<= 1
+			addr -= pos + uint32(i) + 4
+			addr >>= 1
+			buf[i+1] = byte(0xF0 | (addr>>19)&7)
+			buf[i] = byte(addr >> 11)
+			buf[i+3] = byte(0xF8 | (addr>>8)&7)
+			buf[i+2] = byte(addr)
+			i += 2
+		}
+	}
+	return i
+}
+
+// ARM64 filter
+type bcjARM64 struct{}
+
+func (bcjARM64) convert(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		instr := binary.LittleEndian.Uint32(buf[i:])
+		pc := pos + uint32(i)
+		if instr>>26 == 0x25 {
+			// BL
+			addr := instr - pc>>2
+			instr = 0x94000000 | addr&0x03FFFFFF
+			binary.LittleEndian.PutUint32(buf[i:], instr)
+		} else if instr&0x9F000000 == 0x90000000 {
+			// ADRP, only values in the range +/-512 MiB are converted
+			addr := (instr>>29)&3 | (instr>>3)&0x1FFFFC
+			if (addr+0x020000)&0x1C0000 != 0 {
+				continue
+			}
+			addr -= pc >> 12
+			instr &= 0x9000001F
+			instr |= (addr & 3) << 29
+			instr |= (addr & 0x03FFFC) << 3
+			instr |= (0 - (addr & 0x020000)) & 0xE00000
+			binary.LittleEndian.PutUint32(buf[i:], instr)
+		}
+	}
+	return i
+}
+
+// SPARC filter
+type bcjSPARC struct{}
+
+func (bcjSPARC) convert(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		instr := binary.BigEndian.Uint32(buf[i:])
+		if instr>>22 == 0x100 || instr>>22 == 0x1FF {
+			instr <<= 2
+			instr -= pos + uint32(i)
+			instr >>= 2
+			instr = (0x40000000 - instr&0x400000) | 0x40000000 | instr&0x3FFFFF
+			binary.BigEndian.PutUint32(buf[i:], instr)
+		}
+	}
+	return i
+}
+
+// deltaReader reverses the delta filter
+type deltaReader struct {
+	r       io.Reader
+	dist    int
+	pos     int
+	history [256]byte
+}
+
+func (dr *deltaReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] += dr.history[(dr.pos-dr.dist)&0xFF]
+		dr.history[dr.pos&0xFF] = p[i]
+		dr.pos++
+	}
+	return n, err
+}
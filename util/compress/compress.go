@@ -0,0 +1,126 @@
+package compress
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrCorrupt is returned when the compressed data is invalid
+	ErrCorrupt = errors.New("compressed data is corrupt")
+
+	// ErrUnsupported is returned for valid but unsupported features
+	ErrUnsupported = errors.New("unsupported compression feature")
+
+	// ErrChecksum is returned when the checksum of decompressed data does not match
+	ErrChecksum = errors.New("checksum mismatch")
+)
+
+// byteReader returns r as an io.ByteReader, adding a buffer if needed
+func byteReader(r io.Reader) interface {
+	io.Reader
+	io.ByteReader
+} {
+	if br, ok := r.(interface {
+		io.Reader
+		io.ByteReader
+	}); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// window is the sliding dictionary used by LZ decoders. It also holds
+// decoded data until it has been read, pending bytes are never overwritten
+// as long as the decoder stays below limit()
+type window struct {
+	buf     []byte
+	pos     int   // next write position in buf
+	size    int   // max size of buf
+	pending int   // bytes written but not read yet
+	total   int64 // bytes written since the last reset
+}
+
+const minWindowSize = 1 << 16
+
+func (w *window) init(size int64) {
+	if size < minWindowSize {
+		size = minWindowSize
+	}
+	w.size = int(size)
+	w.buf, w.pos, w.pending, w.total = nil, 0, 0, 0
+}
+
+// reset forgets the history, pending data can still be read
+func (w *window) reset() {
+	w.total = 0
+}
+
+// limit returns how much data can be pending before the decoder must stop
+func (w *window) limit() int {
+	return w.size - 512
+}
+
+// has returns true if the history contains dist bytes
+func (w *window) has(dist int64) bool {
+	return dist > 0 && dist <= w.total && dist <= int64(w.size)
+}
+
+func (w *window) grow() {
+	if len(w.buf) == w.size {
+		w.pos = 0
+		return
+	}
+	n := 2 * len(w.buf)
+	if n < 4096 {
+		n = 4096
+	}
+	if n > w.size {
+		n = w.size
+	}
+	buf := make([]byte, n)
+	copy(buf, w.buf)
+	w.buf = buf
+}
+
+func (w *window) put(b byte) {
+	if w.pos == len(w.buf) {
+		w.grow()
+	}
+	w.buf[w.pos] = b
+	w.pos++
+	w.pending++
+	w.total++
+}
+
+// get returns the byte dist positions back, dist=1 is the last byte written
+func (w *window) get(dist int) byte {
+	i := w.pos - dist
+	if i < 0 {
+		i += len(w.buf)
+	}
+	return w.buf[i]
+}
+
+func (w *window) copyMatch(dist, n int) {
+	for ; n > 0; n-- {
+		w.put(w.get(dist))
+	}
+}
+
+// read moves pending data to p
+func (w *window) read(p []byte) int {
+	n := 0
+	for n < len(p) && w.pending > 0 {
+		start, end := w.pos-w.pending, w.pos
+		if start < 0 {
+			start += len(w.buf)
+			end = len(w.buf)
+		}
+		c := copy(p[n:], w.buf[start:end])
+		n += c
+		w.pending -= c
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os/exec"
+	"testing"
+)
+
+// testData returns the data used to create the test vectors
+func testData() []byte {
+	var data []byte
+	for i := 0; len(data) < 2000; i++ {
+		data = append(data, fmt.Sprintf("molly %d %s\n", i%13, "firmware"[i%8:])...)
+	}
+	return data
+}
+
+type vector struct {
+	name string
+	data string
+}
+
+// testVectors decodes base64 test vectors and checks the output
+func testVectors(t *testing.T, vectors []vector, open func(io.Reader) (io.Reader, error)) {
+	want := testData()
+	for _, v := range vectors {
+		data, err := base64.StdEncoding.DecodeString(v.data)
+		if err != nil {
+			t.Fatalf("%s: bad vector: %v", v.name, err)
+		}
+
+		r, err := open(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: open failed: %v", v.name, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: decompression failed: %v", v.name, err)
+		}
+
+		// damaged data must give an error, not a panic
+		for _, n := range []int{len(data) / 2, len(data) - 8} {
+			for _, broken := range [][]byte{data[:n], flip(data, n)} {
+				if r, err := open(bytes.NewReader(broken)); err == nil {
+					if got, err := io.ReadAll(r); err == nil && bytes.Equal(got, want) {
+						t.Errorf("%s: damaged data at %d was accepted", v.name, n)
+					}
+				}
+			}
+		}
+	}
+}
+
+func flip(data []byte, n int) []byte {
+	ret := append([]byte{}, data...)
+	ret[n] ^= 0x55
+	return ret
+}
+
+// TestTools compares the decompressors with the command line tools, if they exist
+func TestTools(t *testing.T) {
+	// larger input with both text and binary data
+	var input []byte
+	seed := uint32(1)
+	for i := 0; len(input) < 1<<18; i++ {
+		seed = seed*1103515245 + 12345
+		if i%2 == 0 {
+			input = append(input, fmt.Sprintf("%d molly %x\n", i, seed>>16)...)
+		} else {
+			input = append(input, byte(seed>>24), 0xE8, byte(seed>>16), 0, 0, 0xEB)
+		}
+	}
+
+	testdata := []struct {
+		cmd  []string
+		open func(io.Reader) (io.Reader, error)
+	}{
+		{[]string{"xz", "-c"}, NewXzReader},
+		{[]string{"xz", "-c", "-C", "crc32", "--block-size=100000"}, NewXzReader},
+		{[]string{"xz", "-c", "--x86", "--lzma2"}, NewXzReader},
+		{[]string{"xz", "-c", "--arm", "--lzma2"}, NewXzReader},
+		{[]string{"xz", "-c", "--armthumb", "--lzma2"}, NewXzReader},
+		{[]string{"xz", "-c", "--powerpc", "--lzma2"}, NewXzReader},
+		{[]string{"xz", "-c", "--sparc", "--lzma2"}, NewXzReader},
+		{[]string{"xz", "-c", "--delta=dist=6", "--lzma2"}, NewXzReader},
+		{[]string{"xz", "-c", "--format=lzma", "--lzma1=preset=6,lc=0,lp=2,pb=0"}, NewLzmaReader},
+		{[]string{"zstd", "-c", "-q", "-1"}, NewZstdReader},
+		{[]string{"zstd", "-c", "-q", "-19"}, NewZstdReader},
+		{[]string{"zstd", "-c", "-q", "-3", "--long=27"}, NewZstdReader},
+	}
+	for _, test := range testdata {
+		if _, err := exec.LookPath(test.cmd[0]); err != nil {
+			t.Logf("%s not found, skipping test", test.cmd[0])
+			continue
+		}
+		cmd := exec.Command(test.cmd[0], test.cmd[1:]...)
+		cmd.Stdin = bytes.NewReader(input)
+		data, err := cmd.Output()
+		if err != nil {
+			t.Logf("%v failed, skipping test: %v", test.cmd, err)
+			continue
+		}
+
+		r, err := test.open(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%v: open failed: %v", test.cmd, err)
+			continue
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, input) {
+			t.Errorf("%v: decompression failed: %v", test.cmd, err)
+		}
+	}
+}
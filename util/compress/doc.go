@@ -0,0 +1,3 @@
+// Package compress contains decompressors for formats that are not in the
+// standard library but are common in firmware images
+package compress
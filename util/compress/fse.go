@@ -0,0 +1,218 @@
+package compress
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// revBits reads a zstd backward bit stream, which starts at the highest
+// set bit of the last byte. Reading past the start returns zeros
+type revBits struct {
+	data []byte
+	left int
+}
+
+func newRevBits(data []byte) (*revBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, ErrCorrupt
+	}
+	last := data[len(data)-1]
+	return &revBits{data: data, left: len(data)*8 - 9 + bits.Len8(last)}, nil
+}
+
+func (b *revBits) read(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	b.left -= int(n)
+	pos := b.left
+	var shift uint
+	if pos < 0 {
+		if -pos >= int(n) {
+			return 0
+		}
+		shift = uint(-pos)
+		n -= shift
+		pos = 0
+	}
+
+	i := pos >> 3
+	var v uint64
+	if i+8 <= len(b.data) {
+		v = binary.LittleEndian.Uint64(b.data[i:])
+	} else {
+		for j := 0; i+j < len(b.data); j++ {
+			v |= uint64(b.data[i+j]) << (8 * j)
+		}
+	}
+	v >>= uint(pos & 7)
+	return (v & (1<<n - 1)) << shift
+}
+
+// fwdBits reads a little endian bit stream
+type fwdBits struct {
+	data []byte
+	pos  int
+}
+
+func (b *fwdBits) peek(n uint) int {
+	var v int
+	for i := uint(0); i < n; i++ {
+		p := b.pos + int(i)
+		if p < len(b.data)*8 && b.data[p>>3]&(1<<(p&7)) != 0 {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+func (b *fwdBits) read(n uint) int {
+	v := b.peek(n)
+	b.pos += int(n)
+	return v
+}
+
+type fseEntry struct {
+	symbol uint8
+	bits   uint8
+	base   uint16
+}
+
+// fseTable is a FSE decoding table
+type fseTable struct {
+	log     uint
+	entries []fseEntry
+}
+
+func (t *fseTable) init(b *revBits) uint64 {
+	return b.read(t.log)
+}
+
+func (t *fseTable) update(b *revBits, state uint64) uint64 {
+	e := t.entries[state]
+	return uint64(e.base) + b.read(uint(e.bits))
+}
+
+func (t *fseTable) symbol(state uint64) int {
+	return int(t.entries[state].symbol)
+}
+
+// newFseTable builds a decoding table from normalized counts
+func newFseTable(norm []int16, log uint) (*fseTable, error) {
+	size := 1 << log
+	t := &fseTable{log: log, entries: make([]fseEntry, size)}
+
+	// symbols with probability "less than one" go at the end
+	high := size - 1
+	next := make([]int, len(norm))
+	for s, c := range norm {
+		if c == -1 {
+			if high < 0 {
+				return nil, ErrCorrupt
+			}
+			t.entries[high].symbol = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = int(c)
+		}
+	}
+
+	// spread the other symbols
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			t.entries[pos].symbol = uint8(s)
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, ErrCorrupt
+	}
+
+	for i := range t.entries {
+		e := &t.entries[i]
+		state := next[e.symbol]
+		next[e.symbol]++
+		if state == 0 {
+			return nil, ErrCorrupt
+		}
+		e.bits = uint8(int(log) + 1 - bits.Len(uint(state)))
+		e.base = uint16(state<<e.bits - size)
+	}
+	return t, nil
+}
+
+// newRleTable returns a table that always decodes to the same symbol
+func newRleTable(symbol byte) *fseTable {
+	return &fseTable{entries: []fseEntry{{symbol: symbol}}}
+}
+
+// readFseTable reads the normalized counts of a FSE table and builds it,
+// it returns the table and the number of bytes used
+func readFseTable(src []byte, maxLog uint, maxSymbol int) (*fseTable, int, error) {
+	b := fwdBits{data: src}
+	log := uint(b.read(4)) + 5
+	if log > maxLog {
+		return nil, 0, ErrCorrupt
+	}
+
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbits := log + 1
+	var norm []int16
+	prev0 := false
+	for remaining > 1 && len(norm) <= maxSymbol {
+		if prev0 {
+			// a zero count is followed by a number of repeated zeros
+			for {
+				n := b.read(2)
+				for i := 0; i < n; i++ {
+					norm = append(norm, 0)
+				}
+				if n != 3 {
+					break
+				}
+			}
+			if len(norm) > maxSymbol {
+				return nil, 0, ErrCorrupt
+			}
+		}
+
+		max := 2*threshold - 1 - remaining
+		v := b.peek(nbits)
+		count := v & (threshold - 1)
+		if count < max {
+			b.pos += int(nbits) - 1
+		} else {
+			count = v & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			b.pos += int(nbits)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return nil, 0, ErrCorrupt
+		}
+		norm = append(norm, int16(count))
+		prev0 = count == 0
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	used := (b.pos + 7) / 8
+	if remaining != 1 || used > len(src) {
+		return nil, 0, ErrCorrupt
+	}
+	t, err := newFseTable(norm, log)
+	return t, used, err
+}
@@ -0,0 +1,113 @@
+package compress
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	lzipHeaderSize  = 6
+	lzipTrailerSize = 20
+	lzipProps       = 0x5D // lc=3, lp=0, pb=2
+)
+
+// lzipReader reads a lzip file, which may contain several members
+type lzipReader struct {
+	r      *countingReader
+	lr     lzmaReader
+	start  int64 // where the current member started
+	crc    uint32
+	size   uint64
+	member bool // true while reading a member
+	err    error
+}
+
+// NewLzipReader returns a reader that decompresses a lzip file. Like xz,
+// data after the last member is ignored
+func NewLzipReader(r io.Reader) (io.Reader, error) {
+	zr := &lzipReader{r: &countingReader{r: byteReader(r)}}
+	if err := zr.header(true); err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+// header reads a member header, it returns io.EOF if there are no more members
+func (zr *lzipReader) header(first bool) error {
+	zr.start = zr.r.n
+	var head [lzipHeaderSize]byte
+	if n, err := io.ReadFull(zr.r, head[:]); err != nil {
+		if !first && (n == 0 || err == io.ErrUnexpectedEOF) {
+			return io.EOF
+		}
+		return err
+	}
+	if string(head[:4]) != "LZIP" {
+		if !first {
+			return io.EOF
+		}
+		return ErrCorrupt
+	}
+	if head[4] != 1 {
+		return ErrUnsupported
+	}
+
+	// the dictionary size is a power of 2 minus up to 7/16 of it
+	base := uint32(1) << (head[5] & 0x1F)
+	dictSize := base - (base/16)*uint32(head[5]>>5)
+	if base < 1<<12 || base > 1<<29 || dictSize < 1<<12 {
+		return ErrCorrupt
+	}
+
+	zr.lr = lzmaReader{remaining: -1}
+	d := &zr.lr.d
+	d.setProps(lzipProps)
+	d.win.init(int64(dictSize))
+	d.reset()
+	if err := d.rd.init(zr.r); err != nil {
+		return noEOF(err)
+	}
+	zr.crc, zr.size, zr.member = 0, 0, true
+	return nil
+}
+
+// trailer checks the trailer of a member
+func (zr *lzipReader) trailer() error {
+	if !zr.lr.d.rd.finished() {
+		return ErrCorrupt
+	}
+	var trail [lzipTrailerSize]byte
+	if _, err := io.ReadFull(zr.r, trail[:]); err != nil {
+		return noEOF(err)
+	}
+	if binary.LittleEndian.Uint32(trail[0:]) != zr.crc {
+		return ErrChecksum
+	}
+	if binary.LittleEndian.Uint64(trail[4:]) != zr.size ||
+		int64(binary.LittleEndian.Uint64(trail[12:])) != zr.r.n-zr.start {
+		return ErrCorrupt
+	}
+	zr.member = false
+	return nil
+}
+
+func (zr *lzipReader) Read(p []byte) (int, error) {
+	for zr.err == nil {
+		if !zr.member {
+			zr.err = zr.header(false)
+			continue
+		}
+		n, err := zr.lr.Read(p)
+		if n > 0 {
+			zr.crc = crc32.Update(zr.crc, crc32.IEEETable, p[:n])
+			zr.size += uint64(n)
+			return n, nil
+		}
+		if err == io.EOF {
+			err = zr.trailer()
+		}
+		zr.err = err
+	}
+	return 0, zr.err
+}
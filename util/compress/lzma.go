@@ -0,0 +1,310 @@
+package compress
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	lzmaStates         = 12
+	lzmaPosBitsMax     = 4
+	lzmaLenLowBits     = 3
+	lzmaLenMidBits     = 3
+	lzmaLenHighBits    = 8
+	lzmaPosSlotBits    = 6
+	lzmaLenToPosStates = 4
+	lzmaEndPosModel    = 14
+	lzmaFullDistances  = 1 << (lzmaEndPosModel >> 1)
+	lzmaAlignBits      = 4
+	lzmaMatchMinLen    = 2
+	lzmaHeaderSize     = 13
+)
+
+type lzmaLenDecoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [1 << lzmaPosBitsMax][1 << lzmaLenLowBits]uint16
+	mid     [1 << lzmaPosBitsMax][1 << lzmaLenMidBits]uint16
+	high    [1 << lzmaLenHighBits]uint16
+}
+
+func (ld *lzmaLenDecoder) reset() {
+	ld.choice, ld.choice2 = rcProbInit, rcProbInit
+	for i := range ld.low {
+		initProbs(ld.low[i][:])
+		initProbs(ld.mid[i][:])
+	}
+	initProbs(ld.high[:])
+}
+
+func (ld *lzmaLenDecoder) decode(rd *rangeDecoder, posState uint32) uint32 {
+	if rd.bit(&ld.choice) == 0 {
+		return rd.bitTree(ld.low[posState][:], lzmaLenLowBits)
+	}
+	if rd.bit(&ld.choice2) == 0 {
+		return 1<<lzmaLenLowBits + rd.bitTree(ld.mid[posState][:], lzmaLenMidBits)
+	}
+	return 1<<lzmaLenLowBits + 1<<lzmaLenMidBits + rd.bitTree(ld.high[:], lzmaLenHighBits)
+}
+
+// lzmaDecoder decodes LZMA symbols into a window, it is shared by LZMA and LZMA2
+type lzmaDecoder struct {
+	rd  rangeDecoder
+	win window
+
+	lc, lp, pb uint32
+	literal    []uint16
+	isMatch    [lzmaStates << lzmaPosBitsMax]uint16
+	isRep      [lzmaStates]uint16
+	isRepG0    [lzmaStates]uint16
+	isRepG1    [lzmaStates]uint16
+	isRepG2    [lzmaStates]uint16
+	isRep0Long [lzmaStates << lzmaPosBitsMax]uint16
+	posSlot    [lzmaLenToPosStates][1 << lzmaPosSlotBits]uint16
+	posDecoder [1 + lzmaFullDistances - lzmaEndPosModel]uint16
+	align      [1 << lzmaAlignBits]uint16
+	lenDec     lzmaLenDecoder
+	repLenDec  lzmaLenDecoder
+
+	state uint32
+	rep   [4]uint32
+}
+
+// setProps decodes the lc/lp/pb properties byte
+func (d *lzmaDecoder) setProps(props byte) error {
+	if props >= 9*5*5 {
+		return ErrCorrupt
+	}
+	d.lc = uint32(props % 9)
+	props /= 9
+	d.lp = uint32(props % 5)
+	d.pb = uint32(props / 5)
+	d.literal = make([]uint16, 0x300<<(d.lc+d.lp))
+	return nil
+}
+
+// reset resets the probabilities and the state, but not the window
+func (d *lzmaDecoder) reset() {
+	initProbs(d.literal)
+	initProbs(d.isMatch[:])
+	initProbs(d.isRep[:])
+	initProbs(d.isRepG0[:])
+	initProbs(d.isRepG1[:])
+	initProbs(d.isRepG2[:])
+	initProbs(d.isRep0Long[:])
+	for i := range d.posSlot {
+		initProbs(d.posSlot[i][:])
+	}
+	initProbs(d.posDecoder[:])
+	initProbs(d.align[:])
+	d.lenDec.reset()
+	d.repLenDec.reset()
+	d.state = 0
+	d.rep = [4]uint32{}
+}
+
+func (d *lzmaDecoder) decodeLiteral() {
+	var prev uint32
+	if d.win.total > 0 {
+		prev = uint32(d.win.get(1))
+	}
+	pos := uint32(d.win.total)
+	litState := ((pos & (1<<d.lp - 1)) << d.lc) + (prev >> (8 - d.lc))
+	probs := d.literal[0x300*litState:]
+
+	symbol := uint32(1)
+	if d.state >= 7 {
+		match := uint32(d.win.get(int(d.rep[0]) + 1))
+		for symbol < 0x100 {
+			matchBit := (match >> 7) & 1
+			match <<= 1
+			bit := d.rd.bit(&probs[((1+matchBit)<<8)+symbol])
+			symbol = symbol<<1 | bit
+			if matchBit != bit {
+				break
+			}
+		}
+	}
+	for symbol < 0x100 {
+		symbol = symbol<<1 | d.rd.bit(&probs[symbol])
+	}
+	d.win.put(byte(symbol))
+
+	switch {
+	case d.state < 4:
+		d.state = 0
+	case d.state < 10:
+		d.state -= 3
+	default:
+		d.state -= 6
+	}
+}
+
+func (d *lzmaDecoder) decodeDistance(length uint32) uint32 {
+	lenState := length
+	if lenState > lzmaLenToPosStates-1 {
+		lenState = lzmaLenToPosStates - 1
+	}
+	posSlot := d.rd.bitTree(d.posSlot[lenState][:], lzmaPosSlotBits)
+	if posSlot < 4 {
+		return posSlot
+	}
+	bits := (posSlot >> 1) - 1
+	dist := (2 | (posSlot & 1)) << bits
+	if posSlot < lzmaEndPosModel {
+		return dist + d.rd.bitTreeReverse(d.posDecoder[dist-posSlot:], bits)
+	}
+	dist += d.rd.directBits(bits-lzmaAlignBits) << lzmaAlignBits
+	return dist + d.rd.bitTreeReverse(d.align[:], lzmaAlignBits)
+}
+
+// decode decodes one literal or match of at most max bytes,
+// io.EOF is returned when the end marker is found
+func (d *lzmaDecoder) decode(max int) error {
+	posState := uint32(d.win.total) & (1<<d.pb - 1)
+	state := d.state
+
+	if d.rd.bit(&d.isMatch[state<<lzmaPosBitsMax+posState]) == 0 {
+		d.decodeLiteral()
+		return d.rd.err
+	}
+
+	var length uint32
+	if d.rd.bit(&d.isRep[state]) != 0 {
+		if d.win.total == 0 {
+			return ErrCorrupt
+		}
+		if d.rd.bit(&d.isRepG0[state]) == 0 {
+			if d.rd.bit(&d.isRep0Long[state<<lzmaPosBitsMax+posState]) == 0 {
+				// short rep, a single byte
+				if state < 7 {
+					d.state = 9
+				} else {
+					d.state = 11
+				}
+				d.win.put(d.win.get(int(d.rep[0]) + 1))
+				return d.rd.err
+			}
+		} else {
+			var dist uint32
+			if d.rd.bit(&d.isRepG1[state]) == 0 {
+				dist = d.rep[1]
+			} else {
+				if d.rd.bit(&d.isRepG2[state]) == 0 {
+					dist = d.rep[2]
+				} else {
+					dist = d.rep[3]
+					d.rep[3] = d.rep[2]
+				}
+				d.rep[2] = d.rep[1]
+			}
+			d.rep[1] = d.rep[0]
+			d.rep[0] = dist
+		}
+		length = d.repLenDec.decode(&d.rd, posState)
+		if state < 7 {
+			d.state = 8
+		} else {
+			d.state = 11
+		}
+	} else {
+		d.rep[3], d.rep[2], d.rep[1] = d.rep[2], d.rep[1], d.rep[0]
+		length = d.lenDec.decode(&d.rd, posState)
+		if state < 7 {
+			d.state = 7
+		} else {
+			d.state = 10
+		}
+		d.rep[0] = d.decodeDistance(length)
+		if d.rep[0] == 0xFFFFFFFF {
+			if d.rd.err != nil {
+				return d.rd.err
+			}
+			if !d.rd.finished() {
+				return ErrCorrupt
+			}
+			return io.EOF
+		}
+	}
+	if d.rd.err != nil {
+		return d.rd.err
+	}
+
+	dist := int64(d.rep[0]) + 1
+	if !d.win.has(dist) {
+		return ErrCorrupt
+	}
+	n := int(length) + lzmaMatchMinLen
+	if n > max {
+		d.win.copyMatch(int(dist), max)
+		return ErrCorrupt
+	}
+	d.win.copyMatch(int(dist), n)
+	return nil
+}
+
+// lzmaReader reads the lzma "alone" format
+type lzmaReader struct {
+	d         lzmaDecoder
+	remaining int64 // -1 if unknown
+	err       error
+}
+
+// NewLzmaReader returns a reader that decompresses the legacy lzma format,
+// as created by lzma utils or "xz --format=lzma"
+func NewLzmaReader(r io.Reader) (io.Reader, error) {
+	br := byteReader(r)
+	var head [lzmaHeaderSize]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, err
+	}
+
+	lr := &lzmaReader{remaining: int64(binary.LittleEndian.Uint64(head[5:]))}
+	if err := lr.d.setProps(head[0]); err != nil {
+		return nil, err
+	}
+	if lr.remaining < -1 {
+		return nil, ErrCorrupt
+	}
+	lr.d.win.init(int64(binary.LittleEndian.Uint32(head[1:5])))
+	lr.d.reset()
+	if err := lr.d.rd.init(br); err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+func (lr *lzmaReader) fill() error {
+	d := &lr.d
+	for d.win.pending < d.win.limit() {
+		if lr.remaining == 0 {
+			return io.EOF
+		}
+		max := 1 << 30
+		if lr.remaining > 0 && lr.remaining < int64(max) {
+			max = int(lr.remaining)
+		}
+		before := d.win.total
+		err := d.decode(max)
+		if lr.remaining > 0 {
+			lr.remaining -= d.win.total - before
+		}
+		if err == io.EOF && lr.remaining > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lr *lzmaReader) Read(p []byte) (int, error) {
+	for lr.d.win.pending == 0 && lr.err == nil {
+		lr.err = lr.fill()
+	}
+	if n := lr.d.win.read(p); n > 0 {
+		return n, nil
+	}
+	return 0, lr.err
+}
@@ -0,0 +1,185 @@
+package compress
+
+import (
+	"io"
+)
+
+// limitedByteReader is an io.ByteReader that stops after n bytes
+type limitedByteReader struct {
+	r io.ByteReader
+	n int
+}
+
+func (l *limitedByteReader) ReadByte() (byte, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	l.n--
+	return l.r.ReadByte()
+}
+
+// lzma2Reader decodes a LZMA2 stream, which is a sequence of LZMA
+// and uncompressed chunks
+type lzma2Reader struct {
+	r   io.ByteReader
+	d   lzmaDecoder
+	err error
+
+	// remaining bytes in the current chunk
+	compressed   limitedByteReader
+	unpacked     int
+	uncompressed int
+
+	needDictReset bool
+	needProps     bool
+}
+
+// lzma2DictSize decodes the dictionary size property
+func lzma2DictSize(props byte) (int64, error) {
+	if props > 40 {
+		return 0, ErrCorrupt
+	}
+	if props == 40 {
+		return 0xFFFFFFFF, nil
+	}
+	return int64(2|(props&1)) << (props/2 + 11), nil
+}
+
+// NewLzma2Reader returns a reader for a raw LZMA2 stream with the given dictionary size
+func NewLzma2Reader(r io.Reader, dictSize int64) io.Reader {
+	return newLzma2Reader(byteReader(r), dictSize)
+}
+
+func newLzma2Reader(r io.ByteReader, dictSize int64) *lzma2Reader {
+	lr := &lzma2Reader{r: r, needDictReset: true, needProps: true}
+	lr.d.win.init(dictSize)
+	return lr
+}
+
+// chunk reads the next chunk header
+func (lr *lzma2Reader) chunk() error {
+	control, err := lr.r.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	if control == 0x00 {
+		return io.EOF
+	}
+
+	var head [5]byte
+	size := 2
+	if control >= 0x80 {
+		size = 4
+	}
+	for i := 0; i < size; i++ {
+		if head[i], err = lr.r.ReadByte(); err != nil {
+			return noEOF(err)
+		}
+	}
+
+	// uncompressed chunk, with or without dictionary reset
+	if control < 0x80 {
+		if control > 2 {
+			return ErrCorrupt
+		}
+		if control == 1 {
+			lr.d.win.reset()
+			lr.needDictReset = false
+		} else if lr.needDictReset {
+			return ErrCorrupt
+		}
+		lr.uncompressed = (int(head[0])<<8 | int(head[1])) + 1
+		return nil
+	}
+
+	// lzma chunk, bits 5-6 tell what needs to be reset
+	reset := (control >> 5) & 3
+	if reset == 3 {
+		lr.d.win.reset()
+		lr.needDictReset = false
+	} else if lr.needDictReset {
+		return ErrCorrupt
+	}
+	if reset >= 2 {
+		props, err := lr.r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		if err := lr.d.setProps(props); err != nil {
+			return err
+		}
+		if lr.d.lc+lr.d.lp > 4 {
+			return ErrCorrupt
+		}
+		lr.needProps = false
+	} else if lr.needProps {
+		return ErrCorrupt
+	}
+	if reset >= 1 {
+		lr.d.reset()
+	}
+
+	lr.unpacked = (int(control&0x1F)<<16 | int(head[0])<<8 | int(head[1])) + 1
+	lr.compressed = limitedByteReader{r: lr.r, n: (int(head[2])<<8 | int(head[3])) + 1}
+	return lr.d.rd.init(&lr.compressed)
+}
+
+func (lr *lzma2Reader) fill() error {
+	d := &lr.d
+	for d.win.pending < d.win.limit() {
+		switch {
+		case lr.unpacked > 0:
+			before := d.win.total
+			err := d.decode(lr.unpacked)
+			lr.unpacked -= int(d.win.total - before)
+			if err == io.EOF {
+				// end markers are not allowed in LZMA2
+				err = ErrCorrupt
+			}
+			if err != nil {
+				return err
+			}
+			if lr.unpacked == 0 && (lr.compressed.n != 0 || !d.rd.finished()) {
+				return ErrCorrupt
+			}
+
+		case lr.uncompressed > 0:
+			n := d.win.limit() - d.win.pending
+			if n > lr.uncompressed {
+				n = lr.uncompressed
+			}
+			for i := 0; i < n; i++ {
+				b, err := lr.r.ReadByte()
+				if err != nil {
+					return noEOF(err)
+				}
+				d.win.put(b)
+			}
+			lr.uncompressed -= n
+
+		default:
+			if err := lr.chunk(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (lr *lzma2Reader) Read(p []byte) (int, error) {
+	for lr.d.win.pending == 0 && lr.err == nil {
+		lr.err = lr.fill()
+	}
+	if n := lr.d.win.read(p); n > 0 {
+		return n, nil
+	}
+	return 0, lr.err
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package compress
+
+// lzoState keeps track of the input and output of the LZO1X decompressor
+type lzoState struct {
+	src []byte
+	ip  int
+	dst []byte
+	max int
+	err error
+}
+
+func (s *lzoState) byte() int {
+	if s.ip >= len(s.src) {
+		s.err = ErrCorrupt
+		return 0
+	}
+	s.ip++
+	return int(s.src[s.ip-1])
+}
+
+// length reads an extended length, which is a run of zeros and a final byte
+func (s *lzoState) length(t, base int) int {
+	if t != 0 {
+		return t
+	}
+	for s.err == nil {
+		b := s.byte()
+		if b != 0 {
+			return t + base + b
+		}
+		t += 255
+		if t > s.max {
+			s.err = ErrCorrupt
+		}
+	}
+	return 0
+}
+
+func (s *lzoState) literals(n int) {
+	if s.ip+n > len(s.src) || len(s.dst)+n > s.max {
+		s.err = ErrCorrupt
+		return
+	}
+	s.dst = append(s.dst, s.src[s.ip:s.ip+n]...)
+	s.ip += n
+}
+
+// match copies n bytes from dist bytes back
+func (s *lzoState) match(dist, n int) {
+	pos := len(s.dst) - dist
+	if dist <= 0 || pos < 0 || len(s.dst)+n > s.max {
+		s.err = ErrCorrupt
+		return
+	}
+	for i := 0; i < n; i++ {
+		s.dst = append(s.dst, s.dst[pos+i])
+	}
+}
+
+// Lzo1xDecompress decompresses a LZO1X block, which has no header and is
+// at most max bytes when decompressed
+func Lzo1xDecompress(src []byte, max int) ([]byte, error) {
+	s := &lzoState{src: src, max: max}
+
+	// state is the number of literals that were copied after the last
+	// instruction, it decides how the next instruction is interpreted
+	state := 0
+	if len(src) > 0 && src[0] > 17 {
+		s.ip++
+		n := int(src[0]) - 17
+		s.literals(n)
+		state = 4
+		if n < 4 {
+			state = n
+		}
+	}
+
+	for s.err == nil {
+		t := s.byte()
+		var dist, n int
+		switch {
+		case t < 16 && state == 0:
+			// a literal run
+			s.literals(s.length(t, 15) + 3)
+			state = 4
+			continue
+		case t < 16 && state == 4:
+			// a 3 byte match, after a literal run
+			dist = 1 + 0x0800 + t>>2 + s.byte()<<2
+			n = 3
+		case t < 16:
+			// a 2 byte match
+			dist = 1 + t>>2 + s.byte()<<2
+			n = 2
+		case t >= 64:
+			dist = 1 + (t>>2)&7 + s.byte()<<3
+			n = t>>5 + 1
+		case t >= 32:
+			n = s.length(t&31, 31) + 2
+			b := s.byte()
+			dist = 1 + b>>2 + s.byte()<<6
+			t = b
+		default:
+			n = s.length(t&7, 7) + 2
+			b := s.byte()
+			dist = (t&8)<<11 + b>>2 + s.byte()<<6
+			if dist == 0 {
+				// end of stream
+				if s.err == nil && s.ip != len(src) {
+					s.err = ErrCorrupt
+				}
+				return s.dst, s.err
+			}
+			dist += 0x4000
+			t = b
+		}
+		if s.err != nil {
+			break
+		}
+		s.match(dist, n)
+
+		// the low bits tell how many literals follow
+		state = t & 3
+		s.literals(state)
+	}
+	return s.dst, s.err
+}
@@ -0,0 +1,47 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLzo1x(t *testing.T) {
+	eof := []byte{0x11, 0x00, 0x00}
+	long := bytes.Repeat([]byte("0123456789abcdef"), 1100)[:16400]
+
+	var testdata = []struct {
+		input, output []byte
+	}{
+		// literals then a M3 match
+		{[]byte{0x15, 'a', 'b', 'c', 'd', 0x26, 0x0C, 0x00, 0x11, 0x00, 0x00}, []byte("abcdabcdabcd")},
+		// M2 match with a trailing literal, then a 2 byte M1 match
+		{[]byte{0x15, 'a', 'b', 'c', 'd', 0x4D, 0x00, 'x', 0x08, 0x01, 0x11, 0x00, 0x00}, []byte("abcdabcxbc")},
+		// long literal run, then a long M3 match
+		{join([]byte{0x00, 0x00, 0x02}, long[:275], []byte{0x20, 0x00, 0x05, 0x04, 0x00}, eof),
+			join(long[:275], bytes.Repeat(long[273:275], 147)[:293])},
+		// 3 byte M1 match after a literal run, then a M4 match with a distance above 16k
+		{join([]byte{0x00}, bytes.Repeat([]byte{0}, 64), []byte{62}, long, []byte{0x00, 0x00, 0x13, 0x40, 0x00}, eof),
+			join(long, long[16400-2049:][:3], long[3:8])},
+	}
+	for i, test := range testdata {
+		got, err := Lzo1xDecompress(test.input, len(test.output))
+		if err != nil || !bytes.Equal(got, test.output) {
+			t.Errorf("Lzo1xDecompress failed for test %d: %v", i, err)
+		}
+	}
+
+	// bad distance, missing end of stream, output too large
+	for _, input := range [][]byte{
+		{0x15, 'a', 'b', 'c', 'd', 0x26, 0xFC, 0x00, 0x11, 0x00, 0x00},
+		{0x15, 'a', 'b', 'c', 'd', 0x26, 0x0C, 0x00},
+		{0x15, 'a', 'b', 'c', 'd', 0x3F, 0x0C, 0x00, 0x11, 0x00, 0x00},
+	} {
+		if _, err := Lzo1xDecompress(input, 32); err == nil {
+			t.Errorf("Lzo1xDecompress accepted bad input %v", input)
+		}
+	}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
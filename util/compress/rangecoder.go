@@ -0,0 +1,113 @@
+package compress
+
+import (
+	"io"
+)
+
+const (
+	rcProbBits = 11
+	rcProbInit = 1 << (rcProbBits - 1)
+	rcMoveBits = 5
+	rcTopValue = 1 << 24
+)
+
+// rangeDecoder is the LZMA range decoder. Input errors are sticky
+// and reported in err, reads past the end of input return zeros
+type rangeDecoder struct {
+	r    io.ByteReader
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rd *rangeDecoder) init(r io.ByteReader) error {
+	rd.r, rd.rng, rd.code, rd.err = r, 0xFFFFFFFF, 0, nil
+	first := rd.readByte()
+	for i := 0; i < 4; i++ {
+		rd.code = rd.code<<8 | uint32(rd.readByte())
+	}
+	if rd.err != nil {
+		return rd.err
+	}
+	if first != 0 || rd.code == rd.rng {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func (rd *rangeDecoder) readByte() byte {
+	b, err := rd.r.ReadByte()
+	if err != nil && rd.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		rd.err = err
+	}
+	return b
+}
+
+func (rd *rangeDecoder) normalize() {
+	if rd.rng < rcTopValue {
+		rd.rng <<= 8
+		rd.code = rd.code<<8 | uint32(rd.readByte())
+	}
+}
+
+// finished returns true if the decoder ended at a valid point
+func (rd *rangeDecoder) finished() bool {
+	return rd.code == 0
+}
+
+func (rd *rangeDecoder) directBits(n uint32) uint32 {
+	var res uint32
+	for ; n > 0; n-- {
+		rd.rng >>= 1
+		rd.code -= rd.rng
+		t := 0 - (rd.code >> 31)
+		rd.code += rd.rng & t
+		rd.normalize()
+		res = res<<1 + t + 1
+	}
+	return res
+}
+
+func (rd *rangeDecoder) bit(p *uint16) uint32 {
+	bound := (rd.rng >> rcProbBits) * uint32(*p)
+	var bit uint32
+	if rd.code < bound {
+		*p += (1<<rcProbBits - *p) >> rcMoveBits
+		rd.rng = bound
+	} else {
+		*p -= *p >> rcMoveBits
+		rd.code -= bound
+		rd.rng -= bound
+		bit = 1
+	}
+	rd.normalize()
+	return bit
+}
+
+func (rd *rangeDecoder) bitTree(probs []uint16, bits uint32) uint32 {
+	m := uint32(1)
+	for i := uint32(0); i < bits; i++ {
+		m = m<<1 + rd.bit(&probs[m])
+	}
+	return m - (1 << bits)
+}
+
+func (rd *rangeDecoder) bitTreeReverse(probs []uint16, bits uint32) uint32 {
+	m := uint32(1)
+	var sym uint32
+	for i := uint32(0); i < bits; i++ {
+		bit := rd.bit(&probs[m])
+		m = m<<1 + bit
+		sym |= bit << i
+	}
+	return sym
+}
+
+func initProbs(probs []uint16) {
+	for i := range probs {
+		probs[i] = rcProbInit
+	}
+}
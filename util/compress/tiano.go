@@ -0,0 +1,307 @@
+package compress
+
+import "encoding/binary"
+
+const (
+	tianoBitBufSize = 32
+	tianoMaxMatch   = 256
+	tianoThreshold  = 3
+	tianoCodeBit    = 16
+	tianoNC         = 0xFF + tianoMaxMatch + 2 - tianoThreshold
+	tianoCBit       = 9
+	tianoMaxPBit    = 5
+	tianoTBit       = 5
+	tianoMaxNP      = 1<<tianoMaxPBit - 1
+	tianoNT         = tianoCodeBit + 3
+	tianoNPT        = tianoMaxNP
+)
+
+// tianoState is the state of the EFI and Tiano decompressor, which use
+// LZ77 with Huffman coded blocks
+type tianoState struct {
+	src    []byte
+	ip     int
+	dst    []byte
+	pbit   uint
+	bitBuf uint32
+	subBuf uint32
+	bitCnt uint
+	block  uint16
+	err    error
+
+	left, right [2*tianoNC - 1]uint16
+	cLen        [tianoNC]uint8
+	ptLen       [tianoNPT]uint8
+	cTable      [4096]uint16
+	ptTable     [256]uint16
+}
+
+// fill shifts n bits out of the bit buffer and reads new ones, the input is
+// padded with zeros at the end
+func (s *tianoState) fill(n uint) {
+	s.bitBuf = uint32(uint64(s.bitBuf) << n)
+	for n > s.bitCnt {
+		n -= s.bitCnt
+		s.bitBuf |= uint32(uint64(s.subBuf) << n)
+		s.subBuf = 0
+		if s.ip < len(s.src) {
+			s.subBuf = uint32(s.src[s.ip])
+			s.ip++
+		}
+		s.bitCnt = 8
+	}
+	s.bitCnt -= n
+	s.bitBuf |= s.subBuf >> s.bitCnt
+}
+
+func (s *tianoState) bits(n uint) uint32 {
+	v := uint32(uint64(s.bitBuf) >> (tianoBitBufSize - n))
+	s.fill(n)
+	return v
+}
+
+// walk follows the tree for codes longer than the table, starting at bit
+func (s *tianoState) walk(v uint16, max uint16, bit uint) uint16 {
+	mask := uint32(1) << (tianoBitBufSize - 1 - bit)
+	for v >= max {
+		if s.bitBuf&mask != 0 {
+			v = s.right[v]
+		} else {
+			v = s.left[v]
+		}
+		mask >>= 1
+		if mask == 0 && v >= max {
+			s.err = ErrCorrupt
+			return 0
+		}
+	}
+	return v
+}
+
+// makeTable creates a lookup table for a canonical Huffman code, codes
+// longer than tableBits continue in a tree
+func (s *tianoState) makeTable(nchar int, bitLen []uint8, tableBits uint, table []uint16) bool {
+	var count [17]uint16
+	var weight [17]uint16
+	var start [18]uint16
+	for _, l := range bitLen[:nchar] {
+		if l > 16 {
+			return false
+		}
+		count[l]++
+	}
+	for i := 1; i <= 16; i++ {
+		start[i+1] = start[i] + count[i]<<(16-i)
+	}
+	if start[17] != 0 {
+		return false
+	}
+
+	jutBits := 16 - tableBits
+	for i := uint(1); i <= tableBits; i++ {
+		start[i] >>= jutBits
+		weight[i] = 1 << (tableBits - i)
+	}
+	for i := tableBits + 1; i <= 16; i++ {
+		weight[i] = 1 << (16 - i)
+	}
+	if i := int(start[tableBits+1] >> jutBits); i != 0 {
+		for ; i < 1<<tableBits; i++ {
+			table[i] = 0
+		}
+	}
+
+	avail := uint16(nchar)
+	mask := uint16(1) << (15 - tableBits)
+	for char := 0; char < nchar; char++ {
+		l := uint(bitLen[char])
+		if l == 0 {
+			continue
+		}
+		next := start[l] + weight[l]
+		if l <= tableBits {
+			if start[l] >= next || int(next) > len(table) {
+				return false
+			}
+			for i := start[l]; i < next; i++ {
+				table[i] = uint16(char)
+			}
+		} else {
+			code := start[l]
+			p := &table[code>>jutBits]
+			for i := l - tableBits; i != 0; i-- {
+				if *p == 0 && avail < 2*tianoNC-1 {
+					s.left[avail], s.right[avail] = 0, 0
+					*p = avail
+					avail++
+				}
+				if *p < 2*tianoNC-1 {
+					if code&mask != 0 {
+						p = &s.right[*p]
+					} else {
+						p = &s.left[*p]
+					}
+				}
+				code <<= 1
+			}
+			*p = uint16(char)
+		}
+		start[l] = next
+	}
+	return true
+}
+
+// readPTLen reads the code lengths of the position or the length code, a
+// run of zeros follows the length at index special
+func (s *tianoState) readPTLen(nn int, nbit uint, special int) bool {
+	n := int(s.bits(nbit))
+	if n > tianoNPT || nn > tianoNPT {
+		return false
+	}
+	if n == 0 {
+		c := uint16(s.bits(nbit))
+		for i := range s.ptTable {
+			s.ptTable[i] = c
+		}
+		for i := 0; i < nn; i++ {
+			s.ptLen[i] = 0
+		}
+		return true
+	}
+
+	i := 0
+	for i < n {
+		c := uint(s.bitBuf >> (tianoBitBufSize - 3))
+		if c == 7 {
+			for mask := uint32(1) << (tianoBitBufSize - 1 - 3); mask&s.bitBuf != 0; mask >>= 1 {
+				c++
+			}
+		}
+		if c < 7 {
+			s.fill(3)
+		} else {
+			s.fill(c - 3)
+		}
+		s.ptLen[i] = uint8(c)
+		i++
+		if i == special {
+			for z := s.bits(2); z > 0 && i < tianoNPT; z-- {
+				s.ptLen[i] = 0
+				i++
+			}
+		}
+	}
+	for ; i < nn; i++ {
+		s.ptLen[i] = 0
+	}
+	return s.makeTable(nn, s.ptLen[:], 8, s.ptTable[:])
+}
+
+// readCLen reads the code lengths of the literal and match length code
+func (s *tianoState) readCLen() bool {
+	n := int(s.bits(tianoCBit))
+	if n == 0 {
+		c := uint16(s.bits(tianoCBit))
+		for i := range s.cLen {
+			s.cLen[i] = 0
+		}
+		for i := range s.cTable {
+			s.cTable[i] = c
+		}
+		return true
+	}
+
+	i := 0
+	for i < n && i < tianoNC {
+		c := s.walk(s.ptTable[s.bitBuf>>(tianoBitBufSize-8)], tianoNT, 8)
+		s.fill(uint(s.ptLen[c]))
+		if c > 2 {
+			s.cLen[i] = uint8(c - 2)
+			i++
+			continue
+		}
+		// runs of zeros
+		z := 1
+		if c == 1 {
+			z = int(s.bits(4)) + 3
+		} else if c == 2 {
+			z = int(s.bits(tianoCBit)) + 20
+		}
+		for ; z > 0 && i < tianoNC; z-- {
+			s.cLen[i] = 0
+			i++
+		}
+	}
+	for ; i < tianoNC; i++ {
+		s.cLen[i] = 0
+	}
+	return s.makeTable(tianoNC, s.cLen[:], 12, s.cTable[:])
+}
+
+// decodeC returns the next literal or match length, a new block starts
+// with the code tables
+func (s *tianoState) decodeC() uint16 {
+	if s.block == 0 {
+		s.block = uint16(s.bits(16))
+		if !s.readPTLen(tianoNT, tianoTBit, 3) || !s.readCLen() || !s.readPTLen(tianoMaxNP, s.pbit, -1) {
+			s.err = ErrCorrupt
+			return 0
+		}
+	}
+	s.block--
+	c := s.walk(s.cTable[s.bitBuf>>(tianoBitBufSize-12)], tianoNC, 12)
+	s.fill(uint(s.cLen[c]))
+	return c
+}
+
+// decodeP returns the distance of a match
+func (s *tianoState) decodeP() uint32 {
+	v := s.walk(s.ptTable[s.bitBuf>>(tianoBitBufSize-8)], tianoMaxNP, 8)
+	s.fill(uint(s.ptLen[v]))
+	if v > 1 {
+		return 1<<(v-1) + s.bits(uint(v-1))
+	}
+	return uint32(v)
+}
+
+// EfiDecompress decompresses data compressed with the EFI 1.1 algorithm or
+// with Tiano, which only differ in the size of the distance code. The data
+// starts with the compressed and the original size and at most max bytes
+// are returned
+func EfiDecompress(src []byte, max int, tiano bool) ([]byte, error) {
+	if len(src) < 8 {
+		return nil, ErrCorrupt
+	}
+	compSize := int(binary.LittleEndian.Uint32(src))
+	origSize := int(binary.LittleEndian.Uint32(src[4:]))
+	if compSize > len(src)-8 || origSize > max {
+		return nil, ErrCorrupt
+	}
+
+	// the output grows as it is decoded, origSize is not trusted for allocation
+	s := &tianoState{src: src[8 : 8+compSize], pbit: 4}
+	if tiano {
+		s.pbit = 5
+	}
+	s.fill(tianoBitBufSize)
+	for len(s.dst) < origSize {
+		c := s.decodeC()
+		if s.err != nil {
+			return nil, s.err
+		}
+		if c < 256 {
+			s.dst = append(s.dst, byte(c))
+			continue
+		}
+
+		n := int(c) - (256 - tianoThreshold)
+		pos := len(s.dst) - int(s.decodeP()) - 1
+		if s.err != nil || pos < 0 {
+			return nil, ErrCorrupt
+		}
+		for i := 0; i < n && len(s.dst) < origSize; i++ {
+			s.dst = append(s.dst, s.dst[pos+i])
+		}
+	}
+	return s.dst, nil
+}
@@ -0,0 +1,90 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// tianoBits writes bits with the most significant first
+type tianoBits struct {
+	data []byte
+	n    uint
+}
+
+func (b *tianoBits) put(v uint32, n uint) *tianoBits {
+	for i := n; i > 0; i-- {
+		if b.n%8 == 0 {
+			b.data = append(b.data, 0)
+		}
+		if v&(1<<(i-1)) != 0 {
+			b.data[len(b.data)-1] |= 0x80 >> (b.n % 8)
+		}
+		b.n++
+	}
+	return b
+}
+
+// constant writes a block where every symbol is c and distances are p
+func (b *tianoBits) constant(size, c, p uint32, pbit uint) *tianoBits {
+	return b.put(size, 16).put(0, tianoTBit).put(0, tianoTBit).put(0, tianoCBit).put(c, tianoCBit).put(0, pbit).put(p, pbit)
+}
+
+func (b *tianoBits) bytes(orig int) []byte {
+	head := make([]byte, 8)
+	binary.LittleEndian.PutUint32(head, uint32(len(b.data)))
+	binary.LittleEndian.PutUint32(head[4:], uint32(orig))
+	return append(head, b.data...)
+}
+
+func TestEfiDecompress(t *testing.T) {
+	// blocks with a single literal, then a match with distance code 2
+	for _, tiano := range []bool{false, true} {
+		pbit := uint(4)
+		if tiano {
+			pbit = 5
+		}
+		b := &tianoBits{}
+		b.constant(3, 'A', 0, pbit).constant(2, 'B', 0, pbit).constant(1, 253+4, 2, pbit).put(1, 1)
+		got, err := EfiDecompress(b.bytes(9), 100, tiano)
+		if err != nil || string(got) != "AAABBAABB" {
+			t.Errorf("tiano %v: got %q, %v", tiano, got, err)
+		}
+	}
+
+	// a block with Huffman codes, the length code has symbols 10 and 15
+	// which give 8 bit codes for 0-253 and 13 bit codes for 254-317
+	b := &tianoBits{}
+	b.put(4, 16).put(16, tianoTBit).put(0, 3).put(0, 3).put(0, 3).put(3, 2)
+	for i := 6; i < 16; i++ {
+		if i == 10 || i == 15 {
+			b.put(1, 3)
+		} else {
+			b.put(0, 3)
+		}
+	}
+	b.put(318, tianoCBit)
+	for i := 0; i < 318; i++ {
+		if i < 254 {
+			b.put(0, 1)
+		} else {
+			b.put(1, 1)
+		}
+	}
+	b.put(0, 5).put(0, 5)
+	b.put('h', 8).put('i', 8).put(254<<5+3, 13).put(250, 8)
+	got, err := EfiDecompress(b.bytes(7), 100, true)
+	if err != nil || !bytes.Equal(got, []byte("hiiiii\xfa")) {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	// too large, a match before the start
+	if _, err := EfiDecompress(b.bytes(200), 100, true); err == nil {
+		t.Errorf("output larger than max was accepted")
+	}
+	b = &tianoBits{}
+	b.constant(1, 253+4, 0, 5)
+	if _, err := EfiDecompress(b.bytes(4), 100, true); err == nil {
+		t.Errorf("match before the start was accepted")
+	}
+}
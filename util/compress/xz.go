@@ -0,0 +1,386 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+const (
+	xzHeaderSize = 12
+
+	xzCheckNone   = 0x00
+	xzCheckCrc32  = 0x01
+	xzCheckCrc64  = 0x04
+	xzCheckSha256 = 0x0A
+
+	xzFilterDelta    = 0x03
+	xzFilterX86      = 0x04
+	xzFilterPPC      = 0x05
+	xzFilterIA64     = 0x06
+	xzFilterARM      = 0x07
+	xzFilterARMThumb = 0x08
+	xzFilterSPARC    = 0x09
+	xzFilterARM64    = 0x0A
+	xzFilterLzma2    = 0x21
+)
+
+var (
+	xzMagic       = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+	xzCrc64Table  = crc64.MakeTable(crc64.ECMA)
+)
+
+// countingReader counts bytes read, which is needed to find the padding in xz files
+type countingReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// crcReader computes the crc32 of bytes read
+type crcReader struct {
+	r   io.ByteReader
+	crc uint32
+	n   int64
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc = crc32.Update(c.crc, crc32.IEEETable, []byte{b})
+		c.n++
+	}
+	return b, err
+}
+
+// xzReader reads a xz file, which may contain several streams
+type xzReader struct {
+	r      *countingReader
+	check  byte
+	hash   hash.Hash
+	block  io.Reader // nil between blocks
+	start  int64     // where the current block started
+	blocks int
+	err    error
+}
+
+// NewXzReader returns a reader that decompresses a xz file. Data after the
+// last stream is ignored, which is common when the file has been carved
+func NewXzReader(r io.Reader) (io.Reader, error) {
+	xr := &xzReader{r: &countingReader{r: byteReader(r)}}
+	if err := xr.streamHeader(); err != nil {
+		return nil, err
+	}
+	return xr, nil
+}
+
+// readVarint reads a xz multibyte integer
+func readVarint(r io.ByteReader) (uint64, error) {
+	var value uint64
+	for i := uint(0); i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		value |= uint64(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			if b == 0 && i > 0 {
+				return 0, ErrCorrupt
+			}
+			return value, nil
+		}
+	}
+	return 0, ErrCorrupt
+}
+
+func xzCheckSize(check byte) int {
+	if check == 0 {
+		return 0
+	}
+	return 4 << ((check - 1) / 3)
+}
+
+func (xr *xzReader) streamHeader() error {
+	var head [xzHeaderSize]byte
+	if _, err := io.ReadFull(xr.r, head[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(head[:6], xzMagic) {
+		return ErrCorrupt
+	}
+	if crc32.ChecksumIEEE(head[6:8]) != binary.LittleEndian.Uint32(head[8:]) {
+		return ErrChecksum
+	}
+	if head[6] != 0 || head[7] > 0x0F {
+		return ErrUnsupported
+	}
+	xr.check = head[7]
+	xr.blocks = 0
+	return nil
+}
+
+// nextStream skips the stream padding and reads the next stream header,
+// io.EOF is returned if there is no other stream
+func (xr *xzReader) nextStream() error {
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(xr.r, buf[:]); err != nil {
+			return io.EOF
+		}
+		if buf != [4]byte{} {
+			break
+		}
+	}
+	if !bytes.Equal(buf[:], xzMagic[:4]) {
+		return io.EOF
+	}
+
+	// put back what we read and parse the header
+	r := xr.r
+	xr.r = &countingReader{r: byteReader(io.MultiReader(bytes.NewReader(buf[:]), r))}
+	if err := xr.streamHeader(); err != nil {
+		return io.EOF
+	}
+	return nil
+}
+
+// index reads the index and the stream footer, the index indicator is already read
+func (xr *xzReader) index() error {
+	r := &crcReader{r: xr.r, crc: crc32.Update(0, crc32.IEEETable, []byte{0}), n: 1}
+
+	count, err := readVarint(r)
+	if err != nil {
+		return err
+	}
+	if count != uint64(xr.blocks) {
+		return ErrCorrupt
+	}
+	for i := uint64(0); i < count; i++ {
+		if _, err := readVarint(r); err != nil {
+			return err
+		}
+		if _, err := readVarint(r); err != nil {
+			return err
+		}
+	}
+	for r.n%4 != 0 {
+		if b, err := r.ReadByte(); err != nil || b != 0 {
+			return ErrCorrupt
+		}
+	}
+	sum := r.crc
+
+	var footer [4 + xzHeaderSize]byte
+	if _, err := io.ReadFull(xr.r, footer[:]); err != nil {
+		return noEOF(err)
+	}
+	if binary.LittleEndian.Uint32(footer[:]) != sum ||
+		crc32.ChecksumIEEE(footer[8:14]) != binary.LittleEndian.Uint32(footer[4:]) {
+		return ErrChecksum
+	}
+	size := (int64(binary.LittleEndian.Uint32(footer[8:])) + 1) * 4
+	if !bytes.Equal(footer[14:], xzFooterMagic) || footer[13] != xr.check || size != r.n+4 {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// blockHeader reads a block header and sets up the filter chain
+func (xr *xzReader) blockHeader(size byte) error {
+	head := make([]byte, (int(size)+1)*4)
+	head[0] = size
+	if _, err := io.ReadFull(xr.r, head[1:]); err != nil {
+		return noEOF(err)
+	}
+	n := len(head) - 4
+	if crc32.ChecksumIEEE(head[:n]) != binary.LittleEndian.Uint32(head[n:]) {
+		return ErrChecksum
+	}
+
+	r := bytes.NewReader(head[2:n])
+	flags := head[1]
+	if flags&0x3C != 0 {
+		return ErrUnsupported
+	}
+	if flags&0x40 != 0 {
+		if _, err := readVarint(r); err != nil {
+			return err
+		}
+	}
+	if flags&0x80 != 0 {
+		if _, err := readVarint(r); err != nil {
+			return err
+		}
+	}
+
+	type filter struct {
+		id    uint64
+		props []byte
+	}
+	filters := make([]filter, int(flags&3)+1)
+	for i := range filters {
+		id, err := readVarint(r)
+		if err != nil {
+			return err
+		}
+		size, err := readVarint(r)
+		if err != nil {
+			return err
+		}
+		if size > uint64(r.Len()) {
+			return ErrCorrupt
+		}
+		props := make([]byte, size)
+		r.Read(props)
+		filters[i] = filter{id, props}
+	}
+	for r.Len() > 0 {
+		if b, _ := r.ReadByte(); b != 0 {
+			return ErrCorrupt
+		}
+	}
+
+	// the last filter is LZMA2 and is applied first
+	last := filters[len(filters)-1]
+	if last.id != xzFilterLzma2 || len(last.props) != 1 {
+		return ErrUnsupported
+	}
+	dictSize, err := lzma2DictSize(last.props[0])
+	if err != nil {
+		return err
+	}
+	var block io.Reader = newLzma2Reader(xr.r, dictSize)
+	for i := len(filters) - 2; i >= 0; i-- {
+		f := filters[i]
+		if f.id == xzFilterDelta {
+			if len(f.props) != 1 {
+				return ErrCorrupt
+			}
+			block = &deltaReader{r: block, dist: int(f.props[0]) + 1}
+			continue
+		}
+
+		var start uint32
+		if len(f.props) == 4 {
+			start = binary.LittleEndian.Uint32(f.props)
+		} else if len(f.props) != 0 {
+			return ErrCorrupt
+		}
+		var bcj bcjFilter
+		switch f.id {
+		case xzFilterX86:
+			bcj = &bcjX86{}
+		case xzFilterPPC:
+			bcj = bcjPPC{}
+		case xzFilterARM:
+			bcj = bcjARM{}
+		case xzFilterARMThumb:
+			bcj = bcjARMThumb{}
+		case xzFilterSPARC:
+			bcj = bcjSPARC{}
+		case xzFilterARM64:
+			bcj = bcjARM64{}
+		default:
+			return ErrUnsupported
+		}
+		block = newBcjReader(block, bcj, start)
+	}
+
+	switch xr.check {
+	case xzCheckCrc32:
+		xr.hash = crc32.NewIEEE()
+	case xzCheckCrc64:
+		xr.hash = crc64.New(xzCrc64Table)
+	case xzCheckSha256:
+		xr.hash = sha256.New()
+	default:
+		xr.hash = nil
+	}
+	xr.block = block
+	return nil
+}
+
+// endBlock reads the block padding and verifies the check
+func (xr *xzReader) endBlock() error {
+	for (xr.r.n-xr.start)%4 != 0 {
+		if b, err := xr.r.ReadByte(); err != nil || b != 0 {
+			return ErrCorrupt
+		}
+	}
+	check := make([]byte, xzCheckSize(xr.check))
+	if _, err := io.ReadFull(xr.r, check); err != nil {
+		return noEOF(err)
+	}
+	if xr.hash != nil {
+		sum := xr.hash.Sum(nil)
+		if xr.check != xzCheckSha256 {
+			// crc values are stored in little endian
+			for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+				sum[i], sum[j] = sum[j], sum[i]
+			}
+		}
+		if !bytes.Equal(sum, check) {
+			return ErrChecksum
+		}
+	}
+	xr.blocks++
+	xr.block = nil
+	return nil
+}
+
+func (xr *xzReader) Read(p []byte) (int, error) {
+	for xr.err == nil {
+		if xr.block != nil {
+			n, err := xr.block.Read(p)
+			if xr.hash != nil {
+				xr.hash.Write(p[:n])
+			}
+			if err == io.EOF {
+				xr.err = xr.endBlock()
+			} else if err != nil {
+				xr.err = err
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		// block header or index
+		b, err := xr.r.ReadByte()
+		if err != nil {
+			xr.err = noEOF(err)
+			break
+		}
+		if b != 0 {
+			xr.err = xr.blockHeader(b)
+			xr.start = xr.r.n
+			continue
+		}
+		if xr.err = xr.index(); xr.err == nil {
+			xr.err = xr.nextStream()
+		}
+	}
+	return 0, xr.err
+}
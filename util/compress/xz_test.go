@@ -0,0 +1,51 @@
+package compress
+
+import (
+	"testing"
+)
+
+func TestXz(t *testing.T) {
+	vectors := []vector{
+		{"xz", `/Td6WFoAAATm1rRGBMCEAtoPIQEWAAAAAAAAAOw0Nm7gB9kA/F0ANpvJ4pXWqF4qqFfJgsXBd4ePyImT6rxY2Be7zfqJgpfl9Zug
+slAPXlTPqOdvxSkEGdrE+ouFFn8SDYVjIMKpEfzlUdxGTc9bQ47GYCUFNid4aRQapUt2K15X1l9LU9ISrR1lhW5H64J9xCVYSTAJ
+YQqiNiNqDS8Es64KhPKLoJz3XrVBkG8OOGpe73P0BcLJvlqSFeQeCk4AFpDxGv1bg3TfRcztMSevEC/S4KvrAI8qYBYKXSmNGxtv
+IKmRHsRfAT4dyQL8BSISpwnqYmOfKxmzY8KX9Adj8hmigmdQcIqDzrKQSX9EODnjvzIL03i4nawIpHi/jJ5WBTgAAJIBc1WHmnga
+AAGgAtoPAACTiDziscRn+wIAAAAABFla`},
+		// x86 filter and sha256 check
+		{"xz-x86", `/Td6WFoAAArh+wyhBMGEAtoPBAAhARwAAAAAAOOgqTTgB9kA/F0ANpvJ4pXWqF4qqFfJgsXBd4ePyImT6rxY2Be7zfqJgpfl9Zug
+slAPXlTPqOdvxSkEGdrE+ouFFn8SDYVjIMKpEfzlUdxGTc9bQ47GYCUFNid4aRQapUt2K15X1l9LU9ISrR1lhW5H64J9xCVYSTAJ
+YQqiNiNqDS8Es64KhPKLoJz3XrVBkG8OOGpe73P0BcLJvlqSFeQeCk4AFpDxGv1bg3TfRcztMSevEC/S4KvrAI8qYBYKXSmNGxtv
+IKmRHsRfAT4dyQL8BSISpwnqYmOfKxmzY8KX9Adj8hmigmdQcIqDzrKQSX9EODnjvzIL03i4nawIpHi/jJ5WBTgAAEzAP0Q1/AMK
+PQz3aULCA/Oq6dMZ07CJwD2tWx1GvkJyAAG4AtoPAABlCLkNtunfHAIAAAAAClla`},
+	}
+	testVectors(t, vectors, NewXzReader)
+}
+
+func TestLzma(t *testing.T) {
+	vectors := []vector{
+		// unknown size and an end marker
+		{"lzma", `XQAAgAD//////////wA2m8nildaoXiqoV8mCxcF3h4/IiZPqvFjYF7vN+omCl+X1m6CyUA9eVM+o52/FKQQZ2sT6i4UWfxINhWMg
+wqkR/OVR3EZNz1tDjsZgJQU2J3hpFBqlS3YrXlfWX0tT0hKtHWWFbkfrgn3EJVhJMAlhCqI2I2oNLwSzrgqE8ougnPdetUGQbw44
+al7vc/QFwsm+WpIV5B4KTgAWkPEa/VuDdN9FzO0xJ68QL9Lgq+sAjypgFgpdKY0bG28gqZEexF8BPh3JAvwFIhKnCepiY58rGbNj
+wpf0B2PyGaKCZ1BwioPOspBJf0Q4OeO/MgvTeLidrAikeL+MnmDqtR7f/iGNTg==`},
+	}
+	testVectors(t, vectors, NewLzmaReader)
+}
+
+func TestLzip(t *testing.T) {
+	vectors := []vector{
+		{"lzip", `TFpJUAESADabyc5EcFEaGTQKhLJDgX9yJOcLx43tbqTZj8tLQIC8pp6FpxEtYJ+I0zihZPnCb/qdGSjwargkdvi881ZNijOH8/Ve
+5Ua5nnSywLdBpM6kmZSKoJjb+1ejSTfKyAMyEO+VjH8XY/FBvRxV+AWkKqaDCWHxoIANnNSo4utvbNoWum3q0wesPsLRkdbU/djT
+uV5yB2/oZG47p/reBiZzQQwKSJDetgd8SioUDuXZ+XDNX3UIIwJoPjlgaQOb5ply3l57OIYbKODAooKMjH/wCy9FcWEuA54XWkCQ
+tK7UxWKS/1fz3ajv63UW+AQyft0pXSyH6q3NMr+rzHMxYCP6Z4jVydFOAGRhyeZ7l+//ZT3XAFZFsBPaBwAAAAAAACwBAAAAAAAA`},
+		// two members
+		{"lzip-members", `TFpJUAESADabyc5EcFEaGTQKhLJDgX9yJOcLx43tbqTZj8tLQIC8pp6FpxEtYJ+I0zihZPnCb/qdGSjwargkdvi881ZNijOH8/Ve
+5Ua5nnSywLdBpM6kmZSKoJjb+1ejSTfKyAMyEO+VjH8XY/FBvRxV+AWkKqaDCWHxoIANnNSo4utvbNoWum3q0wesPsLRkdbU/djT
+uV5yB2/nwy7UVeT+xO9ZGCYvULwCAAAAAAAAuQAAAAAAAABMWklQARIAORtLVJSb4ROIBC9ft7lLMRkrw00iQniobueCNiNy0wdk
+pheNuU0NO22+ozPMo3A4//UbZIoTg3RzGvXIxIzrfyYfBQ6FdpOW+WhWBYFECkHQQC++7pcvQaoeHqM+FQk4laVl89oALQZGtNP1
+LmdnZ4137rKUVcWRT3UDZsR2ZCB95WbcIzgg2FVsF48QVPW4jql+FZlPJOdbAV+o/F2VN4nOM2J/HkohPYTEYKZlMAsY4RWOR38s
+D1tT0ppQ6eOo+XCAbsCCWLlQsXAW6eIwk+ApmNhANmsX+jsdrhAgh4g4imVS89LSue1MzS9NGYikFz3CtCZ1WP+pOu+g+KSdCR4F
+AAAAAAAAFwEAAAAAAAA=`},
+	}
+	testVectors(t, vectors, NewLzipReader)
+}
@@ -0,0 +1,672 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+const (
+	zstdMagic         = 0xFD2FB528
+	zstdSkippableMask = 0xFFFFFFF0
+	zstdSkippable     = 0x184D2A50
+	zstdMaxBlockSize  = 128 * 1024
+	zstdMaxWindow     = 1 << 31
+	zstdHuffMaxBits   = 11
+
+	zstdModePredefined = 0
+	zstdModeRLE        = 1
+	zstdModeFSE        = 2
+	zstdModeRepeat     = 3
+)
+
+var (
+	zstdLLBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536}
+	zstdLLBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16}
+	zstdMLBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16}
+
+	zstdLLDefault = mustFseTable([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}, 6)
+	zstdMLDefault = mustFseTable([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1}, 6)
+	zstdOFDefault = mustFseTable([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}, 5)
+)
+
+func mustFseTable(norm []int16, log uint) *fseTable {
+	t, err := newFseTable(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// hufTable is a huffman decoding table for zstd literals
+type hufTable struct {
+	maxBits uint
+	symbols []byte
+	bits    []uint8
+}
+
+// readHufTable reads a huffman tree description, it returns the
+// table and the number of bytes used
+func readHufTable(src []byte) (*hufTable, int, error) {
+	if len(src) == 0 {
+		return nil, 0, ErrCorrupt
+	}
+	var weights []byte
+	head := int(src[0])
+	used := 1 + head
+	if head >= 128 {
+		// weights are stored directly as 4 bit values
+		n := head - 127
+		used = 1 + (n+1)/2
+		if used > len(src) {
+			return nil, 0, ErrCorrupt
+		}
+		weights = make([]byte, n)
+		for i := range weights {
+			b := src[1+i/2]
+			if i%2 == 0 {
+				b >>= 4
+			}
+			weights[i] = b & 0xF
+		}
+	} else {
+		// weights are FSE compressed, decoded with two interleaved states
+		if used > len(src) {
+			return nil, 0, ErrCorrupt
+		}
+		t, n, err := readFseTable(src[1:used], 6, 255)
+		if err != nil {
+			return nil, 0, err
+		}
+		b, err := newRevBits(src[1+n : used])
+		if err != nil {
+			return nil, 0, err
+		}
+		state := [2]uint64{t.init(b), t.init(b)}
+		for i := 0; ; i ^= 1 {
+			if len(weights) > 254 {
+				return nil, 0, ErrCorrupt
+			}
+			weights = append(weights, byte(t.symbol(state[i])))
+			state[i] = t.update(b, state[i])
+			if b.left < 0 {
+				weights = append(weights, byte(t.symbol(state[i^1])))
+				break
+			}
+		}
+	}
+
+	// the weight of the last symbol is implied
+	var total uint32
+	for _, w := range weights {
+		if w > zstdHuffMaxBits {
+			return nil, 0, ErrCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 || len(weights) > 255 {
+		return nil, 0, ErrCorrupt
+	}
+	maxBits := uint(bits.Len32(total))
+	rest := uint32(1)<<maxBits - total
+	if maxBits > zstdHuffMaxBits || rest&(rest-1) != 0 {
+		return nil, 0, ErrCorrupt
+	}
+	weights = append(weights, byte(bits.Len32(rest)))
+
+	// fill the table, starting with the lowest weights
+	h := &hufTable{maxBits: maxBits, symbols: make([]byte, 1<<maxBits), bits: make([]uint8, 1<<maxBits)}
+	pos := 0
+	for w := uint(1); w <= maxBits; w++ {
+		for s, sw := range weights {
+			if uint(sw) != w {
+				continue
+			}
+			n := 1 << (w - 1)
+			for i := pos; i < pos+n; i++ {
+				h.symbols[i] = byte(s)
+				h.bits[i] = uint8(maxBits + 1 - w)
+			}
+			pos += n
+		}
+	}
+	return h, used, nil
+}
+
+// decode decodes one huffman stream to fill dst
+func (h *hufTable) decode(dst, src []byte) error {
+	b, err := newRevBits(src)
+	if err != nil {
+		return err
+	}
+	mask := uint64(1)<<h.maxBits - 1
+	state := b.read(h.maxBits)
+	for i := range dst {
+		dst[i] = h.symbols[state]
+		n := uint(h.bits[state])
+		state = (state<<n | b.read(n)) & mask
+	}
+	if b.left != -int(h.maxBits) {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// zstdReader decompresses zstd frames
+type zstdReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	err error
+
+	// hist holds decoded data, the last window bytes are used as history
+	hist       []byte
+	out        int // start of unread data in hist
+	frameStart int // start of the current frame in hist
+	frames     int
+	inFrame    bool
+
+	window    int
+	blockMax  int
+	last      bool
+	checksum  bool
+	hash      *xxhash64
+	size      int64 // frame content size, -1 if unknown
+	frameSize int64
+	block     []byte
+	literals  []byte
+
+	// entropy tables and offsets can be reused by later blocks
+	huf        *hufTable
+	ll, of, ml *fseTable
+	rep        [3]int
+}
+
+// NewZstdReader returns a reader that decompresses zstd data. Data after the
+// last frame is ignored, which is common when the file has been carved.
+// Dictionaries are not supported
+func NewZstdReader(r io.Reader) (io.Reader, error) {
+	z := &zstdReader{r: byteReader(r)}
+	if err := z.frameHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return z, nil
+}
+
+// frameHeader reads the header of the next frame, skippable frames are ignored
+func (z *zstdReader) frameHeader() error {
+	for {
+		var buf [4]byte
+		if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+			return io.EOF
+		}
+		magic := binary.LittleEndian.Uint32(buf[:])
+		if magic&zstdSkippableMask == zstdSkippable {
+			if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+				return noEOF(err)
+			}
+			size := int64(binary.LittleEndian.Uint32(buf[:]))
+			if n, _ := io.CopyN(io.Discard, z.r, size); n != size {
+				return io.ErrUnexpectedEOF
+			}
+			continue
+		}
+		if magic != zstdMagic {
+			if z.frames > 0 {
+				return io.EOF
+			}
+			return ErrCorrupt
+		}
+		break
+	}
+
+	fhd, err := z.r.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	if fhd&0x08 != 0 {
+		return ErrCorrupt
+	}
+	single := fhd&0x20 != 0
+	z.checksum = fhd&0x04 != 0
+
+	var head [1 + 4 + 8]byte
+	fcsSize := [4]int{0, 2, 4, 8}[fhd>>6]
+	if fcsSize == 0 && single {
+		fcsSize = 1
+	}
+	dictSize := [4]int{0, 1, 2, 4}[fhd&3]
+	wdSize := 1
+	if single {
+		wdSize = 0
+	}
+	hs := head[:wdSize+dictSize+fcsSize]
+	if _, err := io.ReadFull(z.r, hs); err != nil {
+		return noEOF(err)
+	}
+
+	if !single {
+		exp, mantissa := uint(hs[0]>>3), int64(hs[0]&7)
+		base := int64(1) << (10 + exp)
+		window := base + base/8*mantissa
+		if window > zstdMaxWindow {
+			return ErrUnsupported
+		}
+		z.window = int(window)
+	}
+	var dict [4]byte
+	copy(dict[:], hs[wdSize:wdSize+dictSize])
+	if binary.LittleEndian.Uint32(dict[:]) != 0 {
+		return ErrUnsupported
+	}
+	var fcs [8]byte
+	copy(fcs[:], hs[wdSize+dictSize:])
+	z.size = int64(binary.LittleEndian.Uint64(fcs[:]))
+	switch {
+	case fcsSize == 2:
+		z.size += 256
+	case fcsSize == 0:
+		z.size = -1
+	}
+	if single {
+		if z.size < 0 || z.size > zstdMaxWindow {
+			return ErrUnsupported
+		}
+		z.window = int(z.size)
+	}
+
+	z.blockMax = zstdMaxBlockSize
+	if z.window < z.blockMax {
+		z.blockMax = z.window
+	}
+	z.inFrame = true
+	z.last = false
+	z.frames++
+	z.frameSize = 0
+	z.frameStart = len(z.hist)
+	z.hash = newXXHash64()
+	z.huf, z.ll, z.of, z.ml = nil, nil, nil, nil
+	z.rep = [3]int{1, 4, 8}
+	return nil
+}
+
+// endFrame verifies the size and checksum of the frame
+func (z *zstdReader) endFrame() error {
+	z.inFrame = false
+	if z.size >= 0 && z.size != z.frameSize {
+		return ErrCorrupt
+	}
+	if z.checksum {
+		var buf [4]byte
+		if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+			return noEOF(err)
+		}
+		if binary.LittleEndian.Uint32(buf[:]) != uint32(z.hash.Sum64()) {
+			return ErrChecksum
+		}
+	}
+	return nil
+}
+
+// nextBlock decodes the next block, all data in hist has been read
+func (z *zstdReader) nextBlock() error {
+	if !z.inFrame {
+		return z.frameHeader()
+	}
+
+	// drop history we no longer need
+	if len(z.hist) > 2*z.window+zstdMaxBlockSize {
+		drop := len(z.hist) - z.window
+		z.hist = append(z.hist[:0], z.hist[drop:]...)
+		z.frameStart -= drop
+		if z.frameStart < 0 {
+			z.frameStart = 0
+		}
+	}
+	z.out = len(z.hist)
+
+	var head [3]byte
+	if _, err := io.ReadFull(z.r, head[:]); err != nil {
+		return noEOF(err)
+	}
+	v := uint32(head[0]) | uint32(head[1])<<8 | uint32(head[2])<<16
+	z.last = v&1 != 0
+	size := int(v >> 3)
+
+	switch (v >> 1) & 3 {
+	case 0:
+		if size > z.blockMax {
+			return ErrCorrupt
+		}
+		z.hist = append(z.hist, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.hist[z.out:]); err != nil {
+			return noEOF(err)
+		}
+	case 1:
+		if size > z.blockMax {
+			return ErrCorrupt
+		}
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		z.hist = append(z.hist, bytes.Repeat([]byte{b}, size)...)
+	case 2:
+		if size > z.blockMax {
+			return ErrCorrupt
+		}
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		z.block = z.block[:size]
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return noEOF(err)
+		}
+		if err := z.decodeBlock(z.block); err != nil {
+			return err
+		}
+	default:
+		return ErrCorrupt
+	}
+
+	z.hash.Write(z.hist[z.out:])
+	z.frameSize += int64(len(z.hist) - z.out)
+	if z.last {
+		return z.endFrame()
+	}
+	return nil
+}
+
+// readLiterals decodes the literals section, it returns the number of bytes used
+func (z *zstdReader) readLiterals(src []byte) (int, error) {
+	// pad the input so that headers can be read without checks
+	avail := len(src)
+	if avail < 5 {
+		src = append(src[:avail:avail], make([]byte, 5)...)
+	}
+	typ, format := src[0]&3, (src[0]>>2)&3
+
+	// raw and RLE literals
+	if typ < 2 {
+		var size, used int
+		switch format {
+		case 0, 2:
+			size, used = int(src[0]>>3), 1
+		case 1:
+			size, used = int(src[0]>>4)|int(src[1])<<4, 2
+		case 3:
+			size, used = int(src[0]>>4)|int(src[1])<<4|int(src[2])<<12, 3
+		}
+		if size > z.blockMax {
+			return 0, ErrCorrupt
+		}
+		if typ == 0 {
+			if used+size > avail {
+				return 0, ErrCorrupt
+			}
+			z.literals = append(z.literals[:0], src[used:used+size]...)
+			return used + size, nil
+		}
+		if used+1 > avail {
+			return 0, ErrCorrupt
+		}
+		z.literals = append(z.literals[:0], bytes.Repeat(src[used:used+1], size)...)
+		return used + 1, nil
+	}
+
+	// huffman compressed literals
+	var regen, comp, used int
+	streams := 4
+	switch format {
+	case 0, 1:
+		if format == 0 {
+			streams = 1
+		}
+		v := uint32(src[0]) | uint32(src[1])<<8 | uint32(src[2])<<16
+		regen, comp, used = int(v>>4)&0x3FF, int(v>>14)&0x3FF, 3
+	case 2:
+		v := binary.LittleEndian.Uint32(src)
+		regen, comp, used = int(v>>4)&0x3FFF, int(v>>18), 4
+	case 3:
+		v := uint64(binary.LittleEndian.Uint32(src)) | uint64(src[4])<<32
+		regen, comp, used = int(v>>4)&0x3FFFF, int(v>>22)&0x3FFFF, 5
+	}
+	if regen > z.blockMax || used+comp > avail {
+		return 0, ErrCorrupt
+	}
+	data := src[used : used+comp]
+	if typ == 2 {
+		huf, n, err := readHufTable(data)
+		if err != nil {
+			return 0, err
+		}
+		z.huf = huf
+		data = data[n:]
+	} else if z.huf == nil {
+		return 0, ErrCorrupt
+	}
+
+	if cap(z.literals) < regen {
+		z.literals = make([]byte, regen)
+	}
+	z.literals = z.literals[:regen]
+	if streams == 1 {
+		return used + comp, z.huf.decode(z.literals, data)
+	}
+
+	if len(data) < 6 {
+		return 0, ErrCorrupt
+	}
+	sizes := [4]int{
+		int(binary.LittleEndian.Uint16(data)),
+		int(binary.LittleEndian.Uint16(data[2:])),
+		int(binary.LittleEndian.Uint16(data[4:])),
+	}
+	data = data[6:]
+	sizes[3] = len(data) - sizes[0] - sizes[1] - sizes[2]
+	segment := (regen + 3) / 4
+	if sizes[3] < 0 || 3*segment > regen {
+		return 0, ErrCorrupt
+	}
+	out := z.literals
+	for i, size := range sizes {
+		n := segment
+		if i == 3 {
+			n = len(out)
+		}
+		if err := z.huf.decode(out[:n], data[:size]); err != nil {
+			return 0, err
+		}
+		out, data = out[n:], data[size:]
+	}
+	return used + comp, nil
+}
+
+// readSeqTable reads one of the sequence decoding tables
+func readSeqTable(src []byte, mode byte, prev, def *fseTable, maxLog uint, maxSymbol int) (*fseTable, int, error) {
+	switch mode {
+	case zstdModePredefined:
+		return def, 0, nil
+	case zstdModeRLE:
+		if len(src) < 1 || int(src[0]) > maxSymbol {
+			return nil, 0, ErrCorrupt
+		}
+		return newRleTable(src[0]), 1, nil
+	case zstdModeFSE:
+		return readFseTable(src, maxLog, maxSymbol)
+	default:
+		if prev == nil {
+			return nil, 0, ErrCorrupt
+		}
+		return prev, 0, nil
+	}
+}
+
+// decodeBlock decodes a compressed block and appends it to hist
+func (z *zstdReader) decodeBlock(src []byte) error {
+	n, err := z.readLiterals(src)
+	if err != nil {
+		return err
+	}
+	src = src[n:]
+
+	// sequences section header
+	if len(src) < 1 {
+		return ErrCorrupt
+	}
+	var count int
+	switch b := int(src[0]); {
+	case b < 128:
+		count, src = b, src[1:]
+	case b < 255:
+		if len(src) < 2 {
+			return ErrCorrupt
+		}
+		count, src = (b-128)<<8|int(src[1]), src[2:]
+	default:
+		if len(src) < 3 {
+			return ErrCorrupt
+		}
+		count, src = int(src[1])|int(src[2])<<8+0x7F00, src[3:]
+	}
+	if count == 0 {
+		z.hist = append(z.hist, z.literals...)
+		return nil
+	}
+
+	if len(src) < 1 {
+		return ErrCorrupt
+	}
+	modes := src[0]
+	src = src[1:]
+	if modes&3 != 0 {
+		return ErrCorrupt
+	}
+	if z.ll, n, err = readSeqTable(src, modes>>6, z.ll, zstdLLDefault, 9, 35); err != nil {
+		return err
+	}
+	src = src[n:]
+	if z.of, n, err = readSeqTable(src, (modes>>4)&3, z.of, zstdOFDefault, 8, 31); err != nil {
+		return err
+	}
+	src = src[n:]
+	if z.ml, n, err = readSeqTable(src, (modes>>2)&3, z.ml, zstdMLDefault, 9, 52); err != nil {
+		return err
+	}
+	src = src[n:]
+
+	b, err := newRevBits(src)
+	if err != nil {
+		return err
+	}
+	llState, ofState, mlState := z.ll.init(b), z.of.init(b), z.ml.init(b)
+	lits := z.literals
+	start := len(z.hist)
+	for i := 0; i < count; i++ {
+		ofCode := uint(z.of.symbol(ofState))
+		mlCode := z.ml.symbol(mlState)
+		llCode := z.ll.symbol(llState)
+		if ofCode > 31 || mlCode >= len(zstdMLBase) || llCode >= len(zstdLLBase) {
+			return ErrCorrupt
+		}
+		offset := int(1<<ofCode + b.read(ofCode))
+		ml := int(zstdMLBase[mlCode]) + int(b.read(uint(zstdMLBits[mlCode])))
+		ll := int(zstdLLBase[llCode]) + int(b.read(uint(zstdLLBits[llCode])))
+		if i != count-1 {
+			llState = z.ll.update(b, llState)
+			mlState = z.ml.update(b, mlState)
+			ofState = z.of.update(b, ofState)
+		}
+
+		// repeated offsets
+		if offset > 3 {
+			offset -= 3
+			z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+		} else {
+			idx := offset - 1
+			if ll == 0 {
+				idx++
+			}
+			switch idx {
+			case 0:
+				offset = z.rep[0]
+			case 1:
+				offset = z.rep[1]
+				z.rep[0], z.rep[1] = offset, z.rep[0]
+			case 2:
+				offset = z.rep[2]
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			default:
+				offset = z.rep[0] - 1
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			}
+		}
+
+		// literals then match
+		if ll > len(lits) || len(z.hist)-start+ll+ml > z.blockMax {
+			return ErrCorrupt
+		}
+		z.hist = append(z.hist, lits[:ll]...)
+		lits = lits[ll:]
+		if offset <= 0 || offset > len(z.hist)-z.frameStart || offset > z.window {
+			return ErrCorrupt
+		}
+		for pos := len(z.hist) - offset; ml > 0; {
+			n := ml
+			if n > offset {
+				n = offset
+			}
+			z.hist = append(z.hist, z.hist[pos:pos+n]...)
+			pos += n
+			ml -= n
+		}
+	}
+	if b.left != 0 {
+		return ErrCorrupt
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.out == len(z.hist) && z.err == nil {
+		z.err = z.nextBlock()
+	}
+	n := copy(p, z.hist[z.out:])
+	z.out += n
+	if n > 0 {
+		return n, nil
+	}
+	return 0, z.err
+}
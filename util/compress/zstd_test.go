@@ -0,0 +1,36 @@
+package compress
+
+import (
+	"testing"
+)
+
+func TestZstd(t *testing.T) {
+	vectors := []vector{
+		{"zstd-19", `KLUv/WTaBt0HAFKHExSQqTnTX+q1vLudUTcREcKBsU0DAsCwOfGsqi01OCbx7IMznlXpHM+q2lKDYxLPPjgm8ez6bM7xnq47NTib
+c/y26wJDIihHUhDTi2EgR2ioYWHdfgfAKBALY44BElAQQMBgTM2zTd///zNDLkvPMOMgtLZama06l+Nhr0xBhzyStJQlMygGWbnf
+A3YBOpquppbNx/Tuo3rQMIsxylwX8hkQB4jWqxWy1c/e5GvoJg9S9pJgCkpIjtfghWAUN8XpaLNqVxuTR+vY9gCGplsmyPUys+Gi
+AHIACjBCfrskM6cGCChByyGD3mG/YrB4t0GwaBLUYFgmAKwC31/rnw==`},
+		// no checksum
+		{"zstd-1", `KLUv/WDaBrUHAGIJFxWQJ8UcM0fPuFpXVS1LS0ubSNy/HpxWNHI/8axo5H7iWdHIlb8nnhWNXPl74lnRyJW/J54VjVz5e+JZ0ciV
+vyeeFY1c+XtiXFhUUExIDCBQCDAgFAgGonEwDAWEcKghxK9/BjAjkdA5ElAQQOCAQFD23gv7/58B25dtKPJDAi/yYReBLvb7nXLL
+QLS8ZMJdMqlLVfZGmMU9yFYvC2NUWJ2/AUziy9+JlJuxFu643oW1+EEdduVtbAqX3VfDQEzNDpbyM46F3cmbYBNvj2qs3I1B4brz
+PWyLh265UC5jW7j9+6HXD/bqfoZKo47U9tSAlAC1Cg==`},
+	}
+	testVectors(t, vectors, NewZstdReader)
+}
+
+func TestXXHash64(t *testing.T) {
+	testdata := map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	}
+	for str, ans := range testdata {
+		h := newXXHash64()
+		h.Write([]byte(str))
+		if got := h.Sum64(); got != ans {
+			t.Errorf("xxhash64 of '%s': got %x wanted %x", str, got, ans)
+		}
+	}
+}
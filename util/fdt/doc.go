@@ -0,0 +1,3 @@
+// Package fdt reads flattened device trees, which are used both for device
+// tree blobs and for U-Boot FIT images
+package fdt
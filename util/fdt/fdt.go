@@ -0,0 +1,257 @@
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Magic is the first word of a device tree, in big endian
+	Magic = 0xd00dfeed
+
+	// MaxSize is the largest device tree we read, FIT images may be large
+	MaxSize = 1 << 28
+
+	headerSize = 40
+	maxDepth   = 64
+
+	tokenBeginNode = 1
+	tokenEndNode   = 2
+	tokenProp      = 3
+	tokenNop       = 4
+	tokenEnd       = 9
+)
+
+// ErrFormat is returned when the data is not a valid device tree
+var ErrFormat = errors.New("fdt: invalid device tree")
+
+// Header is the header of a flattened device tree
+type Header struct {
+	Magic           uint32
+	TotalSize       uint32
+	OffStruct       uint32
+	OffStrings      uint32
+	OffReserved     uint32
+	Version         uint32
+	LastCompVersion uint32
+	BootCPU         uint32
+	SizeStrings     uint32
+	SizeStruct      uint32
+}
+
+// Property is a named value in a node
+type Property struct {
+	Name  string
+	Value []byte
+}
+
+// Node is a device tree node, properties and children are kept in order
+type Node struct {
+	Name     string
+	Props    []Property
+	Children []*Node
+}
+
+// Tree is a parsed device tree
+type Tree struct {
+	Header
+	Root *Node
+}
+
+// Read reads and parses a device tree from the start of r
+func Read(r io.ReadSeeker) (*Tree, error) {
+	var head Header
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &head); err != nil {
+		return nil, err
+	}
+	if head.Magic != Magic || head.TotalSize < headerSize || head.TotalSize > MaxSize {
+		return nil, ErrFormat
+	}
+	data := make([]byte, head.TotalSize)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses a device tree
+func Parse(data []byte) (*Tree, error) {
+	t := &Tree{}
+	if len(data) < headerSize {
+		return nil, ErrFormat
+	}
+	binary.Read(bytes.NewReader(data), binary.BigEndian, &t.Header)
+	if t.Magic != Magic || int64(t.TotalSize) > int64(len(data)) || t.Version < 16 {
+		return nil, ErrFormat
+	}
+	data = data[:t.TotalSize]
+	if t.OffStruct > t.TotalSize || t.OffStrings > t.TotalSize ||
+		t.SizeStrings > t.TotalSize-t.OffStrings {
+		return nil, ErrFormat
+	}
+	strs := data[t.OffStrings : t.OffStrings+t.SizeStrings]
+	p := parser{data: data, pos: int(t.OffStruct), strs: strs}
+
+	// the root node comes first, possibly after some nops
+	tok, err := p.token()
+	for err == nil && tok == tokenNop {
+		tok, err = p.token()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tok != tokenBeginNode {
+		return nil, ErrFormat
+	}
+	if t.Root, err = p.node(0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+type parser struct {
+	data []byte
+	pos  int
+	strs []byte
+}
+
+func (p *parser) token() (uint32, error) {
+	if p.pos+4 > len(p.data) {
+		return 0, ErrFormat
+	}
+	tok := binary.BigEndian.Uint32(p.data[p.pos:])
+	p.pos += 4
+	return tok, nil
+}
+
+// cstring returns a zero-terminated string from data
+func cstring(data []byte) (string, bool) {
+	n := bytes.IndexByte(data, 0)
+	if n < 0 {
+		return "", false
+	}
+	return string(data[:n]), true
+}
+
+func (p *parser) align() {
+	p.pos = (p.pos + 3) &^ 3
+}
+
+// node parses a node, the begin token has been read
+func (p *parser) node(depth int) (*Node, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("fdt: nodes are nested too deep")
+	}
+	name, ok := cstring(p.data[p.pos:])
+	if !ok {
+		return nil, ErrFormat
+	}
+	p.pos += len(name) + 1
+	p.align()
+
+	n := &Node{Name: name}
+	for {
+		tok, err := p.token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok {
+		case tokenBeginNode:
+			child, err := p.node(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			n.Children = append(n.Children, child)
+		case tokenEndNode:
+			return n, nil
+		case tokenProp:
+			if p.pos+8 > len(p.data) {
+				return nil, ErrFormat
+			}
+			size := int(binary.BigEndian.Uint32(p.data[p.pos:]))
+			nameoff := int(binary.BigEndian.Uint32(p.data[p.pos+4:]))
+			p.pos += 8
+			if size < 0 || size > len(p.data)-p.pos || nameoff >= len(p.strs) {
+				return nil, ErrFormat
+			}
+			pname, ok := cstring(p.strs[nameoff:])
+			if !ok {
+				return nil, ErrFormat
+			}
+			n.Props = append(n.Props, Property{Name: pname, Value: p.data[p.pos : p.pos+size]})
+			p.pos += size
+			p.align()
+		case tokenNop:
+		default:
+			return nil, ErrFormat
+		}
+	}
+}
+
+// Child returns the child with the given name
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Prop returns the value of a property
+func (n *Node) Prop(name string) ([]byte, bool) {
+	for _, p := range n.Props {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// String returns a property as a string, or "" if it is not a string
+func (n *Node) String(name string) string {
+	value, _ := n.Prop(name)
+	s, _ := cstring(value)
+	return s
+}
+
+// Uint returns a property that is one or two cells as a number
+func (n *Node) Uint(name string) (uint64, bool) {
+	value, _ := n.Prop(name)
+	switch len(value) {
+	case 4:
+		return uint64(binary.BigEndian.Uint32(value)), true
+	case 8:
+		return binary.BigEndian.Uint64(value), true
+	}
+	return 0, false
+}
+
+// Strings returns the property as a list of strings, if it is one
+func Strings(value []byte) ([]string, bool) {
+	if len(value) == 0 || value[len(value)-1] != 0 {
+		return nil, false
+	}
+	list := strings.Split(string(value[:len(value)-1]), "\x00")
+	for _, s := range list {
+		if s == "" {
+			return nil, false
+		}
+		for _, r := range s {
+			if r < 0x20 || r > 0x7e {
+				return nil, false
+			}
+		}
+	}
+	return list, true
+}
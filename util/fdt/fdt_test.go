@@ -0,0 +1,65 @@
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testTree returns a tree with a root property and a child node
+func testTree() []byte {
+	st := []uint32{
+		tokenBeginNode, 0,
+		tokenProp, 4, 0, 0x12345678,
+		tokenNop,
+		tokenBeginNode, 0x63707500, // "cpu"
+		tokenProp, 8, 4, 0x61726d00, 0x78383600, // "arm", "x86"
+		tokenEndNode,
+		tokenEndNode,
+		tokenEnd,
+	}
+	strs := []byte("reg\x00compatible\x00")
+	head := Header{
+		Magic: Magic, TotalSize: uint32(headerSize + 4*len(st) + len(strs)),
+		OffStruct: headerSize, OffStrings: uint32(headerSize + 4*len(st)),
+		Version: 17, LastCompVersion: 16,
+		SizeStrings: uint32(len(strs)), SizeStruct: uint32(4 * len(st)),
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &head)
+	binary.Write(&b, binary.BigEndian, st)
+	b.Write(strs)
+	return b.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	tree, err := Read(bytes.NewReader(testTree()))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if v, _ := tree.Root.Uint("reg"); v != 0x12345678 {
+		t.Errorf("wrong root property %x", v)
+	}
+	cpu := tree.Root.Child("cpu")
+	if cpu == nil {
+		t.Fatalf("child node is missing")
+	}
+	value, _ := cpu.Prop("compatible")
+	if list, ok := Strings(value); !ok || len(list) != 2 || list[1] != "x86" {
+		t.Errorf("wrong string list %q", list)
+	}
+	if cpu.String("compatible") != "arm" {
+		t.Errorf("wrong string %q", cpu.String("compatible"))
+	}
+
+	// damaged trees must give an error, not a panic
+	data := testTree()
+	for i := 0; i < len(data); i++ {
+		if _, err := Parse(data[:i]); err == nil {
+			t.Errorf("truncated tree at %d was accepted", i)
+		}
+		damaged := append([]byte{}, data...)
+		damaged[i] ^= 0xff
+		Parse(damaged)
+	}
+}
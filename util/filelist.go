@@ -3,12 +3,16 @@ package util
 import (
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 // FileList is a list of files, including files in folders
 type FileList struct {
 	FollowSymlinks bool
 	In             []string
+
+	// FS is where the files are, nil means the disk
+	FS FileSystem
 }
 
 // Push puts a file in§to the queue
@@ -21,6 +25,10 @@ func (fl *FileList) Push(paths ...string) {
 // Pop takes a file from the queue
 func (fl *FileList) Pop() (string, os.FileInfo, error) {
 	var fi os.FileInfo
+	fs := fl.FS
+	if fs == nil {
+		fs = NewDiskFS()
+	}
 	for {
 		// pop one from the queue
 		n := len(fl.In)
@@ -31,7 +39,7 @@ func (fl *FileList) Pop() (string, os.FileInfo, error) {
 		filename := fl.In[n-1]
 		fl.In = fl.In[:n-1]
 
-		fi, err := os.Lstat(filename)
+		fi, err := fs.Lstat(filename)
 		if err != nil {
 			// let someone else take care of the error
 			return filename, fi, err
@@ -44,18 +52,14 @@ func (fl *FileList) Pop() (string, os.FileInfo, error) {
 
 		mode := fi.Mode()
 		if mode.IsDir() {
-			dir, err := os.Open(filename)
-			if err != nil {
-				return filename, fi, err
-			}
-			defer dir.Close()
-
-			files, err := dir.Readdir(0)
+			names, err := fs.ReadDirNames(filename)
 			if err != nil {
 				return filename, fi, err
 			}
-			for _, file := range files {
-				fl.Push(filepath.Join(filename, file.Name()))
+			// sorted backwards since they are popped from the end
+			sort.Sort(sort.Reverse(sort.StringSlice(names)))
+			for _, name := range names {
+				fl.Push(filepath.Join(filename, name))
 			}
 		} else if mode.IsRegular() {
 			return filename, fi, nil
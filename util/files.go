@@ -22,24 +22,67 @@ func Extensions(filename string) []string {
 	}
 }
 
-// SanitizeFilename performs file name sanitization
+// SanitizeFilename performs file name sanitization.
+// The result is a relative path without any ".." components,
+// so it can safely be appended to a directory name
 func SanitizeFilename(filename string) string {
 	const badchars = "()\\;<>?* \000"
-	filename = strings.Replace(filename, "../", "", -1)
-	filename = strings.Replace(filename, "..", "", -1)
 
-	var buf bytes.Buffer
-	for _, r := range filename {
-		if r == 0 {
-			break
+	// anything after a zero is ignored
+	if n := strings.IndexRune(filename, 0); n != -1 {
+		filename = filename[:n]
+	}
+
+	var parts []string
+	isSeparator := func(r rune) bool { return r == '/' || r == '\\' }
+	for _, part := range strings.FieldsFunc(filename, isSeparator) {
+		switch part {
+		case ".":
+			continue
+		case "..":
+			if len(parts) > 0 {
+				parts = parts[:len(parts)-1]
+			}
+			continue
 		}
-		if strings.IndexRune(badchars, r) != -1 || !strconv.IsPrint(r) {
-			buf.WriteRune('_')
-		} else {
-			buf.WriteRune(r)
+
+		var buf bytes.Buffer
+		for _, r := range part {
+			if strings.IndexRune(badchars, r) != -1 || !strconv.IsPrint(r) {
+				buf.WriteRune('_')
+			} else {
+				buf.WriteRune(r)
+			}
 		}
+		parts = append(parts, buf.String())
 	}
-	return buf.String()
+	return strings.Join(parts, "/")
+}
+
+// SafePath checks that a path is inside the root directory and
+// that none of its existing components below root is a symbolic link,
+// i.e. that creating the path cannot affect anything outside root
+func SafePath(fs FileSystem, root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("'%s' is outside '%s'", path, root)
+	}
+
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		fi, err := fs.Lstat(current)
+		if err != nil {
+			return nil // does not exist yet
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("'%s' is a symbolic link", current)
+		}
+	}
+	return nil
 }
 
 // NewEmptyDir accepts a new or empty dir and if new creates it
@@ -84,6 +127,32 @@ const (
 	NonEmptyDir
 )
 
+// Exists checks if a file exists, without following symlinks
+func Exists(fs FileSystem, path string) bool {
+	_, err := fs.Lstat(path)
+	return err == nil
+}
+
+// RemoveAll removes a path and everything below it, links are not followed
+func RemoveAll(fs FileSystem, path string) error {
+	info, err := fs.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		names, err := fs.ReadDirNames(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := RemoveAll(fs, filepath.Join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(path)
+}
+
 // GetPathType returns type of a path
 func GetPathType(path string) PathType {
 	info, err := os.Stat(path)
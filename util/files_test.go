@@ -0,0 +1,67 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	testdata := map[string]string{
+		"a/b/c.txt":         "a/b/c.txt",
+		"file..txt":         "file..txt",
+		"../../etc/passwd":  "etc/passwd",
+		"/etc/passwd":       "etc/passwd",
+		"a/../../b":         "b",
+		"./a//b/./c":        "a/b/c",
+		"..\\..\\windows":   "windows",
+		"a b(c);d":          "a_b_c__d",
+		"name\x00/../../ab": "name",
+		"..":                "",
+	}
+	for str, ans := range testdata {
+		if got := SanitizeFilename(str); got != ans {
+			t.Errorf("Failed to sanitize '%s': got '%s' wanted '%s'", str, got, ans)
+		}
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	fs := NewMemFS()
+	for _, name := range []string{"out/a/b/c", "out/a/d", "out/e"} {
+		w, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+	fs.Symlink("out/e", "out/a/b/link")
+	if err := RemoveAll(fs, "out/a"); err != nil {
+		t.Fatal(err)
+	}
+	if Exists(fs, "out/a") || !Exists(fs, "out/e") {
+		t.Errorf("RemoveAll removed the wrong files")
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	root := t.TempDir()
+	Mkdir(filepath.Join(root, "dir"))
+	os.Symlink("/", filepath.Join(root, "dir", "link"))
+
+	testdata := map[string]bool{
+		"dir":            true,
+		"dir/file":       true,
+		"new/dir/file":   true,
+		"dir/link":       false,
+		"dir/link/file":  false,
+		"../file":        false,
+		"dir/../../file": false,
+	}
+	for path, ans := range testdata {
+		err := SafePath(NewDiskFS(), root, filepath.Join(root, path))
+		if (err == nil) != ans {
+			t.Errorf("SafePath failed for '%s': got %v", path, err)
+		}
+	}
+}
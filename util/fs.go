@@ -0,0 +1,284 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSystem is where extracted files are stored
+type FileSystem interface {
+	// Create creates a new file and any missing directories, it fails if the file exists
+	Create(name string) (io.WriteCloser, error)
+	// Mkdir creates a directory and any missing parents
+	Mkdir(path string) error
+	Open(name string) (io.ReadSeekCloser, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDirNames returns names of the files in a directory
+	ReadDirNames(path string) ([]string, error)
+	Remove(name string) error
+	Symlink(oldname, newname string) error
+	Chtimes(name string, t time.Time) error
+}
+
+// diskfs stores files in the real file system
+type diskfs struct{}
+
+// NewDiskFS returns a FileSystem that uses the disk
+func NewDiskFS() FileSystem {
+	return diskfs{}
+}
+
+func (diskfs) Create(name string) (io.WriteCloser, error)  { return CreateFile(name) }
+func (diskfs) Mkdir(path string) error                     { return Mkdir(path) }
+func (diskfs) Open(name string) (io.ReadSeekCloser, error) { return os.Open(name) }
+func (diskfs) Lstat(name string) (os.FileInfo, error)      { return os.Lstat(name) }
+func (diskfs) Remove(name string) error                    { return os.Remove(name) }
+func (diskfs) Symlink(oldname, newname string) error       { return os.Symlink(oldname, newname) }
+func (diskfs) Chtimes(name string, t time.Time) error      { return os.Chtimes(name, t, t) }
+
+func (diskfs) ReadDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdirnames(0)
+}
+
+// memnode is a file, directory or symlink in memfs
+type memnode struct {
+	name  string
+	mode  os.FileMode
+	time  time.Time
+	data  []byte
+	link  string
+	files map[string]*memnode
+}
+
+// os.FileInfo
+func (n *memnode) Name() string       { return n.name }
+func (n *memnode) Size() int64        { return int64(len(n.data)) }
+func (n *memnode) Mode() os.FileMode  { return n.mode }
+func (n *memnode) ModTime() time.Time { return n.time }
+func (n *memnode) IsDir() bool        { return n.mode.IsDir() }
+func (n *memnode) Sys() interface{}   { return nil }
+
+// memfs stores files in memory
+type memfs struct {
+	lock sync.Mutex
+	root *memnode
+}
+
+// NewMemFS returns a FileSystem that keeps all files in memory
+func NewMemFS() FileSystem {
+	return &memfs{root: newMemNode("/", os.ModeDir|0755)}
+}
+
+func newMemNode(name string, mode os.FileMode) *memnode {
+	n := &memnode{name: name, mode: mode, time: time.Now()}
+	if mode.IsDir() {
+		n.files = make(map[string]*memnode)
+	}
+	return n
+}
+
+// split returns the components of a path, which are all relative to the root
+func (fs *memfs) split(path string) []string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// find returns the node for a path, symlinks are only followed if follow is set
+func (fs *memfs) find(path string, follow bool) (*memnode, error) {
+	n := fs.root
+	for depth := 0; ; depth++ {
+		parts := fs.split(path)
+		for i, part := range parts {
+			if !n.IsDir() {
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+			}
+			next, found := n.files[part]
+			if !found {
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+			}
+			// symlinks in the middle of a path are not followed
+			if next.mode&os.ModeSymlink != 0 && i != len(parts)-1 {
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrInvalid}
+			}
+			n = next
+		}
+		if !follow || n.mode&os.ModeSymlink == 0 {
+			return n, nil
+		}
+		if depth > 8 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("too many links")}
+		}
+		path, n = n.link, fs.root
+	}
+}
+
+// mkdir creates a directory and its parents, lock must be held
+func (fs *memfs) mkdir(path string) (*memnode, error) {
+	n := fs.root
+	for _, part := range fs.split(path) {
+		next, found := n.files[part]
+		if !found {
+			next = newMemNode(part, os.ModeDir|0755)
+			n.files[part] = next
+		}
+		if !next.IsDir() {
+			return nil, &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// add puts a new node in the file system, lock must be held
+func (fs *memfs) add(name string, n *memnode) error {
+	dirname, basename := filepath.Split(filepath.Clean(name))
+	if strings.HasSuffix(name, "/") || basename == "." || basename == ".." || basename == "/" {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrInvalid}
+	}
+	dir, err := fs.mkdir(dirname)
+	if err != nil {
+		return err
+	}
+	if _, found := dir.files[basename]; found {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	n.name = basename
+	dir.files[basename] = n
+	return nil
+}
+
+// memwriter appends to a memnode
+type memwriter struct {
+	fs *memfs
+	n  *memnode
+}
+
+func (w memwriter) Write(p []byte) (int, error) {
+	w.fs.lock.Lock()
+	defer w.fs.lock.Unlock()
+	w.n.data = append(w.n.data, p...)
+	return len(p), nil
+}
+
+func (w memwriter) Close() error {
+	return nil
+}
+
+// memreader reads a snapshot of a memnode
+type memreader struct {
+	*bytes.Reader
+}
+
+func (memreader) Close() error {
+	return nil
+}
+
+func (fs *memfs) Create(name string) (io.WriteCloser, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n := newMemNode("", 0644)
+	if err := fs.add(name, n); err != nil {
+		return nil, err
+	}
+	return memwriter{fs: fs, n: n}, nil
+}
+
+func (fs *memfs) Mkdir(path string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, err := fs.mkdir(path)
+	return err
+}
+
+func (fs *memfs) Open(name string) (io.ReadSeekCloser, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, err := fs.find(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	return memreader{bytes.NewReader(n.data)}, nil
+}
+
+func (fs *memfs) Lstat(name string) (os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, err := fs.find(name, false)
+	if err != nil {
+		return nil, err
+	}
+	// return a copy, the node may change after this
+	ret := *n
+	return &ret, nil
+}
+
+func (fs *memfs) ReadDirNames(path string) ([]string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, err := fs.find(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: fmt.Errorf("not a directory")}
+	}
+	var names []string
+	for name := range n.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *memfs) Remove(name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	dirname, basename := filepath.Split(filepath.Clean(name))
+	dir, err := fs.find(dirname, true)
+	if err != nil {
+		return err
+	}
+	n, found := dir.files[basename]
+	if !found || !dir.IsDir() {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if n.IsDir() && len(n.files) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+	}
+	delete(dir.files, basename)
+	return nil
+}
+
+func (fs *memfs) Symlink(oldname, newname string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n := newMemNode("", os.ModeSymlink|0777)
+	n.link = oldname
+	return fs.add(newname, n)
+}
+
+func (fs *memfs) Chtimes(name string, t time.Time) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, err := fs.find(name, true)
+	if err != nil {
+		return err
+	}
+	n.time = t
+	return nil
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+
+	w, err := fs.Create("/out/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello ")
+	io.WriteString(w, "world")
+	w.Close()
+
+	if _, err := fs.Create("/out/dir/file"); err == nil {
+		t.Errorf("Created a file that already exists")
+	}
+	if err := fs.Symlink("/out/dir/file", "/out/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/out/empty/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// links are followed when opening files but not in Lstat
+	for _, name := range []string{"/out/dir/file", "out/dir/../dir/file", "/out/link"} {
+		r, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Could not open %s: %v", name, err)
+		}
+		data, _ := io.ReadAll(r)
+		if string(data) != "hello world" {
+			t.Errorf("Read '%s' from %s", string(data), name)
+		}
+	}
+	if fi, err := fs.Lstat("/out/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat on link failed: %v", err)
+	}
+	if _, err := fs.Open("/out/link/file"); err == nil {
+		t.Errorf("Opened a file through a link")
+	}
+
+	names, err := fs.ReadDirNames("/out")
+	if err != nil || !reflect.DeepEqual(names, []string{"dir", "empty", "link"}) {
+		t.Errorf("Bad folder contents: %v %v", names, err)
+	}
+
+	if err := fs.Remove("/out/empty"); err == nil {
+		t.Errorf("Removed a folder that is not empty")
+	}
+	if err := fs.Remove("/out/dir/file"); err != nil || Exists(fs, "/out/dir/file") {
+		t.Errorf("Could not remove file: %v", err)
+	}
+	if _, err := fs.Open("/out/link"); err == nil {
+		t.Errorf("Opened a dangling link")
+	}
+}
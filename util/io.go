@@ -3,6 +3,7 @@ package util
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"io"
@@ -36,7 +37,12 @@ func (rsa readeratwrapper) ReadAt(p []byte, off int64) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return rsa.r.Read(p)
+	// ReaderAt must either fill p or explain why it didn't
+	n, err := io.ReadFull(rsa.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
 }
 
 // NewReaderAt turns a ReadSeeker into a ReaderAt for the rare cases its needed
@@ -44,6 +50,37 @@ func NewReaderAt(r io.ReadSeeker) io.ReaderAt {
 	return &readeratwrapper{r: r}
 }
 
+// NewSectionReader returns a ReadSeeker that sees only size bytes of r
+// starting at offset, with offset becoming position 0
+func NewSectionReader(r io.ReadSeeker, offset, size int64) io.ReadSeeker {
+	return io.NewSectionReader(NewReaderAt(r), offset, size)
+}
+
+type contextreader struct {
+	ctx context.Context
+	r   io.ReadSeeker
+}
+
+func (cr contextreader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+func (cr contextreader) Seek(offset int64, whence int) (int64, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Seek(offset, whence)
+}
+
+// NewContextReader returns a ReadSeeker that fails once the context is done,
+// which stops most parsers working on it
+func NewContextReader(ctx context.Context, r io.ReadSeeker) io.ReadSeeker {
+	return &contextreader{ctx: ctx, r: r}
+}
+
 // BufreaderAt is a helper for creating a buffered reader at a position
 func BufreaderAt(r io.ReadSeeker, offset int64) (*bufio.Reader, error) {
 	if _, err := r.Seek(offset, os.SEEK_SET); err != nil {
@@ -84,9 +121,6 @@ func Process(r io.ByteReader, p func(b uint8, n int) bool) (int, error) {
 	}
 }
 
-// hasher is used by HashFile
-var hasher = sha256.New()
-
 // HashFile generates a hash for a file with an unspecified algorithm
 func HashFile(filename string) ([]byte, error) {
 	reader, err := os.Open(filename)
@@ -99,7 +133,7 @@ func HashFile(filename string) ([]byte, error) {
 
 // HashStream is similar to HashFile but operates on streams
 func HashStream(r io.Reader) ([]byte, error) {
-	hasher.Reset()
+	hasher := sha256.New()
 	_, err := io.Copy(hasher, r)
 	if err != nil {
 		return nil, err
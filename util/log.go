@@ -3,9 +3,11 @@ package util
 import (
 	"fmt"
 	"log"
+	"sync"
 )
 
 var warnings []string
+var warningsLock sync.Mutex
 
 // RegisterFatalf regiters a fatal error
 func RegisterFatalf(format string, v ...interface{}) {
@@ -20,9 +22,15 @@ func RegisterFatal(v interface{}) {
 // RegisterWarningf regiters a warning that will be printed and recorded
 func RegisterWarningf(format string, v ...interface{}) {
 	msg := fmt.Sprintf(format, v...)
+	warningsLock.Lock()
 	warnings = append(warnings, msg)
+	warningsLock.Unlock()
 	log.Println(msg)
 }
 
 // Warnings returns all warnings seen by the library
-func Warnings() []string { return warnings }
+func Warnings() []string {
+	warningsLock.Lock()
+	defer warningsLock.Unlock()
+	return warnings
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"bufio"
+	"io"
+)
+
+// Matcher finds occurrences of multiple patterns in one pass over the data,
+// it is a plain Aho-Corasick automaton
+type Matcher struct {
+	nodes   []matcherNode
+	lengths []int
+}
+
+type matcherNode struct {
+	next [256]int32
+	out  []int
+}
+
+// NewMatcher creates a matcher for a list of patterns, empty patterns are ignored
+func NewMatcher(patterns [][]byte) *Matcher {
+	m := &Matcher{nodes: make([]matcherNode, 1)}
+
+	// 1. build the trie, -1 means no edge yet
+	for i := range m.nodes[0].next {
+		m.nodes[0].next[i] = -1
+	}
+	for id, pattern := range patterns {
+		m.lengths = append(m.lengths, len(pattern))
+		if len(pattern) == 0 {
+			continue
+		}
+		n := 0
+		for _, c := range pattern {
+			if m.nodes[n].next[c] == -1 {
+				m.nodes = append(m.nodes, matcherNode{})
+				for i := range m.nodes[len(m.nodes)-1].next {
+					m.nodes[len(m.nodes)-1].next[i] = -1
+				}
+				m.nodes[n].next[c] = int32(len(m.nodes) - 1)
+			}
+			n = int(m.nodes[n].next[c])
+		}
+		m.nodes[n].out = append(m.nodes[n].out, id)
+	}
+
+	// 2. add failure transitions breadth first, turning the trie into a DFA
+	fail := make([]int32, len(m.nodes))
+	var queue []int32
+	for c, n := range m.nodes[0].next {
+		if n == -1 {
+			m.nodes[0].next[c] = 0
+		} else {
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		f := fail[n]
+		m.nodes[n].out = append(m.nodes[n].out, m.nodes[f].out...)
+		for c, child := range m.nodes[n].next {
+			if child == -1 {
+				m.nodes[n].next[c] = m.nodes[f].next[c]
+			} else {
+				fail[child] = m.nodes[f].next[c]
+				queue = append(queue, child)
+			}
+		}
+	}
+	return m
+}
+
+// Find reports every occurrence of every pattern in the stream together with
+// the offset where it starts. Searching stops if found returns false
+func (m *Matcher) Find(r io.Reader, found func(pattern int, offset int64) bool) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	state := int32(0)
+	for pos := int64(0); ; pos++ {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		state = m.nodes[state].next[c]
+		for _, id := range m.nodes[state].out {
+			if !found(id, pos-int64(m.lengths[id])+1) {
+				return nil
+			}
+		}
+	}
+}
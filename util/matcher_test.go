@@ -0,0 +1,51 @@
+package util
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	patterns := [][]byte{[]byte("he"), []byte("she"), []byte("his"), []byte("hers"), {}}
+	text := []byte("ushers and his hens")
+
+	type hit struct {
+		pattern int
+		offset  int64
+	}
+	var want []hit
+	for i := range text {
+		for id, p := range patterns {
+			if len(p) > 0 && bytes.HasPrefix(text[i:], p) {
+				want = append(want, hit{id, int64(i)})
+			}
+		}
+	}
+
+	var got []hit
+	m := NewMatcher(patterns)
+	if err := m.Find(bytes.NewReader(text), func(id int, offset int64) bool {
+		got = append(got, hit{id, offset})
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the matcher reports by end position, compare as sets
+	seen := make(map[hit]bool)
+	for _, h := range got {
+		seen[h] = true
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Matcher found %v, wanted %v", got, want)
+	}
+	for _, h := range want {
+		if !seen[h] {
+			t.Errorf("Matcher missed pattern %d at %d", h.pattern, h.offset)
+		}
+	}
+	if !reflect.DeepEqual(got[0], hit{1, 1}) {
+		t.Errorf("Matcher reported %v first", got[0])
+	}
+}
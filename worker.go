@@ -0,0 +1,141 @@
+package molly
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/avahidi/molly/types"
+)
+
+// scanJob is a file or folder waiting to be scanned
+type scanJob struct {
+	filename string
+	parent   *types.FileData
+
+	// root files are registered before the scan starts
+	file *types.FileData
+	info os.FileInfo
+	err  error
+}
+
+// scheduler hands out files to a number of workers.
+// Children of a file are queued before everything else, so with a single
+// worker files are scanned depth first in the order they were found
+type scheduler struct {
+	m      *types.Molly
+	ctx    context.Context
+	lock   sync.Mutex
+	cond   *sync.Cond
+	jobs   []*scanJob
+	active int
+}
+
+func newScheduler(ctx context.Context, m *types.Molly) *scheduler {
+	s := &scheduler{m: m, ctx: ctx}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// push adds a job to the end of the queue
+func (s *scheduler) push(job *scanJob) {
+	s.lock.Lock()
+	s.jobs = append(s.jobs, job)
+	s.lock.Unlock()
+	s.cond.Signal()
+}
+
+// pushChildren adds the children of a file to the start of the queue
+func (s *scheduler) pushChildren(parent *types.FileData) {
+	if len(parent.Children) == 0 {
+		return
+	}
+	jobs := make([]*scanJob, 0, len(parent.Children))
+	for _, child := range parent.Children {
+		jobs = append(jobs, &scanJob{filename: child.Filename, parent: parent})
+	}
+
+	s.lock.Lock()
+	s.jobs = append(jobs, s.jobs...)
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+// cancel records that a job was never scanned since the scan was stopped
+func (s *scheduler) cancel(job *scanJob, err error) {
+	fr := job.file
+	if fr == nil {
+		fr, _ = s.m.AddFile(job.filename, job.parent)
+	}
+	if s.m.MarkProcessed(fr) {
+		fr.RegisterErrorf("scan stopped: %v", err)
+	}
+}
+
+// pop waits for a job, it returns nil when there is nothing more to do
+// or when the scan has been stopped
+func (s *scheduler) pop() *scanJob {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.jobs) == 0 && s.active > 0 && s.ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if err := s.ctx.Err(); err != nil {
+		for _, job := range s.jobs {
+			s.cancel(job, err)
+		}
+		s.jobs = nil
+		return nil
+	}
+	if len(s.jobs) == 0 {
+		return nil
+	}
+	job := s.jobs[0]
+	s.jobs = s.jobs[1:]
+	s.active++
+	return job
+}
+
+// done is called by a worker when it has finished a job
+func (s *scheduler) done() {
+	s.lock.Lock()
+	s.active--
+	idle := (s.active == 0 && len(s.jobs) == 0) || s.ctx.Err() != nil
+	s.lock.Unlock()
+	if idle {
+		s.cond.Broadcast()
+	}
+}
+
+// worker scans files until the queue is empty, each worker has its own environment
+func (s *scheduler) worker() {
+	env := types.NewEnv(s.m)
+	for job := s.pop(); job != nil; job = s.pop() {
+		if job.file != nil {
+			scanFile(s, env, job.file, job.info, job.err)
+		} else {
+			scanPath(s, env, job.filename, job.parent)
+		}
+		s.done()
+	}
+}
+
+// run starts the workers and waits until all jobs are done.
+// It returns the context error if the scan was stopped
+func (s *scheduler) run() error {
+	workers := s.m.Config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker()
+		}()
+	}
+	wg.Wait()
+	return s.ctx.Err()
+}